@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/config"
+	"github.com/keithballdotnet/blocker/crypto"
+)
+
+// exportCommand writes the passed blocked files into an archive which another installation can import
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to a YAML, JSON or TOML configuration file")
+	output := flags.String("o", "-", "Path of the archive to write, or - for standard output")
+	targetPath := flags.String("target", "", "Configuration of the installation importing the archive.  Its compression and crypto settings encode the blocks, so they need not share keys")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: blocker export [options] <id>...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	store, _, err := openStore(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open store: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	var options blocks.ExportOptions
+	if *targetPath != "" {
+		if options.Codec, err = targetCodec(*targetPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to use target configuration: %v\n", err)
+			return 1
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create archive: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if err := store.Export(context.Background(), w, flags.Args(), options); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to export: %v\n", err)
+		if *output != "-" {
+			os.Remove(*output)
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// targetCodec creates the codec of the installation configured by the file
+func targetCodec(configPath string) (blocks.Codec, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var cryptoProvider crypto.CryptoProvider
+	if cfg.Blocks.Encryption {
+		if cryptoProvider, err = crypto.NewCryptoProvider(cfg.Crypto); err != nil {
+			return nil, err
+		}
+	}
+
+	return blocks.NewCodec(cfg.Blocks.Compression, cryptoProvider), nil
+}
+
+// importCommand adds the blocked files of an archive to the store
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to a YAML, JSON or TOML configuration file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: blocker import [options] <archive>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open archive: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		r = file
+	}
+
+	store, _, err := openStore(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open store: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	stats, err := store.Import(context.Background(), r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to import: %v\n", err)
+		return 1
+	}
+
+	log.Printf("Files: %d Skipped: %d Blocks: %d Deduplicated: %d", stats.Files, stats.SkippedFiles, stats.Blocks, stats.DedupedBlocks)
+
+	return 0
+}
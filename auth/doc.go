@@ -0,0 +1,5 @@
+// Package auth signs and checks requests to the REST API
+//
+// Current version: experimental
+//
+package auth
@@ -0,0 +1,502 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BearerScheme is the Authorization scheme of requests carrying a token instead of a signature
+const BearerScheme = "Bearer"
+
+// minRSABits is the smallest RSA key tokens are accepted from
+const minRSABits = 2048
+
+var (
+	// ErrTokenInvalid is returned for a token which is malformed or whose signature does not match
+	ErrTokenInvalid = errors.New("The token is invalid")
+	// ErrTokenExpired is returned for a token past its expiry, or not valid yet
+	ErrTokenExpired = errors.New("The token has expired or is not valid yet")
+	// ErrUnknownTokenKey is returned for a token signed with a key ID the verifier does not have
+	ErrUnknownTokenKey = errors.New("The token is signed with an unknown key")
+)
+
+// BearerToken returns the token of an Authorization header using the Bearer scheme, or "" for any other scheme
+func BearerToken(authorization string) string {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, BearerScheme) {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Claims are the claims of a verified token
+type Claims map[string]interface{}
+
+// String returns the claim if it is a string
+func (c Claims) String(name string) (string, bool) {
+	value, ok := c[name].(string)
+	return value, ok
+}
+
+// Strings returns the claim as a list.  A string claim is split at spaces, the way the OAuth scope claim is written.
+func (c Claims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// time returns the claim if it is a NumericDate
+func (c Claims) time(name string) (time.Time, bool) {
+	seconds, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// tokenKey is a public key tokens may be signed with
+type tokenKey struct {
+	// id is the key ID tokens name it with, empty for keys which are not part of a key set
+	id string
+	// alg is the only algorithm the key is used with, empty to allow any algorithm suiting the key
+	alg    string
+	public crypto.PublicKey
+}
+
+// JWTVerifier checks the signature and registered claims of JSON Web Tokens.  Tokens must be signed with RS256,
+// RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512 or EdDSA; shared secrets and unsigned tokens are refused.
+type JWTVerifier struct {
+	lock sync.RWMutex
+	keys []tokenKey
+	// Issuer is the iss claim tokens must have, or empty to accept any issuer
+	Issuer string
+	// Audience is a value the aud claim of tokens must have.  Every token is refused while it is empty.
+	Audience string
+	// ClockSkew is how far the clock of the token issuer may be from ours
+	ClockSkew time.Duration
+}
+
+// NewJWTVerifier creates a verifier without keys
+func NewJWTVerifier(issuer string, audience string, clockSkew time.Duration) *JWTVerifier {
+	return &JWTVerifier{Issuer: issuer, Audience: audience, ClockSkew: clockSkew}
+}
+
+// Load replaces the keys of the verifier with those of the JSON Web Key Set files and the PEM public key or
+// certificate files.  The keys are only replaced if every file can be read.
+func (v *JWTVerifier) Load(jwksPaths []string, publicKeyPaths []string) error {
+	var keys []tokenKey
+
+	for _, path := range jwksPaths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		set, err := parseJWKS(content)
+		if err != nil {
+			return fmt.Errorf("Unable to read key set %s: %v", path, err)
+		}
+		keys = append(keys, set...)
+	}
+
+	for _, path := range publicKeyPaths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		public, err := ParsePublicKey(content)
+		if err != nil {
+			return fmt.Errorf("Unable to read public key %s: %v", path, err)
+		}
+		keys = append(keys, tokenKey{public: public})
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.keys = keys
+	return nil
+}
+
+// Verify checks the signature of the token, that it has not expired and that its issuer and audience are expected.
+// Tokens must have an expiry.  Returns the claims of the token.
+func (v *JWTVerifier) Verify(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: it must have three parts", ErrTokenInvalid)
+	}
+
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+	}
+	if len(header.Crit) > 0 {
+		return nil, fmt.Errorf("%w: critical header parameters %v are not supported", ErrTokenInvalid, header.Crit)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+	}
+
+	if err := v.checkSignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+	}
+
+	if err := v.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// checkSignature checks the signature with the key named by the key ID, or with every key if the token names none
+func (v *JWTVerifier) checkSignature(alg string, kid string, signed []byte, signature []byte) error {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	var candidates []tokenKey
+	for _, key := range v.keys {
+		if kid == "" || key.id == kid {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		// Keys without an ID are tried before giving up, as issuers with a single key often name it anyway
+		for _, key := range v.keys {
+			if key.id == "" {
+				candidates = append(candidates, key)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("%w %q", ErrUnknownTokenKey, kid)
+	}
+
+	for _, key := range candidates {
+		if key.alg != "" && key.alg != alg {
+			continue
+		}
+		if verifySignature(alg, key.public, signed, signature) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: the %s signature does not match", ErrTokenInvalid, alg)
+}
+
+// checkClaims checks the expiry, issuer and audience of the token.  Tokens are only accepted for an audience.
+func (v *JWTVerifier) checkClaims(claims Claims, now time.Time) error {
+	expires, ok := claims.time("exp")
+	if !ok {
+		return fmt.Errorf("%w: it has no expiry", ErrTokenInvalid)
+	}
+	if !now.Add(-v.ClockSkew).Before(expires) {
+		return ErrTokenExpired
+	}
+
+	if notBefore, ok := claims.time("nbf"); ok && now.Add(v.ClockSkew).Before(notBefore) {
+		return ErrTokenExpired
+	}
+
+	if v.Issuer != "" {
+		if issuer, _ := claims.String("iss"); issuer != v.Issuer {
+			return fmt.Errorf("%w: it was issued by %q", ErrTokenInvalid, issuer)
+		}
+	}
+
+	if v.Audience == "" {
+		return fmt.Errorf("%w: there is no audience to check it against", ErrTokenInvalid)
+	}
+
+	// The audience is a single string or a list of them
+	audience, found := claims.String("aud")
+	found = found && audience == v.Audience
+	if _, list := claims["aud"].([]interface{}); list {
+		for _, audience := range claims.Strings("aud") {
+			found = found || audience == v.Audience
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: it is not meant for %q", ErrTokenInvalid, v.Audience)
+	}
+
+	return nil
+}
+
+// decodeSegment decodes a base64url segment of a token holding JSON
+func decodeSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// verifySignature checks the signature with the algorithm, if the key suits the algorithm
+func verifySignature(alg string, public crypto.PublicKey, signed []byte, signature []byte) bool {
+	if alg == "EdDSA" {
+		key, ok := public.(ed25519.PublicKey)
+		return ok && ed25519.Verify(key, signed, signature)
+	}
+
+	if len(alg) != 5 {
+		return false
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		key, ok := public.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case "PS":
+		key, ok := public.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		key, ok := public.(*ecdsa.PublicKey)
+		if !ok || key.Curve != curveFor(alg) {
+			return false
+		}
+
+		// The signature is R and S, each as long as the curve order
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+
+	return false
+}
+
+// curveFor returns the curve of an ECDSA algorithm
+func curveFor(alg string) elliptic.Curve {
+	switch alg {
+	case "ES256":
+		return elliptic.P256()
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// parseJWKS reads the signing keys of a JSON Web Key Set.  Keys meant for encryption are skipped.
+func parseJWKS(content []byte) ([]tokenKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []tokenKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		var public crypto.PublicKey
+		var err error
+		switch jwk.Kty {
+		case "RSA":
+			public, err = rsaJWK(jwk.N, jwk.E)
+		case "EC":
+			public, err = ecJWK(jwk.Crv, jwk.X, jwk.Y)
+		case "OKP":
+			public, err = okpJWK(jwk.Crv, jwk.X)
+		default:
+			err = fmt.Errorf("unsupported key type %q", jwk.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Key %q: %v", jwk.Kid, err)
+		}
+
+		keys = append(keys, tokenKey{id: jwk.Kid, alg: jwk.Alg, public: public})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("The key set has no signing keys")
+	}
+
+	return keys, nil
+}
+
+// rsaJWK reads the modulus and exponent of an RSA key
+func rsaJWK(n string, e string) (crypto.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}
+	return key, checkRSA(key)
+}
+
+// ecJWK reads the point of an elliptic curve key, checking it is on the curve
+func ecJWK(crv string, x string, y string) (crypto.PublicKey, error) {
+	var curve elliptic.Curve
+	var exchange ecdh.Curve
+	switch crv {
+	case "P-256":
+		curve, exchange = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, exchange = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, exchange = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+
+	size := (curve.Params().BitSize + 7) / 8
+	if len(xBytes) != size || len(yBytes) != size {
+		return nil, fmt.Errorf("the coordinates must be %d bytes", size)
+	}
+
+	// ecdh refuses points which are not on the curve
+	point := append(append([]byte{4}, xBytes...), yBytes...)
+	if _, err := exchange.NewPublicKey(point); err != nil {
+		return nil, err
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}, nil
+}
+
+// okpJWK reads an Ed25519 key
+func okpJWK(crv string, x string) (crypto.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("an Ed25519 key must be %d bytes", ed25519.PublicKeySize)
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// ParsePublicKey reads a PEM encoded RSA, ECDSA or Ed25519 public key, or the key of a certificate
+func ParsePublicKey(content []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("No PEM block found")
+	}
+
+	var public crypto.PublicKey
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var certificate *x509.Certificate
+		if certificate, err = x509.ParseCertificate(block.Bytes); err == nil {
+			public = certificate.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return key, checkRSA(key)
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported public key %T", public)
+}
+
+// checkRSA refuses RSA keys too short to trust
+func checkRSA(key *rsa.PublicKey) error {
+	if key.N.BitLen() < minRSABits {
+		return fmt.Errorf("RSA keys must have at least %d bits", minRSABits)
+	}
+	if key.E < 3 {
+		return errors.New("The RSA exponent is invalid")
+	}
+	return nil
+}
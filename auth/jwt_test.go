@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// signToken signs the claims with the key
+func signToken(c *C, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	payload, err := json.Marshal(claims)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if alg == "PS256" {
+			signature, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		r, s, signErr := ecdsa.Sign(rand.Reader, k, digest[:])
+		err = signErr
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	}
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// claims are valid claims of a token for the subject
+func claims(subject string) map[string]interface{} {
+	return map[string]interface{}{"sub": subject, "iss": "https://idp", "aud": "blocker", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+// tokenKeys creates an EC and an Ed25519 key in a key set and an RSA key in a PEM file
+func tokenKeys(c *C) (*ecdsa.PrivateKey, ed25519.PrivateKey, *rsa.PrivateKey, *JWTVerifier) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	encode := base64.RawURLEncoding.EncodeToString
+	x, y := make([]byte, 32), make([]byte, 32)
+	ecKey.X.FillBytes(x)
+	ecKey.Y.FillBytes(y)
+	set, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(x), "y": encode(y)},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": encode(edPublic)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	dir := c.MkDir()
+	err = ioutil.WriteFile(filepath.Join(dir, "jwks.json"), set, 0644)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	err = ioutil.WriteFile(filepath.Join(dir, "rsa.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	verifier := NewJWTVerifier("https://idp", "blocker", time.Minute)
+	err = verifier.Load([]string{filepath.Join(dir, "jwks.json")}, []string{filepath.Join(dir, "rsa.pem")})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return ecKey, edKey, rsaKey, verifier
+}
+
+func (s *AuthSuite) TestVerifyTokens(c *C) {
+	ecKey, edKey, rsaKey, verifier := tokenKeys(c)
+
+	tokens := map[string]string{
+		"ES256": signToken(c, "ES256", "ec", ecKey, claims("ES256")),
+		"EdDSA": signToken(c, "EdDSA", "ed", edKey, claims("EdDSA")),
+		"RS256": signToken(c, "RS256", "", rsaKey, claims("RS256")),
+		"PS256": signToken(c, "PS256", "", rsaKey, claims("PS256")),
+		// Keys without an ID are tried for tokens naming a key the verifier does not have
+		"named": signToken(c, "RS256", "rsa", rsaKey, claims("named")),
+	}
+
+	for name, token := range tokens {
+		verified, err := verifier.Verify(token, time.Now())
+		c.Assert(err == nil, IsTrue, Commentf("%s failed with error: %v", name, err))
+
+		subject, _ := verified.String("sub")
+		c.Assert(subject, Equals, name)
+	}
+
+	// A list of audiences only needs to have ours
+	listed := claims("listed")
+	listed["aud"] = []string{"other", "blocker"}
+	_, err := verifier.Verify(signToken(c, "ES256", "ec", ecKey, listed), time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+}
+
+func (s *AuthSuite) TestRefusedTokens(c *C) {
+	ecKey, edKey, _, verifier := tokenKeys(c)
+
+	changed := func(name string, value interface{}) map[string]interface{} {
+		changed := claims("refused")
+		if value == nil {
+			delete(changed, name)
+		} else {
+			changed[name] = value
+		}
+		return changed
+	}
+
+	valid := strings.Split(signToken(c, "ES256", "ec", ecKey, claims("refused")), ".")
+	admin := strings.Split(signToken(c, "ES256", "ec", ecKey, claims("admin")), ".")
+
+	tokens := map[string]string{
+		"expired":       signToken(c, "ES256", "ec", ecKey, changed("exp", time.Now().Add(-2*time.Minute).Unix())),
+		"not yet valid": signToken(c, "ES256", "ec", ecKey, changed("nbf", time.Now().Add(2*time.Minute).Unix())),
+		"no expiry":     signToken(c, "ES256", "ec", ecKey, changed("exp", nil)),
+		"audience":      signToken(c, "ES256", "ec", ecKey, changed("aud", "other")),
+		"issuer":        signToken(c, "ES256", "ec", ecKey, changed("iss", "https://other")),
+		"tampered":      valid[0] + "." + admin[1] + "." + valid[2],
+		"wrong key":     signToken(c, "EdDSA", "ec", edKey, claims("refused")),
+		"wrong alg":     signToken(c, "ES384", "ec", ecKey, claims("refused")),
+		"unsigned":      valid[0] + "." + valid[1] + ".",
+		"malformed":     "not a token",
+	}
+
+	for name, token := range tokens {
+		_, err := verifier.Verify(token, time.Now())
+		c.Assert(err != nil, IsTrue, Commentf("Accepted %s token", name))
+	}
+
+	_, err := verifier.Verify(tokens["expired"], time.Now())
+	c.Assert(errors.Is(err, ErrTokenExpired), IsTrue, Commentf("Wrong error: %v", err))
+
+	// Tokens claiming to be unsigned are refused
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload, _ := json.Marshal(claims("refused"))
+	_, err = verifier.Verify(header+"."+base64.RawURLEncoding.EncodeToString(payload)+".", time.Now())
+	c.Assert(errors.Is(err, ErrTokenInvalid), IsTrue, Commentf("Wrong error: %v", err))
+
+	// Tokens are refused when there is no audience to check
+	verifier.Audience = ""
+	_, err = verifier.Verify(signToken(c, "ES256", "ec", ecKey, claims("refused")), time.Now())
+	c.Assert(errors.Is(err, ErrTokenInvalid), IsTrue, Commentf("Wrong error: %v", err))
+	verifier.Audience = "blocker"
+
+	// Tokens naming an unknown key can be told apart, so the keys can be read again
+	onlyNamed := NewJWTVerifier("", "blocker", time.Minute)
+	onlyNamed.keys = verifier.keys[:2]
+	_, err = onlyNamed.Verify(signToken(c, "ES256", "new", ecKey, claims("refused")), time.Now())
+	c.Assert(errors.Is(err, ErrUnknownTokenKey), IsTrue, Commentf("Wrong error: %v", err))
+}
+
+func (s *AuthSuite) TestParseTokenKeys(c *C) {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	// A point which is not on the curve
+	point := make([]byte, 32)
+	point[31] = 1
+	_, err := parseJWKS([]byte(`{"keys": [{"kty": "EC", "crv": "P-256", "x": "` + encode(point) + `", "y": "` + encode(point) + `"}]}`))
+	c.Assert(err != nil, IsTrue)
+
+	// A key set without signing keys
+	_, err = parseJWKS([]byte(`{"keys": [{"kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}]}`))
+	c.Assert(err != nil, IsTrue)
+
+	// RSA keys must be long enough
+	short, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	_, err = ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&short.PublicKey)}))
+	c.Assert(err != nil, IsTrue)
+
+	c.Assert(BearerToken("Bearer abc.def.ghi"), Equals, "abc.def.ghi")
+	c.Assert(BearerToken("bearer abc"), Equals, "abc")
+	c.Assert(BearerToken(Algorithm+" SignedHeaders=host, Signature=abc"), Equals, "")
+}
@@ -0,0 +1,303 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is something an access key is allowed to do
+type Scope string
+
+// The scopes an access key can be given
+const (
+	// ScopeRead allows files to be downloaded, listed and described
+	ScopeRead Scope = "read"
+	// ScopeWrite allows files to be uploaded
+	ScopeWrite Scope = "write"
+	// ScopeDelete allows files to be deleted
+	ScopeDelete Scope = "delete"
+	// ScopeCopy allows files to be copied
+	ScopeCopy Scope = "copy"
+	// ScopeAdmin allows access keys to be managed, and everything else
+	ScopeAdmin Scope = "admin"
+)
+
+// Scopes are all the scopes an access key can be given
+var Scopes = []Scope{ScopeRead, ScopeWrite, ScopeDelete, ScopeCopy, ScopeAdmin}
+
+var (
+	// ErrKeyNotFound is returned for an access key ID which is not in the store
+	ErrKeyNotFound = errors.New("The access key does not exist")
+	// ErrKeyDisabled is returned for an access key which has been disabled
+	ErrKeyDisabled = errors.New("The access key is disabled")
+	// ErrKeyExpired is returned for an access key past its expiry
+	ErrKeyExpired = errors.New("The access key has expired")
+)
+
+// AccessKey is a key requests are signed with, and what requests signed with it may do
+type AccessKey struct {
+	ID string `json:"id"`
+	// Secret is the key requests are signed with.  It is only given out when the key is created.
+	Secret      string `json:"secret,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Tenant is the tenant whose files the key works on.  Keys without one work on the default tenant, and with the
+	// admin scope manage the keys and see the usage of every tenant.
+	Tenant   string    `json:"tenant,omitempty"`
+	Scopes   []Scope   `json:"scopes"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+	// Expires is when the key stops working.  A key without it does not expire.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Allows checks if the key has the scope.  The admin scope allows everything.
+func (k AccessKey) Allows(scope Scope) bool {
+	for _, allowed := range k.Scopes {
+		if allowed == scope || allowed == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Usable checks the key is enabled and has not expired
+func (k AccessKey) Usable(now time.Time) error {
+	if k.Disabled {
+		return ErrKeyDisabled
+	}
+	if k.Expires != nil && !now.Before(*k.Expires) {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+// Redacted returns the key without its secret
+func (k AccessKey) Redacted() AccessKey {
+	k.Secret = ""
+	return k
+}
+
+// ValidateScopes checks there is at least one scope and each is known
+func ValidateScopes(scopes []Scope) error {
+	if len(scopes) == 0 {
+		return errors.New("An access key needs at least one scope")
+	}
+
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return fmt.Errorf("Unknown scope %q, must be one of %v", scope, Scopes)
+		}
+	}
+
+	return nil
+}
+
+// KeyStore holds the access keys of a server.  Keys are written to a file if the store was loaded from one.
+type KeyStore struct {
+	lock sync.RWMutex
+	keys map[string]AccessKey
+	// path is where the keys are saved, empty to keep them only in memory
+	path string
+}
+
+// NewKeyStore creates a store which keeps its keys in memory
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keys: make(map[string]AccessKey)}
+}
+
+// Load reads the keys in the file at path, and saves every later change to it.  A file which does not exist yet
+// is created with the first key.  The file holds the secrets, so it is refused if other users can read it.
+func (s *KeyStore) Load(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		s.path = path
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("The access key file %s must only be readable by its owner, it has permissions %v", path, info.Mode().Perm())
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var keys []AccessKey
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return fmt.Errorf("Unable to read access key file %s: %v", path, err)
+	}
+
+	s.keys = make(map[string]AccessKey, len(keys))
+	for _, key := range keys {
+		s.keys[key.ID] = key
+	}
+	s.path = path
+
+	return nil
+}
+
+// Get returns the key with the ID
+func (s *KeyStore) Get(id string) (AccessKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return AccessKey{}, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// List returns the keys ordered by ID, without their secrets
+func (s *KeyStore) List() []AccessKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := make([]AccessKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key.Redacted())
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	return keys
+}
+
+// Create saves a new key with the description, tenant, scopes and expiry of the key, and a random ID and secret.
+// The returned key is the only copy of the secret given out.
+func (s *KeyStore) Create(key AccessKey, now time.Time) (AccessKey, error) {
+	if err := ValidateScopes(key.Scopes); err != nil {
+		return AccessKey{}, err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return AccessKey{}, err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return AccessKey{}, err
+	}
+
+	key.ID = "BK" + strings.ToUpper(id)
+	key.Secret = secret
+	key.Scopes = append([]Scope(nil), key.Scopes...)
+	key.Created = now.UTC()
+	key.Disabled = false
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keys[key.ID] = key
+	if err := s.save(); err != nil {
+		delete(s.keys, key.ID)
+		return AccessKey{}, err
+	}
+
+	return key, nil
+}
+
+// SetDisabled disables or enables the key, and returns it without its secret
+func (s *KeyStore) SetDisabled(id string, disabled bool) (AccessKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return AccessKey{}, ErrKeyNotFound
+	}
+
+	previous := key
+	key.Disabled = disabled
+	s.keys[id] = key
+	if err := s.save(); err != nil {
+		s.keys[id] = previous
+		return AccessKey{}, err
+	}
+
+	return key.Redacted(), nil
+}
+
+// Revoke removes the key, so requests signed with it are refused
+func (s *KeyStore) Revoke(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	delete(s.keys, id)
+	if err := s.save(); err != nil {
+		s.keys[id] = key
+		return err
+	}
+
+	return nil
+}
+
+// save writes the keys to the file, if there is one.  The file is replaced in one step so it is never left half written.
+func (s *KeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	keys := make([]AccessKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	content, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	// TempFile creates the file readable only by its owner
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), s.path)
+}
+
+// randomHex returns size random bytes in hex
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *AuthSuite) TestAccessKeyScopes(c *C) {
+	key := AccessKey{Scopes: []Scope{ScopeRead, ScopeCopy}}
+	c.Assert(key.Allows(ScopeRead), IsTrue)
+	c.Assert(key.Allows(ScopeCopy), IsTrue)
+	c.Assert(key.Allows(ScopeWrite), IsFalse)
+	c.Assert(key.Allows(ScopeAdmin), IsFalse)
+
+	admin := AccessKey{Scopes: []Scope{ScopeAdmin}}
+	c.Assert(admin.Allows(ScopeDelete), IsTrue)
+
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	key.Expires = &expires
+	c.Assert(key.Usable(now) == nil, IsTrue)
+	c.Assert(key.Usable(expires), Equals, ErrKeyExpired)
+
+	key.Disabled = true
+	c.Assert(key.Usable(now), Equals, ErrKeyDisabled)
+
+	c.Assert(ValidateScopes(nil) != nil, IsTrue)
+	c.Assert(ValidateScopes([]Scope{"everything"}) != nil, IsTrue)
+}
+
+func (s *AuthSuite) TestKeyStore(c *C) {
+	dir, err := ioutil.TempDir("", "blocker_keys_")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+
+	store := NewKeyStore()
+	err = store.Load(path)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	key, err := store.Create(AccessKey{Description: "test", Scopes: []Scope{ScopeRead}}, time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(key.Secret != "", IsTrue)
+
+	other, err := store.Create(AccessKey{Description: "other", Scopes: []Scope{ScopeWrite}}, time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(other.ID != key.ID, IsTrue)
+
+	// The file holding the secrets can only be read by its owner
+	info, err := os.Stat(path)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	for _, listed := range store.List() {
+		c.Assert(listed.Secret, Equals, "")
+	}
+
+	_, err = store.SetDisabled(key.ID, true)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	err = store.Revoke(other.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(store.Revoke(other.ID), Equals, ErrKeyNotFound)
+
+	// The changes are read back from the file
+	loaded := NewKeyStore()
+	err = loaded.Load(path)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(loaded.List(), HasLen, 1)
+
+	got, err := loaded.Get(key.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(got.Secret, Equals, key.Secret)
+	c.Assert(got.Disabled, IsTrue)
+
+	_, err = loaded.Get(other.ID)
+	c.Assert(err, Equals, ErrKeyNotFound)
+
+	// A file other users can read is refused
+	err = os.Chmod(path, 0644)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(NewKeyStore().Load(path) != nil, IsTrue)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// NonceCache remembers the nonces of requests until they expire, so each can only be used once
+type NonceCache struct {
+	lock   sync.Mutex
+	seen   map[string]time.Time
+	size   int
+	expiry time.Time
+}
+
+// NewNonceCache creates a cache holding at most size nonces
+func NewNonceCache(size int) *NonceCache {
+	return &NonceCache{seen: make(map[string]time.Time), size: size}
+}
+
+// Use records the nonce until it expires.  Returns false if the nonce was already used,
+// or if the cache is full of nonces which have not expired.
+func (c *NonceCache) Use(nonce string, expires time.Time, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if expiry, ok := c.seen[nonce]; ok && now.Before(expiry) {
+		return false
+	}
+
+	// Only look for expired nonces once the earliest of them can have expired
+	if len(c.seen) >= c.size && !now.Before(c.expiry) {
+		c.expiry = time.Time{}
+		for seen, expiry := range c.seen {
+			if !now.Before(expiry) {
+				delete(c.seen, seen)
+			} else if c.expiry.IsZero() || expiry.Before(c.expiry) {
+				c.expiry = expiry
+			}
+		}
+	}
+
+	if len(c.seen) >= c.size {
+		return false
+	}
+
+	c.seen[nonce] = expires
+	if c.expiry.IsZero() || expires.Before(c.expiry) {
+		c.expiry = expires
+	}
+
+	return true
+}
+
+// Len returns the number of nonces remembered
+func (c *NonceCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.seen)
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Algorithm names the version 2 signing scheme at the start of the Authorization header
+const Algorithm = "BLOCKER-HMAC-SHA256-V2"
+
+// Headers used by signed requests
+const (
+	// DateHeader holds the time the request was signed, in RFC 1123 format and UTC
+	DateHeader = "x-blocker-date"
+	// ContentSHA256Header holds the hex SHA-256 of the body
+	ContentSHA256Header = "x-blocker-content-sha256"
+	// NonceHeader holds a value used by a single request
+	NonceHeader = "x-blocker-nonce"
+)
+
+// RequiredHeaders must be signed by every version 2 request
+var RequiredHeaders = []string{"host", DateHeader, ContentSHA256Header}
+
+// optionalHeaders are signed by SignRequest when the request has them
+var optionalHeaders = []string{"content-type", "range", NonceHeader}
+
+// EmptySHA256 is the content hash of a request without a body
+var EmptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+var (
+	// ErrSignatureMismatch is returned when a request was not signed with the key
+	ErrSignatureMismatch = errors.New("The signature does not match")
+	// ErrContentMismatch is returned by the body of a request which does not match its signed content hash
+	ErrContentMismatch = errors.New("The body does not match " + ContentSHA256Header)
+)
+
+// Authorization is the Authorization header of a version 2 request
+type Authorization struct {
+	// Credential is the ID of the access key the request was signed with.  Requests without one are signed with the shared key.
+	Credential string
+	// SignedHeaders are the lower case names of the headers covered by the signature, in order
+	SignedHeaders []string
+	// Signature is the hex HMAC-SHA256 of the canonical request
+	Signature string
+}
+
+func (a Authorization) String() string {
+	credential := ""
+	if a.Credential != "" {
+		credential = "Credential=" + a.Credential + ", "
+	}
+	return fmt.Sprintf("%s %sSignedHeaders=%s, Signature=%s", Algorithm, credential, strings.Join(a.SignedHeaders, ";"), a.Signature)
+}
+
+// IsV2 checks if the Authorization header uses the version 2 scheme
+func IsV2(header string) bool {
+	return strings.HasPrefix(header, Algorithm+" ")
+}
+
+// ParseAuthorization reads a version 2 Authorization header
+func ParseAuthorization(header string) (Authorization, error) {
+	var authorization Authorization
+
+	if !IsV2(header) {
+		return authorization, fmt.Errorf("The Authorization header does not start with %s", Algorithm)
+	}
+
+	for _, part := range strings.Split(strings.TrimPrefix(header, Algorithm+" "), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return authorization, fmt.Errorf("Invalid Authorization parameter %q", part)
+		}
+
+		switch name {
+		case "Credential":
+			authorization.Credential = value
+		case "SignedHeaders":
+			authorization.SignedHeaders = strings.Split(value, ";")
+		case "Signature":
+			authorization.Signature = value
+		}
+	}
+
+	if len(authorization.SignedHeaders) == 0 || authorization.Signature == "" {
+		return authorization, errors.New("The Authorization header needs SignedHeaders and a Signature")
+	}
+
+	for _, required := range RequiredHeaders {
+		if !authorization.Signs(required) {
+			return authorization, fmt.Errorf("The %s header must be signed", required)
+		}
+	}
+
+	return authorization, nil
+}
+
+// Signs checks if the header is covered by the signature
+func (a Authorization) Signs(name string) bool {
+	for _, signed := range a.SignedHeaders {
+		if signed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CanonicalRequest is the text signed for a request.  It is made of the method, the escaped path, the query sorted by name
+// and value, a line of name:value for each signed header, the list of signed headers and the hash of the body.
+// The host header is taken from host, as Go keeps it out of the header map.
+func CanonicalRequest(method string, u *url.URL, header http.Header, host string, signedHeaders []string, contentSHA256 string) (string, error) {
+	query, err := canonicalQuery(u.RawQuery)
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{method, u.EscapedPath(), query}
+	for _, name := range signedHeaders {
+		value := host
+		if name != "host" {
+			value = strings.Join(header.Values(name), ",")
+		}
+		lines = append(lines, name+":"+strings.TrimSpace(value))
+	}
+
+	lines = append(lines, strings.Join(signedHeaders, ";"), contentSHA256)
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// canonicalQuery sorts the query parameters by name and then value and escapes them the same way
+func canonicalQuery(rawQuery string) (string, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parameters []string
+	for _, name := range names {
+		sorted := append([]string(nil), values[name]...)
+		sort.Strings(sorted)
+		for _, value := range sorted {
+			parameters = append(parameters, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+
+	return strings.Join(parameters, "&"), nil
+}
+
+// Sign returns the hex HMAC-SHA256 of the canonical request made with the key
+func Sign(canonicalRequest string, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	io.WriteString(mac, Algorithm+"\n"+canonicalRequest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the date, content hash, nonce and Authorization headers of the request, signed with the access key
+// keyID, or the shared key if keyID is empty.  contentSHA256 is the hex SHA-256 of the body, EmptySHA256 for a request
+// without one.  No nonce is sent if it is empty.
+func SignRequest(r *http.Request, keyID string, key string, contentSHA256 string, nonce string, now time.Time) error {
+	r.Header.Set(DateHeader, now.UTC().Format(time.RFC1123))
+	r.Header.Set(ContentSHA256Header, contentSHA256)
+	if nonce != "" {
+		r.Header.Set(NonceHeader, nonce)
+	}
+
+	signedHeaders := append([]string(nil), RequiredHeaders...)
+	for _, name := range optionalHeaders {
+		if r.Header.Get(name) != "" {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+
+	canonicalRequest, err := CanonicalRequest(r.Method, r.URL, r.Header, host, signedHeaders, contentSHA256)
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Authorization", Authorization{Credential: keyID, SignedHeaders: signedHeaders, Signature: Sign(canonicalRequest, key)}.String())
+	return nil
+}
+
+// CheckRequest verifies the version 2 signature of a request was made with the key.
+// u is the URL as sent by the client, before any routing added parameters to it.
+func CheckRequest(method string, u *url.URL, header http.Header, host string, key string) (Authorization, error) {
+	authorization, err := ParseAuthorization(header.Get("Authorization"))
+	if err != nil {
+		return authorization, err
+	}
+
+	return authorization, authorization.Check(method, u, header, host, key)
+}
+
+// Check verifies the signature was made over the request with the key
+func (a Authorization) Check(method string, u *url.URL, header http.Header, host string, key string) error {
+	canonicalRequest, err := CanonicalRequest(method, u, header, host, a.SignedHeaders, header.Get(ContentSHA256Header))
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(Sign(canonicalRequest, key)), []byte(a.Signature)) {
+		return ErrSignatureMismatch
+	}
+
+	return nil
+}
+
+// NewNonce returns a random nonce
+func NewNonce() (string, error) {
+	return randomHex(16)
+}
+
+// HashBody returns the hex SHA-256 of the body for ContentSHA256Header
+func HashBody(body io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyBody returns a reader of the body which fails with ErrContentMismatch at the end of a body not matching the hash
+func VerifyBody(body io.ReadCloser, contentSHA256 string) io.ReadCloser {
+	return &verifyingReader{ReadCloser: body, hash: sha256.New(), expected: contentSHA256}
+}
+
+type verifyingReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+
+	if err == io.EOF && !hmac.Equal([]byte(hex.EncodeToString(r.hash.Sum(nil))), []byte(r.expected)) {
+		return n, ErrContentMismatch
+	}
+
+	return n, err
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type AuthSuite struct{}
+
+var _ = Suite(&AuthSuite{})
+
+const testKey = "e7yflbeeid26rredmwtbiyzxijzak6altcnrsi4yol2f5sexbgdwevlpgosfoeyy"
+
+// signedRequest returns a PUT of the body signed with the test key
+func signedRequest(c *C, body string) *http.Request {
+	request, err := http.NewRequest("PUT", "http://localhost:8010/api/v1/blocker?b=2&a=1&a=0", strings.NewReader(body))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	request.Header.Set("Content-Type", "text/plain")
+
+	contentSHA256, err := HashBody(strings.NewReader(body))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = SignRequest(request, "", testKey, contentSHA256, "nonce", time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return request
+}
+
+// check verifies the request the way the server does
+func check(request *http.Request, key string) error {
+	_, err := CheckRequest(request.Method, request.URL, request.Header, request.URL.Host, key)
+	return err
+}
+
+func (s *AuthSuite) TestSignAndCheck(c *C) {
+	request := signedRequest(c, "hello world")
+
+	authorization, err := ParseAuthorization(request.Header.Get("Authorization"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(authorization.SignedHeaders, DeepEquals, []string{"content-type", "host", "x-blocker-content-sha256", "x-blocker-date", "x-blocker-nonce"})
+
+	c.Assert(check(request, testKey) == nil, IsTrue)
+	c.Assert(check(request, "wrong"), Equals, ErrSignatureMismatch)
+
+	// The order of the query does not matter
+	request.URL.RawQuery = "a=0&a=1&b=2"
+	c.Assert(check(request, testKey) == nil, IsTrue)
+}
+
+func (s *AuthSuite) TestChangedRequestsFail(c *C) {
+	changes := map[string]func(request *http.Request){
+		"method": func(request *http.Request) { request.Method = "COPY" },
+		"path":   func(request *http.Request) { request.URL.Path = "/api/v1/blocker/other" },
+		"query":  func(request *http.Request) { request.URL.RawQuery = "a=1&b=2" },
+		"header": func(request *http.Request) { request.Header.Set("Content-Type", "text/html") },
+		"date":   func(request *http.Request) { request.Header.Set(DateHeader, "Wed, 28 Jan 2015 10:42:13 UTC") },
+		"body":   func(request *http.Request) { request.Header.Set(ContentSHA256Header, EmptySHA256) },
+		"host":   func(request *http.Request) { request.URL.Host = "example.com" },
+	}
+
+	for name, change := range changes {
+		request := signedRequest(c, "hello world")
+		change(request)
+		c.Assert(check(request, testKey), Equals, ErrSignatureMismatch, Commentf("Changed %s", name))
+	}
+}
+
+func (s *AuthSuite) TestRequiredHeadersMustBeSigned(c *C) {
+	_, err := ParseAuthorization(Algorithm + " SignedHeaders=host;x-blocker-date, Signature=abc")
+	c.Assert(err != nil, IsTrue)
+
+	_, err = ParseAuthorization("RvPtP0QB7iIun1ehwheD4YUo7+fYfw7/ywl+HsC5Ddk=")
+	c.Assert(err != nil, IsTrue)
+
+	authorization, err := ParseAuthorization(Algorithm + " SignedHeaders=host;x-blocker-content-sha256;x-blocker-date, Signature=abc")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(authorization.Signature, Equals, "abc")
+}
+
+func (s *AuthSuite) TestVerifyBody(c *C) {
+	request := signedRequest(c, "hello world")
+
+	body, err := ioutil.ReadAll(VerifyBody(request.Body, request.Header.Get(ContentSHA256Header)))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(body), Equals, "hello world")
+
+	// A swapped body fails once it is read to the end
+	request = signedRequest(c, "hello world")
+	swapped := ioutil.NopCloser(strings.NewReader("goodbye world"))
+
+	_, err = ioutil.ReadAll(VerifyBody(swapped, request.Header.Get(ContentSHA256Header)))
+	c.Assert(err, Equals, ErrContentMismatch)
+}
+
+func (s *AuthSuite) TestNonceCache(c *C) {
+	cache := NewNonceCache(2)
+	now := time.Now()
+
+	c.Assert(cache.Use("a", now.Add(time.Minute), now), IsTrue)
+	c.Assert(cache.Use("a", now.Add(time.Minute), now), IsFalse)
+	c.Assert(cache.Use("b", now.Add(2*time.Minute), now), IsTrue)
+
+	// A full cache refuses nonces until one expires
+	c.Assert(cache.Use("c", now.Add(time.Minute), now), IsFalse)
+
+	later := now.Add(time.Minute)
+	c.Assert(cache.Use("c", later.Add(time.Minute), later), IsTrue)
+	c.Assert(cache.Len(), Equals, 2)
+
+	// The nonce is remembered until it expires
+	c.Assert(cache.Use("b", later.Add(time.Minute), later), IsFalse)
+	c.Assert(cache.Use("b", later.Add(time.Minute), now.Add(2*time.Minute)), IsTrue)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/keithballdotnet/blocker/blocks"
+)
+
+// backupCommand snapshots the store into the configured backup provider, or lists the snapshots
+func backupCommand(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to a YAML, JSON or TOML configuration file")
+	workers := flags.Int("workers", 4, "Number of blocks copied at the same time")
+	list := flags.Bool("list", false, "List the snapshots instead of taking one")
+	flags.Parse(args)
+
+	store, backup, code := openBackup(*configPath)
+	if store == nil {
+		return code
+	}
+	defer store.Close()
+	defer closeRepository(backup)
+
+	if *list {
+		snapshots, err := store.Snapshots(context.Background(), backup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to list snapshots: %v\n", err)
+			return 1
+		}
+
+		for _, snapshot := range snapshots {
+			fmt.Printf("%s\tfiles: %d\tblocks: %d\tnew blocks: %d\n", snapshot.Created.Format(time.RFC3339), snapshot.Files, snapshot.Blocks, snapshot.NewBlocks)
+		}
+
+		return 0
+	}
+
+	if _, err := store.Backup(context.Background(), backup, blocks.BackupOptions{Workers: *workers}); err != nil {
+		fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// restoreCommand rebuilds the store from a snapshot in the configured backup provider
+func restoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to a YAML, JSON or TOML configuration file")
+	at := flags.String("at", "", "Restore the newest snapshot taken at or before this RFC 3339 time.  Defaults to the newest snapshot")
+	workers := flags.Int("workers", 4, "Number of blocks copied at the same time")
+	prune := flags.Bool("prune", false, "Delete the files and blocks which are not in the snapshot")
+	flags.Parse(args)
+
+	var restoreTime time.Time
+	if *at != "" {
+		var err error
+		if restoreTime, err = time.Parse(time.RFC3339, *at); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid time: %v\n", err)
+			return 2
+		}
+	}
+
+	store, backup, code := openBackup(*configPath)
+	if store == nil {
+		return code
+	}
+	defer store.Close()
+	defer closeRepository(backup)
+
+	report, err := store.Restore(context.Background(), backup, restoreTime, blocks.RestoreOptions{Workers: *workers, Prune: *prune})
+	printJSON(report)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// fsckCommand checks the files, block info and blocks of the store agree
+func fsckCommand(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to a YAML, JSON or TOML configuration file")
+	verify := flags.Bool("verify", false, "Read every block and check it against its hash")
+	repair := flags.Bool("repair", false, "Correct the use counts of the blocks.  The server should be stopped first")
+	flags.Parse(args)
+
+	store, _, err := openStore(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open store: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	report, err := store.Fsck(context.Background(), blocks.FsckOptions{Verify: *verify, Repair: *repair})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Check failed: %v\n", err)
+		return 1
+	}
+
+	printJSON(report)
+	if !report.OK() {
+		return 1
+	}
+
+	return 0
+}
+
+// openBackup opens the store and its backup provider.  The store is nil, with the exit code, when either fails.
+func openBackup(configPath string) (*blocks.Store, blocks.BlockRepository, int) {
+	store, cfg, err := openStore(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open store: %v\n", err)
+		return nil, nil, 1
+	}
+
+	backup, err := blocks.NewBackupRepository(cfg)
+	if err != nil {
+		store.Close()
+		fmt.Fprintf(os.Stderr, "Unable to open backup: %v\n", err)
+		return nil, nil, 1
+	}
+
+	return store, backup, 0
+}
+
+// closeRepository closes the repository if it needs closing
+func closeRepository(repository blocks.BlockRepository) {
+	if closer, ok := repository.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Unable to close repository: %v", err)
+		}
+	}
+}
+
+// printJSON writes a report as indented JSON
+func printJSON(report interface{}) {
+	data, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(data))
+}
@@ -4,20 +4,52 @@ import (
 	"flag"
 	"fmt"
 	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/config"
 	"github.com/keithballdotnet/blocker/server"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 const AppVersion = "1.0.4"
 
+// commands run instead of the server when named as the first argument.  Each returns the exit code.
+var commands = map[string]func(args []string) int{
+	"migrate": migrateCommand,
+	"export":  exportCommand,
+	"import":  importCommand,
+	"backup":  backupCommand,
+	"restore": restoreCommand,
+	"fsck":    fsckCommand,
+	"put":     putCommand,
+	"get":     getCommand,
+	"cp":      cpCommand,
+	"rm":      rmCommand,
+	"ls":      lsCommand,
+	"stat":    statCommand,
+	"info":    infoCommand,
+	"usage":   usageCommand,
+}
+
 func main() {
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	// Set up executable flags
 	version := flag.Bool("v", false, "prints current version without starting the application")
-	storageProvider := flag.String("s", "nfs", "Storage provider selection either 'nfs', 'cb', 'azure' or 's3'")
+	configPath := flag.String("config", "", "Path to a YAML, JSON or TOML configuration file")
+	storageProvider := flag.String("s", "nfs", "Storage provider selection either 'nfs', 'cb', 'azure', 's3' or 'memory'")
 	cryptoProvider := flag.String("c", "openpgp", "Crypto provider selection either 'gokms', 'openpgp' or 'aws'")
+	cert := flag.String("cert", "", "SSL Certificate path")
+	certKey := flag.String("certkey", "", "SSL Private key path")
+	sharedKeyPath := flag.String("sharedKey", "", "Shared Authentication Key path")
+	legacyAuth := flag.Bool("legacyAuth", false, "Accept requests signed with the original method, date and path signature")
 
 	// This code allows someone to ask what version I am from the command line
 
@@ -27,32 +59,80 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Ensure string is to lower
-	blocks.StorageProviderName = strings.ToLower(*storageProvider)
-
-	// Validate storage provider
-	if blocks.StorageProviderName != "nfs" && blocks.StorageProviderName != "cb" && blocks.StorageProviderName != "azure" && blocks.StorageProviderName != "s3" {
-		fmt.Println("Unknown Provider: Storage provider selection either 'nfs', 'cb', 'azure' or 's3'")
-		os.Exit(0)
+	// Load the configuration file and environment
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load configuration: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Ensure string is to lower
-	blocks.CryptoProviderName = strings.ToLower(*cryptoProvider)
+	// Flags given on the command line override everything else
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "s":
+			cfg.Storage.Provider = strings.ToLower(*storageProvider)
+		case "c":
+			cfg.Crypto.Provider = strings.ToLower(*cryptoProvider)
+		case "cert":
+			cfg.Server.CertPath = *cert
+		case "certkey":
+			cfg.Server.CertKeyPath = *certKey
+		case "sharedKey":
+			cfg.Server.SharedKeyPath = *sharedKeyPath
+		case "legacyAuth":
+			cfg.Server.Auth.Legacy = *legacyAuth
+		}
+	})
 
-	// Validate storage provider
-	if blocks.CryptoProviderName != "openpgp" && blocks.CryptoProviderName != "aws" && blocks.CryptoProviderName != "gokms" {
-		fmt.Println("Unknown Provider: Crypto provider selection either 'gokms', 'openpgp' or 'aws'")
-		os.Exit(0)
+	// Validate the whole configuration up front
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
 	}
 
 	// Now set up repos
-	blocks.SetUpRepositories()
+	store, err := blocks.NewStore(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to start Blocker: %v\n", err)
+		os.Exit(1)
+	}
 
 	log.SetOutput(os.Stdout)
 	log.SetPrefix("Blocker:")
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	log.Printf("Starting Blocker: %s - Using Provider: %s", AppVersion, blocks.StorageProviderName)
+	log.Printf("Starting Blocker: %s - Using Provider: %s", AppVersion, cfg.Storage.Provider)
+
+	// Release the store on shutdown so any cached blocks are written back
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Stopping Blocker")
+		if err := store.Close(); err != nil {
+			log.Printf("Unable to close store: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
 
 	// Start the server
-	server.Start()
+	if err := server.New(cfg.Server, store).Start(); err != nil {
+		store.Close()
+		log.Fatal(err)
+	}
+}
+
+// openStore creates the store described by the configuration file and the environment, for the commands
+func openStore(configPath string) (*blocks.Store, config.Config, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, cfg, fmt.Errorf("Unable to load configuration: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, cfg, fmt.Errorf("Invalid configuration:\n%w", err)
+	}
+
+	store, err := blocks.NewStore(cfg)
+	return store, cfg, err
 }
@@ -0,0 +1,370 @@
+package blocks
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keithballdotnet/blocker/crypto"
+)
+
+// ArchiveVersion is the version of the archives written by Store.Export
+const ArchiveVersion = 1
+
+// Entries of an archive.  The manifest comes first, and the blocks of a file come before the file.
+const (
+	archiveManifest     = "manifest.json"
+	archiveBlockInfoDir = "blockinfo/"
+	archiveBlockDir     = "blocks/"
+	archiveFileDir      = "files/"
+)
+
+// ArchiveManifest describes the content of an archive
+type ArchiveManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Files are the IDs of the BlockedFiles in the archive
+	Files []string `json:"files"`
+}
+
+// ExportOptions controls how Store.Export writes the blocks
+type ExportOptions struct {
+	// Codec encodes the blocks for the store importing the archive, for example with its key.
+	// Nil exports the blocks as they are stored, so only a store with the same codec and keys can import them.
+	Codec Codec
+}
+
+// ImportStats counts what Store.Import did
+type ImportStats struct {
+	// Files is the number of BlockedFiles imported
+	Files int `json:"files"`
+	// SkippedFiles is the number of BlockedFiles the store already had
+	SkippedFiles int `json:"skippedFiles"`
+	// Blocks is the number of blocks saved
+	Blocks int `json:"blocks"`
+	// DedupedBlocks is the number of blocks the store already had
+	DedupedBlocks int `json:"dedupedBlocks"`
+}
+
+// Export writes a tar archive holding the BlockedFiles, their BlockInfo and the blocks they use.
+// Every block is checked against its hash before it is written.
+func (s *Store) Export(ctx context.Context, w io.Writer, blockFileIDs []string, options ExportOptions) error {
+	if len(blockFileIDs) == 0 {
+		return errors.New("No Blocked File ID passed")
+	}
+
+	// Find all the files before writing anything
+	blockedFiles := make([]*BlockedFile, len(blockFileIDs))
+	for i, blockFileID := range blockFileIDs {
+		blockedFile, err := s.BlockedFileStore.GetBlockedFile(blockFileID)
+		if err != nil {
+			return fmt.Errorf("Unable to export %s: %w", blockFileID, err)
+		}
+		blockedFiles[i] = blockedFile
+	}
+
+	now := time.Now().UTC()
+	archive := tar.NewWriter(w)
+
+	if err := writeArchiveJSON(archive, archiveManifest, now, ArchiveManifest{Version: ArchiveVersion, Created: now, Files: blockFileIDs}); err != nil {
+		return err
+	}
+
+	written := make(map[string]bool)
+
+	for _, blockedFile := range blockedFiles {
+		for _, fileBlock := range blockedFile.BlockList {
+			if written[fileBlock.Hash] {
+				continue
+			}
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if err := s.exportBlock(ctx, archive, now, fileBlock.Hash, options); err != nil {
+				return err
+			}
+			written[fileBlock.Hash] = true
+		}
+
+		if err := writeArchiveJSON(archive, archiveFileDir+blockedFile.ID+".json", now, blockedFile); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Exported %d files with %d blocks", len(blockedFiles), len(written))
+
+	return archive.Close()
+}
+
+// exportBlock writes the BlockInfo of a block followed by the block
+func (s *Store) exportBlock(ctx context.Context, archive *tar.Writer, now time.Time, hash string, options ExportOptions) error {
+	blockInfo, err := s.BlockInfoStore.GetBlockInfo(hash)
+	if err != nil {
+		return fmt.Errorf("Unable to export block %s: %w", hash, err)
+	}
+
+	data, err := s.BlockStore.GetBlock(ctx, blockInfo.StoreID)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := s.decodeBlock(*blockInfo, data)
+	if err != nil {
+		return err
+	}
+
+	format := blockInfo.Format
+	if options.Codec != nil {
+		format = BlockFormatBuffered
+		if data, err = options.Codec.Encode(decoded); err != nil {
+			return err
+		}
+	}
+
+	// The store ID and use count belong to the store
+	exported := BlockInfo{Hash: blockInfo.Hash, Created: blockInfo.Created, LastUsage: blockInfo.LastUsage, Format: format, Size: int64(len(decoded))}
+	if err := writeArchiveJSON(archive, archiveBlockInfoDir+hash+".json", now, exported); err != nil {
+		return err
+	}
+
+	return writeArchiveEntry(archive, archiveBlockDir+hash, now, data)
+}
+
+// Import reads an archive written by Export.  Blocks the store already has are used instead of the ones in the archive.
+// Files the store already has are skipped, so an archive can be imported again after a failure.
+// The blocks in the archive must decode with the codec of the store.
+func (s *Store) Import(ctx context.Context, r io.Reader) (ImportStats, error) {
+	var stats ImportStats
+
+	// pending holds the blocks saved from the archive until a file uses them
+	pending := make(map[string]*BlockInfo)
+	// Clean up even when ctx is done
+	defer s.releaseImportedBlocks(context.Background(), pending)
+
+	// blockInfos are the BlockInfo read from the archive, waiting for their block
+	blockInfos := make(map[string]BlockInfo)
+
+	archive := tar.NewReader(r)
+	manifestRead := false
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		name := header.Name
+		if !manifestRead && name != archiveManifest {
+			return stats, errors.New("Archive does not start with a manifest")
+		}
+
+		switch {
+		case name == archiveManifest:
+			var manifest ArchiveManifest
+			if err := readArchiveJSON(archive, &manifest); err != nil {
+				return stats, err
+			}
+			if manifest.Version != ArchiveVersion {
+				return stats, fmt.Errorf("Unsupported archive version %d", manifest.Version)
+			}
+			manifestRead = true
+
+		case strings.HasPrefix(name, archiveBlockInfoDir):
+			var blockInfo BlockInfo
+			if err := readArchiveJSON(archive, &blockInfo); err != nil {
+				return stats, err
+			}
+			blockInfos[blockInfo.Hash] = blockInfo
+
+		case strings.HasPrefix(name, archiveBlockDir):
+			hash := path.Base(name)
+			blockInfo, ok := blockInfos[hash]
+			if !ok {
+				return stats, fmt.Errorf("Archive has no block info for block %s", hash)
+			}
+			delete(blockInfos, hash)
+
+			saved, err := s.importBlock(ctx, archive, blockInfo, pending)
+			if err != nil {
+				return stats, err
+			}
+			if saved {
+				stats.Blocks++
+			} else {
+				stats.DedupedBlocks++
+			}
+
+		case strings.HasPrefix(name, archiveFileDir):
+			var blockedFile BlockedFile
+			if err := readArchiveJSON(archive, &blockedFile); err != nil {
+				return stats, err
+			}
+
+			imported, err := s.importBlockedFile(blockedFile, pending)
+			if err != nil {
+				return stats, err
+			}
+			if imported {
+				stats.Files++
+			} else {
+				stats.SkippedFiles++
+			}
+
+		default:
+			return stats, fmt.Errorf("Unexpected archive entry %s", name)
+		}
+	}
+
+	if !manifestRead {
+		return stats, errors.New("Archive is empty")
+	}
+
+	log.Printf("Imported %d files, skipped %d, saved %d blocks, deduplicated %d", stats.Files, stats.SkippedFiles, stats.Blocks, stats.DedupedBlocks)
+
+	return stats, nil
+}
+
+// importBlock saves a block from the archive unless the store already has it.  Returns whether the block was saved.
+func (s *Store) importBlock(ctx context.Context, archive io.Reader, blockInfo BlockInfo, pending map[string]*BlockInfo) (bool, error) {
+	if _, ok := pending[blockInfo.Hash]; ok {
+		return false, nil
+	}
+
+	if _, err := s.BlockInfoStore.GetBlockInfo(blockInfo.Hash); err == nil {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadAll(archive)
+	if err != nil {
+		return false, err
+	}
+
+	decoded, err := s.decodeBlock(blockInfo, data)
+	if err != nil {
+		return false, fmt.Errorf("Unable to import block, it may have been exported for another store: %w", err)
+	}
+
+	storeID := strings.ToLower(crypto.RandomSecret(40))
+	if err := s.BlockStore.SaveBlock(ctx, data, storeID); err != nil {
+		return false, err
+	}
+
+	pending[blockInfo.Hash] = &BlockInfo{
+		Hash:       blockInfo.Hash,
+		StoreID:    storeID,
+		Created:    blockInfo.Created,
+		LastUsage:  time.Now().UTC(),
+		Format:     blockInfo.Format,
+		Size:       int64(len(decoded)),
+		StoredSize: int64(len(data)),
+	}
+
+	return true, nil
+}
+
+// importBlockedFile registers the use of its blocks and saves the file, unless the store already has it.
+// Returns whether the file was imported.
+func (s *Store) importBlockedFile(blockedFile BlockedFile, pending map[string]*BlockInfo) (bool, error) {
+	if _, err := s.BlockedFileStore.GetBlockedFile(blockedFile.ID); err == nil {
+		return false, nil
+	}
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	// Count the uses before saving anything, so a missing block leaves the store as it was
+	now := time.Now().UTC()
+	used := make(map[string]*BlockInfo)
+
+	for _, fileBlock := range blockedFile.BlockList {
+		blockInfo, ok := used[fileBlock.Hash]
+		if !ok {
+			if pendingInfo, ok := pending[fileBlock.Hash]; ok {
+				copied := *pendingInfo
+				blockInfo = &copied
+			} else {
+				var err error
+				if blockInfo, err = s.BlockInfoStore.GetBlockInfo(fileBlock.Hash); err != nil {
+					return false, fmt.Errorf("Archive is missing block %s of file %s", fileBlock.Hash, blockedFile.ID)
+				}
+			}
+			used[fileBlock.Hash] = blockInfo
+		}
+
+		blockInfo.UseCount++
+		blockInfo.LastUsage = now
+	}
+
+	for hash, blockInfo := range used {
+		if err := s.BlockInfoStore.SaveBlockInfo(*blockInfo); err != nil {
+			return false, err
+		}
+
+		// The BlockInfoStore keeps track of it from now on
+		delete(pending, hash)
+	}
+
+	if err := s.BlockedFileStore.SaveBlockedFile(blockedFile); err != nil {
+		return false, err
+	}
+
+	usage := &fileUsage{tenant: blockedFile.Tenant, generation: -1, sizes: make(map[string]int64, len(used))}
+	for hash, blockInfo := range used {
+		usage.sizes[hash] = blockInfo.StoredSize
+	}
+	s.countSavedFile(usage, blockedFile)
+
+	return true, nil
+}
+
+// releaseImportedBlocks deletes the blocks saved from the archive which no imported file uses
+func (s *Store) releaseImportedBlocks(ctx context.Context, pending map[string]*BlockInfo) {
+	for _, blockInfo := range pending {
+		if err := s.BlockStore.DeleteBlock(ctx, blockInfo.StoreID); err != nil {
+			log.Printf("Unable to delete unused imported block Hash: %v StoreID: %v: %v", blockInfo.Hash, blockInfo.StoreID, err)
+		}
+	}
+}
+
+// writeArchiveJSON adds the JSON of the value to the archive
+func writeArchiveJSON(archive *tar.Writer, name string, modTime time.Time, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return writeArchiveEntry(archive, name, modTime, data)
+}
+
+// writeArchiveEntry adds a file to the archive
+func writeArchiveEntry(archive *tar.Writer, name string, modTime time.Time, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := archive.Write(data)
+	return err
+}
+
+// readArchiveJSON decodes the current archive entry into the value
+func readArchiveJSON(archive io.Reader, value interface{}) error {
+	return json.NewDecoder(archive).Decode(value)
+}
@@ -0,0 +1,134 @@
+package blocks
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// archiveConfig is the test configuration with small blocks and without encryption, so files have several blocks
+// which can be compared between stores
+func archiveConfig(compression bool) config.Config {
+	cfg := testConfig()
+	cfg.Blocks.BlockSize = BlockSize30Kb
+	cfg.Blocks.Compression = compression
+	cfg.Blocks.Encryption = false
+
+	return cfg
+}
+
+func (s *BlockSuite) TestExportImport(c *C) {
+	source, _ := newMemoryStore(c, archiveConfig(true))
+	target, targetRepository := newMemoryStore(c, archiveConfig(true))
+
+	blockedFile, err := source.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	var archive bytes.Buffer
+	err = source.Export(ctx, &archive, []string{blockedFile.ID}, ExportOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	stats, err := target.Import(ctx, bytes.NewReader(archive.Bytes()))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.Files, Equals, 1)
+	c.Assert(stats.Blocks, Equals, len(blockedFile.BlockList))
+	c.Assert(targetRepository.Len(), Equals, len(blockedFile.BlockList))
+
+	expected, err := ioutil.ReadFile(inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	buffer, err := target.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(buffer.String() == string(expected), IsTrue)
+
+	blockInfo, err := target.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfo.UseCount, Equals, int64(1))
+
+	// Importing again changes nothing
+	stats, err = target.Import(ctx, bytes.NewReader(archive.Bytes()))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.SkippedFiles, Equals, 1)
+	c.Assert(stats.Files, Equals, 0)
+	c.Assert(targetRepository.Len(), Equals, len(blockedFile.BlockList))
+
+	blockInfo, err = target.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfo.UseCount, Equals, int64(1))
+}
+
+func (s *BlockSuite) TestImportDeduplicates(c *C) {
+	source, _ := newMemoryStore(c, archiveConfig(true))
+	target, targetRepository := newMemoryStore(c, archiveConfig(true))
+
+	blockedFile, err := source.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The target already has the same content in another file
+	existingFile, err := target.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	var archive bytes.Buffer
+	err = source.Export(ctx, &archive, []string{blockedFile.ID}, ExportOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	stats, err := target.Import(ctx, &archive)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.Files, Equals, 1)
+	c.Assert(stats.Blocks, Equals, 0)
+	c.Assert(stats.DedupedBlocks, Equals, len(blockedFile.BlockList))
+	c.Assert(targetRepository.Len(), Equals, len(existingFile.BlockList))
+
+	blockInfo, err := target.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfo.UseCount, Equals, int64(2))
+
+	// Deleting either file leaves the other readable
+	err = target.DeleteBlockedFile(ctx, existingFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = target.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+}
+
+func (s *BlockSuite) TestExportForAnotherCodec(c *C) {
+	source, _ := newMemoryStore(c, archiveConfig(false))
+	target, targetRepository := newMemoryStore(c, archiveConfig(true))
+
+	blockedFile, err := source.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Blocks exported as they are stored do not decode in the target
+	var archive bytes.Buffer
+	err = source.Export(ctx, &archive, []string{blockedFile.ID}, ExportOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = target.Import(ctx, &archive)
+	c.Assert(err != nil, IsTrue)
+	c.Assert(targetRepository.Len(), Equals, 0)
+
+	archive.Reset()
+	err = source.Export(ctx, &archive, []string{blockedFile.ID}, ExportOptions{Codec: target.Codec})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = target.Import(ctx, &archive)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = target.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+}
+
+func (s *BlockSuite) TestExportANonExistingFileShouldFail(c *C) {
+	var archive bytes.Buffer
+	err := s.store.Export(ctx, &archive, []string{"NONEXISTINGID"}, ExportOptions{})
+	c.Assert(err != nil, IsTrue)
+	c.Assert(archive.Len(), Equals, 0)
+}
+
+func (s *BlockSuite) TestImportWithoutManifestShouldFail(c *C) {
+	_, err := s.store.Import(ctx, bytes.NewReader([]byte("not an archive")))
+	c.Assert(err != nil, IsTrue)
+}
@@ -0,0 +1,346 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keithballdotnet/blocker/config"
+)
+
+// azureVersion is the version of the blob service REST API spoken
+const azureVersion = "2020-04-08"
+
+// defaultAzureContainer is the container used when none is configured
+const defaultAzureContainer = "blocks"
+
+// AzureBlockRepository saves blocks as block blobs in an azure storage container.
+// Requests are signed with the account key, or authorised by a SAS token.
+type AzureBlockRepository struct {
+	client    *http.Client
+	account   string
+	endpoint  *url.URL
+	container string
+	prefix    string
+	// key is the decoded account key.  Nil when a SAS token is used.
+	key []byte
+	// sasToken is added to the query of every request
+	sasToken url.Values
+}
+
+// NewAzureBlockRepository - Creates a repository storing blocks in the configured azure account.
+// The container is created if it does not exist and the configuration asks for it.
+func NewAzureBlockRepository(cfg config.AzureConfig) (AzureBlockRepository, error) {
+
+	if err := cfg.Validate(); err != nil {
+		return AzureBlockRepository{}, err
+	}
+
+	repository := AzureBlockRepository{
+		client:    &http.Client{},
+		account:   cfg.Account,
+		container: cfg.Container,
+		prefix:    cfg.Prefix,
+	}
+
+	if repository.container == "" {
+		repository.container = defaultAzureContainer
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", cfg.Account)
+	}
+	repository.endpoint, _ = url.Parse(strings.TrimSuffix(endpoint, "/"))
+
+	// Validate has checked these decode
+	if cfg.SASToken != "" {
+		repository.sasToken, _ = url.ParseQuery(strings.TrimPrefix(cfg.SASToken, "?"))
+	} else {
+		repository.key, _ = base64.StdEncoding.DecodeString(cfg.Secret)
+	}
+
+	if cfg.CreateContainer {
+		if err := repository.createContainer(context.Background()); err != nil {
+			return AzureBlockRepository{}, err
+		}
+	}
+
+	return repository, nil
+}
+
+// createContainer creates the container, unless it already exists
+func (r AzureBlockRepository) createContainer(ctx context.Context) error {
+	res, err := r.do(ctx, "PUT", "", url.Values{"restype": {"container"}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusCreated:
+		log.Printf("Created azure container %s", r.container)
+		return nil
+	case http.StatusConflict:
+		return nil
+	}
+
+	return r.statusError("Unable to create container "+r.container, res)
+}
+
+// blobName is the name of the blob holding the block
+func (r AzureBlockRepository) blobName(blockHash string) string {
+	return r.prefix + blockHash + ".blk"
+}
+
+// SaveBlock persists a block into the repository
+func (r AzureBlockRepository) SaveBlock(ctx context.Context, data []byte, blockHash string) error {
+	return r.PutBlock(ctx, blockHash, bytes.NewReader(data), int64(len(data)))
+}
+
+// GetBlock gets a block from the repository
+func (r AzureBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	body, err := r.OpenBlock(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// PutBlock streams a block into the container.  Azure needs the size up front, so a block of unknown size is read first.
+func (r AzureBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	if size < 0 {
+		block, err := ioutil.ReadAll(data)
+		if err != nil {
+			return err
+		}
+
+		data, size = bytes.NewReader(block), int64(len(block))
+	}
+
+	header := http.Header{"x-ms-blob-type": {"BlockBlob"}}
+	res, err := r.do(ctx, "PUT", r.blobName(blockHash), nil, header, &sizedReader{data, size})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return r.statusError("Unable to upload block "+blockHash, res)
+	}
+
+	return nil
+}
+
+// OpenBlock streams a block from the container
+func (r AzureBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	res, err := r.do(ctx, "GET", r.blobName(blockHash), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, r.statusError("Unable to download block "+blockHash, res)
+	}
+
+	return res.Body, nil
+}
+
+// OpenBlockRange streams part of a block from the container.  A negative length reads to the end of the block.
+func (r AzureBlockRepository) OpenBlockRange(ctx context.Context, blockHash string, offset int64, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+
+	res, err := r.do(ctx, "GET", r.blobName(blockHash), nil, http.Header{"Range": {byteRange}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusOK:
+		// The range was ignored, so skip to it
+		return skipToRange(res.Body, offset, length)
+	}
+
+	res.Body.Close()
+	return nil, r.statusError("Unable to download block "+blockHash, res)
+}
+
+// DeleteBlock deletes a block of data
+func (r AzureBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	res, err := r.do(ctx, "DELETE", r.blobName(blockHash), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		return r.statusError("Unable to delete block "+blockHash, res)
+	}
+
+	return nil
+}
+
+// CheckBlockExists checks to see if a block exists
+func (r AzureBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	res, err := r.do(ctx, "HEAD", r.blobName(blockHash), nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	// A missing container is also a 404, but is not a missing block
+	code := res.Header.Get("x-ms-error-code")
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return true, nil
+	case res.StatusCode == http.StatusNotFound && (code == "" || code == "BlobNotFound"):
+		return false, nil
+	}
+
+	return false, r.statusError("Unable to check block "+blockHash, res)
+}
+
+// sizedReader is a request body whose size is known
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+// do sends a request for the container, or for the blob when one is named, and returns the response.
+// The request is cancelled once the context is done.
+func (r AzureBlockRepository) do(ctx context.Context, method string, blob string, query url.Values, header http.Header, body *sizedReader) (*http.Response, error) {
+	target := *r.endpoint
+	target.Path += "/" + r.container
+	if blob != "" {
+		target.Path += "/" + blob
+	}
+
+	values := url.Values{}
+	for name, value := range query {
+		values[name] = value
+	}
+	for name, value := range r.sasToken {
+		values[name] = value
+	}
+	target.RawQuery = values.Encode()
+
+	var reader io.Reader
+	if body != nil {
+		reader = body.Reader
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, target.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range header {
+		request.Header[http.CanonicalHeaderKey(name)] = value
+	}
+
+	if body != nil {
+		request.ContentLength = body.size
+		// An empty block still needs its length sent
+		if body.size == 0 {
+			request.Body = http.NoBody
+		}
+	}
+
+	request.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	request.Header.Set("x-ms-version", azureVersion)
+
+	if r.key != nil {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(azureStringToSign(r.account, request, query)))
+		request.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", r.account, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+	}
+
+	return r.client.Do(request)
+}
+
+// azureStringToSign builds the string signed with the account key for Shared Key authorisation
+func azureStringToSign(account string, request *http.Request, query url.Values) string {
+	contentLength := ""
+	if request.ContentLength > 0 {
+		contentLength = strconv.FormatInt(request.ContentLength, 10)
+	}
+
+	lines := []string{
+		request.Method,
+		request.Header.Get("Content-Encoding"),
+		request.Header.Get("Content-Language"),
+		contentLength,
+		request.Header.Get("Content-MD5"),
+		request.Header.Get("Content-Type"),
+		// The date is sent in x-ms-date instead
+		"",
+		request.Header.Get("If-Modified-Since"),
+		request.Header.Get("If-Match"),
+		request.Header.Get("If-None-Match"),
+		request.Header.Get("If-Unmodified-Since"),
+		request.Header.Get("Range"),
+	}
+
+	var msHeaders []string
+	for name := range request.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name)
+		}
+	}
+	sort.Strings(msHeaders)
+
+	for _, name := range msHeaders {
+		lines = append(lines, name+":"+strings.TrimSpace(request.Header.Get(name)))
+	}
+
+	resource := "/" + account + request.URL.EscapedPath()
+
+	var parameters []string
+	for name := range query {
+		parameters = append(parameters, name)
+	}
+	sort.Strings(parameters)
+
+	for _, name := range parameters {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	return strings.Join(append(lines, resource), "\n")
+}
+
+// statusError describes a failed request, with the azure error code when there is one
+func (r AzureBlockRepository) statusError(operation string, res *http.Response) error {
+	status := res.Status
+	if code := res.Header.Get("x-ms-error-code"); code != "" {
+		status += " (" + code + ")"
+	}
+
+	return &HTTPStatusError{Operation: operation, StatusCode: res.StatusCode, Status: status}
+}
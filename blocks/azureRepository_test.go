@@ -0,0 +1,231 @@
+package blocks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// azureTestKey is the well known key of the azure storage emulator account
+const azureTestKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// fakeAzure is a stand-in for the azure blob service, addressed like the emulator with the account in the path
+type fakeAzure struct {
+	lock       sync.Mutex
+	containers map[string]bool
+	blobs      map[string][]byte
+	// unauthorised counts requests which were not signed or had no SAS token
+	unauthorised int
+}
+
+func newFakeAzure() (*fakeAzure, *httptest.Server) {
+	fake := &fakeAzure{containers: make(map[string]bool), blobs: make(map[string][]byte)}
+	return fake, httptest.NewServer(fake)
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.authorised(r) {
+		f.unauthorised++
+		w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// The path is /<account>/<container>[/<blob>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	container := parts[1]
+
+	if r.URL.Query().Get("restype") == "container" {
+		if f.containers[container] {
+			w.Header().Set("x-ms-error-code", "ContainerAlreadyExists")
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.containers[container] = true
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if !f.containers[container] {
+		w.Header().Set("x-ms-error-code", "ContainerNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	name := container + "/" + parts[2]
+
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[name], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case "GET", "HEAD":
+		data, ok := f.blobs[name]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var start, end int
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); n > 0 {
+			if n == 1 || end >= len(data) {
+				end = len(data) - 1
+			}
+			data = data[start : end+1]
+			w.WriteHeader(http.StatusPartialContent)
+		}
+
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case "DELETE":
+		if _, ok := f.blobs[name]; !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// authorised checks the request carries a SAS token or the Shared Key signature of the request as it arrived
+func (f *fakeAzure) authorised(r *http.Request) bool {
+	if r.URL.Query().Get("sig") != "" {
+		return r.Header.Get("Authorization") == ""
+	}
+
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		return false
+	}
+
+	query := r.URL.Query()
+	key, _ := base64.StdEncoding.DecodeString(azureTestKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(azureStringToSign("devstoreaccount1", r, query)))
+
+	return r.Header.Get("Authorization") == "SharedKey devstoreaccount1:"+base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func azureTestConfig(endpoint string) config.AzureConfig {
+	return config.AzureConfig{Account: "devstoreaccount1", Secret: azureTestKey, Endpoint: endpoint + "/devstoreaccount1", Container: "test-blocks", CreateContainer: true}
+}
+
+func (s *BlockSuite) TestAzureBlockRepositoryCompatibleStore(c *C) {
+	fake, server := newFakeAzure()
+	defer server.Close()
+
+	cfg := azureTestConfig(server.URL)
+	cfg.Prefix = "store/"
+
+	repository, err := NewAzureBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(fake.containers["test-blocks"], IsTrue)
+
+	// Starting again finds the container already there
+	_, err = NewAzureBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	exists, err := repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsFalse)
+
+	err = repository.SaveBlock(ctx, []byte("0123456789"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(fake.blobs["test-blocks/store/hash.blk"]), Equals, "0123456789")
+
+	exists, err = repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsTrue)
+
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "0123456789")
+
+	body, err := repository.OpenBlockRange(ctx, "hash", 2, 3)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	data, _ = ioutil.ReadAll(body)
+	body.Close()
+	c.Assert(string(data), Equals, "234")
+
+	// A stream of unknown size
+	err = repository.PutBlock(ctx, "stream", strings.NewReader("stream"), -1)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(fake.blobs["test-blocks/store/stream.blk"]), Equals, "stream")
+
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = repository.GetBlock(ctx, "hash")
+	statusErr, ok := err.(*HTTPStatusError)
+	c.Assert(ok, IsTrue, Commentf("Unexpected error: %v", err))
+	c.Assert(statusErr.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(fake.unauthorised, Equals, 0)
+}
+
+func (s *BlockSuite) TestAzureBlockRepositoryWithSASToken(c *C) {
+	fake, server := newFakeAzure()
+	defer server.Close()
+
+	cfg := azureTestConfig(server.URL)
+	cfg.Secret = ""
+	cfg.SASToken = "?sv=2020-04-08&sr=c&sp=racwd&sig=c2lnbmF0dXJl"
+
+	repository, err := NewAzureBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "blob")
+	c.Assert(fake.unauthorised, Equals, 0)
+}
+
+func (s *BlockSuite) TestAzureBlockRepositoryWithoutContainer(c *C) {
+	_, server := newFakeAzure()
+	defer server.Close()
+
+	cfg := azureTestConfig(server.URL)
+	cfg.CreateContainer = false
+
+	repository, err := NewAzureBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// A missing container is an error, not a missing block
+	_, err = repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *BlockSuite) TestAzureStringToSign(c *C) {
+	request, _ := http.NewRequest("PUT", "http://127.0.0.1:10000/devstoreaccount1/blocks/hash.blk", strings.NewReader("blob"))
+	request.Header.Set("x-ms-version", "2020-04-08")
+	request.Header.Set("x-ms-date", "Mon, 19 Oct 2026 10:00:00 GMT")
+	request.Header.Set("x-ms-blob-type", "BlockBlob")
+
+	expected := "PUT\n\n\n4\n\n\n\n\n\n\n\n\n" +
+		"x-ms-blob-type:BlockBlob\nx-ms-date:Mon, 19 Oct 2026 10:00:00 GMT\nx-ms-version:2020-04-08\n" +
+		"/devstoreaccount1/devstoreaccount1/blocks/hash.blk"
+	c.Assert(azureStringToSign("devstoreaccount1", request, nil), Equals, expected)
+
+	request, _ = http.NewRequest("PUT", "http://127.0.0.1:10000/devstoreaccount1/blocks?restype=container", nil)
+	c.Assert(strings.HasSuffix(azureStringToSign("devstoreaccount1", request, request.URL.Query()), "/devstoreaccount1/devstoreaccount1/blocks\nrestype:container"), IsTrue)
+}
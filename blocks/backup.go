@@ -0,0 +1,378 @@
+package blocks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// The backup keeps its index and snapshots next to the blocks, under names which can not be store IDs
+const (
+	backupIndexName    = "blocker-backup-index"
+	backupSnapshotName = "blocker-snapshot-"
+	// backupTimeFormat names the snapshots, so they sort by time
+	backupTimeFormat = "20060102T150405.000000000Z"
+)
+
+// SnapshotInfo describes a snapshot kept in a backup
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Files is the number of BlockedFiles in the snapshot
+	Files int `json:"files"`
+	// Blocks is the number of blocks the files use
+	Blocks int `json:"blocks"`
+	// NewBlocks is the number of blocks copied to the backup by the snapshot
+	NewBlocks int64 `json:"newBlocks"`
+}
+
+// Snapshot is the meta data of a store at the time of a backup
+type Snapshot struct {
+	Created      time.Time     `json:"created"`
+	BlockedFiles []BlockedFile `json:"files"`
+	BlockInfos   []BlockInfo   `json:"blockInfos"`
+}
+
+// BackupOptions controls how Store.Backup copies the blocks
+type BackupOptions struct {
+	// Workers is the number of blocks copied at the same time
+	Workers int
+}
+
+// RestoreOptions controls how Store.Restore rebuilds the store
+type RestoreOptions struct {
+	// Workers is the number of blocks copied at the same time
+	Workers int
+	// Prune deletes the files and blocks which are not in the snapshot.
+	// Otherwise they are kept and the use counts include them.
+	Prune bool
+}
+
+// ErrNoSnapshot is returned when a backup has no snapshot old enough to restore
+var ErrNoSnapshot = errors.New("No snapshot found")
+
+// Backup takes a snapshot of the BlockedFiles and BlockInfo, and copies the blocks into the backup repository.
+// Only blocks which are not in the previous snapshot are copied.  The snapshot is encoded like the blocks.
+// Files saved while the backup runs may be left out of the snapshot, as are files deleted before their blocks are copied.
+func (s *Store) Backup(ctx context.Context, backup BlockRepository, options BackupOptions) (SnapshotInfo, error) {
+	index, err := readBackupIndex(ctx, backup)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	snapshot, err := s.takeSnapshot()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	// The blocks of the previous snapshot are already in the backup
+	backedUp := make(map[string]bool)
+	if len(index) > 0 {
+		previous, err := s.readSnapshot(ctx, backup, index[len(index)-1])
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+
+		for _, blockInfo := range previous.BlockInfos {
+			backedUp[blockInfo.StoreID] = true
+		}
+	}
+
+	var newBlocks []BlockInfo
+	for _, blockInfo := range snapshot.BlockInfos {
+		if !backedUp[blockInfo.StoreID] {
+			newBlocks = append(newBlocks, blockInfo)
+		}
+	}
+
+	// Blocks deleted while the backup runs are skipped
+	stats, err := s.copyBlocks(ctx, s.BlockStore, backup, true, newBlocks, MigrateOptions{Workers: options.Workers})
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	// so the files which used them are left out of the snapshot
+	if stats.Skipped > 0 {
+		kept := make([]BlockInfo, 0, len(snapshot.BlockInfos))
+		for _, blockInfo := range snapshot.BlockInfos {
+			if !backedUp[blockInfo.StoreID] {
+				current, err := s.BlockInfoStore.GetBlockInfo(blockInfo.Hash)
+				if err != nil || current.StoreID != blockInfo.StoreID {
+					continue
+				}
+			}
+			kept = append(kept, blockInfo)
+		}
+
+		snapshot = buildSnapshot(snapshot.Created, snapshot.BlockedFiles, kept)
+	}
+
+	info := SnapshotInfo{
+		Name:      backupSnapshotName + snapshot.Created.Format(backupTimeFormat),
+		Created:   snapshot.Created,
+		Files:     len(snapshot.BlockedFiles),
+		Blocks:    len(snapshot.BlockInfos),
+		NewBlocks: stats.Copied,
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if data, err = s.Codec.Encode(data); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if err := backup.SaveBlock(ctx, data, info.Name); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	// The snapshot only counts once it is in the index
+	if err := writeBackupIndex(ctx, backup, append(index, info)); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	log.Printf("Backed up %d files with %d blocks, %d new, to %s", info.Files, info.Blocks, info.NewBlocks, info.Name)
+
+	return info, nil
+}
+
+// takeSnapshot reads the meta data.  Files whose blocks are not all known are left out,
+// and the use counts are those of the files in the snapshot.
+func (s *Store) takeSnapshot() (Snapshot, error) {
+	created := time.Now().UTC()
+
+	// Files first, so a file saved meanwhile is left out rather than missing its blocks
+	blockedFiles, err := s.BlockedFileStore.ListBlockedFiles()
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	blockInfos, err := s.BlockInfoStore.ListBlockInfo()
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return buildSnapshot(created, blockedFiles, blockInfos), nil
+}
+
+// buildSnapshot puts the files whose blocks are all known into a snapshot, with the use counts of those files
+func buildSnapshot(created time.Time, blockedFiles []BlockedFile, blockInfos []BlockInfo) Snapshot {
+	known := make(map[string]BlockInfo, len(blockInfos))
+	for _, blockInfo := range blockInfos {
+		blockInfo.UseCount = 0
+		known[blockInfo.Hash] = blockInfo
+	}
+
+	snapshot := Snapshot{Created: created}
+
+	for _, blockedFile := range blockedFiles {
+		complete := true
+		for _, fileBlock := range blockedFile.BlockList {
+			if _, ok := known[fileBlock.Hash]; !ok {
+				complete = false
+				break
+			}
+		}
+
+		if !complete {
+			log.Printf("Leaving file %s out of the snapshot, some of its blocks are unknown", blockedFile.ID)
+			continue
+		}
+
+		for _, fileBlock := range blockedFile.BlockList {
+			blockInfo := known[fileBlock.Hash]
+			blockInfo.UseCount++
+			known[fileBlock.Hash] = blockInfo
+		}
+
+		snapshot.BlockedFiles = append(snapshot.BlockedFiles, blockedFile)
+	}
+
+	// Keep the order of the listing
+	for _, blockInfo := range blockInfos {
+		if used := known[blockInfo.Hash]; used.UseCount > 0 {
+			snapshot.BlockInfos = append(snapshot.BlockInfos, used)
+		}
+	}
+
+	return snapshot
+}
+
+// Snapshots lists the snapshots in the backup, oldest first
+func (s *Store) Snapshots(ctx context.Context, backup BlockRepository) ([]SnapshotInfo, error) {
+	return readBackupIndex(ctx, backup)
+}
+
+// Restore rebuilds the store from the newest snapshot taken at or before the passed time.  A zero time restores the newest snapshot.
+// Blocks missing from the store are copied back from the backup, and the store is checked by Fsck afterwards.
+// The store should not be in use while it is restored.
+func (s *Store) Restore(ctx context.Context, backup BlockRepository, at time.Time, options RestoreOptions) (FsckReport, error) {
+	index, err := readBackupIndex(ctx, backup)
+	if err != nil {
+		return FsckReport{}, err
+	}
+
+	var chosen *SnapshotInfo
+	for i := range index {
+		if at.IsZero() || !index[i].Created.After(at) {
+			chosen = &index[i]
+		}
+	}
+	if chosen == nil {
+		return FsckReport{}, ErrNoSnapshot
+	}
+
+	log.Printf("Restoring %s", chosen.Name)
+
+	snapshot, err := s.readSnapshot(ctx, backup, *chosen)
+	if err != nil {
+		return FsckReport{}, err
+	}
+
+	// Blocks which are in the store and verify are left alone
+	if _, err := s.copyBlocks(ctx, backup, s.BlockStore, false, snapshot.BlockInfos, MigrateOptions{Workers: options.Workers}); err != nil {
+		return FsckReport{}, err
+	}
+
+	if options.Prune {
+		if err := s.pruneToSnapshot(ctx, snapshot); err != nil {
+			return FsckReport{}, err
+		}
+	}
+
+	s.infoLock.Lock()
+	for _, blockInfo := range snapshot.BlockInfos {
+		if err = s.BlockInfoStore.SaveBlockInfo(blockInfo); err != nil {
+			break
+		}
+	}
+	s.infoLock.Unlock()
+	if err != nil {
+		return FsckReport{}, err
+	}
+
+	for _, blockedFile := range snapshot.BlockedFiles {
+		if err := s.BlockedFileStore.SaveBlockedFile(blockedFile); err != nil {
+			return FsckReport{}, err
+		}
+	}
+
+	// The files have been replaced, so the usage of the tenants is counted again
+	s.resetUsage()
+
+	// Files kept alongside the snapshot also count towards the use counts
+	report, err := s.Fsck(ctx, FsckOptions{Verify: true, Repair: !options.Prune})
+	if err != nil {
+		return report, err
+	}
+
+	if !report.OK() {
+		return report, errors.New("The restored store failed its check")
+	}
+
+	return report, nil
+}
+
+// pruneToSnapshot deletes the files, BlockInfo and blocks which are not in the snapshot
+func (s *Store) pruneToSnapshot(ctx context.Context, snapshot Snapshot) error {
+	inSnapshot := make(map[string]bool)
+	for _, blockedFile := range snapshot.BlockedFiles {
+		inSnapshot[blockedFile.ID] = true
+	}
+	for _, blockInfo := range snapshot.BlockInfos {
+		inSnapshot[blockInfo.Hash] = true
+	}
+
+	blockedFiles, err := s.BlockedFileStore.ListBlockedFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, blockedFile := range blockedFiles {
+		if !inSnapshot[blockedFile.ID] {
+			if err := s.BlockedFileStore.DeleteBlockedFile(blockedFile.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	blockInfos, err := s.BlockInfoStore.ListBlockInfo()
+	if err != nil {
+		return err
+	}
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	for _, blockInfo := range blockInfos {
+		if inSnapshot[blockInfo.Hash] {
+			continue
+		}
+
+		log.Printf("Deleting Hash: %v StoreID: %v", blockInfo.Hash, blockInfo.StoreID)
+
+		if err := s.BlockStore.DeleteBlock(ctx, blockInfo.StoreID); err != nil {
+			return err
+		}
+
+		if err := s.BlockInfoStore.DeleteBlockInfo(blockInfo.Hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSnapshot loads and decodes a snapshot from the backup
+func (s *Store) readSnapshot(ctx context.Context, backup BlockRepository, info SnapshotInfo) (Snapshot, error) {
+	data, err := backup.GetBlock(ctx, info.Name)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("Unable to read snapshot %s: %w", info.Name, err)
+	}
+
+	if data, err = s.Codec.Decode(data); err != nil {
+		return Snapshot{}, fmt.Errorf("Unable to decode snapshot %s: %w", info.Name, err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return Snapshot{}, fmt.Errorf("Unable to decode snapshot %s: %w", info.Name, err)
+	}
+
+	return snapshot, nil
+}
+
+// readBackupIndex loads the snapshots in the backup, which has none when it has no index yet
+func readBackupIndex(ctx context.Context, backup BlockRepository) ([]SnapshotInfo, error) {
+	exists, err := backup.CheckBlockExists(ctx, backupIndexName)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	data, err := backup.GetBlock(ctx, backupIndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	var index []SnapshotInfo
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("Unable to read backup index: %w", err)
+	}
+
+	return index, nil
+}
+
+// writeBackupIndex replaces the list of snapshots in the backup
+func writeBackupIndex(ctx context.Context, backup BlockRepository, index []SnapshotInfo) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return backup.SaveBlock(ctx, data, backupIndexName)
+}
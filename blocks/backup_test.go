@@ -0,0 +1,145 @@
+package blocks
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BlockSuite) TestBackupIsIncremental(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(true))
+	backup := NewMemoryBlockRepository()
+
+	first, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	info, err := store.Backup(ctx, backup, BackupOptions{Workers: 2})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(info.Files, Equals, 1)
+	c.Assert(info.NewBlocks, Equals, int64(len(first.BlockList)))
+
+	// Only the changed blocks are copied by the next backup
+	second, err := store.BlockFile(ctx, changedInputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	info, err = store.Backup(ctx, backup, BackupOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(info.Files, Equals, 2)
+	c.Assert(info.NewBlocks > 0, IsTrue)
+	c.Assert(info.NewBlocks < int64(len(second.BlockList)), IsTrue)
+
+	snapshots, err := store.Snapshots(ctx, backup)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(len(snapshots), Equals, 2)
+	c.Assert(snapshots[1].Name, Equals, info.Name)
+}
+
+func (s *BlockSuite) TestRestore(c *C) {
+	store, repository := newMemoryStore(c, archiveConfig(true))
+	backup := NewMemoryBlockRepository()
+
+	first, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	firstSnapshot, err := store.Backup(ctx, backup, BackupOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	second, err := store.BlockFile(ctx, changedInputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.Backup(ctx, backup, BackupOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// A new installation gets everything back
+	restored, _ := newMemoryStore(c, archiveConfig(true))
+	report, err := restored.Restore(ctx, backup, time.Time{}, RestoreOptions{Workers: 2})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.Files, Equals, 2)
+
+	for _, blockedFile := range []BlockedFile{first, second} {
+		_, err = restored.UnblockFileToBuffer(ctx, blockedFile.ID)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+
+	// Lost blocks are copied back into the store
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(first.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.DeleteBlock(ctx, blockInfo.StoreID) == nil, IsTrue)
+
+	_, err = store.Restore(ctx, backup, time.Time{}, RestoreOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.UnblockFileToBuffer(ctx, first.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Going back to the first snapshot removes the second file
+	report, err = store.Restore(ctx, backup, firstSnapshot.Created, RestoreOptions{Prune: true})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.Files, Equals, 1)
+	c.Assert(len(report.Orphans), Equals, 0)
+
+	_, err = store.UnblockFileToBuffer(ctx, second.ID)
+	c.Assert(err != nil, IsTrue)
+
+	_, err = store.UnblockFileToBuffer(ctx, first.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Len(), Equals, len(first.BlockList))
+}
+
+func (s *BlockSuite) TestRestoreBeforeFirstSnapshotFails(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(true))
+	backup := NewMemoryBlockRepository()
+
+	_, err := store.Restore(ctx, backup, time.Time{}, RestoreOptions{})
+	c.Assert(err, Equals, ErrNoSnapshot)
+
+	_, err = store.Backup(ctx, backup, BackupOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.Restore(ctx, backup, time.Now().Add(-time.Hour), RestoreOptions{})
+	c.Assert(err, Equals, ErrNoSnapshot)
+}
+
+// deletingRepository runs a function before the first block is read, to change the store while it is read
+type deletingRepository struct {
+	BlockRepository
+	once   sync.Once
+	before func()
+}
+
+func (r *deletingRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	r.once.Do(r.before)
+	return r.BlockRepository.GetBlock(ctx, blockHash)
+}
+
+func (s *BlockSuite) TestBackupSkipsFilesDeletedMeanwhile(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(true))
+	backup := NewMemoryBlockRepository()
+
+	kept, err := store.BlockBuffer(ctx, strings.NewReader("kept"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	deleted, err := store.BlockBuffer(ctx, strings.NewReader("deleted"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The file is deleted after the snapshot is taken, before its block is copied
+	store.BlockStore = &deletingRepository{BlockRepository: store.BlockStore, before: func() {
+		c.Check(store.DeleteBlockedFile(ctx, deleted.ID), IsNil)
+	}}
+
+	info, err := store.Backup(ctx, backup, BackupOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(info.Files, Equals, 1)
+	c.Assert(info.Blocks, Equals, 1)
+
+	restored, _ := newMemoryStore(c, archiveConfig(true))
+	report, err := restored.Restore(ctx, backup, time.Time{}, RestoreOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.Files, Equals, 1)
+
+	_, err = restored.UnblockFileToBuffer(ctx, kept.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+}
@@ -2,19 +2,28 @@ package blocks
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/google/uuid"
+	"github.com/keithballdotnet/blocker/config"
 	"github.com/keithballdotnet/blocker/crypto"
 	"github.com/keithballdotnet/blocker/hash2"
+	"github.com/keithballdotnet/blocker/retry"
 )
 
-// This is a form used to link the File to the Block without needing to load the full data from the database
+// This is a form used to link the File to the Block without needing to load the full data from the database.
+// The hash is the key of the BlockInfo, which is prefixed with the tenant when tenants are isolated.
 type Block struct {
 	BlockPosition int    `json:"position"`
 	Hash          string `json:"hash"`
@@ -26,17 +35,33 @@ type BlockedFile struct {
 	FileHash  string  `json:"fileHash"`
 	Length    int64   `json:"length"`
 	BlockList []Block `json:"blocks"`
+	// Tenant owns the file.  Files saved before tenants belong to the default tenant, "".
+	Tenant string `json:"tenant,omitempty"`
 }
 
-// BlockInfo is used to maintain information about file blocks
+// BlockInfo is used to maintain information about file blocks.  It is kept under its hash, which is prefixed with
+// the tenant when tenants are isolated.
 type BlockInfo struct {
 	Hash      string    `json:"hash"`
 	StoreID   string    `json:"storeid"`
 	UseCount  int64     `json:"usecount"`
 	Created   time.Time `json:"created"`
 	LastUsage time.Time `json:"lastUsed"`
+	// Format records how the block was encoded
+	Format string `json:"format,omitempty"`
+	// Size is the length of the block and StoredSize the length of its encoding.  Both are 0 for blocks saved by older versions.
+	Size       int64 `json:"size,omitempty"`
+	StoredSize int64 `json:"storedSize,omitempty"`
 }
 
+// Block formats recorded in the BlockInfo
+const (
+	// BlockFormatBuffered blocks were encoded as a whole with Codec.Encode.  Blocks saved before formats were recorded have this format.
+	BlockFormatBuffered = ""
+	// BlockFormatStream blocks were encoded while streaming with StreamCodec.EncodeWriter
+	BlockFormatStream = "stream"
+)
+
 // 4Mb block size
 const BlockSize4Mb int64 = 4194304
 
@@ -49,88 +74,165 @@ const BlockSize30Kb int64 = 30720
 // 100kb block size
 const BlockSize100Kb int64 = 102400
 
-// Set default blocksize to 4Mb
-var BlockSize int64 = BlockSize4Mb
-
-// Compression is on by default
-var UseCompression bool = true
+// Store blocks files into a BlockRepository and keeps track of them in its meta data repositories.
+// Each Store is independent, so several differently configured stores can be used side by side.
+// A Store is safe for concurrent use.
+type Store struct {
+	// BlockedFileStore is the repository for BlockedFiles
+	BlockedFileStore BlockedFileRepository
+	// BlockInfoStore is the repository for BlockInfo objects
+	BlockInfoStore BlockInfoRepository
+	// BlockStore is the repository for blocks
+	BlockStore BlockRepository
+	// CryptoProvider is used for encrypting the data at rest.  Nil when encryption is disabled.
+	CryptoProvider crypto.CryptoProvider
+	// Codec transforms blocks before they are stored and after they are loaded
+	Codec Codec
+	// Chunker splits sources into blocks
+	Chunker Chunker
+	// IsolateTenants stops the files of different tenants sharing blocks
+	IsolateTenants bool
+	// Quotas limit the storage of tenants
+	Quotas map[string]config.QuotaConfig
+
+	// infoLock serialises the read, modify, write of BlockInfo use counts.  It is not held while blocks are stored.
+	infoLock sync.Mutex
+	// hashLocks stop a block being stored or deleted while the same block is being stored or deleted
+	hashLocks keyedMutex
+	// usage counts the storage used by each tenant, guarded by the infoLock.  Nil until a quota or usage report needs
+	// it, while usageLoad counts it.  usageGeneration changes each time it is reset.
+	usage           map[string]*usageCounter
+	usageLoad       *usageLoad
+	usageGeneration int64
+}
 
-// Use Encryption is on by default
-var UseEncryption bool = true
+// keyedMutex locks each key on its own.  The zero value is unlocked.
+type keyedMutex struct {
+	lock  sync.Mutex
+	locks map[string]*keyLock
+}
 
-// Repository for blockedFiles
-var BlockedFileStore BlockedFileRepository
+type keyLock struct {
+	sync.Mutex
+	// users is the number of callers holding or waiting for the lock
+	users int
+}
 
-// Repository for blocks
-var BlockStore BlockRepository
+// Lock locks the key and returns the function unlocking it
+func (m *keyedMutex) Lock(key string) func() {
+	m.lock.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyLock{}
+		m.locks[key] = l
+	}
+	l.users++
+	m.lock.Unlock()
 
-// fileBlockInfoRepository for FileBlockInfo objects
-var BlockInfoStore BlockInfoRepository
+	l.Lock()
 
-// StorageProviderName is the name of the selected storage provider
-var StorageProviderName string
+	return func() {
+		l.Unlock()
 
-// CryptoProvider is the configured crypto provider to use for encrypting the data at rest
-var CryptoProvider crypto.CryptoProvider
+		m.lock.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(m.locks, key)
+		}
+		m.lock.Unlock()
+	}
+}
 
-// CryptoProviderName is the name of the crypto provider
-var CryptoProviderName string
+// NewStore creates a Store and all its repositories and providers from the configuration
+func NewStore(cfg config.Config) (*Store, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
-// Set up repositories in the init to keep connections alive
-func SetUpRepositories() {
-	var err error
-	// Create persistent store for BlockedFiles
-	BlockedFileStore, err = NewBlockedFileRepository()
+	blockedFileStore, blockInfoStore, err := newMetadataRepositories(cfg)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	// Create persistent store for FileBlockInfo
-	BlockInfoStore, err = NewCouchbaseBlockInfoRepository()
+	// Load the storage provider
+	blockStore, err := NewBlockRepository(cfg)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	// Load the storage provider
-	switch StorageProviderName {
-	case "nfs":
-		BlockStore, err = NewDiskBlockRepository()
-	case "azure":
-		BlockStore, err = NewAzureBlockRepository()
-	case "cb":
-		BlockStore, err = NewCouchBaseBlockRepository()
-	case "s3":
-		BlockStore, err = NewS3BlockRepository()
-	default:
-		// Default to storing to disk...
-		BlockStore, err = NewDiskBlockRepository()
+	// Load the crypto provider
+	var cryptoProvider crypto.CryptoProvider
+	if cfg.Blocks.Encryption {
+		cryptoProvider, err = crypto.NewCryptoProvider(cfg.Crypto)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if err != nil {
-		panic(err)
+	return &Store{
+		BlockedFileStore: blockedFileStore,
+		BlockInfoStore:   blockInfoStore,
+		BlockStore:       blockStore,
+		CryptoProvider:   cryptoProvider,
+		Codec:            NewCodec(cfg.Blocks.Compression, cryptoProvider),
+		Chunker:          FixedSizeChunker{BlockSize: cfg.Blocks.BlockSize},
+		IsolateTenants:   cfg.Tenants.Isolate,
+		Quotas:           cfg.Tenants.Quotas,
+	}, nil
+}
+
+// newMetadataRepositories creates the repositories of the BlockedFiles and BlockInfo selected in the configuration
+func newMetadataRepositories(cfg config.Config) (BlockedFileRepository, BlockInfoRepository, error) {
+	if cfg.Metadata.Provider == "memory" {
+		return NewMemoryBlockedFileRepository(), NewMemoryBlockInfoRepository(), nil
 	}
 
-	// Load the storage provider
-	switch CryptoProviderName {
-	case "gokms":
-		CryptoProvider, err = crypto.NewGoKMSCryptoProvider()
-	case "aws":
-		CryptoProvider, err = crypto.NewAwsCryptoProvider()
-	case "openpgp":
-		CryptoProvider, err = crypto.NewOpenPGPCryptoProvider()
-	default:
-		// Default to openpgp
-		CryptoProvider, err = crypto.NewOpenPGPCryptoProvider()
+	// Create persistent store for BlockedFiles
+	blockedFileStore, err := NewCouchbaseBlockedFileRepository(cfg.Couchbase)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	// Create persistent store for FileBlockInfo
+	blockInfoStore, err := NewCouchbaseBlockInfoRepository(cfg.Couchbase)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+
+	return blockedFileStore, blockInfoStore, nil
+}
+
+// Close releases the repositories of the store.  A write-back cache writes back its remaining blocks.
+func (s *Store) Close() error {
+	if closer, ok := s.BlockStore.(io.Closer); ok {
+		return closer.Close()
 	}
+
+	return nil
+}
+
+// Status reports the state of the block repository, such as cache use and the health of replicas,
+// and the retries of the crypto provider
+func (s *Store) Status() RepositoryStatus {
+	var status RepositoryStatus
+	reportStatus(s.BlockStore, &status)
+
+	if provider, ok := s.CryptoProvider.(*crypto.RetryCryptoProvider); ok {
+		if status.Retries == nil {
+			status.Retries = make(map[string]retry.Stats)
+		}
+		status.Retries["crypto"] = provider.Stats()
+	}
+
+	return status
 }
 
 // Create a new file.
 // Expects a filename.  Returns any error or the created BlockedFile
-func BlockFile(sourceFilepath string) (BlockedFile, error) {
+func (s *Store) BlockFile(ctx context.Context, sourceFilepath string) (BlockedFile, error) {
 
 	// open the file and read the contents
 	sourceFile, err := os.Open(sourceFilepath)
@@ -139,256 +241,438 @@ func BlockFile(sourceFilepath string) (BlockedFile, error) {
 	}
 	defer sourceFile.Close()
 
-	// Get blocked file (function used for testing so always same here)
-	blockedFile, err := BlockBuffer(sourceFile)
-	if err != nil {
-		return BlockedFile{}, err
-	}
-
-	return blockedFile, nil
+	return s.BlockBuffer(ctx, sourceFile)
 }
 
-// Block a source into a file
-func BlockBuffer(source io.Reader) (BlockedFile, error) {
-
-	// Set up seeker
-	readSeeker, _ := source.(io.ReadSeeker)
-
-	// Create file hash
-	fileHash := hash2.GetSha256HashStringFromStream(readSeeker)
+// Block a source into a file of the tenant of the context
+func (s *Store) BlockBuffer(ctx context.Context, source io.Reader) (BlockedFile, error) {
+	tenant := Tenant(ctx)
 
-	// Go back to start of stream for blocking
-	readSeeker.Seek(0, 0)
+	usage, err := s.startFile(ctx, tenant)
+	if err != nil {
+		return BlockedFile{}, err
+	}
 
-	// Set the BlockSize
-	data := make([]byte, BlockSize)
+	// Create the file hash as we read through the source
+	fileHasher := sha256.New()
+	source = io.TeeReader(source, fileHasher)
 
 	fileblocks := make([]Block, 0)
 
 	var blockCount int
 	var fileLength int64
 
-	// Keep reading blocks of data from the file until we have read less than the BlockSize
-	for count, err := readSeeker.Read(data); err == nil; count, err = readSeeker.Read(data) {
+	err = s.Chunker.Split(source, func(data []byte) error {
+		// Stop if the caller has given up
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The length is counted before the block is saved, so files blocked at the same time can not together go over the quota
+		if err := s.reserveLength(usage, int64(len(data))); err != nil {
+			return err
+		}
+
 		blockCount++
-		fileLength += int64(count)
+		fileLength += int64(len(data))
 
-		if err != nil && err != io.EOF {
-			return BlockedFile{}, err
+		hash, storedSize, err := s.saveBlock(ctx, tenant, data)
+		if err != nil {
+			return err
 		}
 
-		// Calculate the hash of the block
-		hash := hash2.GetSha256HashString(data[:count])
+		// Add the file block to the list of blocks
+		fileblocks = append(fileblocks, Block{blockCount, hash})
 
-		// Get FileBlockInfo (if any)
-		blockExists := false
-		fileBlockInfo, err := BlockInfoStore.GetBlockInfo(hash)
-		if err == nil {
-			blockExists = true
+		return s.countBlock(usage, hash, storedSize)
+	})
+	if err != nil {
+		s.releaseFile(ctx, usage, fileblocks)
+		return BlockedFile{}, err
+	}
+
+	blockedFile := BlockedFile{ID: uuid.New().String(), FileHash: hex.EncodeToString(fileHasher.Sum(nil)), Length: fileLength, BlockList: fileblocks, Tenant: tenant}
+
+	if err := s.BlockedFileStore.SaveBlockedFile(blockedFile); err != nil {
+		s.releaseFile(ctx, usage, fileblocks)
+		return BlockedFile{}, err
+	}
+
+	s.infoLock.Lock()
+	s.countSavedFile(usage, blockedFile)
+	s.infoLock.Unlock()
+
+	return blockedFile, nil
+}
+
+// releaseFile gives back the blocks and usage counted for a file which could not be blocked, so they are not left
+// in use.  They are released even if the caller has given up.
+func (s *Store) releaseFile(ctx context.Context, usage *fileUsage, fileblocks []Block) {
+	ctx = context.WithoutCancel(ctx)
+	for _, fileBlock := range fileblocks {
+		if err := s.releaseBlock(ctx, fileBlock.Hash); err != nil {
+			log.Printf("Unable to release block %v: %v", fileBlock.Hash, err)
 		}
+	}
 
-		// Get the time...
-		now := time.Now().UTC()
+	s.uncountFile(usage)
+}
 
-		if !blockExists {
-			storeData := data[:count]
+// saveBlock stores the data if the tenant does not already have it and registers the usage of the block.
+// Returns the key of the block and its stored size.
+func (s *Store) saveBlock(ctx context.Context, tenant string, data []byte) (string, int64, error) {
+	// Calculate the hash of the block
+	hash := s.blockKey(tenant, hash2.GetSha256HashString(data))
 
-			// Compress the data
-			if UseCompression {
-				storeData = snappy.Encode(nil, storeData)
-			}
+	// Saves of the same block wait for the first to store it, and then only use it again
+	unlock := s.hashLocks.Lock(hash)
+	defer unlock()
 
-			// Encrypt the data
-			if UseEncryption {
-				storeData, err = CryptoProvider.Encrypt(storeData)
-				if err != nil {
-					return BlockedFile{}, err
-				}
-			}
+	storedSize, used, err := s.useBlock(hash)
+	if used || err != nil {
+		return hash, storedSize, err
+	}
 
-			// Get a 50byte secret to store the file under
-			storeID := strings.ToLower(crypto.RandomSecret(40))
+	// Get a 50byte secret to store the file under
+	storeID := strings.ToLower(crypto.RandomSecret(40))
+
+	// Commit block to repository
+	var storeSize int64
+	var format string
+	if streamCodec, ok := s.Codec.(StreamCodec); ok {
+		format = BlockFormatStream
+		storeSize, err = s.putBlockStream(ctx, streamCodec, storeID, data)
+	} else {
+		format = BlockFormatBuffered
+		storeSize, err = s.putBlockBuffered(ctx, storeID, data)
+	}
+	if err != nil {
+		return "", 0, err
+	}
 
-			storeSize := len(storeData)
-			log.Printf("Saving Block: %v Block: %v Store: %v (%.2f%%) StoreID: %v", hash, count, storeSize, ((float64(storeSize) / float64(count)) * 100), storeID)
+	log.Printf("Saving Block: %v Block: %v Store: %v (%.2f%%) StoreID: %v", hash, len(data), storeSize, ((float64(storeSize) / float64(len(data))) * 100), storeID)
 
-			// Commit block to repository
-			err = BlockStore.SaveBlock(storeData, storeID)
-			if err != nil {
-				return BlockedFile{}, err
-			}
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
 
-			// Save BlockInfo for hash
-			err = BlockInfoStore.SaveBlockInfo(BlockInfo{Hash: hash, StoreID: storeID, UseCount: 1, Created: now, LastUsage: now})
-		} else {
-			// Register that we have been used again in another file
-			fileBlockInfo.LastUsage = now
-			fileBlockInfo.UseCount = fileBlockInfo.UseCount + 1
-			err = BlockInfoStore.SaveBlockInfo(*fileBlockInfo)
-		}
+	// Save BlockInfo for hash
+	now := time.Now().UTC()
+	return hash, storeSize, s.BlockInfoStore.SaveBlockInfo(BlockInfo{Hash: hash, StoreID: storeID, UseCount: 1, Created: now, LastUsage: now, Format: format, Size: int64(len(data)), StoredSize: storeSize})
+}
 
-		fileblock := Block{blockCount, hash}
+// useBlock registers that another file uses the block.  Returns its stored size, and false if the block is not stored yet.
+func (s *Store) useBlock(hash string) (int64, bool, error) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
 
-		// Add the file block to the list of blocks
-		fileblocks = append(fileblocks, fileblock)
+	// Only a block known to be missing is stored again, as its BlockInfo would replace the uses of the other files
+	blockInfo, err := s.BlockInfoStore.GetBlockInfo(hash)
+	if errors.Is(err, ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
 	}
 
-	blockedFile := BlockedFile{uuid.New().String(), fileHash, fileLength, fileblocks}
+	blockInfo.LastUsage = time.Now().UTC()
+	blockInfo.UseCount = blockInfo.UseCount + 1
+	return blockInfo.StoredSize, true, s.BlockInfoStore.SaveBlockInfo(*blockInfo)
+}
 
-	err := BlockedFileStore.SaveBlockedFile(blockedFile)
+// putBlockBuffered encodes the whole block before saving it.  Returns the stored size.
+func (s *Store) putBlockBuffered(ctx context.Context, storeID string, data []byte) (int64, error) {
+	storeData, err := s.Codec.Encode(data)
+	if err != nil {
+		return 0, err
+	}
 
-	return blockedFile, err
+	return int64(len(storeData)), s.BlockStore.SaveBlock(ctx, storeData, storeID)
+}
+
+// putBlockStream encodes the block with the stream codec and saves it.  The block is already in memory, so it is
+// encoded into a buffer and the repository is given its size, and a reader it can send again.  Returns the stored size.
+func (s *Store) putBlockStream(ctx context.Context, codec StreamCodec, storeID string, data []byte) (int64, error) {
+	var encoded bytes.Buffer
+
+	encoder, err := codec.EncodeWriter(&encoded)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = encoder.Write(data)
+	if closeErr := encoder.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(encoded.Len())
+
+	return size, s.BlockStore.PutBlock(ctx, storeID, bytes.NewReader(encoded.Bytes()), size)
 }
 
 // DeleteBlockFile -  Deletes a BlockedFile and any unused FileBlocks
-func DeleteBlockedFile(blockFileID string) error {
+func (s *Store) DeleteBlockedFile(ctx context.Context, blockFileID string) error {
 	// Get the blocked file from the repository
-	blockedFile, err := BlockedFileStore.GetBlockedFile(blockFileID)
+	blockedFile, err := s.getBlockedFile(ctx, blockFileID)
 	if err != nil {
 		return err
 	}
 
 	for _, fileBlock := range blockedFile.BlockList {
-		// Store in the FileBlockInfo that we have been used...
-		blockInfo, err := BlockInfoStore.GetBlockInfo(fileBlock.Hash)
-		if err == nil {
-			blockInfo.UseCount = blockInfo.UseCount - 1
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-			// Is the file block in use anymore?
-			if blockInfo.UseCount < 1 {
+		if err := s.releaseBlock(ctx, fileBlock.Hash); err != nil {
+			return err
+		}
+	}
 
-				log.Printf("Deleting Hash: %v StoreID: %v", fileBlock.Hash, blockInfo.StoreID)
+	// Remove blocked file entry
+	s.BlockedFileStore.DeleteBlockedFile(blockedFile.ID)
 
-				// Delete from storage provider
-				err = BlockStore.DeleteBlock(blockInfo.StoreID)
-				if err != nil {
-					return err
-				}
+	s.infoLock.Lock()
+	s.countDeletedFile(*blockedFile)
+	s.infoLock.Unlock()
 
-				// Delete last instance of FileBlockInfo
-				err = BlockInfoStore.DeleteBlockInfo(fileBlock.Hash)
-				if err != nil {
-					return err
-				}
+	return nil
+}
 
-			} else {
-				// Save that we are using the block one less time.
-				BlockInfoStore.SaveBlockInfo(*blockInfo)
-			}
+// releaseBlock registers that a file no longer uses the block and deletes the block once it is unused
+func (s *Store) releaseBlock(ctx context.Context, hash string) error {
+	// The block is not saved again until it is deleted
+	unlock := s.hashLocks.Lock(hash)
+	defer unlock()
 
-		}
+	blockInfo, unused, err := s.dropBlockUse(hash)
+	if err != nil || !unused {
+		return err
 	}
 
-	// Remove blocked file entry
-	BlockedFileStore.DeleteBlockedFile(blockedFile.ID)
+	log.Printf("Deleting Hash: %v StoreID: %v", hash, blockInfo.StoreID)
 
-	return nil
+	// Delete from storage provider
+	err = s.BlockStore.DeleteBlock(ctx, blockInfo.StoreID)
+	if err != nil {
+		return err
+	}
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	// Delete last instance of FileBlockInfo
+	return s.BlockInfoStore.DeleteBlockInfo(hash)
+}
+
+// dropBlockUse registers that a file no longer uses the block.  The last use is left to be deleted with the block,
+// and is reported as unused.
+func (s *Store) dropBlockUse(hash string) (*BlockInfo, bool, error) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	// Store in the FileBlockInfo that we have been used...
+	blockInfo, err := s.BlockInfoStore.GetBlockInfo(hash)
+	if errors.Is(err, ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Is the file block still in use?
+	if blockInfo.UseCount > 1 {
+		blockInfo.UseCount = blockInfo.UseCount - 1
+		// Save that we are using the block one less time.
+		return blockInfo, false, s.BlockInfoStore.SaveBlockInfo(*blockInfo)
+	}
+
+	return blockInfo, true, nil
 }
 
 // CopyBlockedFile -  Copy a blocked file and return the new BlockedFile
-func CopyBlockedFile(blockFileID string) (BlockedFile, error) {
+func (s *Store) CopyBlockedFile(ctx context.Context, blockFileID string) (BlockedFile, error) {
 	// Get the blocked file from the repository
-	blockedFile, err := BlockedFileStore.GetBlockedFile(blockFileID)
+	blockedFile, err := s.getBlockedFile(ctx, blockFileID)
 	if err != nil {
 		return BlockedFile{}, err
 	}
 
+	if err := ctx.Err(); err != nil {
+		return BlockedFile{}, err
+	}
+
+	// The copy adds to the length of the files of the tenant, but uses no more blocks
+	usage, err := s.startFile(ctx, Tenant(ctx))
+	if err != nil {
+		return BlockedFile{}, err
+	}
+	if err := s.reserveLength(usage, blockedFile.Length); err != nil {
+		return BlockedFile{}, err
+	}
+
 	// Create a copy of the BlockedFile and give it a new ID
 	blockedFileCopy := *(blockedFile)
 	blockedFileCopy.ID = uuid.New().String()
-	BlockedFileStore.SaveBlockedFile(blockedFileCopy)
 
-	// Update the FileBlockInfo for all the FileBlocks to maintain the use count...
+	if err := s.saveCopy(blockedFileCopy, usage); err != nil {
+		s.uncountFile(usage)
+		return BlockedFile{}, err
+	}
+
+	// Return the new copy
+	return blockedFileCopy, nil
+}
+
+// saveCopy registers the uses of the blocks of the copy and then saves it.  Nothing is saved unless every block is
+// found, and the use counts are put back if the copy can not be saved.
+func (s *Store) saveCopy(blockedFile BlockedFile, usage *fileUsage) error {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	now := time.Now().UTC()
+	used := make(map[string]*BlockInfo)
+	originals := make(map[string]BlockInfo)
+
 	for _, fileBlock := range blockedFile.BlockList {
+		blockInfo, ok := used[fileBlock.Hash]
+		if !ok {
+			var err error
+			if blockInfo, err = s.BlockInfoStore.GetBlockInfo(fileBlock.Hash); err != nil {
+				return fmt.Errorf("Unable to find block %s: %v", fileBlock.Hash, err)
+			}
+			originals[fileBlock.Hash] = *blockInfo
+			used[fileBlock.Hash] = blockInfo
+			usage.sizes[fileBlock.Hash] = blockInfo.StoredSize
+		}
+
 		// Store in the FileBlockInfo that we have been used...
-		blockInfo, err := BlockInfoStore.GetBlockInfo(fileBlock.Hash)
-		if err == nil {
-			blockInfo.LastUsage = time.Now().UTC()
-			blockInfo.UseCount = blockInfo.UseCount + 1
-			// Save that we are using the block one more time.
-			BlockInfoStore.SaveBlockInfo(*blockInfo)
+		blockInfo.LastUsage = now
+		blockInfo.UseCount = blockInfo.UseCount + 1
+	}
+
+	saved := make([]string, 0, len(used))
+	for hash, blockInfo := range used {
+		if err := s.BlockInfoStore.SaveBlockInfo(*blockInfo); err != nil {
+			s.restoreBlockInfos(originals, saved)
+			return err
 		}
+		saved = append(saved, hash)
 	}
 
-	// Return the new copy
-	return blockedFileCopy, nil
+	if err := s.BlockedFileStore.SaveBlockedFile(blockedFile); err != nil {
+		s.restoreBlockInfos(originals, saved)
+		return err
+	}
+
+	s.countSavedFile(usage, blockedFile)
+
+	return nil
+}
+
+// restoreBlockInfos saves the BlockInfo of the blocks as they were.  Must be called with the infoLock held.
+func (s *Store) restoreBlockInfos(originals map[string]BlockInfo, hashes []string) {
+	for _, hash := range hashes {
+		if err := s.BlockInfoStore.SaveBlockInfo(originals[hash]); err != nil {
+			log.Printf("Unable to restore the use count of Hash: %v: %v", hash, err)
+		}
+	}
 }
 
 // Unblock a file to a buffer stream
-func UnblockFileToBuffer(blockFileID string) (bytes.Buffer, error) {
+func (s *Store) UnblockFileToBuffer(ctx context.Context, blockFileID string) (bytes.Buffer, error) {
 
 	// Data to return
 	var buffer bytes.Buffer
 
-	// Get the blocked file from the repository
-	blockedFile, err := BlockedFileStore.GetBlockedFile(blockFileID)
+	err := s.UnblockFileToWriter(ctx, blockFileID, &buffer)
+
+	return buffer, err
+}
+
+// UnblockFileToWriter unblocks a file and writes it block by block to w
+func (s *Store) UnblockFileToWriter(ctx context.Context, blockFileID string, w io.Writer) error {
+	reader, err := s.OpenBlockedFile(ctx, blockFileID)
 	if err != nil {
-		return buffer, err
+		return err
 	}
+	defer reader.Close()
 
-	for _, fileBlock := range blockedFile.BlockList {
+	_, err = io.Copy(w, reader)
+	return err
+}
 
-		blockInfo, err := BlockInfoStore.GetBlockInfo(fileBlock.Hash)
-		if err != nil {
-			log.Println("Error: " + err.Error())
-			return buffer, err
-		}
+// decodeBlock decodes the stored data of a block and checks it matches the hash of the block
+func (s *Store) decodeBlock(blockInfo BlockInfo, data []byte) ([]byte, error) {
+	var decoded []byte
+	var err error
 
-		log.Printf("Getting Hash: %v StoreID: %v", fileBlock.Hash, blockInfo.StoreID)
+	if blockInfo.Format == BlockFormatStream {
+		codec, ok := s.Codec.(StreamCodec)
+		if !ok {
+			return nil, errNotStreamCodec
+		}
 
-		bytes, err := BlockStore.GetBlock(blockInfo.StoreID)
-		if err != nil {
-			log.Println("Error: " + err.Error())
-			return buffer, err
+		var reader io.Reader
+		reader, err = codec.DecodeReader(bytes.NewReader(data))
+		if err == nil {
+			decoded, err = ioutil.ReadAll(reader)
 		}
+	} else {
+		decoded, err = s.Codec.Decode(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode block %s: %w", blockInfo.Hash, err)
+	}
 
-		storeData := bytes
+	if hash := hash2.GetSha256HashString(decoded); hash != contentHash(blockInfo.Hash) {
+		return nil, fmt.Errorf("Block %s does not match its hash, it has hash %s", blockInfo.Hash, hash)
+	}
 
-		// Decrypt the data
-		if UseEncryption {
-			storeData, err = CryptoProvider.Decrypt(storeData)
-			if err != nil {
-				log.Println("Error: " + err.Error())
-				return buffer, err
-			}
-		}
+	return decoded, nil
+}
 
-		// Uncompress the data
-		if UseCompression {
-			storeData, err = snappy.Decode(nil, storeData)
-			if err != nil {
-				return buffer, err
-			}
-		}
+// verifyBlock checks the stored data of a block decodes to data matching the hash of the block
+func (s *Store) verifyBlock(blockInfo BlockInfo, data []byte) error {
+	_, err := s.decodeBlock(blockInfo, data)
+	return err
+}
 
-		// Store in the FileBlockInfo that we have been used...
-		blockInfo.LastUsage = time.Now().UTC()
-		BlockInfoStore.SaveBlockInfo(*blockInfo)
+// touchBlock records that the block has just been used
+func (s *Store) touchBlock(hash string) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
 
-		// Write data to buffer
-		buffer.Write(storeData)
+	blockInfo, err := s.BlockInfoStore.GetBlockInfo(hash)
+	if err == nil {
+		blockInfo.LastUsage = time.Now().UTC()
+		s.BlockInfoStore.SaveBlockInfo(*blockInfo)
 	}
-
-	return buffer, nil
 }
 
-// Takes a file ID.  Unblocks the files from the underlying system and then writes the file to the target file path
-func UnblockFile(blockFileID string, targetFilePath string) error {
+// Takes a file ID.  Unblocks the files from the underlying system and then writes the file to the target file path.
+// The file is written block by block, and removed again if the file can not be unblocked.
+func (s *Store) UnblockFile(ctx context.Context, blockFileID string, targetFilePath string) error {
 
-	buffer, err := UnblockFileToBuffer(blockFileID)
+	reader, err := s.OpenBlockedFile(ctx, blockFileID)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
 	outFile, err := os.OpenFile(targetFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
 
-	_, err = buffer.WriteTo(outFile)
+	_, err = io.Copy(outFile, reader)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		log.Println("Error: " + err.Error())
+		os.Remove(targetFilePath)
 		return err
 	}
 
@@ -2,292 +2,712 @@ package blocks
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	memcached "github.com/couchbase/gomemcached/client"
 	"github.com/couchbaselabs/go-couchbase"
-	"github.com/keithballdotnet/azure"
+	"github.com/keithballdotnet/blocker/config"
+	"github.com/keithballdotnet/blocker/retry"
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
 )
 
-// BlockRepository is the interface for saving blocks to disk
+// ErrNotFound is returned when a block, BlockInfo or BlockedFile is not in the repository
+var ErrNotFound = errors.New("Not found!")
+
+// BlockRepository is the interface for saving blocks to a storage provider.
+// Implementations should give up and return ctx.Err() once the context is done.
 type BlockRepository interface {
+	SaveBlock(ctx context.Context, bytes []byte, hash string) error
+	GetBlock(ctx context.Context, blockHash string) ([]byte, error)
+	CheckBlockExists(ctx context.Context, blockHash string) (bool, error)
+	DeleteBlock(ctx context.Context, blockHash string) error
+	// PutBlock streams a block into the repository.  A negative size means the size is not known in advance.
+	PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error
+	// OpenBlock streams a block out of the repository.  The caller must close the returned reader.
+	OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error)
+}
+
+// LegacyBlockRepository is the interface for storage providers which do not support a context, such as those written
+// outside this package, or the couchbase provider whose client can not be given one.
+// Use NewContextBlockRepository to turn one into a BlockRepository.
+type LegacyBlockRepository interface {
 	SaveBlock(bytes []byte, hash string) error
 	GetBlock(blockHash string) ([]byte, error)
 	CheckBlockExists(blockHash string) (bool, error)
 	DeleteBlock(blockHash string) error
 }
 
-/* S3 Block Provider */
+// LegacyStreamingBlockRepository is implemented by storage providers without context support which can stream blocks.
+// Other providers are streamed by buffering the whole block.
+type LegacyStreamingBlockRepository interface {
+	LegacyBlockRepository
+	PutBlock(blockHash string, data io.Reader, size int64) error
+	OpenBlock(blockHash string) (io.ReadCloser, error)
+}
 
-type S3BlockRepository struct {
-	s3Store *s3.S3
-	bucket  *s3.Bucket
+// RangeBlockRepository is implemented by repositories which can read part of a block without reading the whole block.
+// Use OpenBlockRange to read part of a block from any BlockRepository.
+type RangeBlockRepository interface {
+	// OpenBlockRange streams length bytes of the block starting at offset.  A negative length reads to the end of the block.
+	OpenBlockRange(ctx context.Context, blockHash string, offset int64, length int64) (io.ReadCloser, error)
 }
 
-// NewAzureBlockRepository
-func NewS3BlockRepository() (S3BlockRepository, error) {
+// LegacyRangeBlockRepository is implemented by storage providers without context support which can read part of a block
+type LegacyRangeBlockRepository interface {
+	OpenBlockRange(blockHash string, offset int64, length int64) (io.ReadCloser, error)
+}
 
-	key := os.Getenv("BLOCKER_S3_KEY")
-	secret := os.Getenv("BLOCKER_S3_SECRET")
-	bucketName := os.Getenv("BLOCKER_S3_BUCKET")
+// OpenBlockRange streams part of a block.  Only that part is read if the repository is a RangeBlockRepository,
+// otherwise the start of the block is read and skipped.
+func OpenBlockRange(ctx context.Context, repository BlockRepository, blockHash string, offset int64, length int64) (io.ReadCloser, error) {
+	if rangeRepository, ok := repository.(RangeBlockRepository); ok {
+		return rangeRepository.OpenBlockRange(ctx, blockHash, offset, length)
+	}
 
-	if key == "" || secret == "" || bucketName == "" {
-		panic("Enivronmental Variable: BLOCKER_S3_KEY or BLOCKER_S3_SECRET or BLOCKER_S3_BUCKET are empty!  You must set these values when using S3 storage!")
+	body, err := repository.OpenBlock(ctx, blockHash)
+	if err != nil {
+		return nil, err
 	}
 
-	auth := aws.Auth{key, secret, ""}
+	return skipToRange(body, offset, length)
+}
 
-	s3Store := s3.New(auth, aws.EUWest)
-	// Create bucket...
-	bucket := s3Store.Bucket(bucketName)
+// skipToRange reads past offset bytes of the body and limits it to length bytes
+func skipToRange(body io.ReadCloser, offset int64, length int64) (io.ReadCloser, error) {
+	if _, err := io.CopyN(ioutil.Discard, body, offset); err != nil {
+		body.Close()
+		return nil, err
+	}
 
-	// Presume bucket is created outside of this application
-	/*err := bucket.PutBucket(s3.Private)
-	if err != nil {
-		log.Printf("Error creating bucket: %v", err)
-	}*/
+	if length < 0 {
+		return body, nil
+	}
 
-	s3BlockRepo := S3BlockRepository{s3Store, bucket}
+	return limitedReadCloser{io.LimitReader(body, length), body}, nil
+}
 
-	return s3BlockRepo, nil
+// limitedReadCloser closes the body it limits
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
 }
 
-func (r S3BlockRepository) SaveBlock(data []byte, blockHash string) error {
+// NewBlockRepository creates the storage provider selected in the configuration.
+// Every operation on the returned repository is limited by the configured timeouts.
+func NewBlockRepository(cfg config.Config) (BlockRepository, error) {
+	var repository BlockRepository
+	var err error
+
+	switch cfg.Storage.Provider {
+	case "replicated":
+		repository, err = newReplicatedRepository(cfg)
+	case "erasure":
+		repository, err = newErasureRepository(cfg)
+	default:
+		repository, err = newProviderRepository(cfg, cfg.Storage.Provider)
+	}
 
-	// TODO:  Work out if there was an error here...
-	err := r.bucket.Put(blockHash+".blk", data, "application/octet-stream", s3.Private)
 	if err != nil {
-		log.Printf("Error upload data: %v", err)
+		return nil, err
 	}
 
-	// log.Printf("Upload hash: %s Code: %v Size: %v", blockHash+".blk", res, len(data))
+	if cfg.Storage.Cache.Provider == "" {
+		return repository, nil
+	}
 
-	return err
+	cache, err := newCacheRepository(cfg.Storage.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCachingBlockRepository(repository, cache, cfg.Storage.Cache.MaxSize, cfg.Storage.Cache.Mode, time.Duration(cfg.Storage.Cache.RetryInterval)), nil
 }
 
-// Get a block from the repository
-func (r S3BlockRepository) GetBlock(blockHash string) ([]byte, error) {
+// NewBackupRepository creates the storage provider keeping backups, selected in the backup configuration
+func NewBackupRepository(cfg config.Config) (BlockRepository, error) {
+	backup := cfg.Storage.Backup
+	if backup.Provider == "" {
+		return nil, &config.MissingSettingsError{Provider: "backup", Settings: []string{"storage.backup.provider"}}
+	}
 
-	// log.Printf("Download hash: %s Code: %v Size: %v", blockHash, res.StatusCode, len(contents))
+	// The other providers keep backups where their own section says
+	if backup.Provider == "nfs" {
+		cfg.Storage.Disk.Directory = backup.Directory
+	}
 
-	return r.bucket.Get(blockHash + ".blk")
+	return newProviderRepository(cfg, backup.Provider)
 }
 
-// DeleteBlock - Deletes a block of data
-func (r S3BlockRepository) DeleteBlock(blockHash string) error {
+// newProviderRepository creates the repository of a single storage provider, limited by the configured timeouts
+// and retrying transient errors
+func newProviderRepository(cfg config.Config, provider string) (BlockRepository, error) {
+	var repository BlockRepository
+	var err error
+
+	switch provider {
+	case "memory":
+		repository = NewMemoryBlockRepository()
+	case "nfs":
+		if cfg.Storage.Disk.PackFiles {
+			repository, err = newPackRepository(cfg.Storage.Disk)
+		} else {
+			repository, err = NewDiskBlockRepository(cfg.Storage.Disk)
+		}
+	case "azure":
+		repository, err = NewAzureBlockRepository(cfg.Storage.Azure)
+	case "cb":
+		// The couchbase client can not be given a context, so is adapted
+		var cb CouchBaseBlockRepository
+		cb, err = NewCouchBaseBlockRepository(cfg.Couchbase)
+		repository = NewContextBlockRepository(cb)
+	case "s3":
+		repository, err = NewS3BlockRepository(cfg.Storage.S3)
+	default:
+		err = cfg.Storage.Validate()
+	}
 
-	return r.bucket.Del(blockHash + ".blk")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each attempt gets the full timeout
+	return newRetryRepository(provider, NewTimeoutBlockRepository(repository, cfg.Storage.Timeouts), cfg.Storage.Retry), nil
 }
 
-// Check to see if a block exists
-func (r S3BlockRepository) CheckBlockExists(blockHash string) (bool, error) {
+// newPackRepository avoids a nil *PackBlockRepository becoming a non nil BlockRepository
+func newPackRepository(cfg config.DiskConfig) (BlockRepository, error) {
+	repository, err := NewPackBlockRepository(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	res, err := r.bucket.Head(blockHash + ".blk")
+	return repository, nil
+}
 
-	if err != nil {
-		log.Printf("Get blob props err: %s blobs: %v", err, res)
-		return false, err
+// newReplicatedRepository creates a repository replicating blocks to each of the configured providers
+func newReplicatedRepository(cfg config.Config) (BlockRepository, error) {
+	if err := cfg.Storage.Validate(); err != nil {
+		return nil, err
 	}
 
-	if res.StatusCode == 200 {
-		return true, nil
+	replication := cfg.Storage.Replication
+	replicas := make([]Replica, 0, len(replication.Providers))
+
+	for _, provider := range replication.Providers {
+		repository, err := newProviderRepository(cfg, provider)
+		if err != nil {
+			return nil, err
+		}
+
+		replicas = append(replicas, Replica{Name: provider, Repository: repository})
 	}
 
-	// Block not present
-	return false, nil
+	return NewReplicatedBlockRepository(replicas, replication.WriteQuorum, time.Duration(replication.RepairInterval)), nil
 }
 
-/* Azure BLOCK Provider */
+// newErasureRepository creates a repository coding blocks into shards kept in each of the configured directories
+func newErasureRepository(cfg config.Config) (BlockRepository, error) {
+	erasure := cfg.Storage.Erasure
+	if err := erasure.Validate(); err != nil {
+		return nil, err
+	}
+
+	shards := make([]BlockRepository, 0, len(erasure.Directories))
+	for _, directory := range erasure.Directories {
+		disk, err := NewDiskBlockRepository(config.DiskConfig{Directory: directory})
+		if invalidErr, ok := err.(*config.InvalidSettingError); ok {
+			return nil, &config.InvalidSettingError{Provider: "erasure", Setting: "storage.erasure.directories", Value: directory, Err: invalidErr.Err}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		shards = append(shards, NewTimeoutBlockRepository(disk, cfg.Storage.Timeouts))
+	}
 
-type AzureBlockRepository struct {
-	blobStore     azure.Azure
-	containerName string
+	repository, err := NewErasureBlockRepository(shards, erasure.DataShards, erasure.ParityShards, time.Duration(erasure.RepairInterval))
+	if err != nil {
+		return nil, err
+	}
+
+	return repository, nil
 }
 
-// NewAzureBlockRepository
-func NewAzureBlockRepository() (AzureBlockRepository, error) {
+// RepositoryStatus reports the state of the block repository
+type RepositoryStatus struct {
+	Cache       *CacheStats        `json:"cache,omitempty"`
+	Replication *ReplicationStatus `json:"replication,omitempty"`
+	Erasure     *ErasureStatus     `json:"erasure,omitempty"`
+	// Retries are the retries and breaker state of each provider with transient errors, and of the crypto provider
+	Retries map[string]retry.Stats `json:"retries,omitempty"`
+}
 
-	accountName := os.Getenv("BLOCKER_AZURE_ACCOUNT")
-	secret := os.Getenv("BLOCKER_AZURE_SECRET")
+// statusReporter is implemented by repositories with something to add to the RepositoryStatus
+type statusReporter interface {
+	reportStatus(status *RepositoryStatus)
+}
 
-	if accountName == "" || secret == "" {
-		panic("Enivronmental Variable: BLOCKER_AZURE_ACCOUNT or BLOCKER_AZURE_SECRET are empty!  You must set these values when using azure storage!")
+// reportStatus adds the status of the repository, if it has any, to the RepositoryStatus
+func reportStatus(repository BlockRepository, status *RepositoryStatus) {
+	if reporter, ok := repository.(statusReporter); ok {
+		reporter.reportStatus(status)
 	}
+}
 
-	blobStore := azure.New(accountName, secret)
+// blockRepairer is implemented by repositories keeping a block more than once, which can rewrite lost copies
+type blockRepairer interface {
+	repairBlock(ctx context.Context, blockHash string) (int, error)
+}
 
-	azureBlockRepo := AzureBlockRepository{blobStore, "blocks"}
+// repairBlock rewrites the lost copies of the block if the repository keeps more than one.  Returns the number rewritten.
+func repairBlock(ctx context.Context, repository BlockRepository, blockHash string) (int, error) {
+	if repairer, ok := repository.(blockRepairer); ok {
+		return repairer.repairBlock(ctx, blockHash)
+	}
 
-	return azureBlockRepo, nil
+	return 0, nil
 }
 
-// Save persists a block into the repository
-func (r AzureBlockRepository) SaveBlock(data []byte, blockHash string) error {
-	buffer := bytes.NewBuffer(data)
+// newCacheRepository creates the repository the cache keeps its blocks in
+func newCacheRepository(cfg config.CacheConfig) (BlockRepository, error) {
+	if cfg.Provider == "memory" {
+		return NewMemoryBlockRepository(), nil
+	}
+
+	directory := cfg.Directory
+	if directory == "" {
+		directory = filepath.Join(os.TempDir(), "blocker-cache")
+	}
+
+	disk, err := NewDiskBlockRepository(config.DiskConfig{Directory: directory})
+	if invalidErr, ok := err.(*config.InvalidSettingError); ok {
+		return nil, &config.InvalidSettingError{Provider: "storage", Setting: "storage.cache.directory", Value: directory, Err: invalidErr.Err}
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO:  Work out if there was an error here...
-	_, err := r.blobStore.FileUpload(r.containerName, blockHash+".blk", buffer)
+	return disk, nil
+}
 
-	// log.Printf("Upload hash: %s Code: %v Size: %v", blockHash+".blk", res, len(data))
+/* S3 Block Provider */
 
-	return err
+// Defaults of the S3 provider, used when the configuration does not set them
+const (
+	// 16Mb
+	defaultS3MultipartThreshold int64 = 16777216
+	// 8Mb
+	defaultS3PartSize int64 = 8388608
+)
+
+type S3BlockRepository struct {
+	s3Store *s3.S3
+	bucket  *s3.Bucket
+	prefix  string
+	headers map[string][]string
+	// multipartThreshold is the size above which blocks are uploaded in parts.  Zero when multipart uploads are not used.
+	multipartThreshold int64
+	partSize           int64
 }
 
-// Get a block from the repository
-func (r AzureBlockRepository) GetBlock(blockHash string) ([]byte, error) {
-	// Get data...
-	res, err := r.blobStore.FileDownload(r.containerName, blockHash+".blk")
+// NewS3BlockRepository - Creates a repository storing blocks in the configured S3 bucket, or S3 compatible store
+func NewS3BlockRepository(cfg config.S3Config) (S3BlockRepository, error) {
+
+	if err := cfg.Validate(); err != nil {
+		return S3BlockRepository{}, err
+	}
+
+	region, err := s3Region(cfg)
 	if err != nil {
-		return nil, err
+		return S3BlockRepository{}, err
 	}
 
-	contents, err := ioutil.ReadAll(res.Body)
+	auth := aws.Auth{AccessKey: cfg.Key, SecretKey: cfg.Secret}
+
+	s3Store := s3.New(auth, region)
+	// Create bucket...
+	bucket := s3Store.Bucket(cfg.Bucket)
+
+	// Presume bucket is created outside of this application
+	/*err := bucket.PutBucket(s3.Private)
 	if err != nil {
-		return nil, err
+		log.Printf("Error creating bucket: %v", err)
+	}*/
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	multipartThreshold, partSize := cfg.MultipartThreshold, cfg.PartSize
+	switch multipartThreshold {
+	case 0:
+		multipartThreshold = defaultS3MultipartThreshold
+	case config.S3MultipartOff:
+		multipartThreshold = 0
+	}
+	if partSize == 0 {
+		partSize = defaultS3PartSize
 	}
 
-	// log.Printf("Download hash: %s Code: %v Size: %v", blockHash, res.StatusCode, len(contents))
+	s3BlockRepo := S3BlockRepository{
+		s3Store:            s3Store,
+		bucket:             bucket,
+		prefix:             prefix,
+		headers:            s3Headers(cfg),
+		multipartThreshold: multipartThreshold,
+		partSize:           partSize,
+	}
 
-	return contents, nil
+	return s3BlockRepo, nil
 }
 
-// DeleteBlock - Deletes a block of data
-func (r AzureBlockRepository) DeleteBlock(blockHash string) error {
-	// Get data...
-	_, err := r.blobStore.DeleteBlob(r.containerName, blockHash+".blk")
-	if err != nil {
-		return err
+// s3Region returns the AWS region, or a region pointing at the custom endpoint, addressing buckets as configured
+func s3Region(cfg config.S3Config) (aws.Region, error) {
+	var region aws.Region
+
+	if cfg.Endpoint == "" {
+		name := cfg.Region
+		if name == "" {
+			name = aws.EUWest.Name
+		}
+
+		var ok bool
+		region, ok = aws.Regions[name]
+		if !ok {
+			return aws.Region{}, &config.InvalidSettingError{Provider: "s3", Setting: "storage.s3.region", Value: cfg.Region, Err: errors.New("unknown AWS region")}
+		}
+	} else {
+		endpoint, err := url.Parse(cfg.Endpoint)
+		if err != nil {
+			return aws.Region{}, &config.InvalidSettingError{Provider: "s3", Setting: "storage.s3.endpoint", Value: cfg.Endpoint, Err: err}
+		}
+
+		name := cfg.Region
+		if name == "" {
+			name = "us-east-1"
+		}
+
+		region = aws.Region{
+			Name:             name,
+			S3Endpoint:       strings.TrimRight(cfg.Endpoint, "/"),
+			S3BucketEndpoint: endpoint.Scheme + "://${bucket}." + endpoint.Host,
+		}
 	}
 
-	return nil
+	// Without a bucket endpoint the bucket is put in the path
+	if cfg.PathStyle {
+		region.S3BucketEndpoint = ""
+	}
+
+	return region, nil
 }
 
-// Check to see if a block exists
-func (r AzureBlockRepository) CheckBlockExists(blockHash string) (bool, error) {
+// s3Headers returns the headers sent with every block written
+func s3Headers(cfg config.S3Config) map[string][]string {
+	headers := map[string][]string{"Content-Type": {"application/octet-stream"}}
 
-	res, err := r.blobStore.GetProperties(r.containerName, blockHash+".blk")
+	if cfg.ServerSideEncryption != "" {
+		headers["x-amz-server-side-encryption"] = []string{cfg.ServerSideEncryption}
+	}
 
-	if err != nil {
-		log.Printf("Get blob props err: %s blobs: %v", err, res)
-		return false, err
+	if cfg.KMSKeyID != "" {
+		headers["x-amz-server-side-encryption-aws-kms-key-id"] = []string{cfg.KMSKeyID}
 	}
 
-	if res.StatusCode == 200 {
-		return true, nil
+	if cfg.StorageClass != "" {
+		headers["x-amz-storage-class"] = []string{cfg.StorageClass}
 	}
 
-	// Block not present
-	return false, nil
+	return headers
 }
 
-/* CouchBase BLOCK Provider */
+// key returns the key of the block in the bucket
+func (r S3BlockRepository) key(blockHash string) string {
+	return r.prefix + blockHash + ".blk"
+}
 
-type CouchBaseBlockRepository struct {
-	bucket *couchbase.Bucket
+// bucketFor returns the bucket with every request bound to the context, so requests stop once it is done
+func (r S3BlockRepository) bucketFor(ctx context.Context) *s3.Bucket {
+	s3Store := *r.s3Store
+	s3Store.HTTPClient = func() *http.Client {
+		return &http.Client{Transport: contextTransport{ctx, http.DefaultTransport}}
+	}
+
+	return s3Store.Bucket(r.bucket.Name)
+}
+
+// contextTransport sends each request with the context
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
 }
 
-// NewCouchBaseBlockRepository
-func NewCouchBaseBlockRepository() (CouchBaseBlockRepository, error) {
+func (t contextTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(request.WithContext(t.ctx))
+}
 
-	couchbaseEnvAddress := os.Getenv("CB_HOST")
+func (r S3BlockRepository) SaveBlock(ctx context.Context, data []byte, blockHash string) error {
 
-	couchbaseAddress := "http://localhost:8091"
-	if couchbaseEnvAddress != "" {
-		couchbaseAddress = couchbaseEnvAddress
+	var err error
+	if r.useMultipart(int64(len(data))) {
+		err = r.putMultipart(ctx, r.key(blockHash), bytes.NewReader(data))
+	} else {
+		err = r.bucketFor(ctx).PutHeader(r.key(blockHash), data, r.headers, s3.Private)
 	}
 
-	bucket, err := couchbase.GetBucket(couchbaseAddress, "default", "blocker")
 	if err != nil {
-		log.Println(fmt.Sprintf("Error getting bucket:  %v", err))
-		return CouchBaseBlockRepository{}, err
+		log.Printf("Error upload data: %v", err)
 	}
 
-	log.Printf("NewCouchBaseBlockRepository: Connected to Couchbase Server: %s\n", couchbaseAddress)
-
-	return CouchBaseBlockRepository{bucket}, nil
+	return err
 }
 
-// Save persists a block into the repository
-func (r CouchBaseBlockRepository) SaveBlock(bytes []byte, blockHash string) error {
-	if r.bucket == nil {
-		return errors.New("No couchbase bucket!")
+// PutBlock streams a block into the bucket.  Large blocks are uploaded in parts.
+// S3 needs the length of a single upload up front, so small blocks of unknown size are buffered.
+func (r S3BlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	if size < 0 {
+		// Read just enough to know if the block is small enough to upload whole
+		buffer, err := ioutil.ReadAll(io.LimitReader(data, r.multipartThreshold+1))
+		if err != nil {
+			return err
+		}
+
+		if !r.useMultipart(int64(len(buffer))) {
+			rest, err := ioutil.ReadAll(data)
+			if err != nil {
+				return err
+			}
+
+			return r.SaveBlock(ctx, append(buffer, rest...), blockHash)
+		}
+
+		data = io.MultiReader(bytes.NewReader(buffer), data)
+		size = r.multipartThreshold + 1
+	}
+
+	var err error
+	if r.useMultipart(size) {
+		err = r.putMultipart(ctx, r.key(blockHash), data)
+	} else {
+		err = r.bucketFor(ctx).PutReaderHeader(r.key(blockHash), data, size, r.headers, s3.Private)
+	}
+
+	if err != nil {
+		log.Printf("Error upload data: %v", err)
 	}
 
-	return r.bucket.SetRaw(blockHash, 0, bytes)
+	return err
 }
 
-// Get a block from the repository
-func (r CouchBaseBlockRepository) GetBlock(blockHash string) ([]byte, error) {
-	if r.bucket == nil {
-		return nil, errors.New("No couchbase bucket!")
+// OpenBlock streams a block from the bucket
+func (r S3BlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	return r.bucketFor(ctx).GetReader(r.key(blockHash))
+}
+
+// OpenBlockRange streams part of a block from the bucket with a ranged GET
+func (r S3BlockRepository) OpenBlockRange(ctx context.Context, blockHash string, offset int64, length int64) (io.ReadCloser, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		// A zero length range can not be asked for, so ask for a byte and drop it
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+max64(length, 1)-1)
 	}
 
-	// Get data...
-	return r.bucket.GetRaw(blockHash)
+	response, err := r.bucketFor(ctx).GetResponseWithHeaders(r.key(blockHash), map[string][]string{"Range": {byteRange}})
+	if err != nil {
+		return nil, err
+	}
+
+	// A store ignoring the range sends the whole block
+	if response.StatusCode != http.StatusPartialContent {
+		return skipToRange(response.Body, offset, length)
+	}
+
+	if length < 0 {
+		return response.Body, nil
+	}
+
+	return limitedReadCloser{io.LimitReader(response.Body, length), response.Body}, nil
+}
+
+// Get a block from the repository
+func (r S3BlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	return r.bucketFor(ctx).Get(r.key(blockHash))
 }
 
 // DeleteBlock - Deletes a block of data
-func (r CouchBaseBlockRepository) DeleteBlock(blockHash string) error {
-	if r.bucket == nil {
-		return errors.New("No couchbase bucket!")
-	}
+func (r S3BlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
 
-	// Delete block
-	return r.bucket.Delete(blockHash)
+	return r.bucketFor(ctx).Del(r.key(blockHash))
 }
 
 // Check to see if a block exists
-func (r CouchBaseBlockRepository) CheckBlockExists(blockHash string) (bool, error) {
-	if r.bucket == nil {
-		return false, errors.New("No couchbase bucket!")
+func (r S3BlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+
+	res, err := r.bucketFor(ctx).Head(r.key(blockHash))
+
+	// A missing block is reported as an error
+	if s3Err, ok := err.(*s3.Error); ok && s3Err.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		log.Printf("Get blob props err: %s blobs: %v", err, res)
+		return false, err
 	}
 
-	// Check to see if hash is present
-	result, err := r.bucket.Observe(blockHash)
-	// If the status is anything other than not found, then it's stored in couch base...
-	if err == nil && result.Status != memcached.ObservedNotFound {
+	if res.StatusCode == 200 {
 		return true, nil
 	}
 
-	// Couch base does not have the block
+	// Block not present
 	return false, nil
 }
 
+// useMultipart checks if a block of the size is uploaded in parts
+func (r S3BlockRepository) useMultipart(size int64) bool {
+	return r.multipartThreshold > 0 && size > r.multipartThreshold
+}
+
+// putMultipart uploads the data in parts, aborting the upload if any part fails.
+// The upload is aborted even when the context is done, so no parts are left behind.
+func (r S3BlockRepository) putMultipart(ctx context.Context, key string, data io.Reader) error {
+	multi, err := r.bucketFor(ctx).InitMulti(key, "application/octet-stream", s3.Private)
+	if err != nil {
+		return err
+	}
+
+	abort := func() {
+		aborting := *multi
+		aborting.Bucket = r.bucketFor(context.WithoutCancel(ctx))
+		aborting.Abort()
+	}
+
+	var parts []s3.Part
+	buffer := make([]byte, r.partSize)
+
+	for number := 1; ; number++ {
+		read, readErr := io.ReadFull(data, buffer)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			abort()
+			return readErr
+		}
+
+		if read > 0 {
+			part, err := multi.PutPart(number, bytes.NewReader(buffer[:read]))
+			if err != nil {
+				abort()
+				return err
+			}
+
+			parts = append(parts, part)
+		}
+
+		// A short read is the last part
+		if readErr != nil {
+			break
+		}
+	}
+
+	err = multi.Complete(parts)
+	if err != nil {
+		abort()
+	}
+
+	return err
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 /* DISK BLOCK Provider */
 
-// DiskBlockRepository : Saves blocks to disk
+// Default permissions of the disk provider
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0777
+)
+
+// quarantineDirectory is where partial block files found at startup are moved to
+const quarantineDirectory = "quarantine"
+
+// DiskBlockRepository : Saves blocks to disk.
+// Blocks are written to a temporary file which is synced and renamed into place, so a block file is never partial.
 type DiskBlockRepository struct {
 	path      string
 	extension string
+	fileMode  os.FileMode
+	dirMode   os.FileMode
 }
 
-// NewBlockRepository
-func NewDiskBlockRepository() (DiskBlockRepository, error) {
+// NewDiskBlockRepository - Creates a repository storing blocks in the configured directory.
+// Partial files left by a crash are moved to the quarantine directory.
+func NewDiskBlockRepository(cfg config.DiskConfig) (DiskBlockRepository, error) {
 
-	// Use the path passed from ENV
-	depositoryDir := os.Getenv("BLOCKER_DISK_DIR")
+	// Use the configured path
+	depositoryDir := cfg.Directory
 	if depositoryDir == "" {
 		depositoryDir = filepath.Join(os.TempDir(), "blocker")
+	}
 
-		err := os.Mkdir(depositoryDir, 0777)
-		if err != nil && !os.IsExist(err) {
-			panic("Unable to create directory: " + err.Error())
-		}
+	fileMode, dirMode := diskModes(cfg)
+
+	err := os.MkdirAll(depositoryDir, dirMode)
+	if err != nil {
+		return DiskBlockRepository{}, &config.InvalidSettingError{Provider: "nfs", Setting: "storage.disk.directory", Value: depositoryDir, Err: err}
 	}
 
 	log.Println("Storing blocks to: ", depositoryDir)
 
-	return DiskBlockRepository{depositoryDir, ".blk"}, nil
+	r := DiskBlockRepository{depositoryDir, ".blk", fileMode, dirMode}
+
+	quarantined, err := r.quarantinePartialFiles()
+	if err != nil {
+		return DiskBlockRepository{}, err
+	}
+	if quarantined > 0 {
+		log.Printf("Quarantined %d partial block files to: %s", quarantined, filepath.Join(depositoryDir, quarantineDirectory))
+	}
+
+	return r, nil
+}
+
+// diskModes returns the configured permissions, or the defaults where they are not set
+func diskModes(cfg config.DiskConfig) (os.FileMode, os.FileMode) {
+	fileMode, dirMode := os.FileMode(cfg.FileMode), os.FileMode(cfg.DirMode)
+	if fileMode == 0 {
+		fileMode = defaultFileMode
+	}
+	if dirMode == 0 {
+		dirMode = defaultDirMode
+	}
+
+	return fileMode, dirMode
 }
 
 func (r DiskBlockRepository) GetDataDirectory(hash string) (string, error) {
+	if len(hash) < 2 {
+		return "", fmt.Errorf("Block hash %q is too short", hash)
+	}
 
 	dataDirectory := filepath.Join(r.path, string(hash[0]), string(hash[1]))
 
@@ -297,21 +717,30 @@ func (r DiskBlockRepository) GetDataDirectory(hash string) (string, error) {
 		return dataDirectory, nil
 	}
 
-	dataDirectory = filepath.Join(r.path, string(hash[0]))
-	err := os.Mkdir(dataDirectory, 0777)
-	if err != nil && !os.IsExist(err) {
-		return "", errors.New("Unable to create directory: " + err.Error())
+	if err := r.makeDirectory(filepath.Join(r.path, string(hash[0]))); err != nil {
+		return "", err
 	}
 
-	dataDirectory = filepath.Join(r.path, string(hash[0]), string(hash[1]))
-	err = os.Mkdir(dataDirectory, 0777)
-	if err != nil && !os.IsExist(err) {
-		return "", errors.New("Unable to create directory: " + err.Error())
+	if err := r.makeDirectory(dataDirectory); err != nil {
+		return "", err
 	}
 
 	return dataDirectory, nil
 }
 
+// makeDirectory creates the directory and syncs its parent, so the new directory survives a crash
+func (r DiskBlockRepository) makeDirectory(directory string) error {
+	err := os.Mkdir(directory, r.dirMode)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("Unable to create directory: " + err.Error())
+	}
+
+	return syncDirectory(filepath.Dir(directory))
+}
+
 func directoryExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -323,14 +752,137 @@ func directoryExists(path string) (bool, error) {
 	return false, err
 }
 
-// Save persists a block into the repository
-func (r DiskBlockRepository) SaveBlock(bytes []byte, blockHash string) error {
+// syncDirectory flushes the entries of a directory to disk
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
 
-	dataDirectory, _ := r.GetDataDirectory(blockHash)
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
 
-	log.Println("Writing block to: ", filepath.Join(dataDirectory, blockHash+r.extension))
+	return err
+}
 
-	err := ioutil.WriteFile(filepath.Join(dataDirectory, blockHash+r.extension), bytes, 0644)
+// blockPath returns the path of the block file, creating its directory if needed
+func (r DiskBlockRepository) blockPath(blockHash string) (string, error) {
+	dataDirectory, err := r.GetDataDirectory(blockHash)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dataDirectory, blockHash+r.extension), nil
+}
+
+// writeBlock writes a block to a temporary file in the block's directory, syncs it and renames it into place
+func (r DiskBlockRepository) writeBlock(blockHash string, write func(io.Writer) error) error {
+	path, err := r.blockPath(blockHash)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Writing block to: ", path)
+
+	file, err := ioutil.TempFile(filepath.Dir(path), blockHash+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	// Only once the file is renamed into place is it not removed
+	renamed := false
+	defer func() {
+		if !renamed {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	if err := file.Chmod(r.fileMode); err != nil {
+		return err
+	}
+
+	if err := write(file); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	renamed = true
+
+	return syncDirectory(filepath.Dir(path))
+}
+
+// quarantinePartialFiles moves temporary files left by a crash while writing, and empty block files, to the quarantine directory.
+// Returns the number of files moved.
+func (r DiskBlockRepository) quarantinePartialFiles() (int, error) {
+	quarantine := filepath.Join(r.path, quarantineDirectory)
+	var partial []string
+
+	err := filepath.Walk(r.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			// Only the two levels of block directories hold blocks
+			relative, _ := filepath.Rel(r.path, path)
+			if relative != "." && (len(info.Name()) != 1 || strings.Count(relative, string(filepath.Separator)) > 1) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasSuffix(path, ".tmp") || (strings.HasSuffix(path, r.extension) && info.Size() == 0) {
+			partial = append(partial, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(partial) == 0 {
+		return 0, nil
+	}
+
+	if err := os.MkdirAll(quarantine, r.dirMode); err != nil {
+		return 0, err
+	}
+
+	for i, path := range partial {
+		log.Printf("Quarantining partial block file: %s", path)
+
+		if err := os.Rename(path, filepath.Join(quarantine, filepath.Base(path))); err != nil {
+			return i, err
+		}
+	}
+
+	return len(partial), syncDirectory(quarantine)
+}
+
+// Save persists a block into the repository
+func (r DiskBlockRepository) SaveBlock(ctx context.Context, bytes []byte, blockHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := r.writeBlock(blockHash, func(w io.Writer) error {
+		_, err := w.Write(bytes)
+		return err
+	})
 	if err != nil {
 		log.Println(fmt.Sprintf("Error writing file : %v", err))
 		return err
@@ -340,11 +892,17 @@ func (r DiskBlockRepository) SaveBlock(bytes []byte, blockHash string) error {
 }
 
 // Get a block from the repository
-func (r DiskBlockRepository) GetBlock(blockHash string) ([]byte, error) {
+func (r DiskBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	dataDirectory, _ := r.GetDataDirectory(blockHash)
+	path, err := r.blockPath(blockHash)
+	if err != nil {
+		return nil, err
+	}
 
-	readBytes, err := ioutil.ReadFile(filepath.Join(dataDirectory, blockHash+r.extension))
+	readBytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Println(fmt.Sprintf("Error reading block : %v", err))
 		return nil, err
@@ -353,19 +911,82 @@ func (r DiskBlockRepository) GetBlock(blockHash string) ([]byte, error) {
 	return readBytes, nil
 }
 
+// PutBlock streams a block into the repository.  The partial file is removed if the context is done while writing.
+func (r DiskBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+
+	err := r.writeBlock(blockHash, func(w io.Writer) error {
+		_, err := io.Copy(w, contextReader{ctx, data})
+		return err
+	})
+	if err != nil {
+		log.Println(fmt.Sprintf("Error writing file : %v", err))
+		return err
+	}
+
+	return nil
+}
+
+// OpenBlock streams a block from the repository.  Reading stops with the context error once the context is done.
+func (r DiskBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	return r.OpenBlockRange(ctx, blockHash, 0, -1)
+}
+
+// OpenBlockRange streams part of a block from the repository
+func (r DiskBlockRepository) OpenBlockRange(ctx context.Context, blockHash string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	path, err := r.blockPath(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var body io.Reader = file
+	if length >= 0 {
+		body = io.LimitReader(file, length)
+	}
+
+	return contextReadCloser{contextReader{ctx, body}, file}, nil
+}
+
 // DeleteBlock - Deletes a block of data
-func (r DiskBlockRepository) DeleteBlock(blockHash string) error {
-	dataDirectory, _ := r.GetDataDirectory(blockHash)
+func (r DiskBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path, err := r.blockPath(blockHash)
+	if err != nil {
+		return err
+	}
 
 	// Delete the file from disk...
-	return os.Remove(filepath.Join(dataDirectory, blockHash+r.extension))
+	return os.Remove(path)
 }
 
 // Check to see if a block exists
-func (r DiskBlockRepository) CheckBlockExists(blockHash string) (bool, error) {
-	dataDirectory, _ := r.GetDataDirectory(blockHash)
+func (r DiskBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 
-	_, err := os.Stat(filepath.Join(dataDirectory, blockHash+r.extension))
+	path, err := r.blockPath(blockHash)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(path)
 	if err == nil {
 		return true, nil
 	}
@@ -382,35 +1003,114 @@ type BlockInfoRepository interface {
 	SaveBlockInfo(blockInfo BlockInfo) error
 	GetBlockInfo(hash string) (*BlockInfo, error)
 	DeleteBlockInfo(hash string) error
+	// ListBlockInfo returns every BlockInfo, ordered by hash
+	ListBlockInfo() ([]BlockInfo, error)
 }
 
 var cbBlockInfoPrefix = "blocker:bi:"
 
+// The design document holding the views listing BlockInfo by hash and BlockedFiles by ID
+const (
+	cbDesignDoc       = "blocker"
+	cbBlockInfoView   = "blockinfo"
+	cbBlockedFileView = "blockedfile"
+	// cbTenantFileView lists BlockedFiles by tenant and ID
+	cbTenantFileView = "tenantfile"
+	// cbViewPageSize is the number of rows read from a view at a time
+	cbViewPageSize = 1000
+)
+
+var cbDesignDocViews = couchbase.DDoc{Views: map[string]couchbase.ViewDefinition{
+	cbBlockInfoView: {Map: fmt.Sprintf(`function (doc, meta) { if (meta.id.indexOf(%q) === 0) { emit(meta.id.substring(%d), doc); } }`, cbBlockInfoPrefix, len(cbBlockInfoPrefix))},
+	// BlockedFiles are kept under their bare ID
+	cbBlockedFileView: {Map: `function (doc, meta) { if (meta.id.indexOf("blocker:") !== 0 && doc.fileHash !== undefined && doc.blocks !== undefined) { emit(meta.id, doc); } }`},
+	cbTenantFileView:  {Map: `function (doc, meta) { if (meta.id.indexOf("blocker:") !== 0 && doc.fileHash !== undefined && doc.blocks !== undefined) { emit([doc.tenant || "", meta.id], doc); } }`},
+}}
+
+// putCouchbaseViews creates the design document holding the views, unless it is already there as it should be.
+// Writing it needs admin rights on the bucket, so a failure is only logged: the views may have been created by an admin,
+// and without them only listing fails.
+func putCouchbaseViews(bucket *couchbase.Bucket) {
+	var current couchbase.DDoc
+	if err := bucket.GetDDoc(cbDesignDoc, &current); err == nil && reflect.DeepEqual(current.Views, cbDesignDocViews.Views) {
+		return
+	}
+
+	if err := bucket.PutDDoc(cbDesignDoc, cbDesignDocViews); err != nil {
+		log.Printf("Unable to create the design document %s, listing files and blocks needs it: %v", cbDesignDoc, err)
+	}
+}
+
+// errViewDone is returned by the function passed to listCouchbaseView to stop reading the view
+var errViewDone = errors.New("View read")
+
+// listCouchbaseView passes the value of each row of the view to each, in key order, until each returns errViewDone.
+// The rows from the start key to the end key are read, or every row when the keys are nil.
+func listCouchbaseView(bucket *couchbase.Bucket, view string, startKey interface{}, endKey interface{}, each func(value []byte) error) error {
+	params := map[string]interface{}{"stale": false, "limit": cbViewPageSize}
+	if startKey != nil {
+		params["startkey"] = startKey
+	}
+	if endKey != nil {
+		params["endkey"] = endKey
+	}
+
+	for {
+		result, err := bucket.View(cbDesignDoc, view, params)
+		if err != nil {
+			return err
+		}
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("Unable to read view %s: %s", view, result.Errors[0].Reason)
+		}
+
+		for _, row := range result.Rows {
+			// The value is the document as decoded into an interface{}
+			value, err := json.Marshal(row.Value)
+			if err != nil {
+				return err
+			}
+
+			if err := each(value); err == errViewDone {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if len(result.Rows) < cbViewPageSize {
+			return nil
+		}
+
+		// Carry on after the last key read
+		params["startkey"] = result.Rows[len(result.Rows)-1].Key
+		params["skip"] = 1
+	}
+}
+
 // CouchbaseFileBlockInfoRepository is the couch base implementation of the FileBlockInfoRepository
 type CouchbaseBlockInfoRepository struct {
 	bucket         *couchbase.Bucket
-	InMemoryBucket map[string]*BlockInfo
+	InMemoryBucket map[string]BlockInfo
+	lock           *sync.RWMutex
 }
 
-// NewBlockedFileRepository
-func NewCouchbaseBlockInfoRepository() (CouchbaseBlockInfoRepository, error) {
-	couchbaseEnvAddress := os.Getenv("CB_HOST")
-
-	couchbaseAddress := "http://localhost:8091"
-	if couchbaseEnvAddress != "" {
-		couchbaseAddress = couchbaseEnvAddress
-	}
+// NewCouchbaseBlockInfoRepository - Creates a repository storing BlockInfo in couchbase
+func NewCouchbaseBlockInfoRepository(cfg config.CouchbaseConfig) (CouchbaseBlockInfoRepository, error) {
+	couchbaseAddress := cfg.Host
 
-	bucket, err := couchbase.GetBucket(couchbaseAddress, "default", "blocker")
+	bucket, err := openCouchbaseBucket(cfg)
 	if err != nil {
 		log.Println(fmt.Sprintf("Error getting bucket:  %v", err))
 		// NOTE:  I want this to run without a couchbase installation, so in event of error use a in memory store
-		return CouchbaseBlockInfoRepository{nil, make(map[string]*BlockInfo)}, nil
+		return CouchbaseBlockInfoRepository{nil, make(map[string]BlockInfo), &sync.RWMutex{}}, nil
 	}
 
 	log.Printf("NewCouchbaseFileBlockInfoRepository: Connected to Couchbase Server: %s\n", couchbaseAddress)
 
-	return CouchbaseBlockInfoRepository{bucket, nil}, nil
+	putCouchbaseViews(bucket)
+
+	return CouchbaseBlockInfoRepository{bucket, nil, nil}, nil
 }
 
 func (r CouchbaseBlockInfoRepository) DeleteBlockInfo(hash string) error {
@@ -419,15 +1119,21 @@ func (r CouchbaseBlockInfoRepository) DeleteBlockInfo(hash string) error {
 	}
 
 	if r.bucket == nil {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
 		if _, ok := r.InMemoryBucket[hash]; ok {
 			delete(r.InMemoryBucket, hash)
 			return nil
 		}
 
-		return errors.New("Not found!")
+		return ErrNotFound
 	}
 
 	if err := r.bucket.Delete(cbBlockInfoPrefix + hash); err != nil {
+		if isCouchbaseNotFound(err) {
+			return ErrNotFound
+		}
 		return err
 	}
 
@@ -437,7 +1143,10 @@ func (r CouchbaseBlockInfoRepository) DeleteBlockInfo(hash string) error {
 // Save persists a BlockedFile into the repository
 func (r CouchbaseBlockInfoRepository) SaveBlockInfo(blockInfo BlockInfo) error {
 	if r.bucket == nil {
-		r.InMemoryBucket[blockInfo.Hash] = &blockInfo
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		r.InMemoryBucket[blockInfo.Hash] = blockInfo
 		return nil
 	}
 
@@ -451,53 +1160,104 @@ func (r CouchbaseBlockInfoRepository) GetBlockInfo(hash string) (*BlockInfo, err
 	}
 
 	if r.bucket == nil {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+
+		// Hand out a copy so callers can not change the stored value without saving it
 		if val, ok := r.InMemoryBucket[hash]; ok {
-			return val, nil
+			return &val, nil
 		}
 
-		return &BlockInfo{}, errors.New("Not found!")
+		return &BlockInfo{}, ErrNotFound
 	}
 
 	var blockInfo BlockInfo
 
 	if err := r.bucket.Get(cbBlockInfoPrefix+hash, &blockInfo); err != nil {
+		if isCouchbaseNotFound(err) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
 
 	return &blockInfo, nil
 }
 
-// BlockedFileRepository : a Couchbase Server repository
-type BlockedFileRepository struct {
-	bucket         *couchbase.Bucket
-	InMemoryBucket map[string]*BlockedFile
-}
+// ListBlockInfo returns every BlockInfo, ordered by hash
+func (r CouchbaseBlockInfoRepository) ListBlockInfo() ([]BlockInfo, error) {
+	if r.bucket == nil {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
 
-// NewBlockedFileRepository
-func NewBlockedFileRepository() (BlockedFileRepository, error) {
-	couchbaseEnvAddress := os.Getenv("CB_HOST")
+		blockInfos := make([]BlockInfo, 0, len(r.InMemoryBucket))
+		for _, blockInfo := range r.InMemoryBucket {
+			blockInfos = append(blockInfos, blockInfo)
+		}
+		sort.Slice(blockInfos, func(i, j int) bool { return blockInfos[i].Hash < blockInfos[j].Hash })
 
-	couchbaseAddress := "http://localhost:8091"
-	if couchbaseEnvAddress != "" {
-		couchbaseAddress = couchbaseEnvAddress
+		return blockInfos, nil
 	}
 
-	bucket, err := couchbase.GetBucket(couchbaseAddress, "default", "blocker")
+	var blockInfos []BlockInfo
+	err := listCouchbaseView(r.bucket, cbBlockInfoView, nil, nil, func(value []byte) error {
+		var blockInfo BlockInfo
+		if err := json.Unmarshal(value, &blockInfo); err != nil {
+			return err
+		}
+
+		blockInfos = append(blockInfos, blockInfo)
+		return nil
+	})
+
+	return blockInfos, err
+}
+
+/* BLOCKEDFILE REPO */
+
+// BlockedFileRepository is the interface for BlockedFile storage
+type BlockedFileRepository interface {
+	SaveBlockedFile(blockedFile BlockedFile) error
+	GetBlockedFile(blockfileid string) (*BlockedFile, error)
+	// ListBlockedFiles returns every BlockedFile, ordered by ID
+	ListBlockedFiles() ([]BlockedFile, error)
+	// ListTenantBlockedFiles returns at most limit BlockedFiles of the tenant with an ID after the given one, ordered by ID.
+	// A limit of 0 returns all of them.
+	ListTenantBlockedFiles(tenant string, after string, limit int) ([]BlockedFile, error)
+	DeleteBlockedFile(blockfileid string) error
+}
+
+// CouchbaseBlockedFileRepository : a Couchbase Server repository
+type CouchbaseBlockedFileRepository struct {
+	bucket         *couchbase.Bucket
+	InMemoryBucket map[string]BlockedFile
+	lock           *sync.RWMutex
+}
+
+// NewCouchbaseBlockedFileRepository - Creates a repository storing BlockedFiles in couchbase
+func NewCouchbaseBlockedFileRepository(cfg config.CouchbaseConfig) (CouchbaseBlockedFileRepository, error) {
+	couchbaseAddress := cfg.Host
+
+	bucket, err := openCouchbaseBucket(cfg)
 	if err != nil {
 		log.Println(fmt.Sprintf("Error getting bucket:  %v", err))
 		// NOTE:  I want this to run without a couchbase installation, so in event of error use a in memory store
-		return BlockedFileRepository{nil, make(map[string]*BlockedFile)}, nil
+		return CouchbaseBlockedFileRepository{nil, make(map[string]BlockedFile), &sync.RWMutex{}}, nil
 	}
 
-	log.Printf("NewBlockedFileRepository: Connected to Couchbase Server: %s\n", couchbaseAddress)
+	log.Printf("NewCouchbaseBlockedFileRepository: Connected to Couchbase Server: %s\n", couchbaseAddress)
 
-	return BlockedFileRepository{bucket, nil}, nil
+	putCouchbaseViews(bucket)
+
+	return CouchbaseBlockedFileRepository{bucket, nil, nil}, nil
 }
 
 // Save persists a BlockedFile into the repository
-func (r BlockedFileRepository) SaveBlockedFile(blockedFile BlockedFile) error {
+func (r CouchbaseBlockedFileRepository) SaveBlockedFile(blockedFile BlockedFile) error {
 	if r.bucket == nil {
-		r.InMemoryBucket[blockedFile.ID] = &blockedFile
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		r.InMemoryBucket[blockedFile.ID] = blockedFile
 		return nil
 	}
 
@@ -505,22 +1265,28 @@ func (r BlockedFileRepository) SaveBlockedFile(blockedFile BlockedFile) error {
 }
 
 // Get a BlockedFile from the repository
-func (r BlockedFileRepository) GetBlockedFile(blockfileid string) (*BlockedFile, error) {
+func (r CouchbaseBlockedFileRepository) GetBlockedFile(blockfileid string) (*BlockedFile, error) {
 	if blockfileid == "" {
 		return nil, errors.New("No Block File ID passed")
 	}
 
 	if r.bucket == nil {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+
 		if val, ok := r.InMemoryBucket[blockfileid]; ok {
-			return val, nil
+			return &val, nil
 		}
 
-		return &BlockedFile{}, errors.New("Not found!")
+		return &BlockedFile{}, ErrNotFound
 	}
 
 	var blockedFile BlockedFile
 
 	if err := r.bucket.Get(blockfileid, &blockedFile); err != nil {
+		if isCouchbaseNotFound(err) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
 
@@ -528,23 +1294,108 @@ func (r BlockedFileRepository) GetBlockedFile(blockfileid string) (*BlockedFile,
 }
 
 // DeleteBlockedFile - Delete a blocked file
-func (r BlockedFileRepository) DeleteBlockedFile(blockfileid string) error {
+func (r CouchbaseBlockedFileRepository) DeleteBlockedFile(blockfileid string) error {
 	if blockfileid == "" {
 		return errors.New("No Block File ID passed")
 	}
 
 	if r.bucket == nil {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
 		if _, ok := r.InMemoryBucket[blockfileid]; ok {
 			delete(r.InMemoryBucket, blockfileid)
 			return nil
 		}
 
-		return errors.New("Not found!")
+		return ErrNotFound
 	}
 
 	if err := r.bucket.Delete(blockfileid); err != nil {
+		if isCouchbaseNotFound(err) {
+			return ErrNotFound
+		}
 		return err
 	}
 
 	return nil
 }
+
+// ListBlockedFiles returns every BlockedFile, ordered by ID
+func (r CouchbaseBlockedFileRepository) ListBlockedFiles() ([]BlockedFile, error) {
+	if r.bucket == nil {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+
+		blockedFiles := make([]BlockedFile, 0, len(r.InMemoryBucket))
+		for _, blockedFile := range r.InMemoryBucket {
+			blockedFiles = append(blockedFiles, blockedFile)
+		}
+		sort.Slice(blockedFiles, func(i, j int) bool { return blockedFiles[i].ID < blockedFiles[j].ID })
+
+		return blockedFiles, nil
+	}
+
+	var blockedFiles []BlockedFile
+	err := listCouchbaseView(r.bucket, cbBlockedFileView, nil, nil, func(value []byte) error {
+		var blockedFile BlockedFile
+		if err := json.Unmarshal(value, &blockedFile); err != nil {
+			return err
+		}
+
+		blockedFiles = append(blockedFiles, blockedFile)
+		return nil
+	})
+
+	return blockedFiles, err
+}
+
+// ListTenantBlockedFiles returns at most limit BlockedFiles of the tenant with an ID after the given one, ordered by ID.
+// A limit of 0 returns all of them.
+func (r CouchbaseBlockedFileRepository) ListTenantBlockedFiles(tenant string, after string, limit int) ([]BlockedFile, error) {
+	if r.bucket == nil {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+
+		var blockedFiles []BlockedFile
+		for _, blockedFile := range r.InMemoryBucket {
+			if blockedFile.Tenant == tenant && blockedFile.ID > after {
+				blockedFiles = append(blockedFiles, blockedFile)
+			}
+		}
+
+		return firstBlockedFiles(blockedFiles, limit), nil
+	}
+
+	var blockedFiles []BlockedFile
+	err := listCouchbaseView(r.bucket, cbTenantFileView, []string{tenant, after}, []interface{}{tenant, map[string]interface{}{}}, func(value []byte) error {
+		var blockedFile BlockedFile
+		if err := json.Unmarshal(value, &blockedFile); err != nil {
+			return err
+		}
+
+		// The start key includes the file named by after
+		if blockedFile.ID == after {
+			return nil
+		}
+
+		blockedFiles = append(blockedFiles, blockedFile)
+		if len(blockedFiles) == limit {
+			return errViewDone
+		}
+		return nil
+	})
+
+	return blockedFiles, err
+}
+
+// firstBlockedFiles sorts the BlockedFiles by ID and returns the first limit of them, or all of them for a limit of 0
+func firstBlockedFiles(blockedFiles []BlockedFile, limit int) []BlockedFile {
+	sort.Slice(blockedFiles, func(i, j int) bool { return blockedFiles[i].ID < blockedFiles[j].ID })
+
+	if limit > 0 && len(blockedFiles) > limit {
+		blockedFiles = blockedFiles[:limit]
+	}
+
+	return blockedFiles
+}
@@ -1,13 +1,17 @@
 package blocks
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/keithballdotnet/blocker/config"
 	"github.com/keithballdotnet/blocker/crypto"
 	. "github.com/keithballdotnet/blocker/gocheck2"
 	. "gopkg.in/check.v1"
@@ -18,6 +22,7 @@ func Test(t *testing.T) {
 }
 
 type BlockSuite struct {
+	store *Store
 }
 
 var _ = Suite(&BlockSuite{})
@@ -32,30 +37,38 @@ const changedOutputFileName = "tempest_changed.txt"
 const liteIdeInFile = "testdata/liteidex23.2.linux-32.tar.bz2"
 const liteIdeoutFile = "liteidex23.2.linux-32.tar.bz2"
 
+// ctx is the context used by the tests
+var ctx = context.Background()
+
 // Path to the certificate
 var publicPath = filepath.Join(os.TempDir(), "blocker", "public.pem")
 
 // Path to the private key
 var privatePath = filepath.Join(os.TempDir(), "blocker", "private.pem")
 
-func (s *BlockSuite) SetUpSuite(c *C) {
-	// Ensure string is to lower
-	StorageProviderName = "nfs"
-
-	publicKeyPath := os.Getenv("BLOCKER_PGP_PUBLICKEY")
-	if publicKeyPath == "" {
-		os.Setenv("BLOCKER_PGP_PUBLICKEY", publicPath)
-	}
-
-	privateKeyPath := os.Getenv("BLOCKER_PGP_PRIVATEKEY")
-	if privateKeyPath == "" {
-		os.Setenv("BLOCKER_PGP_PRIVATEKEY", privatePath)
+// testConfig returns the configuration used by the test suite.  Blocks and meta data are kept in memory so no state
+// is left between runs.
+func testConfig() config.Config {
+	cfg := config.Default()
+	cfg.Storage.Provider = "memory"
+	cfg.Metadata.Provider = "memory"
+	cfg.Crypto.Provider = "openpgp"
+	cfg.Crypto.OpenPGP.PublicKeyPath = publicPath
+	cfg.Crypto.OpenPGP.PrivateKeyPath = privatePath
+
+	// Allow the environment to override the keys
+	if err := cfg.LoadEnv(); err != nil {
+		panic(err)
 	}
 
-	CryptoProviderName = "openpgp"
+	return cfg
+}
 
+func (s *BlockSuite) SetUpSuite(c *C) {
 	// Now set up repos
-	SetUpRepositories()
+	var err error
+	s.store, err = NewStore(testConfig())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 
 	// Get the keys
 	// crypto.GetPGPKeyRings()
@@ -70,10 +83,8 @@ func (s *BlockSuite) SetUpSuite(c *C) {
 }*/
 
 func (s *BlockSuite) TestCBBlockRepositoryCreationWorksWithConfig(c *C) {
-	os.Setenv("CB_HOST", "http://localhost:1337")
-
 	// Couchbase tests the bucket so this should fail...
-	BlockStore, err := NewCouchBaseBlockRepository()
+	BlockStore, err := NewCouchBaseBlockRepository(config.CouchbaseConfig{Host: "http://localhost:1337"})
 	c.Assert(err != nil, IsTrue)
 
 	// Expect all errors..
@@ -93,81 +104,218 @@ func (s *BlockSuite) TestCBBlockRepositoryCreationWorksWithConfig(c *C) {
 func (s *BlockSuite) TestAzureBlockRepositoryCreationWorksWithConfig(c *C) {
 	var BlockStore BlockRepository
 
-	// Set values
-	os.Setenv("BLOCKER_AZURE_ACCOUNT", "THEACCOUNT")
-	os.Setenv("BLOCKER_AZURE_SECRET", "THESECRET")
-
-	BlockStore, err := NewAzureBlockRepository()
+	BlockStore, err := NewAzureBlockRepository(config.AzureConfig{Account: "THEACCOUNT", Secret: "VEhFU0VDUkVU"})
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v on %v", err, BlockStore))
 
 	// Expect all errors..
-	_, err = BlockStore.CheckBlockExists("invalid")
+	_, err = BlockStore.CheckBlockExists(ctx, "invalid")
 	c.Assert(err != nil, IsTrue)
 
-	err = BlockStore.DeleteBlock("invalid")
+	err = BlockStore.DeleteBlock(ctx, "invalid")
 	c.Assert(err != nil, IsTrue)
 
-	err = BlockStore.SaveBlock([]byte("blob"), "invalid")
+	err = BlockStore.SaveBlock(ctx, []byte("blob"), "invalid")
 	c.Assert(err != nil, IsTrue)
 
-	_, err = BlockStore.GetBlock("invalid")
+	_, err = BlockStore.GetBlock(ctx, "invalid")
 	c.Assert(err != nil, IsTrue)
 }
 
-func (s *BlockSuite) TestS3BlockRepositoryCreationPanicsWithEmptyConfig(c *C) {
-	// We catch the panic.  Recover and if there was not panic.  The test failed.
-	defer func() {
-		if r := recover(); r == nil {
-			c.FailNow()
-		}
-	}()
-
+func (s *BlockSuite) TestS3BlockRepositoryCreationFailsWithEmptyConfig(c *C) {
 	// Get the s3 repo.  This should fail..
-	_, _ = NewS3BlockRepository()
+	_, err := NewS3BlockRepository(config.S3Config{})
+	c.Assert(err != nil, IsTrue)
+
+	// All the missing settings should be reported at once
+	missingErr, ok := err.(*config.MissingSettingsError)
+	c.Assert(ok, IsTrue, Commentf("Unexpected error type: %T", err))
+	c.Assert(missingErr.Provider, Equals, "s3")
+	c.Assert(missingErr.Settings, DeepEquals, []string{"storage.s3.key", "storage.s3.secret", "storage.s3.bucket"})
+}
+
+func (s *BlockSuite) TestAzureBlockRepositoryCreationFailsWithPartialConfig(c *C) {
+	_, err := NewAzureBlockRepository(config.AzureConfig{Account: "THEACCOUNT"})
+	c.Assert(err != nil, IsTrue)
+
+	missingErr, ok := err.(*config.MissingSettingsError)
+	c.Assert(ok, IsTrue, Commentf("Unexpected error type: %T", err))
+	c.Assert(missingErr.Settings, DeepEquals, []string{"storage.azure.secret"})
 }
 
 func (s *BlockSuite) TestS3BlockRepositoryCreationWorksWithConfig(c *C) {
 	var BlockStore BlockRepository
 
-	// Set values
-	os.Setenv("BLOCKER_S3_KEY", "THEKEY")
-	os.Setenv("BLOCKER_S3_SECRET", "THESECRET")
-	os.Setenv("BLOCKER_S3_BUCKET", "THEBUCKET")
-
-	BlockStore, err := NewS3BlockRepository()
+	BlockStore, err := NewS3BlockRepository(config.S3Config{Key: "THEKEY", Secret: "THESECRET", Bucket: "THEBUCKET"})
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v on %v", err, BlockStore))
 
 	// Expect all errors..
-	_, err = BlockStore.CheckBlockExists("invalid")
+	_, err = BlockStore.CheckBlockExists(ctx, "invalid")
 	c.Assert(err != nil, IsTrue)
 
-	err = BlockStore.DeleteBlock("invalid")
+	err = BlockStore.DeleteBlock(ctx, "invalid")
 	c.Assert(err != nil, IsTrue)
 
-	err = BlockStore.SaveBlock([]byte("blob"), "invalid")
+	err = BlockStore.SaveBlock(ctx, []byte("blob"), "invalid")
 	c.Assert(err != nil, IsTrue)
 
-	_, err = BlockStore.GetBlock("invalid")
+	_, err = BlockStore.GetBlock(ctx, "invalid")
 	c.Assert(err != nil, IsTrue)
 }
 
+func (s *BlockSuite) TestIndependentStores(c *C) {
+	// An encrypted store and a plain store side by side in their own directories
+	encryptedConfig := testConfig()
+	encryptedConfig.Storage.Provider = "nfs"
+	encryptedConfig.Storage.Disk.Directory = filepath.Join(os.TempDir(), "blocker-test-encrypted")
+	defer os.RemoveAll(encryptedConfig.Storage.Disk.Directory)
+
+	plainConfig := testConfig()
+	plainConfig.Storage.Provider = "nfs"
+	plainConfig.Storage.Disk.Directory = filepath.Join(os.TempDir(), "blocker-test-plain")
+	plainConfig.Blocks.BlockSize = BlockSize30Kb
+	plainConfig.Blocks.Compression = false
+	plainConfig.Blocks.Encryption = false
+	defer os.RemoveAll(plainConfig.Storage.Disk.Directory)
+
+	encryptedStore, err := NewStore(encryptedConfig)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	plainStore, err := NewStore(plainConfig)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	encryptedFile, err := encryptedStore.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	plainFile, err := plainStore.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The stores use their own block sizes
+	c.Assert(len(encryptedFile.BlockList), Equals, 1)
+	c.Assert(len(plainFile.BlockList) > 1, IsTrue)
+
+	// Files are only known to the store that blocked them
+	_, err = plainStore.UnblockFileToBuffer(ctx, encryptedFile.ID)
+	c.Assert(err != nil, IsTrue)
+
+	encryptedBuffer, err := encryptedStore.UnblockFileToBuffer(ctx, encryptedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	plainBuffer, err := plainStore.UnblockFileToBuffer(ctx, plainFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	c.Assert(encryptedBuffer.String() == plainBuffer.String(), IsTrue)
+
+	// The plain store keeps the block as is
+	blockInfo, err := plainStore.BlockInfoStore.GetBlockInfo(plainFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	storedBlock, err := plainStore.BlockStore.GetBlock(ctx, blockInfo.StoreID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(int64(len(storedBlock)), Equals, BlockSize30Kb)
+}
+
+func (s *BlockSuite) TestConcurrentStores(c *C) {
+	// Several stores blocking and unblocking at the same time must not interfere with each other
+	errs := make(chan error, 4)
+
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			cfg := testConfig()
+			cfg.Storage.Provider = "nfs"
+			cfg.Storage.Disk.Directory = filepath.Join(os.TempDir(), fmt.Sprintf("blocker-test-concurrent-%d", i))
+			cfg.Blocks.BlockSize = BlockSize30Kb
+			defer os.RemoveAll(cfg.Storage.Disk.Directory)
+
+			store, err := NewStore(cfg)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			blockedFile, err := store.BlockFile(ctx, inputFile)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			buffer, err := store.UnblockFileToBuffer(ctx, blockedFile.ID)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if int64(buffer.Len()) != blockedFile.Length {
+				errs <- fmt.Errorf("store %d unblocked %d bytes, expected %d", i, buffer.Len(), blockedFile.Length)
+				return
+			}
+
+			errs <- store.DeleteBlockedFile(ctx, blockedFile.ID)
+		}(i)
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+}
+
+func (s *BlockSuite) TestCancelledContextStopsBlocking(c *C) {
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err := s.store.BlockFile(cancelled, inputFile)
+	c.Assert(err == context.Canceled, IsTrue, Commentf("Unexpected error: %v", err))
+}
+
+// unreachableBlockInfoRepository fails to read any BlockInfo, as a metadata store timing out does
+type unreachableBlockInfoRepository struct {
+	BlockInfoRepository
+}
+
+func (r unreachableBlockInfoRepository) GetBlockInfo(hash string) (*BlockInfo, error) {
+	return nil, errors.New("Timed out")
+}
+
+func (s *BlockSuite) TestUnreadableBlockInfoIsNotReplaced(c *C) {
+	store, memory := newMemoryStore(c, archiveConfig(false))
+
+	blockedFile, err := store.BlockBuffer(ctx, strings.NewReader("hello world"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	hash := blockedFile.BlockList[0].Hash
+
+	repository := store.BlockInfoStore
+	store.BlockInfoStore = unreachableBlockInfoRepository{repository}
+
+	_, err = store.BlockBuffer(ctx, strings.NewReader("hello world"))
+	c.Assert(err != nil, IsTrue)
+	err = store.DeleteBlockedFile(ctx, blockedFile.ID)
+	c.Assert(err != nil, IsTrue)
+
+	store.BlockInfoStore = repository
+
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfo.UseCount, Equals, int64(1))
+	c.Assert(memory.Len(), Equals, 1)
+}
+
 func (s *BlockSuite) TestCopyANonExistingBlockShouldFail(c *C) {
-	_, err := CopyBlockedFile("invalid-block-id")
+	_, err := s.store.CopyBlockedFile(ctx, "invalid-block-id")
 	c.Assert(err != nil, IsTrue)
 }
 
 func (s *BlockSuite) TestDeleteANonExistingBlockShouldFail(c *C) {
-	err := DeleteBlockedFile("invalid-block-id")
+	err := s.store.DeleteBlockedFile(ctx, "invalid-block-id")
 	c.Assert(err != nil, IsTrue)
 }
 
 func (s *BlockSuite) TestBlockFileWithInvaidPathShouldFail(c *C) {
-	_, err := BlockFile("/this/file/does/not/exist.data")
+	_, err := s.store.BlockFile(ctx, "/this/file/does/not/exist.data")
 	c.Assert(err != nil, IsTrue)
 }
 
 func (s *BlockSuite) TestUnBlockFileWithInvaidIDShouldFail(c *C) {
-	err := UnblockFile("invalid-block-id", "/this/file/does/not/exist.data")
+	err := s.store.UnblockFile(ctx, "invalid-block-id", "/this/file/does/not/exist.data")
 	c.Assert(err != nil, IsTrue)
 }
 
@@ -184,7 +332,7 @@ func (s *BlockSuite) Test240MbBlock(c *C) {
 
 	// Block a file...
 	start := time.Now()
-	randomBlock, err := BlockFile(randomInFile)
+	randomBlock, err := s.store.BlockFile(ctx, randomInFile)
 	end := time.Now()
 
 	fmt.Printf("Large file BLOCK took: %v\n", end.Sub(start))
@@ -197,7 +345,7 @@ func (s *BlockSuite) Test240MbBlock(c *C) {
 
 	// Get the file and create a copy to the output
 	start = time.Now()
-	err = UnblockFile(randomBlock.ID, randomOutFile)
+	err = s.store.UnblockFile(ctx, randomBlock.ID, randomOutFile)
 	end = time.Now()
 
 	fmt.Printf("Large file UNBLOCK took: %v\n", end.Sub(start))
@@ -207,7 +355,7 @@ func (s *BlockSuite) Test240MbBlock(c *C) {
 
 	// Delete block...
 	start = time.Now()
-	err = DeleteBlockedFile(randomBlock.ID)
+	err = s.store.DeleteBlockedFile(ctx, randomBlock.ID)
 	end = time.Now()
 
 	fmt.Printf("Delete Large file Block took: %v\n", end.Sub(start))
@@ -228,7 +376,7 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 
 	// Block a file...
 	start := time.Now()
-	bibleBlockFile, err := BlockFile(liteIdeInFile)
+	bibleBlockFile, err := s.store.BlockFile(ctx, liteIdeInFile)
 	end := time.Now()
 
 	fmt.Printf("1st Blocked LiteIde took: %v\n", end.Sub(start))
@@ -243,7 +391,7 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 
 	// Get the file and create a copy to the output
 	start = time.Now()
-	err = UnblockFile(bibleBlockFile.ID, bibleOutFile)
+	err = s.store.UnblockFile(ctx, bibleBlockFile.ID, bibleOutFile)
 	end = time.Now()
 
 	fmt.Printf("1st Unblocked LiteIde took: %v\n", end.Sub(start))
@@ -256,16 +404,16 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 	firstBlockFileBlockHash := bibleBlockFile.BlockList[0].Hash
 
 	// Check the block store has the data...
-	blockInfo, err := BlockInfoStore.GetBlockInfo(firstBlockFileBlockHash)
+	blockInfo, err := s.store.BlockInfoStore.GetBlockInfo(firstBlockFileBlockHash)
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 
-	blockExists, _ := BlockStore.CheckBlockExists(blockInfo.StoreID)
+	blockExists, _ := s.store.BlockStore.CheckBlockExists(ctx, blockInfo.StoreID)
 	c.Assert(blockExists, IsTrue)
 
 	// Block the file again
 	start = time.Now()
-	bibleBlockFile, err = BlockFile(liteIdeInFile)
+	bibleBlockFile, err = s.store.BlockFile(ctx, liteIdeInFile)
 	end = time.Now()
 
 	fmt.Printf("2nd Blocked LiteIde took: %v\n", end.Sub(start))
@@ -285,7 +433,7 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 
 	// Copy our first BlockedFile
 	start = time.Now()
-	bibleBlockFile, err = CopyBlockedFile(firstBlockFileID)
+	bibleBlockFile, err = s.store.CopyBlockedFile(ctx, firstBlockFileID)
 	end = time.Now()
 
 	fmt.Printf("Copied BlockFile: %v\n", end.Sub(start))
@@ -302,7 +450,7 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 	// Check that block used in first block is the same
 	c.Assert(firstBlockFileBlockHash == thirdBlockFileBlockHash, IsTrue)
 
-	fileBlockInfo, err := BlockInfoStore.GetBlockInfo(thirdBlockFileBlockHash)
+	fileBlockInfo, err := s.store.BlockInfoStore.GetBlockInfo(thirdBlockFileBlockHash)
 
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
@@ -312,7 +460,7 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 
 	// Delete first block...
 	start = time.Now()
-	err = DeleteBlockedFile(firstBlockFileID)
+	err = s.store.DeleteBlockedFile(ctx, firstBlockFileID)
 	end = time.Now()
 
 	fmt.Printf("Delete Block took: %v\n", end.Sub(start))
@@ -321,13 +469,13 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 
 	// Ensure the BlockedFile is no longer there
-	_, err = BlockedFileStore.GetBlockedFile(firstBlockFileID)
+	_, err = s.store.BlockedFileStore.GetBlockedFile(firstBlockFileID)
 
 	// We should have an error
 	c.Assert(err == nil, IsFalse)
 
 	// Check the use count
-	fileBlockInfo, err = BlockInfoStore.GetBlockInfo(thirdBlockFileBlockHash)
+	fileBlockInfo, err = s.store.BlockInfoStore.GetBlockInfo(thirdBlockFileBlockHash)
 
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
@@ -337,7 +485,7 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 
 	// Delete second blockedfile
 	start = time.Now()
-	err = DeleteBlockedFile(secondBlockFileID)
+	err = s.store.DeleteBlockedFile(ctx, secondBlockFileID)
 	end = time.Now()
 
 	fmt.Printf("Delete Block took: %v\n", end.Sub(start))
@@ -347,7 +495,7 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 
 	// Delete third blockedfile
 	start = time.Now()
-	err = DeleteBlockedFile(thirdBlockFileID)
+	err = s.store.DeleteBlockedFile(ctx, thirdBlockFileID)
 	end = time.Now()
 
 	fmt.Printf("Delete Block took: %v\n", end.Sub(start))
@@ -358,13 +506,13 @@ func (s *BlockSuite) TestAdvancedBlockCopyDelete(c *C) {
 	// There should now be no reference to the data in any repository
 
 	// Check the use count
-	_, err = BlockInfoStore.GetBlockInfo(thirdBlockFileBlockHash)
+	_, err = s.store.BlockInfoStore.GetBlockInfo(thirdBlockFileBlockHash)
 
 	// There should be an error
 	c.Assert(err == nil, IsFalse)
 
 	// Check the block store has deleted the data...
-	blockExists, _ = BlockStore.CheckBlockExists(thirdBlockFileBlockHash)
+	blockExists, _ = s.store.BlockStore.CheckBlockExists(ctx, thirdBlockFileBlockHash)
 	c.Assert(blockExists, IsFalse)
 }
 
@@ -378,7 +526,7 @@ func (s *BlockSuite) TestLiteide(c *C) {
 
 	// Block the bigger
 	start := time.Now()
-	bibleBlockFile, err := BlockFile(liteIdeInFile)
+	bibleBlockFile, err := s.store.BlockFile(ctx, liteIdeInFile)
 	end := time.Now()
 
 	fmt.Printf("Blocked LiteIde took: %v\n", end.Sub(start))
@@ -389,7 +537,7 @@ func (s *BlockSuite) TestLiteide(c *C) {
 	bibleOutFile := os.TempDir() + "/" + liteIdeoutFile
 
 	// Invalid save location test...
-	err = UnblockFile(bibleBlockFile.ID, "/this/file/does/not/exist.data")
+	err = s.store.UnblockFile(ctx, bibleBlockFile.ID, "/this/file/does/not/exist.data")
 	c.Assert(err != nil, IsTrue)
 
 	// Clean up any old file
@@ -397,7 +545,7 @@ func (s *BlockSuite) TestLiteide(c *C) {
 
 	// Get the file and create a copy to the output
 	start = time.Now()
-	err = UnblockFile(bibleBlockFile.ID, bibleOutFile)
+	err = s.store.UnblockFile(ctx, bibleBlockFile.ID, bibleOutFile)
 	end = time.Now()
 
 	fmt.Printf("Unblocked LiteIde took: %v\n", end.Sub(start))
@@ -405,7 +553,7 @@ func (s *BlockSuite) TestLiteide(c *C) {
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 
-	err = DeleteBlockedFile(bibleBlockFile.ID)
+	err = s.store.DeleteBlockedFile(ctx, bibleBlockFile.ID)
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 }
@@ -420,7 +568,7 @@ func (s *BlockSuite) TestKingJamesBible(c *C) {
 
 	// Block the bigger
 	start := time.Now()
-	bibleBlockFile, err := BlockFile(bibleInFile)
+	bibleBlockFile, err := s.store.BlockFile(ctx, bibleInFile)
 	end := time.Now()
 
 	fmt.Printf("Blocked King James Bible took: %v\n", end.Sub(start))
@@ -435,7 +583,7 @@ func (s *BlockSuite) TestKingJamesBible(c *C) {
 
 	// Get the file and create a copy to the output
 	start = time.Now()
-	err = UnblockFile(bibleBlockFile.ID, bibleOutFile)
+	err = s.store.UnblockFile(ctx, bibleBlockFile.ID, bibleOutFile)
 	end = time.Now()
 
 	fmt.Printf("Unblocked King James Bible took: %v\n", end.Sub(start))
@@ -443,7 +591,7 @@ func (s *BlockSuite) TestKingJamesBible(c *C) {
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 
-	err = DeleteBlockedFile(bibleBlockFile.ID)
+	err = s.store.DeleteBlockedFile(ctx, bibleBlockFile.ID)
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 }
@@ -459,7 +607,7 @@ func (s *BlockSuite) TestTempest(c *C) {
 
 	// Block the file
 	start := time.Now()
-	blockFile, err := BlockFile(inputFile)
+	blockFile, err := s.store.BlockFile(ctx, inputFile)
 	end := time.Now()
 
 	fmt.Printf("Blocked Tempest took: %v\n", end.Sub(start))
@@ -483,7 +631,7 @@ func (s *BlockSuite) TestTempest(c *C) {
 
 	// Get the file and create a copy to the output
 	start = time.Now()
-	err = UnblockFile(blockFile.ID, outputFile)
+	err = s.store.UnblockFile(ctx, blockFile.ID, outputFile)
 	end = time.Now()
 
 	fmt.Printf("Unblocked Tempest took: %v\n", end.Sub(start))
@@ -497,7 +645,7 @@ func (s *BlockSuite) TestTempest(c *C) {
 	// Check we wrote the full file size
 	c.Assert(outputFileInfo.Size() == inputFileInfo.Size(), IsTrue, Commentf("Expected Size: %v Resulting Size: %v", inputFileInfo.Size(), outputFileInfo.Size()))
 
-	err = DeleteBlockedFile(blockFile.ID)
+	err = s.store.DeleteBlockedFile(ctx, blockFile.ID)
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 }
@@ -509,7 +657,7 @@ func (s *BlockSuite) TestTempest(c *C) {
 		BlockSize = BlockSize30Kb
 		UseCompression = true
 		UseEncryption = true
-		BlockFile(inputFile)
+		s.store.BlockFile(ctx, inputFile)
 	}
 }
 
@@ -519,7 +667,7 @@ func (s *BlockSuite) BenchmarkTempestCompressedEncrypted4Mb(c *C) {
 		BlockSize = BlockSize4Mb
 		UseCompression = true
 		UseEncryption = true
-		BlockFile(inputFile)
+		s.store.BlockFile(ctx, inputFile)
 	}
 }
 
@@ -531,7 +679,7 @@ func (s *BlockSuite) BenchmarkTempestUncompressedUnencrypted4Mb(c *C) {
 		UseEncryption = false
 		// Need to clean out the block store directory
 
-		BlockFile(inputFile)
+		s.store.BlockFile(ctx, inputFile)
 	}
 }*/
 
@@ -540,14 +688,18 @@ func (s *BlockSuite) TestChangeTempest(c *C) {
 	c.Skip("Not what I want to test right now")
 
 	// Set up test
-	BlockSize = BlockSize30Kb
-	UseCompression = true
-	UseEncryption = true
+	cfg := testConfig()
+	cfg.Blocks.BlockSize = BlockSize30Kb
+	cfg.Blocks.Compression = true
+	cfg.Blocks.Encryption = true
+
+	store, err := NewStore(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 
 	// Get some info about the file we are going test
 	changedInputFileInfo, _ := os.Stat(changedInputFile)
 
-	blockFile, err := BlockFile(inputFile)
+	blockFile, err := store.BlockFile(ctx, inputFile)
 
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
@@ -555,7 +707,7 @@ func (s *BlockSuite) TestChangeTempest(c *C) {
 	firstFileHash := blockFile.BlockList[0].Hash
 
 	// Block the file again.
-	blockFile, err = BlockFile(inputFile)
+	blockFile, err = store.BlockFile(ctx, inputFile)
 
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
@@ -570,7 +722,7 @@ func (s *BlockSuite) TestChangeTempest(c *C) {
 	c.Assert(firstFileHash == blockFile.BlockList[0].Hash, IsTrue)
 
 	// Block the file again.  New version should be created
-	blockFile, err = BlockFile(changedInputFile)
+	blockFile, err = store.BlockFile(ctx, changedInputFile)
 
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
@@ -587,7 +739,7 @@ func (s *BlockSuite) TestChangeTempest(c *C) {
 	os.Remove(changedOutputFile)
 
 	// Get the file and create a copy to the output
-	err = UnblockFile(blockFile.ID, changedOutputFile)
+	err = store.UnblockFile(ctx, blockFile.ID, changedOutputFile)
 
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
@@ -598,11 +750,11 @@ func (s *BlockSuite) TestChangeTempest(c *C) {
 	// Check we wrote the full file size
 	c.Assert(outputFileInfo.Size() == changedInputFileInfo.Size(), IsTrue)
 
-	err = DeleteBlockedFile(firstBlockID)
+	err = store.DeleteBlockedFile(ctx, firstBlockID)
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 
-	err = DeleteBlockedFile(secondBlockID)
+	err = store.DeleteBlockedFile(ctx, secondBlockID)
 	// No error
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 }
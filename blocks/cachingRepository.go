@@ -0,0 +1,627 @@
+package blocks
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache modes
+const (
+	// CacheWriteThrough saves blocks to the backing repository before they are cached
+	CacheWriteThrough = "write-through"
+	// CacheWriteBack saves blocks to the cache and copies them to the backing repository in the background
+	CacheWriteBack = "write-back"
+)
+
+// writeBackJournal is the block of the cache repository listing the blocks still to be written back
+const writeBackJournal = "writebackjournal"
+
+// journalCompactRecords is the fewest records appended to the journal before it is compacted.  It is compacted once
+// the records also number as many as the blocks the journal lists, so each record costs about one line of the journal.
+const journalCompactRecords = 256
+
+// CacheStats counts how the cache has been used
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	// Size is the number of bytes currently cached
+	Size int64 `json:"size"`
+	// Dirty is the number of blocks not yet written to the backing repository
+	Dirty int `json:"dirty"`
+}
+
+// cacheEntry is a block held in the cache
+type cacheEntry struct {
+	hash  string
+	size  int64
+	dirty bool
+}
+
+// CachingBlockRepository keeps the most recently used blocks of a backing repository in a faster cache repository.
+// Blocks are cached as they are stored, so the cache only ever holds encoded blocks.
+// The cache is bounded by size and evicts the least recently used blocks first.
+// The blocks still to be written back are listed in a journal kept in the cache repository, so an earlier process
+// which stopped before writing them back has them written back.  Other blocks left in the cache are not used.
+// Each change is appended to the journal as a record block of its own, and the records are compacted into the journal
+// from time to time, so a growing backlog does not slow down each write.
+type CachingBlockRepository struct {
+	backing BlockRepository
+	cache   BlockRepository
+	maxSize int64
+	mode    string
+
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   CacheStats
+
+	// flushLock stops a block being deleted while it is written back
+	flushLock sync.Mutex
+	flush     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// journalLock keeps the journal in order.  The journal lists journalSize blocks and names its epoch, which names
+	// the records appended since it was saved, journalRecords of them.  An epoch of 0 is no journal.
+	journalLock    sync.Mutex
+	journalEpoch   int64
+	journalSize    int
+	journalRecords int
+}
+
+// NewCachingBlockRepository - Creates a repository caching up to maxSize bytes of the backing repository in the cache repository.
+// In write-back mode blocks which failed to be written back are tried again every retryInterval, unless it is zero,
+// and the repository must be closed to write back the remaining blocks.
+func NewCachingBlockRepository(backing BlockRepository, cache BlockRepository, maxSize int64, mode string, retryInterval time.Duration) *CachingBlockRepository {
+	r := &CachingBlockRepository{
+		backing: backing,
+		cache:   cache,
+		maxSize: maxSize,
+		mode:    mode,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		flush:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	// Blocks left by an earlier process are written back whatever the mode is now
+	if err := r.loadJournal(context.Background()); err != nil {
+		log.Printf("Unable to read the blocks to write back: %v", err)
+	}
+
+	if mode == CacheWriteBack || r.stats.Dirty > 0 {
+		go r.writeBack(retryInterval)
+	}
+
+	return r
+}
+
+// Stats returns the current cache statistics
+func (r *CachingBlockRepository) Stats() CacheStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.stats
+}
+
+// SaveBlock saves the block to the backing repository and the cache according to the mode
+func (r *CachingBlockRepository) SaveBlock(ctx context.Context, data []byte, blockHash string) error {
+	if r.mode != CacheWriteBack {
+		if err := r.backing.SaveBlock(ctx, data, blockHash); err != nil {
+			return err
+		}
+	}
+
+	return r.addToCache(ctx, blockHash, data, r.mode == CacheWriteBack)
+}
+
+// PutBlock streams the block to the backing repository and the cache according to the mode
+func (r *CachingBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	if r.mode == CacheWriteBack {
+		buffer, err := ioutil.ReadAll(data)
+		if err != nil {
+			return err
+		}
+
+		return r.addToCache(ctx, blockHash, buffer, true)
+	}
+
+	// Keep a copy for the cache as the block streams past
+	var buffer bytes.Buffer
+	if err := r.backing.PutBlock(ctx, blockHash, io.TeeReader(data, &buffer), size); err != nil {
+		return err
+	}
+
+	return r.addToCache(ctx, blockHash, buffer.Bytes(), false)
+}
+
+// GetBlock gets the block from the cache, or from the backing repository and caches it
+func (r *CachingBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	if r.hit(blockHash) {
+		data, err := r.cache.GetBlock(ctx, blockHash)
+		if err == nil {
+			return data, nil
+		}
+
+		// The cache lost the block, so fall back to the backing repository
+		log.Printf("Cached block %s could not be read: %v", blockHash, err)
+		r.remove(ctx, blockHash)
+	}
+
+	data, err := r.backing.GetBlock(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.addToCache(ctx, blockHash, data, false); err != nil {
+		log.Printf("Unable to cache block %s: %v", blockHash, err)
+	}
+
+	return data, nil
+}
+
+// OpenBlock streams the block from the cache.  Blocks which are not cached are read whole so they can be cached.
+func (r *CachingBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	if r.hit(blockHash) {
+		body, err := r.cache.OpenBlock(ctx, blockHash)
+		if err == nil {
+			return body, nil
+		}
+
+		log.Printf("Cached block %s could not be read: %v", blockHash, err)
+		r.remove(ctx, blockHash)
+	}
+
+	data, err := r.backing.GetBlock(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.addToCache(ctx, blockHash, data, false); err != nil {
+		log.Printf("Unable to cache block %s: %v", blockHash, err)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// CheckBlockExists checks the cache before the backing repository
+func (r *CachingBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	r.lock.Lock()
+	_, cached := r.entries[blockHash]
+	r.lock.Unlock()
+
+	if cached {
+		return true, nil
+	}
+
+	return r.backing.CheckBlockExists(ctx, blockHash)
+}
+
+// DeleteBlock deletes the block from the cache and the backing repository
+func (r *CachingBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	r.flushLock.Lock()
+	defer r.flushLock.Unlock()
+
+	entry, cached := r.remove(ctx, blockHash)
+
+	// A dirty block never reached the backing repository
+	if cached && entry.dirty {
+		return r.appendJournal(ctx, blockHash)
+	}
+
+	return r.backing.DeleteBlock(ctx, blockHash)
+}
+
+// Flush writes every block not yet in the backing repository
+func (r *CachingBlockRepository) Flush(ctx context.Context) error {
+	r.flushLock.Lock()
+	defer r.flushLock.Unlock()
+
+	var firstErr error
+	for _, blockHash := range r.dirtyBlocks() {
+		if err := r.writeBackBlock(ctx, blockHash); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Close stops writing back in the background and writes back the remaining blocks
+func (r *CachingBlockRepository) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+
+	if err := r.Flush(context.Background()); err != nil {
+		return err
+	}
+
+	if closer, ok := r.backing.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (r *CachingBlockRepository) reportStatus(status *RepositoryStatus) {
+	stats := r.Stats()
+	status.Cache = &stats
+	reportStatus(r.backing, status)
+}
+
+func (r *CachingBlockRepository) repairBlock(ctx context.Context, blockHash string) (int, error) {
+	return repairBlock(ctx, r.backing, blockHash)
+}
+
+// hit looks for the block in the cache and records the hit or miss
+func (r *CachingBlockRepository) hit(blockHash string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	element, ok := r.entries[blockHash]
+	if !ok {
+		r.stats.Misses++
+		return false
+	}
+
+	r.stats.Hits++
+	r.lru.MoveToFront(element)
+
+	return true
+}
+
+// addToCache stores the block in the cache and evicts the least recently used blocks to stay within the size
+func (r *CachingBlockRepository) addToCache(ctx context.Context, blockHash string, data []byte, dirty bool) error {
+	size := int64(len(data))
+
+	// Blocks bigger than the cache are not cached, unless they still have to be written back
+	if size > r.maxSize && !dirty {
+		return nil
+	}
+
+	if err := r.cache.SaveBlock(ctx, data, blockHash); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	if element, ok := r.entries[blockHash]; ok {
+		entry := element.Value.(*cacheEntry)
+		r.stats.Size -= entry.size
+		r.setDirty(entry, entry.dirty || dirty)
+		entry.size = size
+		r.lru.MoveToFront(element)
+	} else {
+		entry := &cacheEntry{hash: blockHash, size: size}
+		r.setDirty(entry, dirty)
+		r.entries[blockHash] = r.lru.PushFront(entry)
+	}
+	r.stats.Size += size
+
+	evicted := r.evict()
+	r.lock.Unlock()
+
+	for _, evictedHash := range evicted {
+		if err := r.cache.DeleteBlock(ctx, evictedHash); err != nil {
+			log.Printf("Unable to evict block %s from the cache: %v", evictedHash, err)
+		}
+	}
+
+	if dirty {
+		// The block is only saved once the journal lists it
+		if err := r.appendJournal(ctx, blockHash); err != nil {
+			r.remove(ctx, blockHash)
+			return err
+		}
+
+		// Wake up the write back without waiting for it
+		select {
+		case r.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// evict removes the least recently used clean blocks until the cache fits.  Must be called with the lock held.
+// Dirty blocks are never evicted, so the cache can grow beyond its size until they are written back.
+func (r *CachingBlockRepository) evict() []string {
+	var evicted []string
+
+	for element := r.lru.Back(); element != nil && r.stats.Size > r.maxSize; {
+		previous := element.Prev()
+		entry := element.Value.(*cacheEntry)
+
+		if !entry.dirty {
+			r.lru.Remove(element)
+			delete(r.entries, entry.hash)
+			r.stats.Size -= entry.size
+			r.stats.Evictions++
+			evicted = append(evicted, entry.hash)
+		}
+
+		element = previous
+	}
+
+	return evicted
+}
+
+// remove drops the block from the cache and returns the entry as it was if it was cached
+func (r *CachingBlockRepository) remove(ctx context.Context, blockHash string) (cacheEntry, bool) {
+	r.lock.Lock()
+	element, ok := r.entries[blockHash]
+	if !ok {
+		r.lock.Unlock()
+		return cacheEntry{}, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	removed := *entry
+
+	r.lru.Remove(element)
+	delete(r.entries, blockHash)
+	r.stats.Size -= entry.size
+	r.setDirty(entry, false)
+	r.lock.Unlock()
+
+	r.cache.DeleteBlock(ctx, blockHash)
+
+	return removed, true
+}
+
+// setDirty marks the entry and keeps the dirty count.  Must be called with the lock held.
+func (r *CachingBlockRepository) setDirty(entry *cacheEntry, dirty bool) {
+	if entry.dirty == dirty {
+		return
+	}
+
+	entry.dirty = dirty
+	if dirty {
+		r.stats.Dirty++
+	} else {
+		r.stats.Dirty--
+	}
+}
+
+// dirtyBlocks returns the hashes of the blocks still to be written back
+func (r *CachingBlockRepository) dirtyBlocks() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var dirty []string
+	for hash, element := range r.entries {
+		if element.Value.(*cacheEntry).dirty {
+			dirty = append(dirty, hash)
+		}
+	}
+
+	return dirty
+}
+
+// writeBackBlock copies a dirty block from the cache to the backing repository.  Must be called with the flushLock held.
+func (r *CachingBlockRepository) writeBackBlock(ctx context.Context, blockHash string) error {
+	data, err := r.cache.GetBlock(ctx, blockHash)
+	if err != nil {
+		return err
+	}
+
+	if err := r.backing.SaveBlock(ctx, data, blockHash); err != nil {
+		log.Printf("Unable to write back block %s: %v", blockHash, err)
+		return err
+	}
+
+	r.lock.Lock()
+	if element, ok := r.entries[blockHash]; ok {
+		r.setDirty(element.Value.(*cacheEntry), false)
+	}
+	evicted := r.evict()
+	r.lock.Unlock()
+
+	for _, evictedHash := range evicted {
+		r.cache.DeleteBlock(ctx, evictedHash)
+	}
+
+	// Written back blocks left in the journal are only written back again
+	if err := r.appendJournal(ctx, blockHash); err != nil {
+		log.Printf("Unable to save the blocks to write back: %v", err)
+	}
+
+	return nil
+}
+
+// writeBack writes back dirty blocks whenever new ones arrive, and retries those which failed every retryInterval,
+// until the repository is closed
+func (r *CachingBlockRepository) writeBack(retryInterval time.Duration) {
+	var retry <-chan time.Time
+	if retryInterval > 0 {
+		ticker := time.NewTicker(retryInterval)
+		defer ticker.Stop()
+		retry = ticker.C
+	}
+
+	// Blocks left by an earlier process are written back straight away
+	r.Flush(context.Background())
+
+	for {
+		select {
+		case <-r.flush:
+			r.Flush(context.Background())
+		case <-retry:
+			if r.Stats().Dirty > 0 {
+				r.Flush(context.Background())
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// appendJournal records in the journal whether the block is still to be written back.  The state is read when the
+// record is appended, so the last record of a block holds its last state whatever order changes are recorded in.
+// The journal is compacted once it has enough records, and a failed compaction is tried again with the next record.
+func (r *CachingBlockRepository) appendJournal(ctx context.Context, blockHash string) error {
+	r.journalLock.Lock()
+	defer r.journalLock.Unlock()
+
+	r.lock.Lock()
+	element, ok := r.entries[blockHash]
+	dirty := ok && element.Value.(*cacheEntry).dirty
+	dirtyCount := r.stats.Dirty
+	r.lock.Unlock()
+
+	// Without a journal there is nothing to take a clean block off
+	if r.journalEpoch == 0 && !dirty {
+		return nil
+	}
+
+	// The records need a journal naming their epoch
+	if r.journalEpoch == 0 {
+		if err := r.saveJournal(ctx, time.Now().UnixNano(), nil); err != nil {
+			return err
+		}
+	}
+
+	record := "-" + blockHash
+	if dirty {
+		record = "+" + blockHash
+	}
+	if err := r.cache.SaveBlock(ctx, []byte(record), journalRecordKey(r.journalEpoch, r.journalRecords)); err != nil {
+		return err
+	}
+	r.journalRecords++
+
+	if dirtyCount == 0 || (r.journalRecords >= journalCompactRecords && r.journalRecords >= r.journalSize) {
+		if err := r.compactJournal(ctx); err != nil {
+			log.Printf("Unable to compact the blocks to write back: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// compactJournal saves the blocks still to be written back as a journal of a new epoch, and deletes the records of the
+// old one.  Without blocks to write back the journal is deleted.  Must be called with the journalLock held.
+func (r *CachingBlockRepository) compactJournal(ctx context.Context) error {
+	epoch, records := r.journalEpoch, r.journalRecords
+
+	dirty := r.dirtyBlocks()
+	if len(dirty) == 0 {
+		if err := r.cache.DeleteBlock(ctx, writeBackJournal); err != nil {
+			return err
+		}
+		r.journalEpoch, r.journalSize, r.journalRecords = 0, 0, 0
+	} else if err := r.saveJournal(ctx, time.Now().UnixNano(), dirty); err != nil {
+		return err
+	}
+
+	// The journal no longer names the old records, so any left behind are never read
+	for i := 0; i < records; i++ {
+		if err := r.cache.DeleteBlock(ctx, journalRecordKey(epoch, i)); err != nil {
+			log.Printf("Unable to delete record %d of the blocks to write back: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// saveJournal saves the journal of a new epoch listing the blocks.  Must be called with the journalLock held.
+func (r *CachingBlockRepository) saveJournal(ctx context.Context, epoch int64, dirty []string) error {
+	sort.Strings(dirty)
+	journal := strconv.FormatInt(epoch, 10)
+	if len(dirty) > 0 {
+		journal += "\n" + strings.Join(dirty, "\n")
+	}
+
+	if err := r.cache.SaveBlock(ctx, []byte(journal), writeBackJournal); err != nil {
+		return err
+	}
+	r.journalEpoch, r.journalSize, r.journalRecords = epoch, len(dirty), 0
+
+	return nil
+}
+
+// journalRecordKey is the block of the cache repository holding a record appended to the journal of the epoch
+func journalRecordKey(epoch int64, record int) string {
+	return fmt.Sprintf("%s.%d.%d", writeBackJournal, epoch, record)
+}
+
+// loadJournal adds the blocks the journal and its records list to the cache as still to be written back
+func (r *CachingBlockRepository) loadJournal(ctx context.Context) error {
+	exists, err := r.cache.CheckBlockExists(ctx, writeBackJournal)
+	if err != nil || !exists {
+		return err
+	}
+
+	journal, err := r.cache.GetBlock(ctx, writeBackJournal)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(journal), "\n")
+	epoch, err := strconv.ParseInt(lines[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid journal epoch %q: %v", lines[0], err)
+	}
+
+	dirty := make(map[string]bool)
+	for _, blockHash := range lines[1:] {
+		dirty[blockHash] = true
+	}
+
+	// The records run from the first until one is missing
+	records := 0
+	for ; ; records++ {
+		exists, err := r.cache.CheckBlockExists(ctx, journalRecordKey(epoch, records))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			break
+		}
+
+		record, err := r.cache.GetBlock(ctx, journalRecordKey(epoch, records))
+		if err != nil {
+			return err
+		}
+		if len(record) < 2 {
+			return fmt.Errorf("Invalid record %d of the blocks to write back", records)
+		}
+
+		blockHash := string(record[1:])
+		if record[0] == '+' {
+			dirty[blockHash] = true
+		} else {
+			delete(dirty, blockHash)
+		}
+	}
+	r.journalEpoch, r.journalSize, r.journalRecords = epoch, len(lines)-1, records
+
+	for blockHash := range dirty {
+		data, err := r.cache.GetBlock(ctx, blockHash)
+		if err != nil {
+			log.Printf("Block %s to write back is not in the cache: %v", blockHash, err)
+			continue
+		}
+
+		entry := &cacheEntry{hash: blockHash, size: int64(len(data))}
+		r.setDirty(entry, true)
+		r.entries[blockHash] = r.lru.PushFront(entry)
+		r.stats.Size += entry.size
+	}
+
+	log.Printf("Writing back %d blocks left in the cache", r.stats.Dirty)
+
+	return nil
+}
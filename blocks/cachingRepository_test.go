@@ -0,0 +1,228 @@
+package blocks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/keithballdotnet/blocker/config"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BlockSuite) TestCachingBlockRepositoryWriteThrough(c *C) {
+	backing := NewMemoryBlockRepository()
+	cache := NewMemoryBlockRepository()
+	repository := NewCachingBlockRepository(backing, cache, 1024, CacheWriteThrough, 0)
+	defer repository.Close()
+
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Written to both straight away
+	c.Assert(backing.Len(), Equals, 1)
+	c.Assert(cache.Len(), Equals, 1)
+
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "blob")
+
+	stats := repository.Stats()
+	c.Assert(stats.Hits, Equals, int64(1))
+	c.Assert(stats.Misses, Equals, int64(0))
+	c.Assert(stats.Size, Equals, int64(4))
+
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(backing.Len(), Equals, 0)
+	c.Assert(cache.Len(), Equals, 0)
+}
+
+func (s *BlockSuite) TestCachingBlockRepositoryCachesMisses(c *C) {
+	backing := NewMemoryBlockRepository()
+	repository := NewCachingBlockRepository(backing, NewMemoryBlockRepository(), 1024, CacheWriteThrough, 0)
+	defer repository.Close()
+
+	// Stored without going through the cache
+	backing.SaveBlock(ctx, []byte("blob"), "hash")
+
+	for i := 0; i < 3; i++ {
+		body, err := repository.OpenBlock(ctx, "hash")
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		c.Assert(string(data), Equals, "blob")
+	}
+
+	stats := repository.Stats()
+	c.Assert(stats.Misses, Equals, int64(1))
+	c.Assert(stats.Hits, Equals, int64(2))
+
+	// Only the first read reached the backing repository
+	c.Assert(backing.Calls(), Equals, 2)
+}
+
+func (s *BlockSuite) TestCachingBlockRepositoryEvictsLeastRecentlyUsed(c *C) {
+	backing := NewMemoryBlockRepository()
+	cache := NewMemoryBlockRepository()
+	repository := NewCachingBlockRepository(backing, cache, 10, CacheWriteThrough, 0)
+	defer repository.Close()
+
+	repository.SaveBlock(ctx, []byte("1111"), "one")
+	repository.SaveBlock(ctx, []byte("2222"), "two")
+
+	// Use the first block so the second is the least recently used
+	repository.GetBlock(ctx, "one")
+
+	repository.SaveBlock(ctx, []byte("3333"), "three")
+
+	stats := repository.Stats()
+	c.Assert(stats.Evictions, Equals, int64(1))
+	c.Assert(stats.Size, Equals, int64(8))
+
+	exists, _ := cache.CheckBlockExists(ctx, "two")
+	c.Assert(exists, IsFalse)
+	exists, _ = cache.CheckBlockExists(ctx, "one")
+	c.Assert(exists, IsTrue)
+
+	// The evicted block is still available from the backing repository
+	data, err := repository.GetBlock(ctx, "two")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "2222")
+}
+
+func (s *BlockSuite) TestCachingBlockRepositoryWriteBack(c *C) {
+	backing := NewMemoryBlockRepository()
+	repository := NewCachingBlockRepository(backing, NewMemoryBlockRepository(), 1024, CacheWriteBack, 0)
+
+	// Keep the background write back from succeeding
+	backing.SetFaults(MemoryFaults{Fail: true})
+
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Served from the cache while the backing repository is failing
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "blob")
+
+	err = repository.Flush(ctx)
+	c.Assert(err, Equals, ErrInjectedFault)
+	c.Assert(repository.Stats().Dirty, Equals, 1)
+
+	// Once the backing repository recovers the block is written back
+	backing.SetFaults(MemoryFaults{})
+
+	err = repository.Close()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Stats().Dirty, Equals, 0)
+
+	exists, _ := backing.CheckBlockExists(ctx, "hash")
+	c.Assert(exists, IsTrue)
+}
+
+func (s *BlockSuite) TestCachingBlockRepositoryWriteBackSurvivesRestart(c *C) {
+	backing := NewMemoryBlockRepository()
+	cache, err := NewDiskBlockRepository(config.DiskConfig{Directory: c.MkDir()})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Stopped before the blocks could be written back
+	backing.SetFaults(MemoryFaults{Fail: true})
+	stopped := NewCachingBlockRepository(backing, cache, 1024, CacheWriteBack, 0)
+
+	for _, blockHash := range []string{"one", "two"} {
+		err := stopped.SaveBlock(ctx, []byte("blob "+blockHash), blockHash)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+	c.Assert(stopped.Close() != nil, IsTrue)
+
+	// The next repository using the cache writes them back
+	backing.SetFaults(MemoryFaults{})
+	repository := NewCachingBlockRepository(backing, cache, 1024, CacheWriteThrough, 0)
+	c.Assert(repository.Close() == nil, IsTrue)
+	c.Assert(repository.Stats().Dirty, Equals, 0)
+
+	for _, blockHash := range []string{"one", "two"} {
+		data, err := backing.GetBlock(ctx, blockHash)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(string(data), Equals, "blob "+blockHash)
+	}
+
+	// Nothing is left to write back
+	exists, _ := cache.CheckBlockExists(ctx, writeBackJournal)
+	c.Assert(exists, IsFalse)
+}
+
+func (s *BlockSuite) TestCachingBlockRepositoryCompactsJournal(c *C) {
+	backing := NewMemoryBlockRepository()
+	cache := NewMemoryBlockRepository()
+
+	// A backlog builds up while the backing repository is down
+	backing.SetFaults(MemoryFaults{Fail: true})
+	stopped := NewCachingBlockRepository(backing, cache, 1<<20, CacheWriteBack, 0)
+
+	for i := 0; i < 600; i++ {
+		err := stopped.SaveBlock(ctx, []byte(fmt.Sprintf("blob %d", i)), fmt.Sprintf("hash%d", i))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+	for i := 0; i < 10; i++ {
+		err := stopped.DeleteBlock(ctx, fmt.Sprintf("hash%d", i))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+	c.Assert(stopped.Close() != nil, IsTrue)
+
+	// The records appended since the journal was last compacted are fewer than the blocks it lists
+	c.Assert(cache.Len()-590 < 300, IsTrue, Commentf("Cache holds %d blocks", cache.Len()))
+
+	// The next repository using the cache writes back the blocks the journal and its records list
+	backing.SetFaults(MemoryFaults{})
+	repository := NewCachingBlockRepository(backing, cache, 1<<20, CacheWriteThrough, 0)
+	c.Assert(repository.Stats().Dirty, Equals, 590)
+	c.Assert(repository.Close() == nil, IsTrue)
+	c.Assert(backing.Len(), Equals, 590)
+
+	// Nothing is left to write back
+	c.Assert(cache.Len(), Equals, 590)
+}
+
+func (s *BlockSuite) TestCachingBlockRepositoryRetriesWriteBack(c *C) {
+	backing := NewMemoryBlockRepository()
+	repository := NewCachingBlockRepository(backing, NewMemoryBlockRepository(), 1024, CacheWriteBack, 10*time.Millisecond)
+	defer repository.Close()
+
+	backing.SetFaults(MemoryFaults{Fail: true})
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Written back once the backing repository recovers, without another block being saved
+	backing.SetFaults(MemoryFaults{})
+	deadline := time.Now().Add(time.Second)
+	for repository.Stats().Dirty > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	c.Assert(repository.Stats().Dirty, Equals, 0)
+	c.Assert(backing.Len(), Equals, 1)
+}
+
+func (s *BlockSuite) TestStoreWithCache(c *C) {
+	cfg := testConfig()
+	cfg.Storage.Cache.Provider = "memory"
+
+	store, err := NewStore(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer store.Close()
+
+	caching, ok := store.BlockStore.(*CachingBlockRepository)
+	c.Assert(ok, IsTrue)
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	c.Assert(caching.Stats().Hits, Equals, int64(len(blockedFile.BlockList)))
+}
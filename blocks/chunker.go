@@ -0,0 +1,41 @@
+package blocks
+
+import (
+	"io"
+)
+
+// Chunker splits a stream of data into blocks
+type Chunker interface {
+	// Split reads the source until it is exhausted and calls fn with each block in order.
+	// The block passed to fn is only valid until fn returns.
+	Split(source io.Reader, fn func(block []byte) error) error
+}
+
+// FixedSizeChunker splits a stream into blocks of BlockSize bytes.  Only the last block may be shorter.
+type FixedSizeChunker struct {
+	BlockSize int64
+}
+
+// Split reads BlockSize bytes at a time from the source
+func (c FixedSizeChunker) Split(source io.Reader, fn func(block []byte) error) error {
+	data := make([]byte, c.BlockSize)
+
+	for {
+		count, err := io.ReadFull(source, data)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		if fnErr := fn(data[:count]); fnErr != nil {
+			return fnErr
+		}
+
+		// A short read means we have reached the end of the source
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+	}
+}
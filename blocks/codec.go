@@ -0,0 +1,235 @@
+package blocks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/keithballdotnet/blocker/crypto"
+)
+
+// Codec transforms a block on its way into and out of the BlockRepository
+type Codec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// StreamCodec transforms a block as it is streamed into and out of the BlockRepository.
+// The streamed encoding may differ from the one produced by Codec.Encode, so the BlockInfo records which was used.
+type StreamCodec interface {
+	// EncodeWriter returns a writer encoding into w.  Close finishes the encoding but does not close w.
+	EncodeWriter(w io.Writer) (io.WriteCloser, error)
+	// DecodeReader returns a reader of the decoded data from r
+	DecodeReader(r io.Reader) (io.Reader, error)
+}
+
+var errNotStreamCodec = errors.New("Codec does not support streaming")
+
+// NewCodec returns the codec for the passed settings.  Blocks are compressed before they are encrypted.
+func NewCodec(useCompression bool, cryptoProvider crypto.CryptoProvider) Codec {
+	chain := CodecChain{}
+
+	if useCompression {
+		chain = append(chain, SnappyCodec{})
+	}
+
+	if cryptoProvider != nil {
+		chain = append(chain, CryptoCodec{cryptoProvider})
+	}
+
+	return chain
+}
+
+// CodecChain applies each codec in order when encoding and in reverse order when decoding.
+// An empty chain stores blocks as they are.
+type CodecChain []Codec
+
+// Encode runs the data through every codec in the chain
+func (c CodecChain) Encode(data []byte) ([]byte, error) {
+	var err error
+	for _, codec := range c {
+		data, err = codec.Encode(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// Decode runs the data back through every codec in the chain
+func (c CodecChain) Decode(data []byte) ([]byte, error) {
+	var err error
+	for i := len(c) - 1; i >= 0; i-- {
+		data, err = c[i].Decode(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// EncodeWriter returns a writer passing the data through every codec in the chain into w.
+// Every codec in the chain must be a StreamCodec.
+func (c CodecChain) EncodeWriter(w io.Writer) (io.WriteCloser, error) {
+	// The last codec writes to w, so build the writers from the end of the chain
+	writers := make(chainWriter, len(c))
+	var next io.Writer = w
+
+	for i := len(c) - 1; i >= 0; i-- {
+		streamCodec, ok := c[i].(StreamCodec)
+		if !ok {
+			return nil, errNotStreamCodec
+		}
+
+		writer, err := streamCodec.EncodeWriter(next)
+		if err != nil {
+			return nil, err
+		}
+
+		writers[i] = writer
+		next = writer
+	}
+
+	if len(writers) == 0 {
+		return nopWriteCloser{w}, nil
+	}
+
+	return writers, nil
+}
+
+// DecodeReader returns a reader passing the data back through every codec in the chain.
+// Every codec in the chain must be a StreamCodec.
+func (c CodecChain) DecodeReader(r io.Reader) (io.Reader, error) {
+	for i := len(c) - 1; i >= 0; i-- {
+		streamCodec, ok := c[i].(StreamCodec)
+		if !ok {
+			return nil, errNotStreamCodec
+		}
+
+		var err error
+		r, err = streamCodec.DecodeReader(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// chainWriter writes to the first writer and closes every writer in order so each flushes into the next
+type chainWriter []io.WriteCloser
+
+func (w chainWriter) Write(p []byte) (int, error) {
+	return w[0].Write(p)
+}
+
+func (w chainWriter) Close() error {
+	for _, writer := range w {
+		if err := writer.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// SnappyCodec compresses blocks using snappy.
+// Whole blocks use the snappy block format and streams use the snappy framing format.
+type SnappyCodec struct{}
+
+// Encode compresses the data
+func (SnappyCodec) Encode(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+// Decode uncompresses the data
+func (SnappyCodec) Decode(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// EncodeWriter returns a writer compressing into w
+func (SnappyCodec) EncodeWriter(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+// DecodeReader returns a reader uncompressing r
+func (SnappyCodec) DecodeReader(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+// CryptoCodec encrypts blocks using a CryptoProvider.
+// Streams are only encrypted without buffering when the provider is a crypto.StreamingCryptoProvider.
+type CryptoCodec struct {
+	Provider crypto.CryptoProvider
+}
+
+// Encode encrypts the data
+func (c CryptoCodec) Encode(data []byte) ([]byte, error) {
+	return c.Provider.Encrypt(data)
+}
+
+// Decode decrypts the data
+func (c CryptoCodec) Decode(data []byte) ([]byte, error) {
+	return c.Provider.Decrypt(data)
+}
+
+// EncodeWriter returns a writer encrypting into w
+func (c CryptoCodec) EncodeWriter(w io.Writer) (io.WriteCloser, error) {
+	if streamingProvider, ok := c.Provider.(crypto.StreamingCryptoProvider); ok {
+		return streamingProvider.EncryptWriter(w)
+	}
+
+	return &bufferedEncryptWriter{provider: c.Provider, w: w}, nil
+}
+
+// DecodeReader returns a reader decrypting r
+func (c CryptoCodec) DecodeReader(r io.Reader) (io.Reader, error) {
+	if streamingProvider, ok := c.Provider.(crypto.StreamingCryptoProvider); ok {
+		return streamingProvider.DecryptReader(r)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = c.Provider.Decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// bufferedEncryptWriter collects the data and encrypts it in one go when closed
+type bufferedEncryptWriter struct {
+	buffer   bytes.Buffer
+	provider crypto.CryptoProvider
+	w        io.Writer
+}
+
+func (b *bufferedEncryptWriter) Write(p []byte) (int, error) {
+	return b.buffer.Write(p)
+}
+
+func (b *bufferedEncryptWriter) Close() error {
+	data, err := b.provider.Encrypt(b.buffer.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = b.w.Write(data)
+	return err
+}
@@ -0,0 +1,109 @@
+package blocks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/keithballdotnet/blocker/crypto"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	"github.com/keithballdotnet/blocker/hash2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BlockSuite) TestCodecStreamRoundTrip(c *C) {
+	data := []byte(crypto.RandomSecret(int(BlockSize100Kb)))
+
+	for _, codec := range []CodecChain{
+		{},
+		{SnappyCodec{}},
+		{CryptoCodec{s.store.CryptoProvider}},
+		{SnappyCodec{}, CryptoCodec{s.store.CryptoProvider}},
+	} {
+		var encoded bytes.Buffer
+		writer, err := codec.EncodeWriter(&encoded)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+		_, err = io.Copy(writer, bytes.NewReader(data))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+		err = writer.Close()
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+		reader, err := codec.DecodeReader(&encoded)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+		decoded, err := ioutil.ReadAll(reader)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(bytes.Equal(data, decoded), IsTrue, Commentf("Codec chain of %d did not round trip", len(codec)))
+	}
+}
+
+func (s *BlockSuite) TestStreamCryptoCodecBuffersWithoutStreamingProvider(c *C) {
+	// Hide the streaming methods of the provider
+	codec := CryptoCodec{struct{ crypto.CryptoProvider }{s.store.CryptoProvider}}
+	data := []byte("encrypted without a streaming provider")
+
+	var encoded bytes.Buffer
+	writer, err := codec.EncodeWriter(&encoded)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	writer.Write(data)
+	c.Assert(writer.Close() == nil, IsTrue)
+
+	// The output is the same as encrypting as a whole
+	decoded, err := codec.Decode(encoded.Bytes())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(bytes.Equal(data, decoded), IsTrue)
+}
+
+func (s *BlockSuite) TestUnblockBufferedFormatBlocks(c *C) {
+	// Blocks saved before formats were recorded were encoded as a whole
+	data := []byte(crypto.RandomSecret(1000))
+	hash := hash2.GetSha256HashString(data)
+	storeID := "buffered" + hash[:32]
+
+	encoded, err := s.store.Codec.Encode(data)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = s.store.BlockStore.SaveBlock(ctx, encoded, storeID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	now := time.Now().UTC()
+	err = s.store.BlockInfoStore.SaveBlockInfo(BlockInfo{Hash: hash, StoreID: storeID, UseCount: 1, Created: now, LastUsage: now})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	blockedFile := BlockedFile{ID: uuid.New().String(), FileHash: hash, Length: int64(len(data)), BlockList: []Block{{1, hash}}}
+	err = s.store.BlockedFileStore.SaveBlockedFile(blockedFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	buffer, err := s.store.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(bytes.Equal(data, buffer.Bytes()), IsTrue)
+
+	err = s.store.DeleteBlockedFile(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+}
+
+func (s *BlockSuite) TestNewBlocksAreStreamed(c *C) {
+	blockedFile, err := s.store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer s.store.DeleteBlockedFile(ctx, blockedFile.ID)
+
+	blockInfo, err := s.store.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfo.Format, Equals, BlockFormatStream)
+
+	block, err := s.store.BlockStore.OpenBlock(ctx, blockInfo.StoreID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer block.Close()
+
+	// The stored block is encrypted so must not look like the input
+	stored, err := ioutil.ReadAll(block)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(len(stored) > 0, IsTrue)
+
+	input, _ := ioutil.ReadFile(inputFile)
+	c.Assert(bytes.Contains(stored, input[:100]), IsFalse)
+}
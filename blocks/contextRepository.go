@@ -0,0 +1,289 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/keithballdotnet/blocker/config"
+)
+
+/* Context adapter */
+
+// ContextBlockRepository adapts a LegacyBlockRepository to the BlockRepository interface.
+// Each call runs in its own goroutine so the caller is released as soon as the context is done.
+// The legacy call itself can not be stopped and is left to finish in the background, so the providers of this
+// package take the context themselves and only providers which can not are adapted.
+type ContextBlockRepository struct {
+	repository LegacyBlockRepository
+}
+
+// NewContextBlockRepository - Creates a BlockRepository from a LegacyBlockRepository
+func NewContextBlockRepository(repository LegacyBlockRepository) ContextBlockRepository {
+	return ContextBlockRepository{repository}
+}
+
+// SaveBlock saves the block unless the context is done first
+func (r ContextBlockRepository) SaveBlock(ctx context.Context, bytes []byte, blockHash string) error {
+	_, err := runWithContext(ctx, func() (interface{}, error) {
+		return nil, r.repository.SaveBlock(bytes, blockHash)
+	})
+
+	return err
+}
+
+// GetBlock gets the block unless the context is done first
+func (r ContextBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	result, err := runWithContext(ctx, func() (interface{}, error) {
+		return r.repository.GetBlock(blockHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.([]byte), nil
+}
+
+// CheckBlockExists checks for the block unless the context is done first
+func (r ContextBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	result, err := runWithContext(ctx, func() (interface{}, error) {
+		return r.repository.CheckBlockExists(blockHash)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return result.(bool), nil
+}
+
+// DeleteBlock deletes the block unless the context is done first
+func (r ContextBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	_, err := runWithContext(ctx, func() (interface{}, error) {
+		return nil, r.repository.DeleteBlock(blockHash)
+	})
+
+	return err
+}
+
+// PutBlock streams the block into the repository unless the context is done first.
+// Repositories which can not stream get the block buffered.
+func (r ContextBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	data = contextReader{ctx, data}
+
+	streamingRepository, ok := r.repository.(LegacyStreamingBlockRepository)
+	if !ok {
+		buffer, err := ioutil.ReadAll(data)
+		if err != nil {
+			return err
+		}
+
+		return r.SaveBlock(ctx, buffer, blockHash)
+	}
+
+	_, err := runWithContext(ctx, func() (interface{}, error) {
+		return nil, streamingRepository.PutBlock(blockHash, data, size)
+	})
+
+	return err
+}
+
+// OpenBlock opens the block for reading unless the context is done first.
+// Reading stops with the context error once the context is done.
+func (r ContextBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	streamingRepository, ok := r.repository.(LegacyStreamingBlockRepository)
+	if !ok {
+		data, err := r.GetBlock(ctx, blockHash)
+		if err != nil {
+			return nil, err
+		}
+
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	result, err := runWithContext(ctx, func() (interface{}, error) {
+		return streamingRepository.OpenBlock(blockHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body := result.(io.ReadCloser)
+
+	return contextReadCloser{contextReader{ctx, body}, body}, nil
+}
+
+// OpenBlockRange streams part of a block, reading only that part if the repository can
+func (r ContextBlockRepository) OpenBlockRange(ctx context.Context, blockHash string, offset int64, length int64) (io.ReadCloser, error) {
+	rangeRepository, ok := r.repository.(LegacyRangeBlockRepository)
+	if !ok {
+		body, err := r.OpenBlock(ctx, blockHash)
+		if err != nil {
+			return nil, err
+		}
+
+		return skipToRange(body, offset, length)
+	}
+
+	result, err := runWithContext(ctx, func() (interface{}, error) {
+		return rangeRepository.OpenBlockRange(blockHash, offset, length)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body := result.(io.ReadCloser)
+
+	return contextReadCloser{contextReader{ctx, body}, body}, nil
+}
+
+// contextReader stops reading once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+type contextReadCloser struct {
+	contextReader
+	io.Closer
+}
+
+type contextResult struct {
+	value interface{}
+	err   error
+}
+
+// runWithContext runs fn and returns its result, or the context error if the context is done first
+func runWithContext(ctx context.Context, fn func() (interface{}, error)) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Buffered so the goroutine can always finish even when nobody is waiting anymore
+	done := make(chan contextResult, 1)
+
+	go func() {
+		value, err := fn()
+		done <- contextResult{value, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+/* Timeouts */
+
+// TimeoutBlockRepository limits how long each operation on a BlockRepository may take
+type TimeoutBlockRepository struct {
+	repository BlockRepository
+	timeouts   config.TimeoutConfig
+}
+
+// NewTimeoutBlockRepository - Creates a BlockRepository applying the timeouts to every operation
+func NewTimeoutBlockRepository(repository BlockRepository, timeouts config.TimeoutConfig) TimeoutBlockRepository {
+	return TimeoutBlockRepository{repository, timeouts}
+}
+
+// SaveBlock saves the block within the save timeout
+func (r TimeoutBlockRepository) SaveBlock(ctx context.Context, bytes []byte, blockHash string) error {
+	ctx, cancel := withTimeout(ctx, r.timeouts.Save)
+	defer cancel()
+
+	return r.repository.SaveBlock(ctx, bytes, blockHash)
+}
+
+// GetBlock gets the block within the get timeout
+func (r TimeoutBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, r.timeouts.Get)
+	defer cancel()
+
+	return r.repository.GetBlock(ctx, blockHash)
+}
+
+// CheckBlockExists checks for the block within the exists timeout
+func (r TimeoutBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	ctx, cancel := withTimeout(ctx, r.timeouts.Exists)
+	defer cancel()
+
+	return r.repository.CheckBlockExists(ctx, blockHash)
+}
+
+// DeleteBlock deletes the block within the delete timeout
+func (r TimeoutBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	ctx, cancel := withTimeout(ctx, r.timeouts.Delete)
+	defer cancel()
+
+	return r.repository.DeleteBlock(ctx, blockHash)
+}
+
+// PutBlock streams the block into the repository within the save timeout
+func (r TimeoutBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	ctx, cancel := withTimeout(ctx, r.timeouts.Save)
+	defer cancel()
+
+	return r.repository.PutBlock(ctx, blockHash, data, size)
+}
+
+// OpenBlock opens the block for reading.  The get timeout covers reading the block until it is closed.
+func (r TimeoutBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	ctx, cancel := withTimeout(ctx, r.timeouts.Get)
+
+	body, err := r.repository.OpenBlock(ctx, blockHash)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return cancelReadCloser{body, cancel}, nil
+}
+
+// OpenBlockRange streams part of a block within the get timeout
+func (r TimeoutBlockRepository) OpenBlockRange(ctx context.Context, blockHash string, offset int64, length int64) (io.ReadCloser, error) {
+	ctx, cancel := withTimeout(ctx, r.timeouts.Get)
+
+	body, err := OpenBlockRange(ctx, r.repository, blockHash, offset, length)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return cancelReadCloser{body, cancel}, nil
+}
+
+// cancelReadCloser releases the context of the reader when it is closed
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r cancelReadCloser) Close() error {
+	defer r.cancel()
+
+	return r.ReadCloser.Close()
+}
+
+func (r TimeoutBlockRepository) reportStatus(status *RepositoryStatus) {
+	reportStatus(r.repository, status)
+}
+
+// withTimeout returns a context limited by the timeout.  A zero timeout leaves the context as it is.
+func withTimeout(ctx context.Context, timeout config.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Duration(timeout))
+}
@@ -0,0 +1,144 @@
+package blocks
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// hangingBlockRepository is a LegacyBlockRepository whose calls never return until released
+type hangingBlockRepository struct {
+	release chan struct{}
+}
+
+func (r hangingBlockRepository) SaveBlock(bytes []byte, blockHash string) error {
+	<-r.release
+	return nil
+}
+
+func (r hangingBlockRepository) GetBlock(blockHash string) ([]byte, error) {
+	<-r.release
+	return []byte(blockHash), nil
+}
+
+func (r hangingBlockRepository) CheckBlockExists(blockHash string) (bool, error) {
+	<-r.release
+	return true, nil
+}
+
+func (r hangingBlockRepository) DeleteBlock(blockHash string) error {
+	<-r.release
+	return nil
+}
+
+func (s *BlockSuite) TestContextBlockRepositoryReturnsResults(c *C) {
+	legacy := hangingBlockRepository{make(chan struct{})}
+	close(legacy.release)
+
+	repository := NewContextBlockRepository(legacy)
+
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "hash")
+
+	exists, err := repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsTrue)
+}
+
+func (s *BlockSuite) TestContextBlockRepositoryReturnsWhenCancelled(c *C) {
+	legacy := hangingBlockRepository{make(chan struct{})}
+	defer close(legacy.release)
+
+	repository := NewContextBlockRepository(legacy)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := repository.GetBlock(cancelled, "hash")
+	c.Assert(err == context.Canceled, IsTrue, Commentf("Unexpected error: %v", err))
+}
+
+func (s *BlockSuite) TestTimeoutBlockRepository(c *C) {
+	legacy := hangingBlockRepository{make(chan struct{})}
+	defer close(legacy.release)
+
+	repository := NewTimeoutBlockRepository(NewContextBlockRepository(legacy), config.TimeoutConfig{
+		Save:   config.Duration(10 * time.Millisecond),
+		Get:    config.Duration(10 * time.Millisecond),
+		Exists: config.Duration(10 * time.Millisecond),
+		Delete: config.Duration(10 * time.Millisecond),
+	})
+
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == context.DeadlineExceeded, IsTrue, Commentf("Unexpected error: %v", err))
+
+	_, err = repository.GetBlock(ctx, "hash")
+	c.Assert(err == context.DeadlineExceeded, IsTrue, Commentf("Unexpected error: %v", err))
+
+	_, err = repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == context.DeadlineExceeded, IsTrue, Commentf("Unexpected error: %v", err))
+
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err == context.DeadlineExceeded, IsTrue, Commentf("Unexpected error: %v", err))
+}
+
+func (s *BlockSuite) TestOpenBlockRangeWithoutRangeSupport(c *C) {
+	repository := NewMemoryBlockRepository()
+	repository.SaveBlock(ctx, []byte("0123456789"), "hash")
+
+	body, err := OpenBlockRange(ctx, repository, "hash", 3, 4)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer body.Close()
+
+	data, _ := ioutil.ReadAll(body)
+	c.Assert(string(data), Equals, "3456")
+}
+
+func (s *BlockSuite) TestProvidersStopWithContext(c *C) {
+	// A store which never answers until the test is over
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	s3Repository, err := NewS3BlockRepository(s3TestConfig(server.URL))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	azureCfg := azureTestConfig(server.URL)
+	azureCfg.CreateContainer = false
+	azureRepository, err := NewAzureBlockRepository(azureCfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	for name, repository := range map[string]BlockRepository{"s3": s3Repository, "azure": azureRepository} {
+		timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		err := repository.SaveBlock(timeout, []byte("blob"), "hash")
+		cancel()
+		c.Assert(errors.Is(err, context.DeadlineExceeded), IsTrue, Commentf("%s failed with: %v", name, err))
+	}
+
+	// A block written to disk when the context is done is not left behind
+	disk, err := NewDiskBlockRepository(config.DiskConfig{Directory: c.MkDir()})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = disk.PutBlock(cancelled, "abcdef", strings.NewReader("blob"), 4)
+	c.Assert(err == context.Canceled, IsTrue, Commentf("Unexpected error: %v", err))
+
+	exists, _ := disk.CheckBlockExists(ctx, "abcdef")
+	c.Assert(exists, IsFalse)
+}
@@ -0,0 +1,240 @@
+package blocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/couchbase/gomemcached"
+	memcached "github.com/couchbase/gomemcached/client"
+	"github.com/couchbaselabs/go-couchbase"
+	"github.com/keithballdotnet/blocker/config"
+)
+
+// Defaults of the couchbase settings
+const (
+	defaultCouchbasePool   = "default"
+	defaultCouchbaseBucket = "blocker"
+	// defaultCouchbaseMaxItemSize is the largest value couchbase accepts, 20Mb
+	defaultCouchbaseMaxItemSize = 20971520
+)
+
+// couchbaseManifestMagic starts the value of a block which was split across several keys
+var couchbaseManifestMagic = []byte("blocker:manifest\x00")
+
+// couchbaseManifest lists the parts of a split block
+type couchbaseManifest struct {
+	Size  int `json:"size"`
+	Parts int `json:"parts"`
+}
+
+// couchbaseBucket is the part of a couchbase bucket the block repository uses
+type couchbaseBucket interface {
+	SetRaw(k string, exp int, v []byte) error
+	GetRaw(k string) ([]byte, error)
+	Delete(k string) error
+	Observe(k string) (memcached.ObserveResult, error)
+}
+
+// openCouchbaseBucket connects to the configured bucket, with its password if it has one
+func openCouchbaseBucket(cfg config.CouchbaseConfig) (*couchbase.Bucket, error) {
+	pool, bucket := cfg.Pool, cfg.Bucket
+	if pool == "" {
+		pool = defaultCouchbasePool
+	}
+	if bucket == "" {
+		bucket = defaultCouchbaseBucket
+	}
+
+	if cfg.Password == "" {
+		return couchbase.GetBucket(cfg.Host, pool, bucket)
+	}
+
+	// Buckets are authenticated with their own name and password
+	client, err := couchbase.ConnectWithAuthCreds(cfg.Host, bucket, cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	couchbasePool, err := client.GetPool(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	return couchbasePool.GetBucketWithAuth(bucket, bucket, cfg.Password)
+}
+
+/* CouchBase BLOCK Provider */
+
+// CouchBaseBlockRepository keeps blocks as raw values in couchbase.
+// Blocks larger than the biggest value couchbase takes are split into parts, found through a manifest kept under the block hash.
+type CouchBaseBlockRepository struct {
+	bucket      couchbaseBucket
+	maxItemSize int
+}
+
+// NewCouchBaseBlockRepository - Creates a repository storing blocks in couchbase
+func NewCouchBaseBlockRepository(cfg config.CouchbaseConfig) (CouchBaseBlockRepository, error) {
+
+	couchbaseAddress := cfg.Host
+
+	bucket, err := openCouchbaseBucket(cfg)
+	if err != nil {
+		log.Println(fmt.Sprintf("Error getting bucket:  %v", err))
+		return CouchBaseBlockRepository{}, err
+	}
+
+	log.Printf("NewCouchBaseBlockRepository: Connected to Couchbase Server: %s\n", couchbaseAddress)
+
+	return newCouchBaseBlockRepository(bucket, cfg.MaxItemSize), nil
+}
+
+func newCouchBaseBlockRepository(bucket couchbaseBucket, maxItemSize int64) CouchBaseBlockRepository {
+	if maxItemSize <= 0 {
+		maxItemSize = defaultCouchbaseMaxItemSize
+	}
+
+	return CouchBaseBlockRepository{bucket: bucket, maxItemSize: int(maxItemSize)}
+}
+
+// Save persists a block into the repository, splitting it if it is too large for a single value
+func (r CouchBaseBlockRepository) SaveBlock(data []byte, blockHash string) error {
+	if r.bucket == nil {
+		return errors.New("No couchbase bucket!")
+	}
+
+	// A block which looks like a manifest is split too, so it is not mistaken for one when read
+	if len(data) <= r.maxItemSize && !bytes.HasPrefix(data, couchbaseManifestMagic) {
+		return r.bucket.SetRaw(blockHash, 0, data)
+	}
+
+	manifest := couchbaseManifest{Size: len(data)}
+
+	// The parts are written first, so a manifest never lists a missing part
+	for offset := 0; offset < len(data) || manifest.Parts == 0; offset += r.maxItemSize {
+		end := offset + r.maxItemSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := r.bucket.SetRaw(couchbasePartKey(blockHash, manifest.Parts), 0, data[offset:end]); err != nil {
+			return err
+		}
+
+		manifest.Parts++
+	}
+
+	value, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	return r.bucket.SetRaw(blockHash, 0, append(append([]byte(nil), couchbaseManifestMagic...), value...))
+}
+
+// Get a block from the repository, joining the parts of a split block
+func (r CouchBaseBlockRepository) GetBlock(blockHash string) ([]byte, error) {
+	if r.bucket == nil {
+		return nil, errors.New("No couchbase bucket!")
+	}
+
+	// Get data...
+	data, err := r.bucket.GetRaw(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, ok, err := readCouchbaseManifest(data)
+	if err != nil || !ok {
+		return data, err
+	}
+
+	block := make([]byte, 0, manifest.Size)
+	for part := 0; part < manifest.Parts; part++ {
+		data, err := r.bucket.GetRaw(couchbasePartKey(blockHash, part))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get part %d of block %s: %v", part, blockHash, err)
+		}
+
+		block = append(block, data...)
+	}
+
+	if len(block) != manifest.Size {
+		return nil, fmt.Errorf("Block %s is %d bytes, expected %d", blockHash, len(block), manifest.Size)
+	}
+
+	return block, nil
+}
+
+// DeleteBlock - Deletes a block of data, and all the parts of a split block
+func (r CouchBaseBlockRepository) DeleteBlock(blockHash string) error {
+	if r.bucket == nil {
+		return errors.New("No couchbase bucket!")
+	}
+
+	data, err := r.bucket.GetRaw(blockHash)
+	if err != nil {
+		return err
+	}
+
+	manifest, ok, err := readCouchbaseManifest(data)
+	if err != nil {
+		return err
+	}
+
+	// The parts go first, so deleting again after a failure finds the manifest and finishes the job
+	if ok {
+		for part := 0; part < manifest.Parts; part++ {
+			if err := r.bucket.Delete(couchbasePartKey(blockHash, part)); err != nil && !isCouchbaseNotFound(err) {
+				return err
+			}
+		}
+	}
+
+	// Delete block
+	return r.bucket.Delete(blockHash)
+}
+
+// Check to see if a block exists
+func (r CouchBaseBlockRepository) CheckBlockExists(blockHash string) (bool, error) {
+	if r.bucket == nil {
+		return false, errors.New("No couchbase bucket!")
+	}
+
+	// Check to see if hash is present
+	result, err := r.bucket.Observe(blockHash)
+	// If the status is anything other than not found, then it's stored in couch base...
+	if err == nil && result.Status != memcached.ObservedNotFound {
+		return true, nil
+	}
+
+	// Couch base does not have the block
+	return false, nil
+}
+
+// couchbasePartKey is the key a part of a split block is kept under
+func couchbasePartKey(blockHash string, part int) string {
+	return fmt.Sprintf("%s.part%d", blockHash, part)
+}
+
+// readCouchbaseManifest reads the manifest of a split block.  Returns false when the value is a whole block.
+func readCouchbaseManifest(data []byte) (couchbaseManifest, bool, error) {
+	var manifest couchbaseManifest
+	if !bytes.HasPrefix(data, couchbaseManifestMagic) {
+		return manifest, false, nil
+	}
+
+	if err := json.Unmarshal(data[len(couchbaseManifestMagic):], &manifest); err != nil {
+		return manifest, false, fmt.Errorf("Unable to read block manifest: %v", err)
+	}
+
+	return manifest, true, nil
+}
+
+// isCouchbaseNotFound checks if couchbase did not have the key
+func isCouchbaseNotFound(err error) bool {
+	var response *gomemcached.MCResponse
+	return errors.As(err, &response) && response.Status == gomemcached.KEY_ENOENT
+}
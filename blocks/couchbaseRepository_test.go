@@ -0,0 +1,145 @@
+package blocks
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/gomemcached"
+	memcached "github.com/couchbase/gomemcached/client"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// fakeCouchbaseBucket keeps values in memory and, like couchbase, refuses values over its item size
+type fakeCouchbaseBucket struct {
+	lock        sync.Mutex
+	values      map[string][]byte
+	maxItemSize int
+}
+
+func newFakeCouchbaseBucket(maxItemSize int) *fakeCouchbaseBucket {
+	return &fakeCouchbaseBucket{values: make(map[string][]byte), maxItemSize: maxItemSize}
+}
+
+func (b *fakeCouchbaseBucket) SetRaw(k string, exp int, v []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(v) > b.maxItemSize {
+		return &gomemcached.MCResponse{Status: gomemcached.E2BIG, Key: []byte(k)}
+	}
+
+	b.values[k] = append([]byte(nil), v...)
+	return nil
+}
+
+func (b *fakeCouchbaseBucket) GetRaw(k string) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	v, ok := b.values[k]
+	if !ok {
+		return nil, &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT, Key: []byte(k)}
+	}
+
+	return v, nil
+}
+
+func (b *fakeCouchbaseBucket) Delete(k string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.values[k]; !ok {
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT, Key: []byte(k)}
+	}
+
+	delete(b.values, k)
+	return nil
+}
+
+func (b *fakeCouchbaseBucket) Observe(k string) (memcached.ObserveResult, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.values[k]; !ok {
+		return memcached.ObserveResult{Status: memcached.ObservedNotFound}, nil
+	}
+
+	return memcached.ObserveResult{Status: memcached.ObservedPersisted}, nil
+}
+
+func (s *BlockSuite) TestCouchBaseBlockRepositorySplitsLargeBlocks(c *C) {
+	// The manifest takes more room than the parts
+	bucket := newFakeCouchbaseBucket(64)
+	repository := newCouchBaseBlockRepository(bucket, 10)
+
+	// Small blocks are kept whole
+	err := repository.SaveBlock([]byte("small"), "small")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(bucket.values["small"]), Equals, "small")
+
+	large := []byte(strings.Repeat("0123456789", 2) + "01234")
+	err = repository.SaveBlock(large, "large")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(bucket.values, HasLen, 5)
+	c.Assert(string(bucket.values["large.part2"]), Equals, "01234")
+
+	for blockHash, expected := range map[string][]byte{"small": []byte("small"), "large": large} {
+		data, err := repository.GetBlock(blockHash)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(bytes.Equal(data, expected), IsTrue, Commentf("Block: %s", blockHash))
+
+		exists, err := repository.CheckBlockExists(blockHash)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(exists, IsTrue)
+	}
+
+	// Every part is deleted
+	err = repository.DeleteBlock("large")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(bucket.values, HasLen, 1)
+
+	exists, err := repository.CheckBlockExists("large")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsFalse)
+}
+
+func (s *BlockSuite) TestCouchBaseBlockRepositoryBlockLikeManifest(c *C) {
+	bucket := newFakeCouchbaseBucket(1024)
+	repository := newCouchBaseBlockRepository(bucket, 1024)
+
+	// A block which happens to start like a manifest is still read back as it was saved
+	block := append(append([]byte(nil), couchbaseManifestMagic...), []byte(`{"size":1,"parts":7}`)...)
+	err := repository.SaveBlock(block, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	data, err := repository.GetBlock("hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(bytes.Equal(data, block), IsTrue)
+
+	// An empty block is kept whole
+	err = repository.SaveBlock(nil, "empty")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	data, err = repository.GetBlock("empty")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(data, HasLen, 0)
+}
+
+func (s *BlockSuite) TestCouchBaseBlockRepositoryMissingPart(c *C) {
+	bucket := newFakeCouchbaseBucket(64)
+	repository := newCouchBaseBlockRepository(bucket, 4)
+
+	err := repository.SaveBlock([]byte("0123456789"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	delete(bucket.values, "hash.part1")
+
+	_, err = repository.GetBlock("hash")
+	c.Assert(err != nil, IsTrue)
+
+	// Deleting skips the missing part
+	err = repository.DeleteBlock("hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(bucket.values, HasLen, 0)
+}
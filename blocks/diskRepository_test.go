@@ -0,0 +1,105 @@
+package blocks
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BlockSuite) TestDiskBlockRepositoryWritesAtomically(c *C) {
+	repository, err := NewDiskBlockRepository(config.DiskConfig{Directory: c.MkDir(), FileMode: 0600, DirMode: 0750})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = repository.SaveBlock(ctx, []byte("blob"), "abcdef")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = repository.PutBlock(ctx, "abcxyz", strings.NewReader("streamed"), -1)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Only the block files are left in the directory
+	files, err := ioutil.ReadDir(filepath.Join(repository.path, "a", "b"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(files, HasLen, 2)
+
+	for _, file := range files {
+		c.Assert(filepath.Ext(file.Name()), Equals, ".blk")
+		c.Assert(file.Mode().Perm(), Equals, os.FileMode(0600))
+	}
+
+	info, err := os.Stat(filepath.Join(repository.path, "a"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(info.Mode().Perm()&^0750, Equals, os.FileMode(0))
+
+	data, err := repository.GetBlock(ctx, "abcxyz")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "streamed")
+}
+
+func (s *BlockSuite) TestDiskBlockRepositoryFailedWriteLeavesNothing(c *C) {
+	repository, err := NewDiskBlockRepository(config.DiskConfig{Directory: c.MkDir()})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = repository.PutBlock(ctx, "abcdef", &faultyReader{}, -1)
+	c.Assert(err != nil, IsTrue)
+
+	exists, err := repository.CheckBlockExists(ctx, "abcdef")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsFalse)
+
+	files, _ := ioutil.ReadDir(filepath.Join(repository.path, "a", "b"))
+	c.Assert(files, HasLen, 0)
+}
+
+func (s *BlockSuite) TestDiskBlockRepositoryQuarantinesPartialFiles(c *C) {
+	cfg := config.DiskConfig{Directory: c.MkDir()}
+	repository, err := NewDiskBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	repository.SaveBlock(ctx, []byte("whole"), "abwhole")
+
+	// Leave behind what a crash would
+	blockDirectory := filepath.Join(repository.path, "a", "b")
+	ioutil.WriteFile(filepath.Join(blockDirectory, "abtorn.blk.123.tmp"), []byte("to"), 0644)
+	ioutil.WriteFile(filepath.Join(blockDirectory, "abempty.blk"), nil, 0644)
+
+	repository, err = NewDiskBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	exists, _ := repository.CheckBlockExists(ctx, "abempty")
+	c.Assert(exists, IsFalse)
+
+	exists, _ = repository.CheckBlockExists(ctx, "abwhole")
+	c.Assert(exists, IsTrue)
+
+	quarantined, err := ioutil.ReadDir(filepath.Join(repository.path, quarantineDirectory))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(quarantined, HasLen, 2)
+}
+
+func (s *BlockSuite) TestDiskBlockRepositoryRejectsShortHash(c *C) {
+	repository, err := NewDiskBlockRepository(config.DiskConfig{Directory: c.MkDir()})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = repository.SaveBlock(ctx, []byte("blob"), "a")
+	c.Assert(err != nil, IsTrue)
+}
+
+// faultyReader returns some data then fails, like a client going away mid upload
+type faultyReader struct {
+	read bool
+}
+
+func (r *faultyReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, errors.New("Connection reset")
+	}
+
+	r.read = true
+	return copy(p, "partial"), nil
+}
@@ -0,0 +1,451 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// erasureHeaderSize is the size of the header in front of every shard.
+// The header holds the size of the block followed by a sha256 of the size and the shard.
+const erasureHeaderSize = 8 + sha256.Size
+
+// ErasureStatus reports the shape and health of an erasure coded repository
+type ErasureStatus struct {
+	DataShards   int `json:"dataShards"`
+	ParityShards int `json:"parityShards"`
+	// DegradedReads counts blocks read with shards missing or corrupt
+	DegradedReads int64 `json:"degradedReads"`
+	// RepairedShards counts shards rewritten by Repair
+	RepairedShards int64 `json:"repairedShards"`
+	// PendingRepairs is the number of blocks which may have shards missing or corrupt
+	PendingRepairs int `json:"pendingRepairs"`
+}
+
+// ErasureBlockRepository splits every block into data and parity shards using Reed-Solomon erasure coding.
+// Each shard is kept in its own repository, so a block survives losing as many repositories as there are parity shards.
+// Blocks found with shards missing or corrupt are queued and repaired in the background.
+type ErasureBlockRepository struct {
+	shards       []BlockRepository
+	dataShards   int
+	parityShards int
+	encoder      reedsolomon.Encoder
+
+	lock    sync.Mutex
+	status  ErasureStatus
+	repairs map[string]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewErasureBlockRepository - Creates a repository coding blocks into dataShards and parityShards.
+// There must be one repository for each shard.  Background repair runs every repairInterval unless it is zero.
+func NewErasureBlockRepository(shards []BlockRepository, dataShards int, parityShards int, repairInterval time.Duration) (*ErasureBlockRepository, error) {
+	if len(shards) != dataShards+parityShards {
+		return nil, fmt.Errorf("Need %d repositories for %d data and %d parity shards, got %d", dataShards+parityShards, dataShards, parityShards, len(shards))
+	}
+
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ErasureBlockRepository{
+		shards:       shards,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		encoder:      encoder,
+		status:       ErasureStatus{DataShards: dataShards, ParityShards: parityShards},
+		repairs:      make(map[string]struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if repairInterval > 0 {
+		go r.repairLoop(repairInterval)
+	}
+
+	return r, nil
+}
+
+// Status returns the shape of the repository and how often it has been degraded
+func (r *ErasureBlockRepository) Status() ErasureStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status := r.status
+	status.PendingRepairs = len(r.repairs)
+
+	return status
+}
+
+func (r *ErasureBlockRepository) reportStatus(status *RepositoryStatus) {
+	erasure := r.Status()
+	status.Erasure = &erasure
+}
+
+// SaveBlock codes the block and saves every shard.  The block is only saved once every shard is, otherwise the
+// shards which were saved are deleted again.
+func (r *ErasureBlockRepository) SaveBlock(ctx context.Context, data []byte, blockHash string) error {
+	// Split uses the slice it is given for the data shards, so give it a copy
+	block := make([]byte, len(data))
+	copy(block, data)
+
+	shards, err := r.encoder.Split(block)
+	if err != nil {
+		return err
+	}
+
+	if err := r.encoder.Encode(shards); err != nil {
+		return err
+	}
+
+	errs := r.eachShard(func(i int, repository BlockRepository) error {
+		return repository.SaveBlock(ctx, encodeShard(shards[i], len(data)), shardHash(blockHash, i))
+	})
+
+	err = r.joinErrors(errs)
+	if err != nil {
+		// The shards are deleted even when the save was given up
+		r.deleteSavedShards(context.WithoutCancel(ctx), blockHash, errs)
+	}
+
+	return err
+}
+
+// deleteSavedShards deletes the shards of a block which failed to save, so they are not left behind
+func (r *ErasureBlockRepository) deleteSavedShards(ctx context.Context, blockHash string, saveErrs []error) {
+	errs := r.eachShard(func(i int, repository BlockRepository) error {
+		if saveErrs[i] != nil {
+			return nil
+		}
+
+		return repository.DeleteBlock(ctx, shardHash(blockHash, i))
+	})
+
+	if err := r.joinErrors(errs); err != nil {
+		log.Printf("Unable to delete the shards of unsaved block %s: %v", blockHash, err)
+	}
+}
+
+// PutBlock reads the block and saves it as shards
+func (r *ErasureBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	block, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	return r.SaveBlock(ctx, block, blockHash)
+}
+
+// GetBlock reads the shards and joins the block, reconstructing missing or corrupt data shards
+func (r *ErasureBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	shards, size, missing, err := r.readShards(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if missing > 0 {
+		log.Printf("Block %s is missing %d shards, reconstructing", blockHash, missing)
+
+		r.lock.Lock()
+		r.status.DegradedReads++
+		r.repairs[blockHash] = struct{}{}
+		r.lock.Unlock()
+
+		if err := r.encoder.ReconstructData(shards); err != nil {
+			return nil, err
+		}
+	}
+
+	var block bytes.Buffer
+	if err := r.encoder.Join(&block, shards, size); err != nil {
+		return nil, err
+	}
+
+	return block.Bytes(), nil
+}
+
+// OpenBlock joins the block in memory, as every shard is needed before any of the block can be read
+func (r *ErasureBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	block, err := r.GetBlock(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(block)), nil
+}
+
+// CheckBlockExists checks enough shards exist to read the block.  Blocks missing shards are queued for repair.
+func (r *ErasureBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	var lock sync.Mutex
+	found := 0
+
+	errs := r.eachShard(func(i int, repository BlockRepository) error {
+		exists, err := repository.CheckBlockExists(ctx, shardHash(blockHash, i))
+		if exists {
+			lock.Lock()
+			found++
+			lock.Unlock()
+		}
+		return err
+	})
+
+	if found >= r.dataShards {
+		if found < len(r.shards) {
+			r.queueRepair(blockHash)
+		}
+		return true, nil
+	}
+
+	return false, r.joinErrors(errs)
+}
+
+// DeleteBlock deletes every shard of the block.  Shards which are already missing are skipped.
+func (r *ErasureBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	r.lock.Lock()
+	delete(r.repairs, blockHash)
+	r.lock.Unlock()
+
+	errs := r.eachShard(func(i int, repository BlockRepository) error {
+		exists, err := repository.CheckBlockExists(ctx, shardHash(blockHash, i))
+		if err != nil || !exists {
+			return err
+		}
+
+		return repository.DeleteBlock(ctx, shardHash(blockHash, i))
+	})
+
+	return r.joinErrors(errs)
+}
+
+// Repair rewrites any missing or corrupt shards of the block.  Returns the number of shards repaired.
+func (r *ErasureBlockRepository) Repair(ctx context.Context, blockHash string) (int, error) {
+	shards, size, missing, err := r.readShards(ctx, blockHash)
+	if err != nil {
+		return 0, err
+	}
+
+	if missing == 0 {
+		return 0, nil
+	}
+
+	// Note which shards were missing before they are reconstructed
+	damaged := make([]bool, len(shards))
+	for i, shard := range shards {
+		damaged[i] = shard == nil
+	}
+
+	if err := r.encoder.Reconstruct(shards); err != nil {
+		return 0, err
+	}
+
+	repaired := 0
+	for i, repository := range r.shards {
+		if !damaged[i] {
+			continue
+		}
+
+		if err := repository.SaveBlock(ctx, encodeShard(shards[i], size), shardHash(blockHash, i)); err != nil {
+			return repaired, fmt.Errorf("shard %d: %v", i, err)
+		}
+
+		repaired++
+	}
+
+	log.Printf("Repaired %d shards of block %s", repaired, blockHash)
+
+	r.lock.Lock()
+	r.status.RepairedShards += int64(repaired)
+	r.lock.Unlock()
+
+	return repaired, nil
+}
+
+func (r *ErasureBlockRepository) repairBlock(ctx context.Context, blockHash string) (int, error) {
+	return r.Repair(ctx, blockHash)
+}
+
+// RepairPending repairs every block queued for repair.  Blocks which can not be repaired stay queued.
+func (r *ErasureBlockRepository) RepairPending(ctx context.Context) error {
+	r.lock.Lock()
+	pending := make([]string, 0, len(r.repairs))
+	for blockHash := range r.repairs {
+		pending = append(pending, blockHash)
+	}
+	r.lock.Unlock()
+
+	var errs []error
+	for _, blockHash := range pending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if _, err := r.Repair(ctx, blockHash); err != nil {
+			errs = append(errs, fmt.Errorf("Block %s: %v", blockHash, err))
+			continue
+		}
+
+		r.lock.Lock()
+		delete(r.repairs, blockHash)
+		r.lock.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close stops the background repair and closes the shard repositories
+func (r *ErasureBlockRepository) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+
+	var errs []error
+	for i, repository := range r.shards {
+		if closer, ok := repository.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("shard %d: %v", i, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r *ErasureBlockRepository) queueRepair(blockHash string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.repairs[blockHash] = struct{}{}
+}
+
+// repairLoop repairs the queued blocks every interval until the repository is closed
+func (r *ErasureBlockRepository) repairLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.RepairPending(context.Background()); err != nil {
+				log.Printf("Unable to repair all blocks: %v", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// readShards reads every shard of the block.  Missing and corrupt shards are left nil.
+// Returns the shards, the size of the block and the number of shards missing.
+func (r *ErasureBlockRepository) readShards(ctx context.Context, blockHash string) ([][]byte, int, int, error) {
+	shards := make([][]byte, len(r.shards))
+	sizes := make([]int, len(r.shards))
+
+	errs := r.eachShard(func(i int, repository BlockRepository) error {
+		data, err := repository.GetBlock(ctx, shardHash(blockHash, i))
+		if err != nil {
+			return err
+		}
+
+		shards[i], sizes[i], err = decodeShard(data)
+		return err
+	})
+
+	size := -1
+	missing := 0
+	for i, shard := range shards {
+		if shard == nil {
+			missing++
+			continue
+		}
+		size = sizes[i]
+	}
+
+	if missing > r.parityShards {
+		return nil, 0, 0, fmt.Errorf("Block %s has %d of %d shards, %d needed: %v", blockHash, len(shards)-missing, len(shards), r.dataShards, r.joinErrors(errs))
+	}
+
+	return shards, size, missing, nil
+}
+
+// eachShard runs the operation on every shard repository at once and returns the error of each
+func (r *ErasureBlockRepository) eachShard(operation func(int, BlockRepository) error) []error {
+	errs := make([]error, len(r.shards))
+
+	var wait sync.WaitGroup
+	for i, repository := range r.shards {
+		wait.Add(1)
+		go func(i int, repository BlockRepository) {
+			defer wait.Done()
+			errs[i] = operation(i, repository)
+		}(i, repository)
+	}
+	wait.Wait()
+
+	return errs
+}
+
+func (r *ErasureBlockRepository) joinErrors(errs []error) error {
+	var named []error
+	for i, err := range errs {
+		if err != nil {
+			named = append(named, fmt.Errorf("shard %d: %v", i, err))
+		}
+	}
+
+	return errors.Join(named...)
+}
+
+// shardHash is the hash a shard of the block is stored under
+func shardHash(blockHash string, shard int) string {
+	return fmt.Sprintf("%s.%d", blockHash, shard)
+}
+
+// encodeShard puts the header in front of the shard
+func encodeShard(shard []byte, size int) []byte {
+	data := make([]byte, erasureHeaderSize+len(shard))
+	binary.BigEndian.PutUint64(data, uint64(size))
+	copy(data[erasureHeaderSize:], shard)
+
+	checksum := shardChecksum(data[:8], shard)
+	copy(data[8:erasureHeaderSize], checksum[:])
+
+	return data
+}
+
+// decodeShard checks the header and returns the shard and the size of the block
+func decodeShard(data []byte) ([]byte, int, error) {
+	if len(data) < erasureHeaderSize {
+		return nil, 0, errors.New("Shard is too short")
+	}
+
+	shard := data[erasureHeaderSize:]
+	checksum := shardChecksum(data[:8], shard)
+	if !bytes.Equal(checksum[:], data[8:erasureHeaderSize]) {
+		return nil, 0, errors.New("Shard checksum does not match")
+	}
+
+	return shard, int(binary.BigEndian.Uint64(data)), nil
+}
+
+func shardChecksum(size []byte, shard []byte) [sha256.Size]byte {
+	hash := sha256.New()
+	hash.Write(size)
+	hash.Write(shard)
+
+	var checksum [sha256.Size]byte
+	copy(checksum[:], hash.Sum(nil))
+
+	return checksum
+}
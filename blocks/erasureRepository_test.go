@@ -0,0 +1,187 @@
+package blocks
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// newErasure returns an erasure repository keeping its shards in memory repositories
+func newErasure(c *C, dataShards int, parityShards int) (*ErasureBlockRepository, []*MemoryBlockRepository) {
+	memories := make([]*MemoryBlockRepository, dataShards+parityShards)
+	shards := make([]BlockRepository, len(memories))
+	for i := range memories {
+		memories[i] = NewMemoryBlockRepository()
+		shards[i] = memories[i]
+	}
+
+	repository, err := NewErasureBlockRepository(shards, dataShards, parityShards, 0)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return repository, memories
+}
+
+func (s *BlockSuite) TestErasureBlockRepository(c *C) {
+	repository, memories := newErasure(c, 4, 2)
+
+	// Not a multiple of the data shards, so the last shard is padded
+	block := bytes.Repeat([]byte("erasure coded "), 1001)
+	err := repository.SaveBlock(ctx, block, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	for _, memory := range memories {
+		c.Assert(memory.Len(), Equals, 1)
+	}
+
+	exists, err := repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsTrue)
+
+	body, err := repository.OpenBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	c.Assert(bytes.Equal(data, block), IsTrue)
+	c.Assert(repository.Status().DegradedReads, Equals, int64(0))
+
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	for _, memory := range memories {
+		c.Assert(memory.Len(), Equals, 0)
+	}
+}
+
+func (s *BlockSuite) TestErasureReconstructsMissingShards(c *C) {
+	repository, memories := newErasure(c, 4, 2)
+
+	block := bytes.Repeat([]byte("0123456789"), 500)
+	err := repository.SaveBlock(ctx, block, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Lose one data shard and corrupt another
+	memories[0].SetFaults(MemoryFaults{Fail: true})
+	memories[2].CorruptBlock(shardHash("hash", 2))
+
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(bytes.Equal(data, block), IsTrue)
+	c.Assert(repository.Status().DegradedReads, Equals, int64(1))
+
+	// One more is more than the parity can cover
+	memories[5].SetFaults(MemoryFaults{Fail: true})
+	_, err = repository.GetBlock(ctx, "hash")
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *BlockSuite) TestErasureRepair(c *C) {
+	repository, memories := newErasure(c, 3, 2)
+
+	block := []byte("a block which is going to lose some shards")
+	err := repository.SaveBlock(ctx, block, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Nothing to do for a healthy block
+	repaired, err := repository.Repair(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repaired, Equals, 0)
+
+	// Lose a data and a parity shard
+	memories[1].DeleteBlock(ctx, shardHash("hash", 1))
+	memories[4].CorruptBlock(shardHash("hash", 4))
+
+	repaired, err = repository.Repair(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repaired, Equals, 2)
+	c.Assert(repository.Status().RepairedShards, Equals, int64(2))
+
+	// Every shard is whole again, so losing two more is survivable
+	memories[0].SetFaults(MemoryFaults{Fail: true})
+	memories[2].SetFaults(MemoryFaults{Fail: true})
+
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, string(block))
+}
+
+func (s *BlockSuite) TestErasureRepairsQueuedBlocks(c *C) {
+	repository, memories := newErasure(c, 3, 2)
+
+	err := repository.SaveBlock(ctx, []byte("a block read with a shard missing"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	memories[1].DeleteBlock(ctx, shardHash("hash", 1))
+
+	// Reading the block finds the missing shard and queues the block
+	_, err = repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Status().PendingRepairs, Equals, 1)
+
+	err = repository.RepairPending(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Status().PendingRepairs, Equals, 0)
+	c.Assert(memories[1].Len(), Equals, 1)
+}
+
+func (s *BlockSuite) TestErasureSaveFailureLeavesNoShards(c *C) {
+	repository, memories := newErasure(c, 3, 2)
+
+	memories[3].SetFaults(MemoryFaults{Fail: true})
+
+	err := repository.SaveBlock(ctx, []byte("a block which can not be saved"), "hash")
+	c.Assert(err != nil, IsTrue)
+
+	for _, memory := range memories {
+		c.Assert(memory.Len(), Equals, 0)
+	}
+}
+
+func (s *BlockSuite) TestFsckRepairsErasureShards(c *C) {
+	store, _ := newMemoryStore(c, testConfig())
+	repository, memories := newErasure(c, 4, 2)
+	store.BlockStore = repository
+
+	blockedFile, err := store.BlockBuffer(ctx, bytes.NewReader([]byte("a file whose shards are lost")))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	memories[0].DeleteBlock(ctx, shardHash(blockInfo.StoreID, 0))
+	memories[5].CorruptBlock(shardHash(blockInfo.StoreID, 5))
+
+	report, err := store.Fsck(ctx, FsckOptions{Repair: true})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.OK(), IsTrue)
+	c.Assert(report.RepairedCopies, Equals, 2)
+
+	// Every shard is whole again
+	repaired, err := repository.Repair(ctx, blockInfo.StoreID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repaired, Equals, 0)
+}
+
+func (s *BlockSuite) TestErasureNeedsRepositoryForEveryShard(c *C) {
+	_, err := NewErasureBlockRepository([]BlockRepository{NewMemoryBlockRepository()}, 2, 1, 0)
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *BlockSuite) TestStoreWithErasure(c *C) {
+	cfg := testConfig()
+	cfg.Storage.Provider = "erasure"
+	cfg.Storage.Erasure.Directories = []string{c.MkDir(), c.MkDir(), c.MkDir(), c.MkDir(), c.MkDir(), c.MkDir()}
+
+	store, err := NewStore(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	status := store.Status()
+	c.Assert(status.Erasure != nil, IsTrue)
+	c.Assert(status.Erasure.DataShards, Equals, 4)
+}
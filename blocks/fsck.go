@@ -0,0 +1,214 @@
+package blocks
+
+import (
+	"context"
+	"log"
+	"sort"
+)
+
+// FsckOptions controls how thoroughly Store.Fsck checks the store
+type FsckOptions struct {
+	// Verify reads every block and checks it against its hash.  Otherwise blocks are only checked to exist.
+	Verify bool
+	// Repair sets the use count of each block to the number of times files use it.  Repositories keeping blocks more
+	// than once, as replicas or erasure coded shards, also rewrite the copies of used blocks they have lost.
+	// Blocks saved before their sizes were recorded have them recorded, so they count towards the usage of tenants.
+	Repair bool
+}
+
+// FsckReport lists the problems found by Store.Fsck.  Blocks are identified by hash.
+type FsckReport struct {
+	// Files is the number of BlockedFiles checked
+	Files int `json:"files"`
+	// Blocks is the number of BlockInfo checked
+	Blocks int `json:"blocks"`
+	// MissingBlockInfo are blocks used by a file which have no BlockInfo
+	MissingBlockInfo []string `json:"missingBlockInfo,omitempty"`
+	// MissingBlocks are blocks not in the BlockStore
+	MissingBlocks []string `json:"missingBlocks,omitempty"`
+	// CorruptBlocks are blocks which do not match their hash
+	CorruptBlocks []string `json:"corruptBlocks,omitempty"`
+	// WrongUseCounts are blocks whose use count is not the number of times files use them
+	WrongUseCounts []string `json:"wrongUseCounts,omitempty"`
+	// Repaired is the number of use counts corrected
+	Repaired int `json:"repaired"`
+	// RepairedCopies is the number of replicas or shards of blocks rewritten
+	RepairedCopies int `json:"repairedCopies"`
+	// RecordedSizes is the number of blocks whose sizes were recorded
+	RecordedSizes int `json:"recordedSizes"`
+	// Orphans are blocks no file uses.  They take up space but do no harm.
+	Orphans []string `json:"orphans,omitempty"`
+}
+
+// OK reports whether every file can be read and every use count is right
+func (r FsckReport) OK() bool {
+	return len(r.MissingBlockInfo) == 0 && len(r.MissingBlocks) == 0 && len(r.CorruptBlocks) == 0 && len(r.WrongUseCounts) == r.Repaired
+}
+
+// Fsck checks the BlockedFiles, the BlockInfo and the blocks agree with each other.
+// Files saved or deleted while Fsck runs may be reported as problems, so a store should not be repaired while it is in use.
+func (s *Store) Fsck(ctx context.Context, options FsckOptions) (FsckReport, error) {
+	var report FsckReport
+
+	blockedFiles, err := s.BlockedFileStore.ListBlockedFiles()
+	if err != nil {
+		return report, err
+	}
+
+	blockInfos, err := s.BlockInfoStore.ListBlockInfo()
+	if err != nil {
+		return report, err
+	}
+
+	report.Files = len(blockedFiles)
+	report.Blocks = len(blockInfos)
+
+	// Count the times each block is used
+	uses := make(map[string]int64)
+	for _, blockedFile := range blockedFiles {
+		for _, fileBlock := range blockedFile.BlockList {
+			uses[fileBlock.Hash]++
+		}
+	}
+
+	known := make(map[string]bool, len(blockInfos))
+
+	for _, blockInfo := range blockInfos {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		known[blockInfo.Hash] = true
+
+		// The block of an orphan is never read, so is not checked.  A use count left on it is still wrong, as it
+		// keeps the block from being freed.
+		used := uses[blockInfo.Hash]
+		if used == 0 {
+			report.Orphans = append(report.Orphans, blockInfo.Hash)
+		} else if err := s.fsckUsedBlock(ctx, blockInfo, options, &report); err != nil {
+			return report, err
+		}
+
+		if blockInfo.UseCount == used {
+			continue
+		}
+
+		report.WrongUseCounts = append(report.WrongUseCounts, blockInfo.Hash)
+
+		if options.Repair {
+			log.Printf("Repairing use count of Hash: %v from %d to %d", blockInfo.Hash, blockInfo.UseCount, used)
+			if err := s.setUseCount(blockInfo.Hash, used); err != nil {
+				return report, err
+			}
+			report.Repaired++
+		}
+	}
+
+	for hash := range uses {
+		if !known[hash] {
+			report.MissingBlockInfo = append(report.MissingBlockInfo, hash)
+		}
+	}
+	sort.Strings(report.MissingBlockInfo)
+
+	// Files changed outside the store are what is repaired, so the usage of the tenants is counted again
+	if options.Repair {
+		s.resetUsage()
+	}
+
+	return report, nil
+}
+
+// fsckUsedBlock checks a block files use.  Repairing also rewrites its lost copies and records its sizes if they are not.
+func (s *Store) fsckUsedBlock(ctx context.Context, blockInfo BlockInfo, options FsckOptions, report *FsckReport) error {
+	if options.Repair {
+		// A block which can not be repaired is reported missing or corrupt below
+		repaired, err := repairBlock(ctx, s.BlockStore, blockInfo.StoreID)
+		if err != nil {
+			log.Printf("Unable to repair Hash: %v: %v", blockInfo.Hash, err)
+		}
+		report.RepairedCopies += repaired
+	}
+
+	if err := s.fsckBlock(ctx, blockInfo, options, report); err != nil {
+		return err
+	}
+
+	if options.Repair && blockInfo.StoredSize == 0 {
+		// A block which can not be read is reported missing or corrupt above
+		if err := s.recordSizes(ctx, blockInfo); err != nil {
+			log.Printf("Unable to record the sizes of Hash: %v: %v", blockInfo.Hash, err)
+		} else {
+			report.RecordedSizes++
+		}
+	}
+
+	return nil
+}
+
+// fsckBlock checks the block is in the BlockStore, and matches its hash when verifying
+func (s *Store) fsckBlock(ctx context.Context, blockInfo BlockInfo, options FsckOptions, report *FsckReport) error {
+	if !options.Verify {
+		exists, err := s.BlockStore.CheckBlockExists(ctx, blockInfo.StoreID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			report.MissingBlocks = append(report.MissingBlocks, blockInfo.Hash)
+		}
+
+		return nil
+	}
+
+	data, err := s.BlockStore.GetBlock(ctx, blockInfo.StoreID)
+	if err != nil {
+		// Only a missing block is a problem with the store
+		exists, existsErr := s.BlockStore.CheckBlockExists(ctx, blockInfo.StoreID)
+		if existsErr != nil || exists {
+			return err
+		}
+
+		report.MissingBlocks = append(report.MissingBlocks, blockInfo.Hash)
+		return nil
+	}
+
+	if err := s.verifyBlock(blockInfo, data); err != nil {
+		log.Printf("Corrupt block: %v", err)
+		report.CorruptBlocks = append(report.CorruptBlocks, blockInfo.Hash)
+	}
+
+	return nil
+}
+
+// recordSizes reads a block saved before sizes were recorded, and records its sizes
+func (s *Store) recordSizes(ctx context.Context, blockInfo BlockInfo) error {
+	size, storedSize, err := s.blockSizes(ctx, blockInfo)
+	if err != nil {
+		return err
+	}
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	saved, err := s.BlockInfoStore.GetBlockInfo(blockInfo.Hash)
+	if err != nil {
+		return err
+	}
+
+	saved.Size, saved.StoredSize = size, storedSize
+	return s.BlockInfoStore.SaveBlockInfo(*saved)
+}
+
+// setUseCount replaces the use count of a block
+func (s *Store) setUseCount(hash string, useCount int64) error {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	blockInfo, err := s.BlockInfoStore.GetBlockInfo(hash)
+	if err != nil {
+		return err
+	}
+
+	blockInfo.UseCount = useCount
+	return s.BlockInfoStore.SaveBlockInfo(*blockInfo)
+}
@@ -0,0 +1,79 @@
+package blocks
+
+import (
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BlockSuite) TestFsck(c *C) {
+	store, repository := newMemoryStore(c, archiveConfig(true))
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	report, err := store.Fsck(ctx, FsckOptions{Verify: true})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.OK(), IsTrue)
+	c.Assert(report.Files, Equals, 1)
+	c.Assert(report.Blocks, Equals, len(blockedFile.BlockList))
+
+	corruptInfo, err := store.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.CorruptBlock(corruptInfo.StoreID) == nil, IsTrue)
+
+	missingInfo, err := store.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[1].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.DeleteBlock(ctx, missingInfo.StoreID) == nil, IsTrue)
+
+	// Corruption is only found when the blocks are read
+	report, err = store.Fsck(ctx, FsckOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.MissingBlocks, DeepEquals, []string{missingInfo.Hash})
+	c.Assert(len(report.CorruptBlocks), Equals, 0)
+
+	report, err = store.Fsck(ctx, FsckOptions{Verify: true})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.MissingBlocks, DeepEquals, []string{missingInfo.Hash})
+	c.Assert(report.CorruptBlocks, DeepEquals, []string{corruptInfo.Hash})
+	c.Assert(report.OK(), IsFalse)
+}
+
+func (s *BlockSuite) TestFsckRepairsUseCounts(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(true))
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	hash := blockedFile.BlockList[0].Hash
+	c.Assert(store.setUseCount(hash, 5) == nil, IsTrue)
+	c.Assert(store.BlockInfoStore.SaveBlockInfo(BlockInfo{Hash: "orphan", StoreID: "orphan", UseCount: 1}) == nil, IsTrue)
+
+	// The use count left on the orphan is wrong too
+	report, err := store.Fsck(ctx, FsckOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.WrongUseCounts, DeepEquals, []string{hash, "orphan"})
+	c.Assert(report.OK(), IsFalse)
+
+	report, err = store.Fsck(ctx, FsckOptions{Repair: true})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.Repaired, Equals, 2)
+	c.Assert(report.OK(), IsTrue)
+
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfo.UseCount, Equals, int64(1))
+
+	blockInfo, err = store.BlockInfoStore.GetBlockInfo("orphan")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfo.UseCount, Equals, int64(0))
+
+	// The orphan is reported, but not its missing block
+	c.Assert(report.Orphans, DeepEquals, []string{"orphan"})
+	c.Assert(len(report.MissingBlocks), Equals, 0)
+
+	// A file whose block info is gone is reported
+	c.Assert(store.BlockInfoStore.DeleteBlockInfo(hash) == nil, IsTrue)
+	report, err = store.Fsck(ctx, FsckOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.MissingBlockInfo, DeepEquals, []string{hash})
+}
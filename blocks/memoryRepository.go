@@ -0,0 +1,359 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is returned by a MemoryBlockRepository when no other fault error is configured
+var ErrInjectedFault = errors.New("Injected fault")
+
+// MemoryFaults configures the failures a MemoryBlockRepository injects
+type MemoryFaults struct {
+	// Fail fails every call
+	Fail bool
+	// FailOnCall fails the Nth call to the repository, counting from 1.  Zero disables the failure.
+	FailOnCall int
+	// FailAfterCall fails every call after the Nth call.  Zero disables the failure.
+	FailAfterCall int
+	// Err is returned by failing calls.  Defaults to ErrInjectedFault.
+	Err error
+	// Latency delays every call.  A delayed call returns early if its context is done.
+	Latency time.Duration
+	// Corrupt flips the bits of the first byte of every block as it is stored
+	Corrupt bool
+}
+
+// MemoryBlockRepository keeps blocks in memory.  It is safe for concurrent use and is intended for tests.
+type MemoryBlockRepository struct {
+	lock   sync.RWMutex
+	blocks map[string][]byte
+	faults MemoryFaults
+	calls  int
+}
+
+// NewMemoryBlockRepository - Creates an empty in memory repository
+func NewMemoryBlockRepository() *MemoryBlockRepository {
+	return &MemoryBlockRepository{blocks: make(map[string][]byte)}
+}
+
+// SetFaults replaces the faults injected by the repository and resets the call count
+func (r *MemoryBlockRepository) SetFaults(faults MemoryFaults) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.faults = faults
+	r.calls = 0
+}
+
+// Calls returns the number of calls made since the faults were last set
+func (r *MemoryBlockRepository) Calls() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.calls
+}
+
+// Len returns the number of stored blocks
+func (r *MemoryBlockRepository) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.blocks)
+}
+
+// CorruptBlock flips the bits of the first byte of a stored block
+func (r *MemoryBlockRepository) CorruptBlock(blockHash string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	data, ok := r.blocks[blockHash]
+	if !ok {
+		return ErrNotFound
+	}
+
+	corrupt(data)
+
+	return nil
+}
+
+// SaveBlock stores a copy of the block
+func (r *MemoryBlockRepository) SaveBlock(ctx context.Context, data []byte, blockHash string) error {
+	faults, err := r.call(ctx)
+	if err != nil {
+		return err
+	}
+
+	stored := make([]byte, len(data))
+	copy(stored, data)
+
+	if faults.Corrupt {
+		corrupt(stored)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.blocks[blockHash] = stored
+
+	return nil
+}
+
+// GetBlock returns a copy of the block
+func (r *MemoryBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	if _, err := r.call(ctx); err != nil {
+		return nil, err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	data, ok := r.blocks[blockHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+// CheckBlockExists checks if the block is stored
+func (r *MemoryBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	if _, err := r.call(ctx); err != nil {
+		return false, err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	_, ok := r.blocks[blockHash]
+
+	return ok, nil
+}
+
+// DeleteBlock removes the block
+func (r *MemoryBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	if _, err := r.call(ctx); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.blocks[blockHash]; !ok {
+		return ErrNotFound
+	}
+
+	delete(r.blocks, blockHash)
+
+	return nil
+}
+
+// PutBlock reads the whole block and stores it
+func (r *MemoryBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	buffer, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	return r.SaveBlock(ctx, buffer, blockHash)
+}
+
+// OpenBlock returns a reader over a copy of the block
+func (r *MemoryBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	data, err := r.GetBlock(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// call counts the call and applies the configured latency and failures
+func (r *MemoryBlockRepository) call(ctx context.Context) (MemoryFaults, error) {
+	r.lock.Lock()
+	r.calls++
+	calls := r.calls
+	faults := r.faults
+	r.lock.Unlock()
+
+	if faults.Latency > 0 {
+		timer := time.NewTimer(faults.Latency)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return faults, ctx.Err()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return faults, err
+	}
+
+	if faults.Fail || calls == faults.FailOnCall || (faults.FailAfterCall > 0 && calls > faults.FailAfterCall) {
+		if faults.Err != nil {
+			return faults, faults.Err
+		}
+		return faults, ErrInjectedFault
+	}
+
+	return faults, nil
+}
+
+// corrupt flips the bits of the first byte
+func corrupt(data []byte) {
+	if len(data) > 0 {
+		data[0] ^= 0xff
+	}
+}
+
+// MemoryBlockInfoRepository keeps BlockInfo in memory.  It is safe for concurrent use and is intended for tests.
+type MemoryBlockInfoRepository struct {
+	lock       sync.RWMutex
+	blockInfos map[string]BlockInfo
+}
+
+// NewMemoryBlockInfoRepository - Creates an empty in memory BlockInfo repository
+func NewMemoryBlockInfoRepository() *MemoryBlockInfoRepository {
+	return &MemoryBlockInfoRepository{blockInfos: make(map[string]BlockInfo)}
+}
+
+// SaveBlockInfo stores a copy of the BlockInfo
+func (r *MemoryBlockInfoRepository) SaveBlockInfo(blockInfo BlockInfo) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.blockInfos[blockInfo.Hash] = blockInfo
+	return nil
+}
+
+// GetBlockInfo returns a copy of the BlockInfo, so it can not be changed without saving it
+func (r *MemoryBlockInfoRepository) GetBlockInfo(hash string) (*BlockInfo, error) {
+	if hash == "" {
+		return nil, errors.New("No hash passed")
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	blockInfo, ok := r.blockInfos[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &blockInfo, nil
+}
+
+// DeleteBlockInfo deletes the BlockInfo
+func (r *MemoryBlockInfoRepository) DeleteBlockInfo(hash string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.blockInfos[hash]; !ok {
+		return ErrNotFound
+	}
+
+	delete(r.blockInfos, hash)
+	return nil
+}
+
+// ListBlockInfo returns every BlockInfo, ordered by hash
+func (r *MemoryBlockInfoRepository) ListBlockInfo() ([]BlockInfo, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	blockInfos := make([]BlockInfo, 0, len(r.blockInfos))
+	for _, blockInfo := range r.blockInfos {
+		blockInfos = append(blockInfos, blockInfo)
+	}
+	sort.Slice(blockInfos, func(i, j int) bool { return blockInfos[i].Hash < blockInfos[j].Hash })
+
+	return blockInfos, nil
+}
+
+// MemoryBlockedFileRepository keeps BlockedFiles in memory.  It is safe for concurrent use and is intended for tests.
+type MemoryBlockedFileRepository struct {
+	lock         sync.RWMutex
+	blockedFiles map[string]BlockedFile
+}
+
+// NewMemoryBlockedFileRepository - Creates an empty in memory BlockedFile repository
+func NewMemoryBlockedFileRepository() *MemoryBlockedFileRepository {
+	return &MemoryBlockedFileRepository{blockedFiles: make(map[string]BlockedFile)}
+}
+
+// SaveBlockedFile stores a copy of the BlockedFile
+func (r *MemoryBlockedFileRepository) SaveBlockedFile(blockedFile BlockedFile) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.blockedFiles[blockedFile.ID] = blockedFile
+	return nil
+}
+
+// GetBlockedFile returns a copy of the BlockedFile
+func (r *MemoryBlockedFileRepository) GetBlockedFile(blockfileid string) (*BlockedFile, error) {
+	if blockfileid == "" {
+		return nil, errors.New("No Block File ID passed")
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	blockedFile, ok := r.blockedFiles[blockfileid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &blockedFile, nil
+}
+
+// DeleteBlockedFile deletes the BlockedFile
+func (r *MemoryBlockedFileRepository) DeleteBlockedFile(blockfileid string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.blockedFiles[blockfileid]; !ok {
+		return ErrNotFound
+	}
+
+	delete(r.blockedFiles, blockfileid)
+	return nil
+}
+
+// ListBlockedFiles returns every BlockedFile, ordered by ID
+func (r *MemoryBlockedFileRepository) ListBlockedFiles() ([]BlockedFile, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	blockedFiles := make([]BlockedFile, 0, len(r.blockedFiles))
+	for _, blockedFile := range r.blockedFiles {
+		blockedFiles = append(blockedFiles, blockedFile)
+	}
+	sort.Slice(blockedFiles, func(i, j int) bool { return blockedFiles[i].ID < blockedFiles[j].ID })
+
+	return blockedFiles, nil
+}
+
+// ListTenantBlockedFiles returns at most limit BlockedFiles of the tenant with an ID after the given one, ordered by ID.
+// A limit of 0 returns all of them.
+func (r *MemoryBlockedFileRepository) ListTenantBlockedFiles(tenant string, after string, limit int) ([]BlockedFile, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var blockedFiles []BlockedFile
+	for _, blockedFile := range r.blockedFiles {
+		if blockedFile.Tenant == tenant && blockedFile.ID > after {
+			blockedFiles = append(blockedFiles, blockedFile)
+		}
+	}
+
+	return firstBlockedFiles(blockedFiles, limit), nil
+}
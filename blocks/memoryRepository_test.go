@@ -0,0 +1,249 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// newMemoryStore returns a store keeping its blocks in a MemoryBlockRepository
+func newMemoryStore(c *C, cfg config.Config) (*Store, *MemoryBlockRepository) {
+	cfg.Storage.Provider = "memory"
+
+	store, err := NewStore(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	memory := NewMemoryBlockRepository()
+	store.BlockStore = memory
+
+	return store, memory
+}
+
+func (s *BlockSuite) TestMemoryBlockRepository(c *C) {
+	repository := NewMemoryBlockRepository()
+
+	data := []byte("blob")
+	err := repository.SaveBlock(ctx, data, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The repository keeps its own copy
+	data[0] = 'x'
+
+	stored, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(stored), Equals, "blob")
+
+	exists, err := repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsTrue)
+
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	exists, _ = repository.CheckBlockExists(ctx, "hash")
+	c.Assert(exists, IsFalse)
+
+	_, err = repository.GetBlock(ctx, "hash")
+	c.Assert(err != nil, IsTrue)
+
+	c.Assert(repository.Calls(), Equals, 6)
+	c.Assert(repository.Len(), Equals, 0)
+}
+
+func (s *BlockSuite) TestMemoryBlockRepositoryFailOnCall(c *C) {
+	repository := NewMemoryBlockRepository()
+	repository.SetFaults(MemoryFaults{FailOnCall: 2})
+
+	c.Assert(repository.SaveBlock(ctx, []byte("blob"), "one"), IsNil)
+	c.Assert(repository.SaveBlock(ctx, []byte("blob"), "two"), Equals, ErrInjectedFault)
+	c.Assert(repository.SaveBlock(ctx, []byte("blob"), "three"), IsNil)
+	c.Assert(repository.Len(), Equals, 2)
+}
+
+func (s *BlockSuite) TestBlockFileFailsWhenRepositoryFails(c *C) {
+	cfg := testConfig()
+	cfg.Blocks.BlockSize = BlockSize30Kb
+	store, memory := newMemoryStore(c, cfg)
+
+	// Fail on the second block
+	memory.SetFaults(MemoryFaults{FailOnCall: 2})
+
+	_, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err, Equals, ErrInjectedFault)
+
+	// The block saved before the failure is given back
+	c.Assert(memory.Len(), Equals, 0)
+	blockInfos, err := store.BlockInfoStore.ListBlockInfo()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfos, HasLen, 0)
+}
+
+func (s *BlockSuite) TestCancelledBlockFileReleasesBlocks(c *C) {
+	cfg := testConfig()
+	cfg.Blocks.BlockSize = BlockSize30Kb
+	store, memory := newMemoryStore(c, cfg)
+
+	// Give up once more than the first block has been read
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	source := &cancellingReader{r: bytes.NewReader(make([]byte, 3*BlockSize30Kb)), after: BlockSize30Kb + 1, cancel: cancel}
+
+	_, err := store.BlockBuffer(cancelCtx, source)
+	c.Assert(errors.Is(err, context.Canceled), IsTrue, Commentf("Wrong error: %v", err))
+	c.Assert(memory.Len(), Equals, 0)
+}
+
+// cancellingReader cancels a context once more than after bytes have been read
+type cancellingReader struct {
+	r      io.Reader
+	read   int64
+	after  int64
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.read += int64(n); r.read > r.after {
+		r.cancel()
+	}
+	return n, err
+}
+
+func (s *BlockSuite) TestConcurrentBlockFilesShareUploads(c *C) {
+	cfg := testConfig()
+	cfg.Blocks.Encryption = false
+	store, memory := newMemoryStore(c, cfg)
+
+	memory.SetFaults(MemoryFaults{Latency: 100 * time.Millisecond})
+
+	// Files of the same block upload it once, while files of other blocks do not wait for it
+	sources := []string{"same", "same", "same", "same", "other 1", "other 2", "other 3", "other 4"}
+	blockedFiles := make([]BlockedFile, len(sources))
+	errs := make([]error, len(sources))
+
+	var wait sync.WaitGroup
+	start := time.Now()
+	for i, source := range sources {
+		wait.Add(1)
+		go func(i int, source string) {
+			defer wait.Done()
+			blockedFiles[i], errs[i] = store.BlockBuffer(ctx, strings.NewReader(source))
+		}(i, source)
+	}
+	wait.Wait()
+
+	for _, err := range errs {
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+	c.Assert(time.Since(start) < 400*time.Millisecond, IsTrue, Commentf("Took %v", time.Since(start)))
+	c.Assert(memory.Len(), Equals, 5)
+
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(blockedFiles[0].BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfo.UseCount, Equals, int64(4))
+}
+
+func (s *BlockSuite) TestUnblockFailsOnCorruptBlock(c *C) {
+	store, memory := newMemoryStore(c, testConfig())
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = memory.CorruptBlock(blockInfo.StoreID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *BlockSuite) TestCorruptingRepositoryIsDetected(c *C) {
+	cfg := testConfig()
+	cfg.Blocks.Encryption = false
+	store, memory := newMemoryStore(c, cfg)
+
+	// Compressed streams carry checksums, so corruption while storing must be noticed when unblocking
+	memory.SetFaults(MemoryFaults{Corrupt: true})
+
+	blockedFile, err := store.BlockBuffer(ctx, bytes.NewReader([]byte("corrupted on the way in")))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *BlockSuite) TestRepositoryLatencyHitsTimeout(c *C) {
+	store, memory := newMemoryStore(c, testConfig())
+	store.BlockStore = NewTimeoutBlockRepository(memory, config.TimeoutConfig{Save: config.Duration(10 * time.Millisecond)})
+
+	memory.SetFaults(MemoryFaults{Latency: time.Second})
+
+	start := time.Now()
+	_, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < time.Second, IsTrue)
+}
+
+func (s *BlockSuite) TestOpenBlockedFileReadsOnlyNeededBlocks(c *C) {
+	cfg := testConfig()
+	cfg.Blocks.BlockSize = BlockSize30Kb
+	store, memory := newMemoryStore(c, cfg)
+
+	data := []byte(strings.Repeat("0123456789", int(3*BlockSize30Kb/10)))
+	blockedFile, err := store.BlockBuffer(ctx, bytes.NewReader(data))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockedFile.BlockList, HasLen, 3)
+
+	reader, err := store.OpenBlockedFile(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer reader.Close()
+	c.Assert(reader.Size(), Equals, int64(len(data)))
+
+	// Reading across the end of the second block loads the second and third blocks only
+	calls := memory.Calls()
+	start := 2*BlockSize30Kb - 5
+	_, err = reader.Seek(start, io.SeekStart)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	part := make([]byte, 10)
+	_, err = io.ReadFull(reader, part)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(part), Equals, string(data[start:start+10]))
+	c.Assert(memory.Calls()-calls, Equals, 2)
+}
+
+func (s *BlockSuite) TestMemoryMetadataRepositories(c *C) {
+	store, _ := newMemoryStore(c, testConfig())
+
+	_, ok := store.BlockInfoStore.(*MemoryBlockInfoRepository)
+	c.Assert(ok, IsTrue)
+	_, ok = store.BlockedFileStore.(*MemoryBlockedFileRepository)
+	c.Assert(ok, IsTrue)
+
+	err := store.BlockInfoStore.SaveBlockInfo(BlockInfo{Hash: "hash", UseCount: 1})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Changing what is handed out does not change what is stored
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo("hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	blockInfo.UseCount = 5
+
+	blockInfo, _ = store.BlockInfoStore.GetBlockInfo("hash")
+	c.Assert(blockInfo.UseCount, Equals, int64(1))
+
+	c.Assert(store.BlockInfoStore.DeleteBlockInfo("hash"), IsNil)
+	c.Assert(store.BlockInfoStore.DeleteBlockInfo("hash"), Equals, ErrNotFound)
+
+	_, err = store.BlockedFileStore.GetBlockedFile("missing")
+	c.Assert(err, Equals, ErrNotFound)
+}
@@ -0,0 +1,301 @@
+package blocks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MigrateOptions controls how Store.Migrate copies the blocks
+type MigrateOptions struct {
+	// Workers is the number of blocks copied at the same time.  Less than one copies a block at a time.
+	Workers int
+	// DeleteSource deletes each block from the store once the copy is verified
+	DeleteSource bool
+	// JournalPath is a file recording the blocks already migrated, so a migration which is run again skips them.
+	// Without a journal the blocks already in the destination are read back and verified instead of copied.
+	JournalPath string
+	// Progress is called after each block with the totals so far.  Calls are never concurrent.
+	Progress func(MigrateStats)
+}
+
+// MigrateStats counts the blocks handled by a migration
+type MigrateStats struct {
+	// Total is the number of blocks to migrate
+	Total int64 `json:"total"`
+	// Copied is the number of blocks copied and verified
+	Copied int64 `json:"copied"`
+	// Existing is the number of blocks found verified in the destination, so not copied again
+	Existing int64 `json:"existing"`
+	// Skipped is the number of blocks in the journal, or deleted from the store during the migration
+	Skipped int64 `json:"skipped"`
+	// Deleted is the number of blocks deleted from the store
+	Deleted int64 `json:"deleted"`
+	// Failed is the number of blocks which could not be migrated
+	Failed int64 `json:"failed"`
+}
+
+// migration is the state shared by the workers copying blocks
+type migration struct {
+	store       *Store
+	source      BlockRepository
+	destination BlockRepository
+	options     MigrateOptions
+	live        bool
+
+	lock     sync.Mutex
+	stats    MigrateStats
+	firstErr error
+	journal  *os.File
+	migrated map[string]bool
+}
+
+// Migrate copies every block known to the BlockInfoStore from the BlockStore into the destination.
+// Each block is read back from the destination and checked against its hash before it counts as copied.
+// Reads from the BlockStore go on working during the migration, unless DeleteSource is set.
+// The migration carries on past blocks which fail, and returns the first error once all the blocks are done.
+func (s *Store) Migrate(ctx context.Context, destination BlockRepository, options MigrateOptions) (MigrateStats, error) {
+	blockInfos, err := s.BlockInfoStore.ListBlockInfo()
+	if err != nil {
+		return MigrateStats{}, err
+	}
+
+	return s.copyBlocks(ctx, s.BlockStore, destination, true, blockInfos, options)
+}
+
+// copyBlocks copies the blocks from the source to the destination in parallel, verifying each copy.
+// Live is set when the source is the BlockStore, whose blocks can be deleted while they are copied.
+func (s *Store) copyBlocks(ctx context.Context, source BlockRepository, destination BlockRepository, live bool, blockInfos []BlockInfo, options MigrateOptions) (MigrateStats, error) {
+	m := &migration{
+		store:       s,
+		source:      source,
+		destination: destination,
+		options:     options,
+		live:        live,
+		migrated:    make(map[string]bool),
+	}
+	m.stats.Total = int64(len(blockInfos))
+
+	if options.JournalPath != "" {
+		if err := m.openJournal(); err != nil {
+			return MigrateStats{}, err
+		}
+		defer m.journal.Close()
+	}
+
+	workers := options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan BlockInfo)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blockInfo := range queue {
+				m.done(m.migrateBlock(ctx, blockInfo))
+			}
+		}()
+	}
+
+	for _, blockInfo := range blockInfos {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- blockInfo
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return m.stats, err
+	}
+
+	if m.firstErr != nil {
+		return m.stats, fmt.Errorf("%d of %d blocks failed to copy, the first with: %w", m.stats.Failed, m.stats.Total, m.firstErr)
+	}
+
+	return m.stats, nil
+}
+
+// Outcomes of migrating a block
+type migrateOutcome int
+
+const (
+	migrateCopied migrateOutcome = iota
+	migrateExisting
+	migrateSkipped
+	migrateFailed
+)
+
+// migrateResult is the outcome of migrating a block, and whether the block was deleted from the store
+type migrateResult struct {
+	outcome migrateOutcome
+	deleted bool
+	err     error
+}
+
+// migrateBlock copies a block unless it is already in the destination, then deletes it from the store if asked to
+func (m *migration) migrateBlock(ctx context.Context, blockInfo BlockInfo) migrateResult {
+	result := m.copyBlock(ctx, blockInfo)
+	if result.outcome == migrateFailed {
+		log.Printf("Unable to migrate Hash: %v StoreID: %v: %v", blockInfo.Hash, blockInfo.StoreID, result.err)
+		return result
+	}
+
+	if !m.options.DeleteSource {
+		return result
+	}
+
+	// The block may have been deleted by an earlier run
+	exists, err := m.source.CheckBlockExists(ctx, blockInfo.StoreID)
+	if err == nil && exists {
+		err = m.source.DeleteBlock(ctx, blockInfo.StoreID)
+		result.deleted = err == nil
+	}
+	if err != nil {
+		log.Printf("Unable to delete migrated Hash: %v StoreID: %v: %v", blockInfo.Hash, blockInfo.StoreID, err)
+		return migrateResult{outcome: migrateFailed, err: err}
+	}
+
+	return result
+}
+
+// copyBlock copies a block and verifies the copy
+func (m *migration) copyBlock(ctx context.Context, blockInfo BlockInfo) migrateResult {
+	if m.isMigrated(blockInfo.StoreID) {
+		return migrateResult{outcome: migrateSkipped}
+	}
+
+	// A block verified in the destination by an earlier run needs no copy
+	exists, err := m.destination.CheckBlockExists(ctx, blockInfo.StoreID)
+	if err != nil {
+		return migrateResult{outcome: migrateFailed, err: err}
+	}
+	if exists {
+		if err := m.verifyCopy(ctx, blockInfo); err == nil {
+			if err := m.journalBlock(blockInfo.StoreID); err != nil {
+				return migrateResult{outcome: migrateFailed, err: err}
+			}
+
+			return migrateResult{outcome: migrateExisting}
+		}
+	}
+
+	data, err := m.source.GetBlock(ctx, blockInfo.StoreID)
+	if err != nil {
+		// The block may have been deleted while the migration was running
+		if _, infoErr := m.store.BlockInfoStore.GetBlockInfo(blockInfo.Hash); m.live && infoErr != nil {
+			return migrateResult{outcome: migrateSkipped}
+		}
+
+		return migrateResult{outcome: migrateFailed, err: err}
+	}
+
+	// Do not spread a corrupt block
+	if err := m.store.verifyBlock(blockInfo, data); err != nil {
+		return migrateResult{outcome: migrateFailed, err: err}
+	}
+
+	if err := m.destination.SaveBlock(ctx, data, blockInfo.StoreID); err != nil {
+		return migrateResult{outcome: migrateFailed, err: err}
+	}
+
+	if err := m.verifyCopy(ctx, blockInfo); err != nil {
+		return migrateResult{outcome: migrateFailed, err: err}
+	}
+
+	if err := m.journalBlock(blockInfo.StoreID); err != nil {
+		return migrateResult{outcome: migrateFailed, err: err}
+	}
+
+	return migrateResult{outcome: migrateCopied}
+}
+
+// verifyCopy reads the block back from the destination and checks it against its hash
+func (m *migration) verifyCopy(ctx context.Context, blockInfo BlockInfo) error {
+	data, err := m.destination.GetBlock(ctx, blockInfo.StoreID)
+	if err != nil {
+		return err
+	}
+
+	return m.store.verifyBlock(blockInfo, data)
+}
+
+// done counts the result of a block and reports the progress
+func (m *migration) done(result migrateResult) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch result.outcome {
+	case migrateCopied:
+		m.stats.Copied++
+	case migrateExisting:
+		m.stats.Existing++
+	case migrateSkipped:
+		m.stats.Skipped++
+	case migrateFailed:
+		m.stats.Failed++
+		if m.firstErr == nil {
+			m.firstErr = result.err
+		}
+	}
+
+	if result.deleted {
+		m.stats.Deleted++
+	}
+
+	if m.options.Progress != nil {
+		m.options.Progress(m.stats)
+	}
+}
+
+// openJournal loads the blocks migrated by earlier runs and opens the journal for adding to it
+func (m *migration) openJournal() error {
+	journal, err := os.OpenFile(m.options.JournalPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(journal)
+	for scanner.Scan() {
+		if storeID := strings.TrimSpace(scanner.Text()); storeID != "" {
+			m.migrated[storeID] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		journal.Close()
+		return err
+	}
+
+	m.journal = journal
+	return nil
+}
+
+func (m *migration) isMigrated(storeID string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.migrated[storeID]
+}
+
+// journalBlock records that the block is migrated
+func (m *migration) journalBlock(storeID string) error {
+	if m.journal == nil {
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.migrated[storeID] = true
+	_, err := m.journal.WriteString(storeID + "\n")
+	return err
+}
@@ -0,0 +1,133 @@
+package blocks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// newMigrateStore returns a store keeping its blocks in the returned memory repository, holding the tempest in several blocks
+func newMigrateStore(c *C) (*Store, *MemoryBlockRepository, BlockedFile) {
+	store, source := newMemoryStore(c, archiveConfig(true))
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(len(blockedFile.BlockList) > 1, IsTrue)
+
+	return store, source, blockedFile
+}
+
+func (s *BlockSuite) TestListBlockInfo(c *C) {
+	store, _, blockedFile := newMigrateStore(c)
+
+	blockInfos, err := store.BlockInfoStore.ListBlockInfo()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(len(blockInfos), Equals, len(blockedFile.BlockList))
+
+	for i := 1; i < len(blockInfos); i++ {
+		c.Assert(blockInfos[i-1].Hash < blockInfos[i].Hash, IsTrue)
+	}
+}
+
+func (s *BlockSuite) TestMigrate(c *C) {
+	store, source, blockedFile := newMigrateStore(c)
+	destination := NewMemoryBlockRepository()
+
+	progress := 0
+	stats, err := store.Migrate(ctx, destination, MigrateOptions{Workers: 4, Progress: func(MigrateStats) { progress++ }})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.Total, Equals, int64(len(blockedFile.BlockList)))
+	c.Assert(stats.Copied, Equals, stats.Total)
+	c.Assert(progress, Equals, len(blockedFile.BlockList))
+
+	// The source is left alone
+	c.Assert(source.Len(), Equals, len(blockedFile.BlockList))
+	c.Assert(destination.Len(), Equals, len(blockedFile.BlockList))
+
+	// The file reads back from the destination
+	expected, err := ioutil.ReadFile(inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	store.BlockStore = destination
+	buffer, err := store.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(buffer.String() == string(expected), IsTrue)
+}
+
+func (s *BlockSuite) TestMigrateResumes(c *C) {
+	store, _, blockedFile := newMigrateStore(c)
+	destination := NewMemoryBlockRepository()
+	blockCount := int64(len(blockedFile.BlockList))
+
+	journal, err := ioutil.TempFile("", "blocker-migrate")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	journal.Close()
+	defer os.Remove(journal.Name())
+
+	// Half the blocks are in the destination from an interrupted run
+	blockInfos, err := store.BlockInfoStore.ListBlockInfo()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	for _, blockInfo := range blockInfos[:len(blockInfos)/2] {
+		data, err := store.BlockStore.GetBlock(ctx, blockInfo.StoreID)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(destination.SaveBlock(ctx, data, blockInfo.StoreID) == nil, IsTrue)
+	}
+
+	stats, err := store.Migrate(ctx, destination, MigrateOptions{JournalPath: journal.Name()})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.Existing, Equals, int64(len(blockInfos)/2))
+	c.Assert(stats.Copied, Equals, blockCount-stats.Existing)
+
+	// The journal skips the blocks without reading the destination
+	calls := destination.Calls()
+	stats, err = store.Migrate(ctx, destination, MigrateOptions{JournalPath: journal.Name()})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.Skipped, Equals, blockCount)
+	c.Assert(destination.Calls(), Equals, calls)
+
+	// Without the journal the blocks are verified in the destination
+	stats, err = store.Migrate(ctx, destination, MigrateOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.Existing, Equals, blockCount)
+}
+
+func (s *BlockSuite) TestMigrateDeletesSource(c *C) {
+	store, source, blockedFile := newMigrateStore(c)
+	destination := NewMemoryBlockRepository()
+
+	stats, err := store.Migrate(ctx, destination, MigrateOptions{Workers: 2, DeleteSource: true})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.Deleted, Equals, int64(len(blockedFile.BlockList)))
+	c.Assert(source.Len(), Equals, 0)
+	c.Assert(destination.Len(), Equals, len(blockedFile.BlockList))
+}
+
+func (s *BlockSuite) TestMigrateSkipsCorruptBlocks(c *C) {
+	store, source, blockedFile := newMigrateStore(c)
+	destination := NewMemoryBlockRepository()
+
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(source.CorruptBlock(blockInfo.StoreID) == nil, IsTrue)
+
+	stats, err := store.Migrate(ctx, destination, MigrateOptions{Workers: 2, DeleteSource: true})
+	c.Assert(err != nil, IsTrue)
+	c.Assert(stats.Failed, Equals, int64(1))
+	c.Assert(stats.Copied, Equals, int64(len(blockedFile.BlockList)-1))
+
+	// The corrupt block is neither copied nor deleted
+	exists, err := destination.CheckBlockExists(ctx, blockInfo.StoreID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsFalse)
+	c.Assert(source.Len(), Equals, 1)
+}
+
+func (s *BlockSuite) TestMigrateWithMissingJournalDirectoryFails(c *C) {
+	store, _, _ := newMigrateStore(c)
+
+	_, err := store.Migrate(ctx, NewMemoryBlockRepository(), MigrateOptions{JournalPath: filepath.Join(os.TempDir(), "blocker-missing", "journal")})
+	c.Assert(err != nil, IsTrue)
+}
@@ -0,0 +1,902 @@
+package blocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/keithballdotnet/blocker/config"
+)
+
+/* PACK FILE Provider */
+
+// Records appended to a segment are either a block or a tombstone deleting an earlier block record
+const (
+	packRecordBlock     byte = 'B'
+	packRecordTombstone byte = 'T'
+)
+
+// packHeaderSize is the size of a record header: the kind, the hash length, the data length and a crc32 of the hash and data
+const packHeaderSize = 1 + 2 + 4 + 4
+
+// packTombstoneSize is the size of a tombstone's data: the segment and offset of the deleted record
+const packTombstoneSize = 4 + 8
+
+// A hint file holds the sizes of its segment, and then a record for each record of the segment.  Block records hold
+// the offset and length of the block and tombstone records the data of the tombstone.
+const (
+	packHintHeaderSize = 8 + 8
+	packHintBlockSize  = 8 + 8
+)
+
+// packLocation is where a record is in the segments
+type packLocation struct {
+	segment int
+	offset  int64
+	length  int64
+}
+
+type packSegment struct {
+	file *os.File
+	size int64
+	// live is the bytes of block records still in the index
+	live int64
+	// hints are the records of the active segment, written to its hint file once it is full
+	hints []packHint
+	// pending is the number of records appended which are not yet in the index, which keep the segment from being removed
+	pending int
+}
+
+// packHint is what the index needs of a record: where a block record is, or which record a tombstone deletes
+type packHint struct {
+	kind      byte
+	blockHash string
+	location  packLocation
+}
+
+// PackStats reports the segments of a PackBlockRepository
+type PackStats struct {
+	Segments    int   `json:"segments"`
+	Blocks      int   `json:"blocks"`
+	Size        int64 `json:"size"`
+	LiveSize    int64 `json:"liveSize"`
+	Compactions int64 `json:"compactions"`
+}
+
+// PackBlockRepository : Appends blocks into large segment files rather than writing a file per block.
+// An index of where each block is in the segments is rebuilt when the repository is opened.  Full segments have a
+// hint file listing their records, so only the active segment, and full segments without a hint file, are read.
+// Deleting a block appends a tombstone.  Segments whose live data drops below the compact threshold are compacted
+// in the background, by copying their live blocks into the active segment and removing the segment.
+type PackBlockRepository struct {
+	directory        string
+	fileMode         os.FileMode
+	segmentSize      int64
+	compactThreshold float64
+
+	lock        sync.RWMutex
+	index       map[string]packLocation
+	segments    map[int]*packSegment
+	active      int
+	compactions int64
+
+	// compactLock stops two compactions running at once.  The lock is only held while each record is copied.
+	compactLock     sync.Mutex
+	compactRequests chan struct{}
+	done            chan struct{}
+	stopped         chan struct{}
+	closeOnce       sync.Once
+}
+
+// NewPackBlockRepository - Creates a repository packing blocks into segments in the configured directory
+func NewPackBlockRepository(cfg config.DiskConfig) (*PackBlockRepository, error) {
+	depositoryDir := cfg.Directory
+	if depositoryDir == "" {
+		depositoryDir = filepath.Join(os.TempDir(), "blocker")
+	}
+	depositoryDir = filepath.Join(depositoryDir, "packs")
+
+	fileMode, dirMode := diskModes(cfg)
+
+	err := os.MkdirAll(depositoryDir, dirMode)
+	if err != nil {
+		return nil, &config.InvalidSettingError{Provider: "nfs", Setting: "storage.disk.directory", Value: depositoryDir, Err: err}
+	}
+
+	r := &PackBlockRepository{
+		directory:        depositoryDir,
+		fileMode:         fileMode,
+		segmentSize:      cfg.SegmentSize,
+		compactThreshold: cfg.CompactThreshold,
+		index:            make(map[string]packLocation),
+		segments:         make(map[int]*packSegment),
+		compactRequests:  make(chan struct{}, 1),
+		done:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+	}
+
+	go r.compactLoop()
+
+	if err := r.load(); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	log.Printf("Packing %d blocks into %d segments in: %s", len(r.index), len(r.segments), depositoryDir)
+
+	for _, number := range r.segmentNumbers() {
+		if r.needsCompaction(number) {
+			r.requestCompaction()
+			break
+		}
+	}
+
+	return r, nil
+}
+
+// SaveBlock appends the block to the active segment
+func (r *PackBlockRepository) SaveBlock(ctx context.Context, data []byte, blockHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	location, err := r.appendSynced(packRecordBlock, blockHash, data, nil)
+	if err != nil {
+		log.Println(fmt.Sprintf("Error writing block : %v", err))
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.settle(location.segment)
+
+	// A later record of the block saved meanwhile is the one kept when the segments are read again
+	if current, ok := r.index[blockHash]; !ok || !after(current, location) {
+		r.setLive(blockHash, location)
+	}
+
+	return nil
+}
+
+// GetBlock reads the block from its segment
+func (r *PackBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	location, ok := r.index[blockHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	record := make([]byte, recordSize(blockHash, location.length))
+	if _, err := r.segments[location.segment].file.ReadAt(record, location.offset); err != nil {
+		log.Println(fmt.Sprintf("Error reading block : %v", err))
+		return nil, err
+	}
+
+	_, _, data, err := decodeRecord(record)
+	if err != nil {
+		return nil, fmt.Errorf("Block %s in segment %d: %v", blockHash, location.segment, err)
+	}
+
+	return data, nil
+}
+
+// PutBlock appends the block to the active segment.  A record is written whole, so the block is read first.
+func (r *PackBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	block, err := ioutil.ReadAll(contextReader{ctx, data})
+	if err != nil {
+		return err
+	}
+
+	return r.SaveBlock(ctx, block, blockHash)
+}
+
+// OpenBlock reads the block from its segment
+func (r *PackBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	data, err := r.GetBlock(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// DeleteBlock appends a tombstone for the block, and has its segment compacted if little of it is still live
+func (r *PackBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var location packLocation
+	tombstone, err := r.appendSynced(packRecordTombstone, blockHash, nil, func() ([]byte, error) {
+		var ok bool
+		if location, ok = r.index[blockHash]; !ok {
+			return nil, ErrNotFound
+		}
+		return encodeTombstone(location), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.settle(tombstone.segment)
+
+	// The tombstone only deletes the record it names, not a record of the block saved meanwhile
+	if r.index[blockHash] != location {
+		return nil
+	}
+
+	delete(r.index, blockHash)
+	r.segments[location.segment].live -= recordSize(blockHash, location.length)
+
+	if r.needsCompaction(location.segment) {
+		r.requestCompaction()
+	}
+
+	return nil
+}
+
+// CheckBlockExists looks for the block in the index
+func (r *PackBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	_, ok := r.index[blockHash]
+	return ok, nil
+}
+
+// Compact compacts every segment whose live data is below the compact threshold.
+// Blocks can be saved, read and deleted while it runs.
+func (r *PackBlockRepository) Compact() error {
+	r.compactLock.Lock()
+	defer r.compactLock.Unlock()
+
+	r.lock.RLock()
+	var numbers []int
+	for _, number := range r.segmentNumbers() {
+		if r.needsCompaction(number) {
+			numbers = append(numbers, number)
+		}
+	}
+	r.lock.RUnlock()
+
+	for _, number := range numbers {
+		if err := r.compact(number); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stats returns the number and size of the segments
+func (r *PackBlockRepository) Stats() PackStats {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	stats := PackStats{Segments: len(r.segments), Blocks: len(r.index), Compactions: r.compactions}
+	for _, segment := range r.segments {
+		stats.Size += segment.size
+		stats.LiveSize += segment.live
+	}
+
+	return stats
+}
+
+// Close stops compacting and closes the segment files
+func (r *PackBlockRepository) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	<-r.stopped
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var errs []error
+	for _, segment := range r.segments {
+		if err := segment.file.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// load opens the existing segments in order and rebuilds the index from their hint files, or from them
+func (r *PackBlockRepository) load() error {
+	// Hint files left half written by a crash are written again
+	partial, err := filepath.Glob(filepath.Join(r.directory, "segment-*.hint.*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, path := range partial {
+		os.Remove(path)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(r.directory, "segment-*.pack"))
+	if err != nil {
+		return err
+	}
+
+	numbers := make([]int, 0, len(paths))
+	for _, path := range paths {
+		var number int
+		if _, err := fmt.Sscanf(filepath.Base(path), "segment-%d.pack", &number); err != nil {
+			log.Printf("Ignoring unexpected file in pack directory: %s", path)
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	for i, number := range numbers {
+		file, err := os.OpenFile(r.segmentPath(number), os.O_RDWR, r.fileMode)
+		if err != nil {
+			return err
+		}
+
+		segment := &packSegment{file: file}
+		r.segments[number] = segment
+		r.active = number
+
+		last := i == len(numbers)-1
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		// The hint file of a full segment saves reading the segment
+		hints, size, err := r.readHints(number, info.Size())
+		if last || err != nil {
+			if !last && !os.IsNotExist(err) {
+				log.Printf("Ignoring the hint file of segment %d: %v", number, err)
+			}
+
+			if hints, size, err = r.scan(number, info.Size(), last); err != nil {
+				return err
+			}
+
+			if !last {
+				if err := r.writeHints(number, info.Size(), size, hints); err != nil {
+					log.Printf("Unable to write the hint file of segment %d: %v", number, err)
+				}
+			}
+		}
+
+		segment.size = size
+		if last {
+			segment.hints = hints
+		}
+
+		for _, hint := range hints {
+			r.replay(number, hint)
+		}
+	}
+
+	if len(r.segments) == 0 {
+		return r.rotate()
+	}
+
+	return nil
+}
+
+// scan reads the records of the segment.  Returns a hint for each record and the size of the whole records.
+// A torn record at the end of the last segment, left by a crash while appending, is truncated away.
+func (r *PackBlockRepository) scan(number int, fileSize int64, last bool) ([]packHint, int64, error) {
+	file := r.segments[number].file
+
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, fileSize))
+	offset := int64(0)
+	var hints []packHint
+
+	for offset < fileSize {
+		kind, blockHash, data, size, err := readRecord(reader)
+		if err != nil {
+			if !last {
+				log.Printf("Segment %d is damaged at offset %d, ignoring the rest of it: %v", number, offset, err)
+				break
+			}
+
+			log.Printf("Truncating segment %d at offset %d: %v", number, offset, err)
+			if err := file.Truncate(offset); err != nil {
+				return nil, 0, err
+			}
+			break
+		}
+
+		hints = append(hints, recordHint(kind, blockHash, data, packLocation{segment: number, offset: offset, length: int64(len(data))}))
+
+		offset += size
+	}
+
+	return hints, offset, nil
+}
+
+// recordHint returns the hint of a record at the location
+func recordHint(kind byte, blockHash string, data []byte, location packLocation) packHint {
+	if kind == packRecordTombstone {
+		location = decodeTombstone(data)
+	}
+
+	return packHint{kind: kind, blockHash: blockHash, location: location}
+}
+
+// replay applies a record of the segment to the index
+func (r *PackBlockRepository) replay(number int, hint packHint) {
+	switch hint.kind {
+	case packRecordBlock:
+		r.setLive(hint.blockHash, hint.location)
+	case packRecordTombstone:
+		if location, ok := r.index[hint.blockHash]; ok && location.segment == hint.location.segment && location.offset == hint.location.offset {
+			delete(r.index, hint.blockHash)
+			r.segments[location.segment].live -= recordSize(hint.blockHash, location.length)
+		}
+	}
+}
+
+// readHints reads the hint file of the segment.  Returns the hints and the size of the whole records of the segment.
+// A hint file written for a segment of a different size is refused.
+func (r *PackBlockRepository) readHints(number int, fileSize int64) ([]packHint, int64, error) {
+	data, err := ioutil.ReadFile(r.hintPath(number))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(data) < packHintHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if int64(binary.BigEndian.Uint64(data)) != fileSize {
+		return nil, 0, errors.New("Hint file is for a segment of another size")
+	}
+	size := int64(binary.BigEndian.Uint64(data[8:]))
+
+	reader := bytes.NewReader(data[packHintHeaderSize:])
+	var hints []packHint
+
+	for reader.Len() > 0 {
+		kind, blockHash, data, _, err := readRecord(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if kind == packRecordTombstone {
+			hints = append(hints, packHint{kind: kind, blockHash: blockHash, location: decodeTombstone(data)})
+			continue
+		}
+
+		if len(data) != packHintBlockSize {
+			return nil, 0, errors.New("Hint record length does not match")
+		}
+		location := packLocation{segment: number, offset: int64(binary.BigEndian.Uint64(data)), length: int64(binary.BigEndian.Uint64(data[8:]))}
+		hints = append(hints, packHint{kind: kind, blockHash: blockHash, location: location})
+	}
+
+	return hints, size, nil
+}
+
+// writeHints writes the hint file of a full segment to a temporary file, syncs it and renames it into place
+func (r *PackBlockRepository) writeHints(number int, fileSize int64, size int64, hints []packHint) error {
+	var buffer bytes.Buffer
+
+	header := make([]byte, packHintHeaderSize)
+	binary.BigEndian.PutUint64(header, uint64(fileSize))
+	binary.BigEndian.PutUint64(header[8:], uint64(size))
+	buffer.Write(header)
+
+	for _, hint := range hints {
+		if hint.kind == packRecordTombstone {
+			buffer.Write(encodeRecord(hint.kind, hint.blockHash, encodeTombstone(hint.location)))
+			continue
+		}
+
+		data := make([]byte, packHintBlockSize)
+		binary.BigEndian.PutUint64(data, uint64(hint.location.offset))
+		binary.BigEndian.PutUint64(data[8:], uint64(hint.location.length))
+		buffer.Write(encodeRecord(hint.kind, hint.blockHash, data))
+	}
+
+	file, err := ioutil.TempFile(r.directory, filepath.Base(r.hintPath(number))+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(buffer.Bytes())
+	if err == nil {
+		err = file.Chmod(r.fileMode)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), r.hintPath(number))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return syncDirectory(r.directory)
+}
+
+// append writes a record to the end of the active segment, starting a new segment when it is full
+func (r *PackBlockRepository) append(kind byte, blockHash string, data []byte) (packLocation, error) {
+	if r.segments[r.active].size >= r.segmentSize {
+		if err := r.rotate(); err != nil {
+			return packLocation{}, err
+		}
+	}
+
+	segment := r.segments[r.active]
+	record := encodeRecord(kind, blockHash, data)
+
+	if _, err := segment.file.WriteAt(record, segment.size); err != nil {
+		// Do not leave a torn record for the next append to follow
+		segment.file.Truncate(segment.size)
+		return packLocation{}, err
+	}
+
+	location := packLocation{segment: r.active, offset: segment.size, length: int64(len(data))}
+	segment.size += int64(len(record))
+	segment.hints = append(segment.hints, recordHint(kind, blockHash, data, location))
+
+	return location, nil
+}
+
+// appendSynced appends a record to the active segment and syncs it.  The sync is done without the lock, so blocks
+// are read and other records appended meanwhile.  The data is the given data, or made by data with the lock held.
+// The segment is not removed until the caller has taken the lock and taken one from its pending records.
+func (r *PackBlockRepository) appendSynced(kind byte, blockHash string, data []byte, makeData func() ([]byte, error)) (packLocation, error) {
+	r.lock.Lock()
+
+	if makeData != nil {
+		var err error
+		if data, err = makeData(); err != nil {
+			r.lock.Unlock()
+			return packLocation{}, err
+		}
+	}
+
+	location, err := r.append(kind, blockHash, data)
+	if err != nil {
+		r.lock.Unlock()
+		return packLocation{}, err
+	}
+
+	segment := r.segments[location.segment]
+	segment.pending++
+	r.lock.Unlock()
+
+	if err := segment.file.Sync(); err != nil {
+		r.lock.Lock()
+		segment.pending--
+		r.lock.Unlock()
+		return packLocation{}, err
+	}
+
+	return location, nil
+}
+
+// settle takes one from the pending records of the segment, once the record is in the index.  A compaction of the
+// segment which was left for its pending records is asked for again.  Must be called with the lock held.
+func (r *PackBlockRepository) settle(number int) {
+	r.segments[number].pending--
+
+	if r.needsCompaction(number) {
+		r.requestCompaction()
+	}
+}
+
+// after reports whether the record at a was appended after the record at b
+func after(a packLocation, b packLocation) bool {
+	return a.segment > b.segment || (a.segment == b.segment && a.offset > b.offset)
+}
+
+// rotate starts a new active segment.  A segment file which can not be started is removed, so the next rotate can
+// start it again.
+func (r *PackBlockRepository) rotate() error {
+	number := r.active + 1
+
+	previous, ok := r.segments[r.active]
+	if ok {
+		if err := previous.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(r.segmentPath(number), os.O_RDWR|os.O_CREATE|os.O_EXCL, r.fileMode)
+	if err != nil {
+		return err
+	}
+
+	if err := syncDirectory(r.directory); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if ok {
+		// Without its hint file the segment is read when the repository is next opened
+		if err := r.writeHints(r.active, previous.size, previous.size, previous.hints); err != nil {
+			log.Printf("Unable to write the hint file of segment %d: %v", r.active, err)
+		}
+		previous.hints = nil
+	}
+
+	r.segments[number] = &packSegment{file: file}
+	r.active = number
+
+	return nil
+}
+
+// setLive points the index at the block record, replacing any earlier record of the block
+func (r *PackBlockRepository) setLive(blockHash string, location packLocation) {
+	if previous, ok := r.index[blockHash]; ok {
+		r.segments[previous.segment].live -= recordSize(blockHash, previous.length)
+	}
+
+	r.index[blockHash] = location
+	r.segments[location.segment].live += recordSize(blockHash, location.length)
+}
+
+// needsCompaction checks if the live data of a full segment has dropped below the threshold
+func (r *PackBlockRepository) needsCompaction(number int) bool {
+	segment, ok := r.segments[number]
+	if !ok || number == r.active || segment.size == 0 || segment.pending > 0 {
+		return false
+	}
+
+	return float64(segment.live)/float64(segment.size) < r.compactThreshold
+}
+
+// requestCompaction wakes the compaction loop, unless it has already been woken
+func (r *PackBlockRepository) requestCompaction() {
+	select {
+	case r.compactRequests <- struct{}{}:
+	default:
+	}
+}
+
+// compactLoop compacts the segments when asked to, until the repository is closed
+func (r *PackBlockRepository) compactLoop() {
+	defer close(r.stopped)
+
+	for {
+		select {
+		case <-r.compactRequests:
+			if err := r.Compact(); err != nil {
+				log.Printf("Unable to compact segments: %v", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// compact copies the live blocks of the segment, and the tombstones still needed, to the active segment and removes
+// the segment.  A full segment does not change, so it is read without the lock, which is only taken to copy each record.
+// A compaction stopped by closing the repository is left to be done again when it is next opened.
+func (r *PackBlockRepository) compact(number int) error {
+	r.lock.RLock()
+	segment, ok := r.segments[number]
+	r.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(segment.file, 0, segment.size))
+	offset := int64(0)
+	moved := 0
+
+	for offset < segment.size {
+		select {
+		case <-r.done:
+			return nil
+		default:
+		}
+
+		kind, blockHash, data, size, err := readRecord(reader)
+		if err != nil {
+			return fmt.Errorf("Unable to compact segment %d: %v", number, err)
+		}
+
+		copied, err := r.copyRecord(number, kind, blockHash, data, packLocation{segment: number, offset: offset, length: int64(len(data))})
+		if err != nil {
+			return err
+		}
+		if copied && kind == packRecordBlock {
+			moved++
+		}
+
+		offset += size
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// A record appended to the segment just before it was full may not be in the index yet, so was not copied
+	if segment.pending > 0 {
+		return nil
+	}
+
+	// The copies must be on disk before the originals go
+	if err := r.segments[r.active].file.Sync(); err != nil {
+		return err
+	}
+
+	segment.file.Close()
+	delete(r.segments, number)
+	r.compactions++
+
+	log.Printf("Compacted segment %d, moved %d blocks", number, moved)
+
+	// The hint file goes first, so it is never left to describe a segment which is gone
+	if err := os.Remove(r.hintPath(number)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(r.segmentPath(number)); err != nil {
+		return err
+	}
+
+	return syncDirectory(r.directory)
+}
+
+// copyRecord appends a record of a segment being compacted to the active segment, if it is still needed.
+// Returns whether it was copied.
+func (r *PackBlockRepository) copyRecord(number int, kind byte, blockHash string, data []byte, location packLocation) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch kind {
+	case packRecordBlock:
+		if r.index[blockHash] != location {
+			return false, nil
+		}
+
+		newLocation, err := r.append(packRecordBlock, blockHash, data)
+		if err != nil {
+			return false, err
+		}
+		r.setLive(blockHash, newLocation)
+
+	case packRecordTombstone:
+		// Keep the tombstone while the record it deletes is still on disk
+		target := decodeTombstone(data)
+		if _, ok := r.segments[target.segment]; !ok || target.segment == number {
+			return false, nil
+		}
+
+		if _, err := r.append(packRecordTombstone, blockHash, data); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (r *PackBlockRepository) segmentNumbers() []int {
+	numbers := make([]int, 0, len(r.segments))
+	for number := range r.segments {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	return numbers
+}
+
+func (r *PackBlockRepository) segmentPath(number int) string {
+	return filepath.Join(r.directory, fmt.Sprintf("segment-%08d.pack", number))
+}
+
+func (r *PackBlockRepository) hintPath(number int) string {
+	return filepath.Join(r.directory, fmt.Sprintf("segment-%08d.hint", number))
+}
+
+// recordSize is the size of a record holding the hash and data
+func recordSize(blockHash string, length int64) int64 {
+	return packHeaderSize + int64(len(blockHash)) + length
+}
+
+func encodeRecord(kind byte, blockHash string, data []byte) []byte {
+	record := make([]byte, recordSize(blockHash, int64(len(data))))
+	record[0] = kind
+	binary.BigEndian.PutUint16(record[1:], uint16(len(blockHash)))
+	binary.BigEndian.PutUint32(record[3:], uint32(len(data)))
+	copy(record[packHeaderSize:], blockHash)
+	copy(record[packHeaderSize+len(blockHash):], data)
+	binary.BigEndian.PutUint32(record[7:], crc32.ChecksumIEEE(record[packHeaderSize:]))
+
+	return record
+}
+
+// decodeRecord checks the crc of a whole record and returns its parts
+func decodeRecord(record []byte) (byte, string, []byte, error) {
+	if len(record) < packHeaderSize {
+		return 0, "", nil, io.ErrUnexpectedEOF
+	}
+
+	hashLength := int(binary.BigEndian.Uint16(record[1:]))
+	dataLength := int(binary.BigEndian.Uint32(record[3:]))
+	if len(record) != packHeaderSize+hashLength+dataLength {
+		return 0, "", nil, errors.New("Record length does not match")
+	}
+
+	if crc32.ChecksumIEEE(record[packHeaderSize:]) != binary.BigEndian.Uint32(record[7:]) {
+		return 0, "", nil, errors.New("Record checksum does not match")
+	}
+
+	body := record[packHeaderSize:]
+	return record[0], string(body[:hashLength]), body[hashLength:], nil
+}
+
+// readRecord reads the next record and returns its parts and size
+func readRecord(reader io.Reader) (byte, string, []byte, int64, error) {
+	header := make([]byte, packHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, "", nil, 0, err
+	}
+
+	kind := header[0]
+	if kind != packRecordBlock && kind != packRecordTombstone {
+		return 0, "", nil, 0, fmt.Errorf("Unknown record kind %q", kind)
+	}
+
+	hashLength := int64(binary.BigEndian.Uint16(header[1:]))
+	dataLength := int64(binary.BigEndian.Uint32(header[3:]))
+
+	record := make([]byte, packHeaderSize+hashLength+dataLength)
+	copy(record, header)
+	if _, err := io.ReadFull(reader, record[packHeaderSize:]); err != nil {
+		return 0, "", nil, 0, err
+	}
+
+	kind, blockHash, data, err := decodeRecord(record)
+	return kind, blockHash, data, int64(len(record)), err
+}
+
+func encodeTombstone(location packLocation) []byte {
+	data := make([]byte, packTombstoneSize)
+	binary.BigEndian.PutUint32(data, uint32(location.segment))
+	binary.BigEndian.PutUint64(data[4:], uint64(location.offset))
+
+	return data
+}
+
+// decodeTombstone returns the location of the record deleted by the tombstone.
+// The length is not kept in a tombstone, so is left zero.
+func decodeTombstone(data []byte) packLocation {
+	if len(data) != packTombstoneSize {
+		return packLocation{segment: -1}
+	}
+
+	return packLocation{segment: int(binary.BigEndian.Uint32(data)), offset: int64(binary.BigEndian.Uint64(data[4:]))}
+}
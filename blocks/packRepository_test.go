@@ -0,0 +1,283 @@
+package blocks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func packConfig(c *C, segmentSize int64) config.DiskConfig {
+	return config.DiskConfig{Directory: c.MkDir(), PackFiles: true, SegmentSize: segmentSize, CompactThreshold: 0.5}
+}
+
+func (s *BlockSuite) TestPackBlockRepository(c *C) {
+	repository, err := NewPackBlockRepository(packConfig(c, 1024))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer repository.Close()
+
+	err = repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	exists, err := repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsTrue)
+
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "blob")
+
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	exists, _ = repository.CheckBlockExists(ctx, "hash")
+	c.Assert(exists, IsFalse)
+
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *BlockSuite) TestPackBlockRepositoryReopens(c *C) {
+	cfg := packConfig(c, 100)
+	repository, err := NewPackBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	for i := 0; i < 10; i++ {
+		err = repository.SaveBlock(ctx, []byte(fmt.Sprintf("block %d of the pack", i)), fmt.Sprintf("hash%d", i))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+
+	// Delete from an old segment, without dropping it below the threshold
+	err = repository.DeleteBlock(ctx, "hash8")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Overwrite a block
+	err = repository.SaveBlock(ctx, []byte("replaced"), "hash9")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	stats := repository.Stats()
+	c.Assert(stats.Segments > 1, IsTrue)
+	c.Assert(stats.Blocks, Equals, 9)
+	repository.Close()
+
+	// Full segments have hint files, which the index is rebuilt from
+	for number := 1; number < stats.Segments; number++ {
+		_, err = os.Stat(repository.hintPath(number))
+		c.Assert(err == nil, IsTrue, Commentf("Segment %d has no hint file: %v", number, err))
+	}
+	_, err = os.Stat(repository.hintPath(stats.Segments))
+	c.Assert(os.IsNotExist(err), IsTrue)
+
+	repository, err = NewPackBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Stats(), DeepEquals, stats)
+	repository.Close()
+
+	// Without hint files, or with a damaged one, the index is rebuilt from the segments
+	err = os.Remove(repository.hintPath(1))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	err = ioutil.WriteFile(repository.hintPath(2), []byte("damaged"), 0644)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	repository, err = NewPackBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer repository.Close()
+
+	c.Assert(repository.Stats(), DeepEquals, stats)
+
+	// and the hint files are written again
+	_, err = os.Stat(repository.hintPath(1))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	_, _, err = repository.readHints(2, repository.segments[2].size)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	exists, _ := repository.CheckBlockExists(ctx, "hash8")
+	c.Assert(exists, IsFalse)
+
+	data, err := repository.GetBlock(ctx, "hash9")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "replaced")
+
+	data, err = repository.GetBlock(ctx, "hash0")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "block 0 of the pack")
+}
+
+func (s *BlockSuite) TestPackBlockRepositoryCompacts(c *C) {
+	cfg := packConfig(c, 200)
+	repository, err := NewPackBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	for i := 0; i < 20; i++ {
+		err = repository.SaveBlock(ctx, []byte(fmt.Sprintf("block %02d of the pack", i)), fmt.Sprintf("hash%02d", i))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+
+	segments := repository.Stats().Segments
+
+	// Deleting most of the blocks has the old segments compacted in the background
+	for i := 0; i < 20; i++ {
+		if i%4 != 0 {
+			err = repository.DeleteBlock(ctx, fmt.Sprintf("hash%02d", i))
+			c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for repository.Stats().Segments >= segments && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stats := repository.Stats()
+	c.Assert(stats.Compactions > 0, IsTrue)
+	c.Assert(stats.Blocks, Equals, 5)
+
+	for i := 0; i < 20; i += 4 {
+		data, err := repository.GetBlock(ctx, fmt.Sprintf("hash%02d", i))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(string(data), Equals, fmt.Sprintf("block %02d of the pack", i))
+	}
+	repository.Close()
+
+	// Tombstones of compacted blocks do not come back to life, nor do the deleted blocks
+	repository, err = NewPackBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer repository.Close()
+
+	c.Assert(repository.Stats().Blocks, Equals, 5)
+	c.Assert(repository.Stats().Segments < segments, IsTrue)
+
+	exists, _ := repository.CheckBlockExists(ctx, "hash01")
+	c.Assert(exists, IsFalse)
+
+	data, err := repository.GetBlock(ctx, "hash16")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "block 16 of the pack")
+}
+
+func (s *BlockSuite) TestPackBlockRepositoryTruncatesTornRecord(c *C) {
+	cfg := packConfig(c, 1024)
+	repository, err := NewPackBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	repository.SaveBlock(ctx, []byte("whole"), "whole")
+	repository.SaveBlock(ctx, []byte("torn by a crash"), "torn")
+	size := repository.Stats().Size
+	repository.Close()
+
+	// Lose the end of the last record
+	err = os.Truncate(repository.segmentPath(1), size-3)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	repository, err = NewPackBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer repository.Close()
+
+	exists, _ := repository.CheckBlockExists(ctx, "torn")
+	c.Assert(exists, IsFalse)
+
+	data, err := repository.GetBlock(ctx, "whole")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "whole")
+
+	// Appends carry on from the last whole record
+	err = repository.SaveBlock(ctx, []byte("after"), "after")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Stats().Size, Equals, size-recordSize("torn", 15)+recordSize("after", 5))
+}
+
+func (s *BlockSuite) TestStoreWithPackFiles(c *C) {
+	cfg := testConfig()
+	cfg.Storage.Provider = "nfs"
+	cfg.Storage.Disk = packConfig(c, 1024*1024)
+	cfg.Blocks.BlockSize = BlockSize30Kb
+
+	store, err := NewStore(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = store.DeleteBlockedFile(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+}
+
+func (s *BlockSuite) TestPackBlockRepositoryRotatesAfterFailure(c *C) {
+	repository, err := NewPackBlockRepository(packConfig(c, 10))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer repository.Close()
+
+	err = repository.SaveBlock(ctx, []byte("fills the segment"), "full")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The full segment can not be synced, so the next segment is not started
+	active := repository.segments[1]
+	active.file.Close()
+
+	err = repository.SaveBlock(ctx, []byte("next"), "next")
+	c.Assert(err != nil, IsTrue)
+	_, err = os.Stat(repository.segmentPath(2))
+	c.Assert(os.IsNotExist(err), IsTrue)
+
+	// Once it syncs again the next segment is started
+	active.file, err = os.OpenFile(repository.segmentPath(1), os.O_RDWR, 0644)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = repository.SaveBlock(ctx, []byte("next"), "next")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Stats().Segments, Equals, 2)
+}
+
+func (s *BlockSuite) TestPackBlockRepositoryConcurrentWrites(c *C) {
+	cfg := packConfig(c, 200)
+	repository, err := NewPackBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hash := fmt.Sprintf("hash%d", i)
+			if err := repository.SaveBlock(ctx, []byte(fmt.Sprintf("block %d of the pack", i)), hash); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := repository.GetBlock(ctx, hash); err != nil {
+				errs <- err
+				return
+			}
+			if i%2 == 0 {
+				if err := repository.DeleteBlock(ctx, hash); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+	repository.Close()
+
+	// The index read back from the segments is the one the writes left
+	repository, err = NewPackBlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer repository.Close()
+
+	for i := 0; i < 20; i++ {
+		exists, err := repository.CheckBlockExists(ctx, fmt.Sprintf("hash%d", i))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(exists, Equals, i%2 == 1)
+	}
+}
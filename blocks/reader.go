@@ -0,0 +1,217 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// FileReader reads a blocked file block by block, so only one block is held at a time.
+// It can seek, and only the blocks from the position read are loaded, so parts of a file are read cheaply.
+type FileReader struct {
+	ctx   context.Context
+	store *Store
+	file  *BlockedFile
+	// infos are the BlockInfo of each block of the file, and starts where each block starts in the file
+	infos  []BlockInfo
+	starts []int64
+	offset int64
+	// block is the rest of the block being read, from blockOffset
+	block       io.ReadCloser
+	blockOffset int64
+}
+
+// OpenBlockedFile opens the blocked file of the tenant of the context for reading.  The reader must be closed.
+func (s *Store) OpenBlockedFile(ctx context.Context, blockFileID string) (*FileReader, error) {
+	blockedFile, err := s.getBlockedFile(ctx, blockFileID)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &FileReader{ctx: ctx, store: s, file: blockedFile}
+
+	var start int64
+	for _, fileBlock := range blockedFile.BlockList {
+		// A missing block is not a missing file, so ErrNotFound is not passed on
+		blockInfo, err := s.BlockInfoStore.GetBlockInfo(fileBlock.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find block %s: %v", fileBlock.Hash, err)
+		}
+
+		size, err := s.blockSize(ctx, *blockInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		reader.infos = append(reader.infos, *blockInfo)
+		reader.starts = append(reader.starts, start)
+		start += size
+	}
+
+	return reader, nil
+}
+
+// blockSize returns the decoded size of the block.  Blocks saved before sizes were recorded are loaded to find out.
+func (s *Store) blockSize(ctx context.Context, blockInfo BlockInfo) (int64, error) {
+	if blockInfo.Size > 0 {
+		return blockInfo.Size, nil
+	}
+
+	block, err := s.openBlock(ctx, blockInfo, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer block.Close()
+
+	return io.Copy(ioutil.Discard, block)
+}
+
+// Read reads the file from the current position, loading each block as it is reached
+func (r *FileReader) Read(p []byte) (int, error) {
+	for {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		if r.offset >= r.file.Length {
+			return 0, io.EOF
+		}
+
+		if err := r.Open(); err != nil {
+			return 0, err
+		}
+
+		n, err := r.block.Read(p)
+		r.offset += int64(n)
+		r.blockOffset = r.offset
+
+		if err == io.EOF {
+			r.block.Close()
+			r.block = nil
+			err = nil
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Open opens the block holding the current position, so a failing repository is known before the file is read.
+// Read opens blocks itself, so calling it is optional.
+func (r *FileReader) Open() error {
+	if r.block != nil && r.blockOffset == r.offset {
+		return nil
+	}
+	if r.block != nil {
+		r.block.Close()
+		r.block = nil
+	}
+	if r.offset >= r.file.Length {
+		return nil
+	}
+
+	i := len(r.starts) - 1
+	for i > 0 && r.starts[i] > r.offset {
+		i--
+	}
+	blockInfo := r.infos[i]
+
+	log.Printf("Getting Hash: %v StoreID: %v", blockInfo.Hash, blockInfo.StoreID)
+
+	block, err := r.store.openBlock(r.ctx, blockInfo, r.offset-r.starts[i])
+	if errors.Is(err, ErrNotFound) {
+		err = fmt.Errorf("Unable to read block %s: %v", blockInfo.Hash, err)
+	}
+	if err != nil {
+		log.Println("Error: " + err.Error())
+		return err
+	}
+
+	// Store in the FileBlockInfo that we have been used...
+	r.store.touchBlock(blockInfo.Hash)
+
+	r.block = block
+	r.blockOffset = r.offset
+	return nil
+}
+
+// Seek moves the position the file is read from.  The open block is kept until a read from elsewhere, so seeking
+// away and back, as http.ServeContent does to find the size, does not load it again.
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.file.Length
+	}
+
+	if offset < 0 {
+		return r.offset, errors.New("Seek before the start of the file")
+	}
+
+	r.offset = offset
+
+	return offset, nil
+}
+
+// Size returns the length of the file
+func (r *FileReader) Size() int64 {
+	return r.file.Length
+}
+
+// Close releases the block being read
+func (r *FileReader) Close() error {
+	if r.block == nil {
+		return nil
+	}
+
+	err := r.block.Close()
+	r.block = nil
+
+	return err
+}
+
+// openBlock opens the decoded block for reading from offset.  Blocks stored as they are only have the part from
+// offset read from the repository, others are decoded from the start.
+func (s *Store) openBlock(ctx context.Context, blockInfo BlockInfo, offset int64) (io.ReadCloser, error) {
+	if chain, ok := s.Codec.(CodecChain); ok && len(chain) == 0 {
+		return OpenBlockRange(ctx, s.BlockStore, blockInfo.StoreID, offset, -1)
+	}
+
+	if blockInfo.Format != BlockFormatStream {
+		data, err := s.BlockStore.GetBlock(ctx, blockInfo.StoreID)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = s.Codec.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return skipToRange(ioutil.NopCloser(bytes.NewReader(data)), offset, -1)
+	}
+
+	codec, ok := s.Codec.(StreamCodec)
+	if !ok {
+		return nil, errNotStreamCodec
+	}
+
+	block, err := s.BlockStore.OpenBlock(ctx, blockInfo.StoreID)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := codec.DecodeReader(block)
+	if err != nil {
+		block.Close()
+		return nil, err
+	}
+
+	return skipToRange(limitedReadCloser{decoded, block}, offset, -1)
+}
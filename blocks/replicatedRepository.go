@@ -0,0 +1,545 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+// Replica is a BlockRepository holding one copy of every block of a ReplicatedBlockRepository
+type Replica struct {
+	Name       string
+	Repository BlockRepository
+}
+
+// ReplicaStatus reports the health of a replica
+type ReplicaStatus struct {
+	Name string `json:"name"`
+	// Healthy is false once an operation on the replica has failed, until one succeeds again
+	Healthy          bool      `json:"healthy"`
+	LastError        string    `json:"lastError,omitempty"`
+	LastErrorTime    time.Time `json:"lastErrorTime,omitempty"`
+	ConsecutiveFails int64     `json:"consecutiveFails"`
+	Operations       int64     `json:"operations"`
+	Failures         int64     `json:"failures"`
+}
+
+// ReplicationStatus reports the health of all replicas
+type ReplicationStatus struct {
+	Replicas    []ReplicaStatus `json:"replicas"`
+	WriteQuorum int             `json:"writeQuorum"`
+	// PendingRepairs is the number of blocks which may be missing from a replica
+	PendingRepairs int `json:"pendingRepairs"`
+	// PendingDeletes is the number of deleted blocks which a replica failed to delete
+	PendingDeletes int `json:"pendingDeletes"`
+}
+
+// ReplicatedBlockRepository keeps a copy of every block in each of its replicas.
+// Saves succeed once the write quorum of replicas has the block.  Reads use the first healthy replica and fall back to the others.
+// Blocks found missing from a replica are queued and repaired in the background, as are deletes a replica failed.
+type ReplicatedBlockRepository struct {
+	replicas    []Replica
+	writeQuorum int
+
+	lock    sync.Mutex
+	status  []ReplicaStatus
+	repairs map[string]struct{}
+	// deletes are the replicas still to delete each block
+	deletes map[string][]int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReplicatedBlockRepository - Creates a repository replicating blocks to every replica.
+// A writeQuorum of zero requires every replica.  Background repair runs every repairInterval unless it is zero.
+func NewReplicatedBlockRepository(replicas []Replica, writeQuorum int, repairInterval time.Duration) *ReplicatedBlockRepository {
+	if writeQuorum <= 0 || writeQuorum > len(replicas) {
+		writeQuorum = len(replicas)
+	}
+
+	r := &ReplicatedBlockRepository{
+		replicas:    replicas,
+		writeQuorum: writeQuorum,
+		status:      make([]ReplicaStatus, len(replicas)),
+		repairs:     make(map[string]struct{}),
+		deletes:     make(map[string][]int),
+		done:        make(chan struct{}),
+	}
+
+	for i, replica := range replicas {
+		r.status[i] = ReplicaStatus{Name: replica.Name, Healthy: true}
+	}
+
+	if repairInterval > 0 {
+		go r.repairLoop(repairInterval)
+	}
+
+	return r
+}
+
+// Status returns the health of every replica
+func (r *ReplicatedBlockRepository) Status() ReplicationStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return ReplicationStatus{
+		Replicas:       append([]ReplicaStatus(nil), r.status...),
+		WriteQuorum:    r.writeQuorum,
+		PendingRepairs: len(r.repairs),
+		PendingDeletes: len(r.deletes),
+	}
+}
+
+func (r *ReplicatedBlockRepository) reportStatus(status *RepositoryStatus) {
+	replication := r.Status()
+	status.Replication = &replication
+
+	for _, replica := range r.replicas {
+		reportStatus(replica.Repository, status)
+	}
+}
+
+// SaveBlock saves the block to every replica
+func (r *ReplicatedBlockRepository) SaveBlock(ctx context.Context, data []byte, blockHash string) error {
+	return r.write(ctx, blockHash, func(repository BlockRepository) error {
+		return repository.SaveBlock(ctx, data, blockHash)
+	})
+}
+
+// PutBlock reads the block once and streams it to every replica
+func (r *ReplicatedBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	buffer, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	return r.write(ctx, blockHash, func(repository BlockRepository) error {
+		return repository.PutBlock(ctx, blockHash, bytes.NewReader(buffer), int64(len(buffer)))
+	})
+}
+
+// GetBlock gets the block from the first replica able to return it
+func (r *ReplicatedBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	var data []byte
+
+	err := r.read(ctx, blockHash, func(repository BlockRepository) error {
+		var err error
+		data, err = repository.GetBlock(ctx, blockHash)
+		return err
+	})
+
+	return data, err
+}
+
+// OpenBlock opens the block on the first replica able to open it
+func (r *ReplicatedBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+
+	err := r.read(ctx, blockHash, func(repository BlockRepository) error {
+		var err error
+		body, err = repository.OpenBlock(ctx, blockHash)
+		return err
+	})
+
+	return body, err
+}
+
+// CheckBlockExists checks the replicas until one has the block.  Replicas without it are queued for repair.
+func (r *ReplicatedBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	var errs []error
+	missing := false
+
+	for _, i := range r.readOrder() {
+		exists, err := r.replicas[i].Repository.CheckBlockExists(ctx, blockHash)
+		r.record(ctx, i, err)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", r.replicas[i].Name, err))
+			continue
+		}
+
+		if exists {
+			if missing || len(errs) > 0 {
+				r.queueRepair(blockHash)
+			}
+			return true, nil
+		}
+
+		missing = true
+	}
+
+	// Only an error if no replica could answer
+	if !missing {
+		return false, errors.Join(errs...)
+	}
+
+	return false, nil
+}
+
+// DeleteBlock deletes the block from every replica.  Succeeds if any replica deleted it, and the replicas which
+// failed are queued to delete it in the background.
+func (r *ReplicatedBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	r.lock.Lock()
+	delete(r.repairs, blockHash)
+	r.lock.Unlock()
+
+	errs := r.each(ctx, func(repository BlockRepository) error {
+		return repository.DeleteBlock(ctx, blockHash)
+	})
+
+	deleted := false
+	var failed []int
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			deleted = true
+		case !errors.Is(err, ErrNotFound):
+			failed = append(failed, i)
+		}
+	}
+
+	if !deleted {
+		return r.joinErrors(errs)
+	}
+
+	if len(failed) > 0 {
+		log.Printf("Block %s was not deleted from every replica, queued: %v", blockHash, r.joinErrors(errs))
+
+		r.lock.Lock()
+		r.deletes[blockHash] = failed
+		r.lock.Unlock()
+	}
+
+	return nil
+}
+
+// Repair copies the block to every replica missing it.  Replicas which can not be checked or saved to are skipped
+// and reported in the error, once the others are repaired.  Returns the number of replicas repaired.
+func (r *ReplicatedBlockRepository) Repair(ctx context.Context, blockHash string) (int, error) {
+	var data []byte
+	var missing []int
+	var errs []error
+
+	for i, replica := range r.replicas {
+		exists, err := replica.Repository.CheckBlockExists(ctx, blockHash)
+		r.record(ctx, i, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", replica.Name, err))
+			continue
+		}
+
+		if !exists {
+			missing = append(missing, i)
+			continue
+		}
+
+		if data == nil {
+			data, err = replica.Repository.GetBlock(ctx, blockHash)
+			r.record(ctx, i, err)
+			if err != nil {
+				data = nil
+			}
+		}
+	}
+
+	if len(missing) == 0 {
+		return 0, errors.Join(errs...)
+	}
+
+	if data == nil {
+		errs = append(errs, fmt.Errorf("No replica could supply block %s", blockHash))
+		return 0, errors.Join(errs...)
+	}
+
+	repaired := 0
+	for _, i := range missing {
+		err := r.replicas[i].Repository.SaveBlock(ctx, data, blockHash)
+		r.record(ctx, i, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", r.replicas[i].Name, err))
+			continue
+		}
+
+		log.Printf("Repaired block %s on replica %s", blockHash, r.replicas[i].Name)
+		repaired++
+	}
+
+	return repaired, errors.Join(errs...)
+}
+
+func (r *ReplicatedBlockRepository) repairBlock(ctx context.Context, blockHash string) (int, error) {
+	return r.Repair(ctx, blockHash)
+}
+
+// RepairPending repairs every block queued for repair and retries the queued deletes.  Blocks which can not be
+// repaired or deleted stay queued.
+func (r *ReplicatedBlockRepository) RepairPending(ctx context.Context) error {
+	r.lock.Lock()
+	pending := make([]string, 0, len(r.repairs))
+	for blockHash := range r.repairs {
+		pending = append(pending, blockHash)
+	}
+	r.lock.Unlock()
+
+	errs := r.retryDeletes(ctx)
+	for _, blockHash := range pending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if _, err := r.Repair(ctx, blockHash); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		r.lock.Lock()
+		delete(r.repairs, blockHash)
+		r.lock.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// retryDeletes deletes the queued blocks from the replicas which failed to delete them
+func (r *ReplicatedBlockRepository) retryDeletes(ctx context.Context) []error {
+	r.lock.Lock()
+	deletes := make(map[string][]int, len(r.deletes))
+	for blockHash, failed := range r.deletes {
+		deletes[blockHash] = failed
+	}
+	r.lock.Unlock()
+
+	var errs []error
+	for blockHash, failed := range deletes {
+		if err := ctx.Err(); err != nil {
+			return append(errs, err)
+		}
+
+		var remaining []int
+		for _, i := range failed {
+			err := r.replicas[i].Repository.DeleteBlock(ctx, blockHash)
+			r.record(ctx, i, err)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				errs = append(errs, fmt.Errorf("%s: %v", r.replicas[i].Name, err))
+				remaining = append(remaining, i)
+			}
+		}
+
+		r.lock.Lock()
+		if len(remaining) > 0 {
+			r.deletes[blockHash] = remaining
+		} else {
+			delete(r.deletes, blockHash)
+		}
+		r.lock.Unlock()
+	}
+
+	return errs
+}
+
+// Close stops the background repair and closes the replicas
+func (r *ReplicatedBlockRepository) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+
+	var errs []error
+	for _, replica := range r.replicas {
+		if closer, ok := replica.Repository.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", replica.Name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// write runs the save on every replica at once and checks the quorum was reached
+func (r *ReplicatedBlockRepository) write(ctx context.Context, blockHash string, save func(BlockRepository) error) error {
+	// A block saved again is no longer to be deleted
+	r.lock.Lock()
+	delete(r.deletes, blockHash)
+	r.lock.Unlock()
+
+	errs := r.each(ctx, save)
+
+	saved := 0
+	for _, err := range errs {
+		if err == nil {
+			saved++
+		}
+	}
+
+	if saved < r.writeQuorum {
+		// The store does not record the block, so the copies saved would never be deleted
+		r.deleteSavedCopies(context.WithoutCancel(ctx), blockHash, errs)
+		return fmt.Errorf("Block saved to %d of %d replicas, %d required: %v", saved, len(r.replicas), r.writeQuorum, r.joinErrors(errs))
+	}
+
+	if saved < len(r.replicas) {
+		r.queueRepair(blockHash)
+	}
+
+	return nil
+}
+
+// deleteSavedCopies deletes the copies of a block which failed to save from the replicas which saved it.  The deletes
+// which fail are queued and retried in the background.
+func (r *ReplicatedBlockRepository) deleteSavedCopies(ctx context.Context, blockHash string, saveErrs []error) {
+	var failed []int
+	var errs []error
+	for i, saveErr := range saveErrs {
+		if saveErr != nil {
+			continue
+		}
+
+		err := r.replicas[i].Repository.DeleteBlock(ctx, blockHash)
+		r.record(ctx, i, err)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			failed = append(failed, i)
+			errs = append(errs, fmt.Errorf("%s: %v", r.replicas[i].Name, err))
+		}
+	}
+
+	if len(failed) == 0 {
+		return
+	}
+
+	log.Printf("Unable to delete the copies of unsaved block %s, queued to retry: %v", blockHash, errors.Join(errs...))
+
+	r.lock.Lock()
+	r.deletes[blockHash] = failed
+	r.lock.Unlock()
+}
+
+// read tries the replicas in read order until one succeeds.  Earlier replicas which failed are queued for repair.
+func (r *ReplicatedBlockRepository) read(ctx context.Context, blockHash string, load func(BlockRepository) error) error {
+	var errs []error
+
+	for _, i := range r.readOrder() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := load(r.replicas[i].Repository)
+		r.record(ctx, i, err)
+
+		if err == nil {
+			if len(errs) > 0 {
+				r.queueRepair(blockHash)
+			}
+			return nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %v", r.replicas[i].Name, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// each runs the operation on every replica at once and returns the error of each replica
+func (r *ReplicatedBlockRepository) each(ctx context.Context, operation func(BlockRepository) error) []error {
+	errs := make([]error, len(r.replicas))
+
+	var wait sync.WaitGroup
+	for i, replica := range r.replicas {
+		wait.Add(1)
+		go func(i int, replica Replica) {
+			defer wait.Done()
+			errs[i] = operation(replica.Repository)
+			r.record(ctx, i, errs[i])
+		}(i, replica)
+	}
+	wait.Wait()
+
+	return errs
+}
+
+// readOrder returns the replica indexes with the healthy replicas first, otherwise in configured order
+func (r *ReplicatedBlockRepository) readOrder() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	order := make([]int, 0, len(r.replicas))
+	for i, status := range r.status {
+		if status.Healthy {
+			order = append(order, i)
+		}
+	}
+	for i, status := range r.status {
+		if !status.Healthy {
+			order = append(order, i)
+		}
+	}
+
+	return order
+}
+
+// record updates the health of the replica with the result of an operation run with the context
+func (r *ReplicatedBlockRepository) record(ctx context.Context, i int, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status := &r.status[i]
+	status.Operations++
+
+	if err == nil {
+		status.Healthy = true
+		status.ConsecutiveFails = 0
+		return
+	}
+
+	// A caller giving up says nothing about the replica, however the transport wraps the error
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	status.Healthy = false
+	status.LastError = err.Error()
+	status.LastErrorTime = time.Now().UTC()
+	status.ConsecutiveFails++
+	status.Failures++
+}
+
+func (r *ReplicatedBlockRepository) queueRepair(blockHash string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.repairs[blockHash] = struct{}{}
+}
+
+func (r *ReplicatedBlockRepository) joinErrors(errs []error) error {
+	var named []error
+	for i, err := range errs {
+		if err != nil {
+			named = append(named, fmt.Errorf("%s: %v", r.replicas[i].Name, err))
+		}
+	}
+
+	return errors.Join(named...)
+}
+
+// repairLoop repairs the queued blocks every interval until the repository is closed
+func (r *ReplicatedBlockRepository) repairLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.RepairPending(context.Background()); err != nil {
+				log.Printf("Unable to repair all blocks: %v", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
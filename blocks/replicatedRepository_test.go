@@ -0,0 +1,233 @@
+package blocks
+
+import (
+	"context"
+	"io/ioutil"
+	"time"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// newReplicas returns count memory repositories and the replicas using them
+func newReplicas(count int) ([]*MemoryBlockRepository, []Replica) {
+	memories := make([]*MemoryBlockRepository, count)
+	replicas := make([]Replica, count)
+	for i := range memories {
+		memories[i] = NewMemoryBlockRepository()
+		replicas[i] = Replica{Name: string(rune('a' + i)), Repository: memories[i]}
+	}
+
+	return memories, replicas
+}
+
+func (s *BlockSuite) TestReplicatedSavesToEveryReplica(c *C) {
+	memories, replicas := newReplicas(3)
+	repository := NewReplicatedBlockRepository(replicas, 0, 0)
+	defer repository.Close()
+
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	for _, memory := range memories {
+		c.Assert(memory.Len(), Equals, 1)
+	}
+
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	for _, memory := range memories {
+		c.Assert(memory.Len(), Equals, 0)
+	}
+}
+
+func (s *BlockSuite) TestReplicatedWriteQuorum(c *C) {
+	memories, replicas := newReplicas(3)
+	repository := NewReplicatedBlockRepository(replicas, 2, 0)
+	defer repository.Close()
+
+	// One replica down still meets the quorum
+	memories[2].SetFaults(MemoryFaults{Fail: true})
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Status().PendingRepairs, Equals, 1)
+
+	// Two down does not, and the copy saved is deleted again
+	memories[1].SetFaults(MemoryFaults{Fail: true})
+	err = repository.SaveBlock(ctx, []byte("other"), "other")
+	c.Assert(err != nil, IsTrue)
+
+	exists, err := memories[0].CheckBlockExists(ctx, "other")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsFalse)
+}
+
+func (s *BlockSuite) TestReplicatedCallerDeadlineKeepsReplicasHealthy(c *C) {
+	memories, replicas := newReplicas(2)
+	repository := NewReplicatedBlockRepository(replicas, 0, 0)
+	defer repository.Close()
+
+	memories[1].SetFaults(MemoryFaults{Latency: time.Second})
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err := repository.SaveBlock(timeout, []byte("blob"), "hash")
+	c.Assert(err != nil, IsTrue)
+
+	for _, status := range repository.Status().Replicas {
+		c.Assert(status.Failures, Equals, int64(0))
+	}
+}
+
+func (s *BlockSuite) TestReplicatedReadFallsBack(c *C) {
+	memories, replicas := newReplicas(2)
+	repository := NewReplicatedBlockRepository(replicas, 0, 0)
+	defer repository.Close()
+
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	memories[0].SetFaults(MemoryFaults{Fail: true})
+
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "blob")
+
+	status := repository.Status()
+	c.Assert(status.Replicas[0].Healthy, IsFalse)
+	c.Assert(status.Replicas[0].LastError, Not(Equals), "")
+	c.Assert(status.Replicas[1].Healthy, IsTrue)
+
+	// The unhealthy replica is now tried last
+	body, err := repository.OpenBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	data, _ = ioutil.ReadAll(body)
+	body.Close()
+	c.Assert(string(data), Equals, "blob")
+	c.Assert(memories[0].Calls(), Equals, 1)
+
+	// Every replica failing is an error
+	memories[1].SetFaults(MemoryFaults{Fail: true})
+	_, err = repository.GetBlock(ctx, "hash")
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *BlockSuite) TestReplicatedRepairsMissingBlocks(c *C) {
+	memories, replicas := newReplicas(3)
+	repository := NewReplicatedBlockRepository(replicas, 1, 0)
+	defer repository.Close()
+
+	memories[1].SetFaults(MemoryFaults{Fail: true})
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(memories[1].Len(), Equals, 0)
+
+	// Lost from another replica behind our back
+	memories[2].DeleteBlock(ctx, "hash")
+
+	// Can not repair while the replica is down, but the others are repaired
+	err = repository.RepairPending(ctx)
+	c.Assert(err != nil, IsTrue)
+	c.Assert(repository.Status().PendingRepairs, Equals, 1)
+	c.Assert(memories[2].Len(), Equals, 1)
+
+	memories[1].SetFaults(MemoryFaults{})
+	err = repository.RepairPending(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Status().PendingRepairs, Equals, 0)
+
+	for _, memory := range memories {
+		data, err := memory.GetBlock(ctx, "hash")
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(string(data), Equals, "blob")
+	}
+}
+
+func (s *BlockSuite) TestReplicatedExistsQueuesRepair(c *C) {
+	memories, replicas := newReplicas(2)
+	repository := NewReplicatedBlockRepository(replicas, 0, 0)
+	defer repository.Close()
+
+	memories[1].SaveBlock(ctx, []byte("blob"), "hash")
+
+	exists, err := repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsTrue)
+	c.Assert(repository.Status().PendingRepairs, Equals, 1)
+
+	repaired, err := repository.Repair(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repaired, Equals, 1)
+	c.Assert(memories[0].Len(), Equals, 1)
+}
+
+func (s *BlockSuite) TestReplicatedRetriesFailedDeletes(c *C) {
+	memories, replicas := newReplicas(2)
+	repository := NewReplicatedBlockRepository(replicas, 0, 0)
+	defer repository.Close()
+
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Deleted from one replica is deleted, and the other is left to retry
+	memories[1].SetFaults(MemoryFaults{Fail: true})
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Status().PendingDeletes, Equals, 1)
+
+	err = repository.RepairPending(ctx)
+	c.Assert(err != nil, IsTrue)
+	c.Assert(repository.Status().PendingDeletes, Equals, 1)
+
+	memories[1].SetFaults(MemoryFaults{})
+	err = repository.RepairPending(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(repository.Status().PendingDeletes, Equals, 0)
+	c.Assert(memories[1].Len(), Equals, 0)
+
+	// No replica able to delete is an error
+	err = repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	memories[0].SetFaults(MemoryFaults{Fail: true})
+	memories[1].SetFaults(MemoryFaults{Fail: true})
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err != nil, IsTrue)
+	c.Assert(repository.Status().PendingDeletes, Equals, 0)
+}
+
+func (s *BlockSuite) TestReplicatedClosesReplicas(c *C) {
+	_, inner := newReplicas(2)
+	nested := NewReplicatedBlockRepository(inner, 0, time.Hour)
+	repository := NewReplicatedBlockRepository([]Replica{{Name: "nested", Repository: nested}}, 0, 0)
+
+	c.Assert(repository.Close(), IsNil)
+
+	select {
+	case <-nested.done:
+	default:
+		c.Fatal("Replica was not closed")
+	}
+}
+
+func (s *BlockSuite) TestStoreWithReplication(c *C) {
+	cfg := testConfig()
+	cfg.Storage.Provider = "replicated"
+	cfg.Storage.Replication.Providers = []string{"memory", "nfs"}
+	cfg.Storage.Cache.Provider = "memory"
+
+	store, err := NewStore(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer store.Close()
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.UnblockFileToBuffer(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	status := store.Status()
+	c.Assert(status.Cache != nil, IsTrue)
+	c.Assert(status.Replication != nil, IsTrue)
+	c.Assert(status.Replication.Replicas, HasLen, 2)
+	c.Assert(status.Replication.Replicas[1].Name, Equals, "nfs")
+}
@@ -0,0 +1,205 @@
+package blocks
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/keithballdotnet/blocker/config"
+	"github.com/keithballdotnet/blocker/retry"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// RetryBlockRepository retries operations on a BlockRepository which fail with a transient error,
+// and stops calling the repository for a while after too many failures in a row
+type RetryBlockRepository struct {
+	name       string
+	repository BlockRepository
+	retrier    *retry.Retrier
+}
+
+// NewRetryBlockRepository - Creates a BlockRepository retrying the errors the classifier finds transient.
+// The name identifies the repository in the status.
+func NewRetryBlockRepository(name string, repository BlockRepository, policy retry.Policy, transient retry.Classifier) *RetryBlockRepository {
+	return &RetryBlockRepository{name: name, repository: repository, retrier: retry.New(policy, transient)}
+}
+
+// Stats returns the retries made and the state of the breaker
+func (r *RetryBlockRepository) Stats() retry.Stats {
+	return r.retrier.Stats()
+}
+
+func (r *RetryBlockRepository) reportStatus(status *RepositoryStatus) {
+	if status.Retries == nil {
+		status.Retries = make(map[string]retry.Stats)
+	}
+	status.Retries[r.name] = r.Stats()
+
+	reportStatus(r.repository, status)
+}
+
+// SaveBlock saves the block, retrying transient errors
+func (r *RetryBlockRepository) SaveBlock(ctx context.Context, bytes []byte, blockHash string) error {
+	return r.retrier.Do(ctx, func() error {
+		return r.repository.SaveBlock(ctx, bytes, blockHash)
+	})
+}
+
+// GetBlock gets the block, retrying transient errors
+func (r *RetryBlockRepository) GetBlock(ctx context.Context, blockHash string) ([]byte, error) {
+	var data []byte
+	err := r.retrier.Do(ctx, func() error {
+		var err error
+		data, err = r.repository.GetBlock(ctx, blockHash)
+		return err
+	})
+
+	return data, err
+}
+
+// CheckBlockExists checks for the block, retrying transient errors
+func (r *RetryBlockRepository) CheckBlockExists(ctx context.Context, blockHash string) (bool, error) {
+	var exists bool
+	err := r.retrier.Do(ctx, func() error {
+		var err error
+		exists, err = r.repository.CheckBlockExists(ctx, blockHash)
+		return err
+	})
+
+	return exists, err
+}
+
+// DeleteBlock deletes the block, retrying transient errors
+func (r *RetryBlockRepository) DeleteBlock(ctx context.Context, blockHash string) error {
+	return r.retrier.Do(ctx, func() error {
+		return r.repository.DeleteBlock(ctx, blockHash)
+	})
+}
+
+// PutBlock streams the block into the repository.
+// The block can only be sent again when the reader can seek back to the start, otherwise it is tried once.
+func (r *RetryBlockRepository) PutBlock(ctx context.Context, blockHash string, data io.Reader, size int64) error {
+	seeker, ok := data.(io.Seeker)
+	if !ok {
+		return r.retrier.Once(ctx, func() error {
+			return r.repository.PutBlock(ctx, blockHash, data, size)
+		})
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	return r.retrier.Do(ctx, func() error {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+
+		return r.repository.PutBlock(ctx, blockHash, data, size)
+	})
+}
+
+// OpenBlock opens the block, retrying transient errors.  Reading the block is not retried.
+func (r *RetryBlockRepository) OpenBlock(ctx context.Context, blockHash string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := r.retrier.Do(ctx, func() error {
+		var err error
+		body, err = r.repository.OpenBlock(ctx, blockHash)
+		return err
+	})
+
+	return body, err
+}
+
+// OpenBlockRange opens part of the block, retrying transient errors.  Reading the block is not retried.
+func (r *RetryBlockRepository) OpenBlockRange(ctx context.Context, blockHash string, offset int64, length int64) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := r.retrier.Do(ctx, func() error {
+		var err error
+		body, err = OpenBlockRange(ctx, r.repository, blockHash, offset, length)
+		return err
+	})
+
+	return body, err
+}
+
+// Close closes the repository if it needs closing
+func (r *RetryBlockRepository) Close() error {
+	if closer, ok := r.repository.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// newRetryRepository retries the transient errors of the storage provider.
+// The disk and memory providers have no transient errors, so are returned as they are.
+func newRetryRepository(provider string, repository BlockRepository, cfg config.RetryConfig) BlockRepository {
+	var transient retry.Classifier
+
+	switch provider {
+	case "s3":
+		transient = isTransientS3Error
+	case "azure":
+		transient = isTransientHTTPError
+	case "cb":
+		transient = isTransientCouchbaseError
+	default:
+		return repository
+	}
+
+	return NewRetryBlockRepository(provider, repository, retry.NewPolicy(cfg), transient)
+}
+
+// HTTPStatusError is returned when a provider answers a request with an unexpected HTTP status
+type HTTPStatusError struct {
+	Operation  string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return e.Operation + ": " + e.Status
+}
+
+// isTransientHTTPError checks if a provider talking HTTP failed with a server error, throttling or a network error
+func isTransientHTTPError(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return retry.IsTransientStatus(statusErr.StatusCode)
+	}
+
+	return retry.IsNetworkError(err)
+}
+
+// isTransientCouchbaseError checks if couchbase is too busy or out of memory for now, or could not be reached
+func isTransientCouchbaseError(err error) bool {
+	var response *gomemcached.MCResponse
+	if errors.As(err, &response) {
+		switch response.Status {
+		case gomemcached.TMPFAIL, gomemcached.EBUSY, gomemcached.ENOMEM:
+			return true
+		}
+
+		return false
+	}
+
+	return retry.IsNetworkError(err)
+}
+
+// isTransientS3Error checks if the request failed with an error worth retrying
+func isTransientS3Error(err error) bool {
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) {
+		switch s3Err.Code {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout":
+			return true
+		}
+
+		return retry.IsTransientStatus(s3Err.StatusCode)
+	}
+
+	return retry.IsNetworkError(err)
+}
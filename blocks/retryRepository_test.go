@@ -0,0 +1,86 @@
+package blocks
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	"github.com/keithballdotnet/blocker/retry"
+	"github.com/mitchellh/goamz/s3"
+	. "gopkg.in/check.v1"
+)
+
+func isInjectedFault(err error) bool {
+	return err == ErrInjectedFault
+}
+
+func (s *BlockSuite) TestRetryBlockRepository(c *C) {
+	memory := NewMemoryBlockRepository()
+	repository := NewRetryBlockRepository("memory", memory, retry.Policy{MaxRetries: 2, InitialDelay: time.Millisecond}, isInjectedFault)
+
+	// The first attempt fails and the retry works
+	memory.SetFaults(MemoryFaults{FailOnCall: 1})
+	err := repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	memory.SetFaults(MemoryFaults{FailOnCall: 1})
+	data, err := repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "blob")
+
+	// A stream which can seek back is sent again
+	memory.SetFaults(MemoryFaults{FailOnCall: 1})
+	err = repository.PutBlock(ctx, "stream", bytes.NewReader([]byte("stream")), 6)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	body, err := repository.OpenBlock(ctx, "stream")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	data, _ = ioutil.ReadAll(body)
+	body.Close()
+	c.Assert(string(data), Equals, "stream")
+
+	// One which cannot is tried once
+	memory.SetFaults(MemoryFaults{FailOnCall: 1})
+	err = repository.PutBlock(ctx, "once", ioutil.NopCloser(bytes.NewReader([]byte("once"))), 4)
+	c.Assert(err, Equals, ErrInjectedFault)
+
+	// Missing blocks are not retried
+	memory.SetFaults(MemoryFaults{})
+	_, err = repository.GetBlock(ctx, "missing")
+	c.Assert(err != nil, IsTrue)
+
+	stats := repository.Stats()
+	c.Assert(stats.Retries, Equals, int64(3))
+	c.Assert(stats.Failures, Equals, int64(1))
+}
+
+func (s *BlockSuite) TestRetryBlockRepositoryBreaker(c *C) {
+	memory := NewMemoryBlockRepository()
+	repository := NewRetryBlockRepository("memory", memory, retry.Policy{BreakerThreshold: 2, BreakerCooldown: time.Hour}, isInjectedFault)
+
+	memory.SetFaults(MemoryFaults{Fail: true})
+	for i := 0; i < 2; i++ {
+		_, err := repository.CheckBlockExists(ctx, "hash")
+		c.Assert(err, Equals, ErrInjectedFault)
+	}
+
+	// The repository is not called once the breaker is open
+	memory.SetFaults(MemoryFaults{})
+	_, err := repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err, Equals, retry.ErrCircuitOpen)
+
+	var status RepositoryStatus
+	reportStatus(repository, &status)
+	c.Assert(status.Retries["memory"].BreakerState, Equals, retry.Open)
+	c.Assert(status.Retries["memory"].Rejected, Equals, int64(1))
+}
+
+func (s *BlockSuite) TestTransientErrors(c *C) {
+	c.Assert(isTransientS3Error(&s3.Error{StatusCode: 503, Code: "SlowDown"}), IsTrue)
+	c.Assert(isTransientS3Error(&s3.Error{StatusCode: 404, Code: "NoSuchKey"}), IsFalse)
+	c.Assert(isTransientHTTPError(&HTTPStatusError{StatusCode: 429}), IsTrue)
+	c.Assert(isTransientHTTPError(&HTTPStatusError{StatusCode: 403}), IsFalse)
+	c.Assert(isTransientHTTPError(errors.New("Not found!")), IsFalse)
+}
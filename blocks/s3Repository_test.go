@@ -0,0 +1,293 @@
+package blocks
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// fakeS3 is a stand-in for an S3 compatible store, addressed path-style
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+	// uploads holds the parts of the multipart uploads in progress
+	uploads   map[string]map[int][]byte
+	completed int
+	// failures is the number of requests to fail with a throttling error
+	failures int
+	requests int
+}
+
+func newFakeS3() (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{objects: make(map[string][]byte), headers: make(map[string]http.Header), uploads: make(map[string]map[int][]byte)}
+	return fake, httptest.NewServer(fake)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests++
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>"))
+		return
+	}
+
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == "POST" && query.Has("uploads"):
+		uploadID = strconv.Itoa(len(f.uploads) + f.completed + 1)
+		f.uploads[uploadID] = make(map[int][]byte)
+		w.Write([]byte("<InitiateMultipartUploadResult><UploadId>" + uploadID + "</UploadId></InitiateMultipartUploadResult>"))
+	case r.Method == "PUT" && uploadID != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[uploadID][number], _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("ETag", strconv.Quote(query.Get("partNumber")))
+	case r.Method == "POST" && uploadID != "":
+		var data []byte
+		for number := 1; number <= len(f.uploads[uploadID]); number++ {
+			data = append(data, f.uploads[uploadID][number]...)
+		}
+		f.objects[r.URL.Path] = data
+		delete(f.uploads, uploadID)
+		f.completed++
+	case r.Method == "DELETE" && uploadID != "":
+		delete(f.uploads, uploadID)
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = data
+		f.headers[r.URL.Path] = r.Header
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == "GET" {
+				w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>"))
+			}
+			return
+		}
+
+		var start, end int
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); n > 0 {
+			if n == 1 || end >= len(data) {
+				end = len(data) - 1
+			}
+			data = data[start : end+1]
+			w.WriteHeader(http.StatusPartialContent)
+		}
+
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case r.Method == "DELETE":
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) object(path string) ([]byte, http.Header, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, ok := f.objects[path]
+	return data, f.headers[path], ok
+}
+
+func s3TestConfig(endpoint string) config.S3Config {
+	return config.S3Config{Key: "key", Secret: "secret", Bucket: "blocks", Endpoint: endpoint, PathStyle: true}
+}
+
+func (s *BlockSuite) TestS3BlockRepositoryCompatibleStore(c *C) {
+	fake, server := newFakeS3()
+	defer server.Close()
+
+	cfg := s3TestConfig(server.URL)
+	cfg.Prefix = "/tenant/"
+	cfg.ServerSideEncryption = "aws:kms"
+	cfg.KMSKeyID = "the-key"
+	cfg.StorageClass = "STANDARD_IA"
+
+	// Multipart uploads can not be encrypted or given a storage class
+	_, err := NewS3BlockRepository(cfg)
+	c.Assert(err != nil, IsTrue)
+
+	cfg.MultipartThreshold = config.S3MultipartOff
+	repository, err := NewS3BlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	exists, err := repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsFalse)
+
+	err = repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The bucket is in the path and the prefix in the key
+	data, headers, ok := fake.object("/blocks/tenant/hash.blk")
+	c.Assert(ok, IsTrue)
+	c.Assert(string(data), Equals, "blob")
+	c.Assert(headers.Get("x-amz-server-side-encryption"), Equals, "aws:kms")
+	c.Assert(headers.Get("x-amz-server-side-encryption-aws-kms-key-id"), Equals, "the-key")
+	c.Assert(headers.Get("x-amz-storage-class"), Equals, "STANDARD_IA")
+
+	err = repository.PutBlock(ctx, "streamed", strings.NewReader("stream"), 6)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	_, headers, _ = fake.object("/blocks/tenant/streamed.blk")
+	c.Assert(headers.Get("x-amz-storage-class"), Equals, "STANDARD_IA")
+
+	exists, err = repository.CheckBlockExists(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(exists, IsTrue)
+
+	data, err = repository.GetBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "blob")
+
+	err = repository.DeleteBlock(ctx, "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = repository.GetBlock(ctx, "hash")
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *BlockSuite) TestS3Region(c *C) {
+	cfg := config.Default().Storage.S3
+
+	// The default AWS region, addressed as goamz does by default
+	region, err := s3Region(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(region.Name, Equals, "eu-west-1")
+
+	cfg.Region = "mars-north-1"
+	_, err = s3Region(cfg)
+	c.Assert(err != nil, IsTrue)
+
+	// A custom endpoint addresses buckets by host name unless path style is asked for
+	cfg.Endpoint = "https://minio.local:9000"
+	region, err = s3Region(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(region.S3Endpoint, Equals, "https://minio.local:9000")
+	c.Assert(region.S3BucketEndpoint, Equals, "https://${bucket}.minio.local:9000")
+
+	cfg.PathStyle = true
+	region, err = s3Region(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(region.S3BucketEndpoint, Equals, "")
+}
+
+func (s *BlockSuite) TestS3BlockRepositoryMultipart(c *C) {
+	fake, server := newFakeS3()
+	defer server.Close()
+
+	cfg := s3TestConfig(server.URL)
+	cfg.MultipartThreshold = config.S3MinPartSize
+	cfg.PartSize = config.S3MinPartSize
+
+	repository, err := NewS3BlockRepository(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Two whole parts and a bit
+	block := bytes.Repeat([]byte("0123456789abcdef"), (2*config.S3MinPartSize+1000)/16)
+
+	err = repository.SaveBlock(ctx, block, "saved")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(fake.completed, Equals, 1)
+
+	// Streamed without knowing the size
+	err = repository.PutBlock(ctx, "streamed", bytes.NewReader(block), -1)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(fake.completed, Equals, 2)
+	c.Assert(fake.uploads, HasLen, 0)
+
+	for _, blockHash := range []string{"saved", "streamed"} {
+		data, err := repository.GetBlock(ctx, blockHash)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(bytes.Equal(data, block), IsTrue, Commentf("Block: %v", blockHash))
+	}
+
+	// Small blocks are still put whole
+	err = repository.PutBlock(ctx, "small", strings.NewReader("small"), -1)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(fake.completed, Equals, 2)
+}
+
+func (s *BlockSuite) TestS3BlockRepositoryRange(c *C) {
+	_, server := newFakeS3()
+	defer server.Close()
+
+	repository, err := NewS3BlockRepository(s3TestConfig(server.URL))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = repository.SaveBlock(ctx, []byte("0123456789"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	ranges := []struct {
+		offset   int64
+		length   int64
+		expected string
+	}{
+		{2, 3, "234"},
+		{5, -1, "56789"},
+		{0, 0, ""},
+	}
+
+	// Through the context and timeout wrappers, as the store uses it
+	wrapped := NewTimeoutBlockRepository(repository, config.Default().Storage.Timeouts)
+
+	for _, r := range ranges {
+		body, err := OpenBlockRange(ctx, wrapped, "hash", r.offset, r.length)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		c.Assert(string(data), Equals, r.expected)
+	}
+}
+
+func (s *BlockSuite) TestS3BlockRepositoryRetries(c *C) {
+	fake, server := newFakeS3()
+	defer server.Close()
+
+	provider, err := NewS3BlockRepository(s3TestConfig(server.URL))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The provider sends each request once, retrying is left to the retry repository
+	fake.failures = 1
+	err = provider.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err != nil, IsTrue)
+	c.Assert(fake.requests, Equals, 1)
+
+	repository := newRetryRepository("s3", provider, config.RetryConfig{MaxRetries: 2, InitialDelay: config.Duration(time.Millisecond)})
+
+	fake.failures = 2
+	err = repository.SaveBlock(ctx, []byte("blob"), "hash")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	fake.failures = 3
+	_, err = repository.GetBlock(ctx, "hash")
+	c.Assert(err != nil, IsTrue)
+	c.Assert(fake.failures, Equals, 0)
+
+	// A missing block is not worth retrying
+	fake.requests = 0
+	_, err = repository.GetBlock(ctx, "missing")
+	c.Assert(err != nil, IsTrue)
+	c.Assert(fake.requests, Equals, 1)
+}
@@ -0,0 +1,142 @@
+package blocks
+
+import (
+	"context"
+	"fmt"
+)
+
+// FileStats describes how a blocked file is stored
+type FileStats struct {
+	ID       string `json:"id"`
+	FileHash string `json:"fileHash"`
+	Length   int64  `json:"length"`
+	// Blocks is the number of blocks in the file, UniqueBlocks the number of different ones
+	Blocks       int `json:"blocks"`
+	UniqueBlocks int `json:"uniqueBlocks"`
+	// SharedBlocks is the number of different blocks also used by other files
+	SharedBlocks int `json:"sharedBlocks"`
+	// StoredSize is the space taken by the different blocks of the file, shared or not
+	StoredSize int64 `json:"storedSize"`
+	// DedupRatio is the length of the file divided by the length of its different blocks
+	DedupRatio float64 `json:"dedupRatio"`
+}
+
+// StoreInfo holds the totals of the store
+type StoreInfo struct {
+	Files  int `json:"files"`
+	Blocks int `json:"blocks"`
+	// Length is the total length of the files, Size of the blocks and StoredSize of the encoded blocks
+	Length     int64 `json:"length"`
+	Size       int64 `json:"size"`
+	StoredSize int64 `json:"storedSize"`
+	// DedupRatio is Length divided by Size
+	DedupRatio float64 `json:"dedupRatio"`
+}
+
+// Stat describes how the blocked file of the tenant of the context is stored
+func (s *Store) Stat(ctx context.Context, blockFileID string) (FileStats, error) {
+	blockedFile, err := s.getBlockedFile(ctx, blockFileID)
+	if err != nil {
+		return FileStats{}, err
+	}
+
+	stats := FileStats{ID: blockedFile.ID, FileHash: blockedFile.FileHash, Length: blockedFile.Length, Blocks: len(blockedFile.BlockList)}
+
+	uses := make(map[string]int64)
+	for _, block := range blockedFile.BlockList {
+		uses[block.Hash]++
+	}
+	stats.UniqueBlocks = len(uses)
+
+	var size int64
+	for hash, count := range uses {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		blockInfo, err := s.BlockInfoStore.GetBlockInfo(hash)
+		if err != nil {
+			return stats, fmt.Errorf("Unable to find block %s: %v", hash, err)
+		}
+
+		if blockInfo.UseCount > count {
+			stats.SharedBlocks++
+		}
+
+		blockSize, storedSize, err := s.blockSizes(ctx, *blockInfo)
+		if err != nil {
+			return stats, err
+		}
+		size += blockSize
+		stats.StoredSize += storedSize
+	}
+
+	stats.DedupRatio = ratio(stats.Length, size)
+
+	return stats, nil
+}
+
+// Info adds up the files and blocks of the store
+func (s *Store) Info(ctx context.Context) (StoreInfo, error) {
+	var info StoreInfo
+
+	blockedFiles, err := s.BlockedFileStore.ListBlockedFiles()
+	if err != nil {
+		return info, err
+	}
+
+	info.Files = len(blockedFiles)
+	for _, blockedFile := range blockedFiles {
+		info.Length += blockedFile.Length
+	}
+
+	blockInfos, err := s.BlockInfoStore.ListBlockInfo()
+	if err != nil {
+		return info, err
+	}
+
+	info.Blocks = len(blockInfos)
+	for _, blockInfo := range blockInfos {
+		if err := ctx.Err(); err != nil {
+			return info, err
+		}
+
+		size, storedSize, err := s.blockSizes(ctx, blockInfo)
+		if err != nil {
+			return info, err
+		}
+		info.Size += size
+		info.StoredSize += storedSize
+	}
+
+	info.DedupRatio = ratio(info.Length, info.Size)
+
+	return info, nil
+}
+
+// blockSizes returns the length of the block and of its encoding.  Blocks saved without their sizes are read to find them.
+func (s *Store) blockSizes(ctx context.Context, blockInfo BlockInfo) (int64, int64, error) {
+	if blockInfo.StoredSize > 0 {
+		return blockInfo.Size, blockInfo.StoredSize, nil
+	}
+
+	data, err := s.BlockStore.GetBlock(ctx, blockInfo.StoreID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to read block %s: %v", blockInfo.Hash, err)
+	}
+
+	decoded, err := s.decodeBlock(blockInfo, data)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int64(len(decoded)), int64(len(data)), nil
+}
+
+// ratio divides a by b, or returns 0 when b is 0
+func ratio(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
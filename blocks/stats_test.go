@@ -0,0 +1,70 @@
+package blocks
+
+import (
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BlockSuite) TestStat(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(true))
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	stats, err := store.Stat(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.Length, Equals, blockedFile.Length)
+	c.Assert(stats.Blocks, Equals, len(blockedFile.BlockList))
+	c.Assert(stats.UniqueBlocks > 0, IsTrue)
+	c.Assert(stats.SharedBlocks, Equals, 0)
+	c.Assert(stats.StoredSize > 0, IsTrue)
+	c.Assert(stats.DedupRatio >= 1, IsTrue)
+
+	// A copy shares every block
+	copied, err := store.CopyBlockedFile(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	copyStats, err := store.Stat(ctx, copied.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(copyStats.SharedBlocks, Equals, stats.UniqueBlocks)
+	c.Assert(copyStats.StoredSize, Equals, stats.StoredSize)
+
+	// Blocks saved without their sizes are read instead
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	blockInfo.Size = 0
+	blockInfo.StoredSize = 0
+	c.Assert(store.BlockInfoStore.SaveBlockInfo(*blockInfo) == nil, IsTrue)
+
+	legacyStats, err := store.Stat(ctx, copied.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(legacyStats, DeepEquals, copyStats)
+
+	_, err = store.Stat(ctx, "missing")
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *BlockSuite) TestInfo(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(true))
+
+	info, err := store.Info(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(info, DeepEquals, StoreInfo{})
+
+	blockedFile, err := store.BlockFile(ctx, inputFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = store.CopyBlockedFile(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	stats, err := store.Stat(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	info, err = store.Info(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(info.Files, Equals, 2)
+	c.Assert(info.Blocks, Equals, stats.UniqueBlocks)
+	c.Assert(info.Length, Equals, 2*blockedFile.Length)
+	c.Assert(info.StoredSize, Equals, stats.StoredSize)
+	c.Assert(info.DedupRatio, Equals, 2*stats.DedupRatio)
+}
@@ -0,0 +1,474 @@
+package blocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/keithballdotnet/blocker/config"
+)
+
+// ErrQuotaExceeded is returned when blocking or copying a file would take a tenant over its quota
+var ErrQuotaExceeded = errors.New("Quota exceeded")
+
+type tenantContextKey struct{}
+
+// WithTenant returns a context acting for the tenant.  The Store only finds the files of the tenant of the context,
+// and blocks new files for it.  A context without a tenant acts for the default tenant, "".
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// Tenant returns the tenant the context acts for
+func Tenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// TenantUsage is the storage used by the files of a tenant
+type TenantUsage struct {
+	Tenant string `json:"tenant"`
+	Files  int    `json:"files"`
+	// Length is the total length of the files
+	Length int64 `json:"length"`
+	// Blocks is the number of different blocks used by the files and StoredSize the space they take.
+	// Blocks shared with other tenants are counted in full by each of them.
+	Blocks     int   `json:"blocks"`
+	StoredSize int64 `json:"storedSize"`
+	// Quota is the limit of the tenant, if it has one
+	Quota *config.QuotaConfig `json:"quota,omitempty"`
+}
+
+// blockKey is the key of the BlockInfo of a block of the tenant.  Blocks are shared by all tenants unless tenants are
+// isolated, when the hash is prefixed with the tenant.  The default tenant never has a prefix.
+func (s *Store) blockKey(tenant string, hash string) string {
+	if !s.IsolateTenants || tenant == "" {
+		return hash
+	}
+	return tenant + ":" + hash
+}
+
+// contentHash returns the hash of the data of the block with the key
+func contentHash(key string) string {
+	return key[strings.LastIndex(key, ":")+1:]
+}
+
+// getBlockedFile returns the file if it belongs to the tenant of the context
+func (s *Store) getBlockedFile(ctx context.Context, blockFileID string) (*BlockedFile, error) {
+	blockedFile, err := s.BlockedFileStore.GetBlockedFile(blockFileID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The files of other tenants can not be told from missing ones
+	if blockedFile.Tenant != Tenant(ctx) {
+		return nil, ErrNotFound
+	}
+
+	return blockedFile, nil
+}
+
+// ListBlockedFiles returns the files of the tenant of the context, ordered by ID
+func (s *Store) ListBlockedFiles(ctx context.Context) ([]BlockedFile, error) {
+	return s.BlockedFileStore.ListTenantBlockedFiles(Tenant(ctx), "", 0)
+}
+
+// ListBlockedFilesAfter returns at most limit files of the tenant of the context with an ID after the given one, ordered by ID
+func (s *Store) ListBlockedFilesAfter(ctx context.Context, after string, limit int) ([]BlockedFile, error) {
+	return s.BlockedFileStore.ListTenantBlockedFiles(Tenant(ctx), after, limit)
+}
+
+// Usage returns the storage used by the tenant of the context
+func (s *Store) Usage(ctx context.Context) (TenantUsage, error) {
+	if err := s.loadUsage(ctx); err != nil {
+		return TenantUsage{}, err
+	}
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	return s.tenantUsage(Tenant(ctx)), nil
+}
+
+// Usages returns the storage used by every tenant with files or a quota, ordered by tenant
+func (s *Store) Usages(ctx context.Context) ([]TenantUsage, error) {
+	if err := s.loadUsage(ctx); err != nil {
+		return nil, err
+	}
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	tenants := make(map[string]bool)
+	for tenant := range s.Quotas {
+		tenants[tenant] = true
+	}
+	for tenant, counter := range s.usage {
+		if counter.files > 0 {
+			tenants[tenant] = true
+		}
+	}
+
+	usages := make([]TenantUsage, 0, len(tenants))
+	for tenant := range tenants {
+		usages = append(usages, s.tenantUsage(tenant))
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Tenant < usages[j].Tenant })
+
+	return usages, nil
+}
+
+// usageCounter is the storage used by the files of a tenant, and by its files still being blocked
+type usageCounter struct {
+	files  int
+	length int64
+	// blocks are the blocks used by the tenant, with the stored size they were counted with
+	blocks     map[string]blockUse
+	storedSize int64
+}
+
+type blockUse struct {
+	uses       int64
+	storedSize int64
+}
+
+// usageLoad counts the usage from the files without holding the infoLock.  The files saved and deleted meanwhile
+// are kept in events, and counted once it is done.
+type usageLoad struct {
+	done   chan struct{}
+	err    error
+	events []usageEvent
+}
+
+type usageEvent struct {
+	blockedFile BlockedFile
+	// sizes are the stored sizes of the blocks of a saved file, nil for a deleted file
+	sizes   map[string]int64
+	deleted bool
+}
+
+// fileUsage follows a file being blocked or copied, so its usage is counted as it grows, or once it is saved
+type fileUsage struct {
+	tenant string
+	// generation is the generation of the counted usage the file is counted in as it grows, or -1 if it is only
+	// counted once saved
+	generation int64
+	// length and blocks are what has been counted so far
+	length int64
+	blocks []string
+	// sizes are the stored sizes of the blocks of the file
+	sizes map[string]int64
+}
+
+// tenantUsage reports the counted usage of the tenant.  Must be called with the infoLock held.
+func (s *Store) tenantUsage(tenant string) TenantUsage {
+	usage := TenantUsage{Tenant: tenant}
+	if counter, ok := s.usage[tenant]; ok {
+		usage.Files, usage.Length, usage.Blocks, usage.StoredSize = counter.files, counter.length, len(counter.blocks), counter.storedSize
+	}
+	if quota, ok := s.Quotas[tenant]; ok {
+		usage.Quota = &quota
+	}
+
+	return usage
+}
+
+// loadUsage counts the usage of every tenant from the files, unless it is already counted.  From then on it is kept
+// up to date as files are added and removed.  It is only counted once a quota or a usage report needs it, and the
+// files are listed without holding the infoLock, so files are saved and deleted while it is counted.
+func (s *Store) loadUsage(ctx context.Context) error {
+	for {
+		s.infoLock.Lock()
+		if s.usage != nil {
+			s.infoLock.Unlock()
+			return nil
+		}
+
+		load := s.usageLoad
+		if load == nil {
+			load = &usageLoad{done: make(chan struct{})}
+			s.usageLoad = load
+			s.infoLock.Unlock()
+
+			if err := s.countUsage(ctx, load); err != nil {
+				return err
+			}
+			continue
+		}
+		s.infoLock.Unlock()
+
+		select {
+		case <-load.done:
+			if load.err != nil {
+				return load.err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// countUsage lists the files and blocks to count the usage, then adds the events of the files saved and deleted
+// while they were listed.  The usage is dropped if it was reset meanwhile.
+func (s *Store) countUsage(ctx context.Context, load *usageLoad) error {
+	usage, listed, err := s.listUsage(ctx)
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	load.err = err
+	close(load.done)
+
+	if s.usageLoad != load {
+		return nil
+	}
+	s.usageLoad = nil
+
+	if err != nil {
+		return err
+	}
+
+	s.usage = usage
+	for _, event := range load.events {
+		if event.deleted != listed[event.blockedFile.ID] {
+			continue
+		}
+
+		counter := s.usageCounter(event.blockedFile.Tenant)
+		if event.deleted {
+			counter.addFile(event.blockedFile, nil, -1)
+		} else {
+			counter.addFile(event.blockedFile, event.sizes, 1)
+		}
+		listed[event.blockedFile.ID] = !event.deleted
+	}
+
+	return nil
+}
+
+// listUsage counts the usage of every tenant from the files and the sizes recorded in the BlockInfo.  Blocks saved
+// before sizes were recorded are counted as taking no space, until fsck -repair records their sizes.
+// Also returns the IDs of the files counted.
+func (s *Store) listUsage(ctx context.Context) (map[string]*usageCounter, map[string]bool, error) {
+	blockedFiles, err := s.BlockedFileStore.ListBlockedFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	blockInfos, err := s.BlockInfoStore.ListBlockInfo()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sizes := make(map[string]int64, len(blockInfos))
+	unsized := 0
+	for _, blockInfo := range blockInfos {
+		sizes[blockInfo.Hash] = blockInfo.StoredSize
+		if blockInfo.StoredSize == 0 {
+			unsized++
+		}
+	}
+	if unsized > 0 {
+		log.Printf("Warning: %d blocks have no recorded size and are not counted in the usage of tenants, fsck -repair records them", unsized)
+	}
+
+	usage := make(map[string]*usageCounter)
+	listed := make(map[string]bool, len(blockedFiles))
+
+	for _, blockedFile := range blockedFiles {
+		counter, ok := usage[blockedFile.Tenant]
+		if !ok {
+			counter = &usageCounter{blocks: make(map[string]blockUse)}
+			usage[blockedFile.Tenant] = counter
+		}
+
+		counter.addFile(blockedFile, sizes, 1)
+		listed[blockedFile.ID] = true
+	}
+
+	return usage, listed, nil
+}
+
+// resetUsage forgets the counted usage, so it is counted again.  Used after files have been changed wholesale.
+func (s *Store) resetUsage() {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	s.usage = nil
+	s.usageLoad = nil
+	s.usageGeneration++
+}
+
+// usageCounter returns the counted usage of the tenant, or nil if the usage is not counted.
+// Must be called with the infoLock held.
+func (s *Store) usageCounter(tenant string) *usageCounter {
+	if s.usage == nil {
+		return nil
+	}
+
+	counter, ok := s.usage[tenant]
+	if !ok {
+		counter = &usageCounter{blocks: make(map[string]blockUse)}
+		s.usage[tenant] = counter
+	}
+
+	return counter
+}
+
+// addFile adds or, with a negative sign, takes away a file.  The sizes are only needed to add blocks.
+func (c *usageCounter) addFile(blockedFile BlockedFile, sizes map[string]int64, sign int64) {
+	c.files += int(sign)
+	c.length += sign * blockedFile.Length
+	for _, block := range blockedFile.BlockList {
+		c.addUse(block.Hash, sizes[block.Hash], sign)
+	}
+}
+
+// addUse adds uses of the block.  The block takes its stored size while the tenant uses it.
+func (c *usageCounter) addUse(hash string, storedSize int64, uses int64) {
+	use, ok := c.blocks[hash]
+	if !ok {
+		if uses <= 0 {
+			return
+		}
+		use.storedSize = storedSize
+		c.storedSize += storedSize
+	}
+
+	use.uses += uses
+	if use.uses <= 0 {
+		c.storedSize -= use.storedSize
+		delete(c.blocks, hash)
+		return
+	}
+
+	c.blocks[hash] = use
+}
+
+// startFile starts following the usage of a file of the tenant.  The usage is counted first if the tenant has a
+// quota, and the file is then counted as it grows, so files added at the same time can not together go over it.
+func (s *Store) startFile(ctx context.Context, tenant string) (*fileUsage, error) {
+	if quota := s.Quotas[tenant]; quota.Length > 0 || quota.StoredSize > 0 {
+		if err := s.loadUsage(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	file := &fileUsage{tenant: tenant, generation: -1, sizes: make(map[string]int64)}
+	if s.usage != nil {
+		file.generation = s.usageGeneration
+	}
+
+	return file, nil
+}
+
+// growingCounter returns the counter the file is counted in as it grows, or nil if it is only counted once saved.
+// Must be called with the infoLock held.
+func (s *Store) growingCounter(file *fileUsage) *usageCounter {
+	if file.generation != s.usageGeneration {
+		return nil
+	}
+
+	return s.usageCounter(file.tenant)
+}
+
+// reserveLength counts file data being blocked or copied, unless it would take the tenant over its quota
+func (s *Store) reserveLength(file *fileUsage, length int64) error {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	counter := s.growingCounter(file)
+	if counter == nil {
+		return nil
+	}
+
+	if quota := s.Quotas[file.tenant]; quota.Length > 0 && counter.length+length > quota.Length {
+		return fmt.Errorf("%w: the files of tenant %q would be longer than %d bytes", ErrQuotaExceeded, file.tenant, quota.Length)
+	}
+
+	counter.length += length
+	file.length += length
+
+	return nil
+}
+
+// countBlock counts a block added to the file, and checks the blocks used by the tenant, including those of files
+// still being blocked, are within its quota
+func (s *Store) countBlock(file *fileUsage, hash string, storedSize int64) error {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	file.sizes[hash] = storedSize
+
+	counter := s.growingCounter(file)
+	if counter == nil {
+		return nil
+	}
+
+	counter.addUse(hash, storedSize, 1)
+	file.blocks = append(file.blocks, hash)
+
+	if quota := s.Quotas[file.tenant]; quota.StoredSize > 0 && counter.storedSize > quota.StoredSize {
+		return fmt.Errorf("%w: the blocks of tenant %q would take more than %d bytes", ErrQuotaExceeded, file.tenant, quota.StoredSize)
+	}
+
+	return nil
+}
+
+// uncountFile gives back what was counted for a file which was not saved
+func (s *Store) uncountFile(file *fileUsage) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+
+	if counter := s.growingCounter(file); counter != nil {
+		counter.length -= file.length
+		for _, hash := range file.blocks {
+			counter.addUse(hash, 0, -1)
+		}
+	}
+
+	file.length = 0
+	file.blocks = nil
+}
+
+// countSavedFile counts a file once it is saved, adding what was not counted as it grew.
+// Must be called with the infoLock held.
+func (s *Store) countSavedFile(file *fileUsage, blockedFile BlockedFile) {
+	if s.usageLoad != nil {
+		s.usageLoad.events = append(s.usageLoad.events, usageEvent{blockedFile: blockedFile, sizes: file.sizes})
+	}
+
+	if counter := s.growingCounter(file); counter != nil {
+		counter.files++
+		counter.length += blockedFile.Length - file.length
+		for _, block := range blockedFile.BlockList[len(file.blocks):] {
+			counter.addUse(block.Hash, file.sizes[block.Hash], 1)
+		}
+		return
+	}
+
+	if counter := s.usageCounter(file.tenant); counter != nil {
+		counter.addFile(blockedFile, file.sizes, 1)
+	}
+}
+
+// countDeletedFile takes away a file once it is deleted.  Must be called with the infoLock held.
+func (s *Store) countDeletedFile(blockedFile BlockedFile) {
+	if s.usageLoad != nil {
+		s.usageLoad.events = append(s.usageLoad.events, usageEvent{blockedFile: blockedFile, deleted: true})
+	}
+
+	if counter := s.usageCounter(blockedFile.Tenant); counter != nil {
+		counter.addFile(blockedFile, nil, -1)
+	}
+}
@@ -0,0 +1,298 @@
+package blocks
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BlockSuite) TestTenantsOnlySeeTheirFiles(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(true))
+	acme := WithTenant(ctx, "acme")
+	other := WithTenant(ctx, "other")
+
+	blockedFile, err := store.BlockBuffer(acme, strings.NewReader("hello world"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockedFile.Tenant, Equals, "acme")
+
+	_, err = store.BlockBuffer(ctx, strings.NewReader("hello world"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	buffer, err := store.UnblockFileToBuffer(acme, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(buffer.String(), Equals, "hello world")
+
+	for _, wrong := range []string{"other", ""} {
+		tenantCtx := WithTenant(ctx, wrong)
+
+		_, err = store.UnblockFileToBuffer(tenantCtx, blockedFile.ID)
+		c.Assert(errors.Is(err, ErrNotFound), IsTrue, Commentf("Wrong error: %v", err))
+		_, err = store.Stat(tenantCtx, blockedFile.ID)
+		c.Assert(errors.Is(err, ErrNotFound), IsTrue, Commentf("Wrong error: %v", err))
+		_, err = store.CopyBlockedFile(tenantCtx, blockedFile.ID)
+		c.Assert(errors.Is(err, ErrNotFound), IsTrue, Commentf("Wrong error: %v", err))
+		err = store.DeleteBlockedFile(tenantCtx, blockedFile.ID)
+		c.Assert(errors.Is(err, ErrNotFound), IsTrue, Commentf("Wrong error: %v", err))
+	}
+
+	files, err := store.ListBlockedFiles(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].ID, Equals, blockedFile.ID)
+
+	files, err = store.ListBlockedFiles(other)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(files, HasLen, 0)
+
+	copied, err := store.CopyBlockedFile(acme, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(copied.Tenant, Equals, "acme")
+}
+
+func (s *BlockSuite) TestListBlockedFilesAfter(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(true))
+	acme := WithTenant(ctx, "acme")
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		blockedFile, err := store.BlockBuffer(acme, strings.NewReader(fmt.Sprintf("file %d", i)))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		ids = append(ids, blockedFile.ID)
+
+		// The files of other tenants are not in the pages
+		_, err = store.BlockBuffer(ctx, strings.NewReader(fmt.Sprintf("file %d", i)))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	}
+	sort.Strings(ids)
+
+	files, err := store.ListBlockedFilesAfter(acme, "", 2)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(files, HasLen, 2)
+	c.Assert(files[0].ID, Equals, ids[0])
+	c.Assert(files[1].ID, Equals, ids[1])
+
+	files, err = store.ListBlockedFilesAfter(acme, ids[1], 2)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(files, HasLen, 2)
+	c.Assert(files[0].ID, Equals, ids[2])
+	c.Assert(files[1].ID, Equals, ids[3])
+
+	files, err = store.ListBlockedFilesAfter(acme, ids[3], 2)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].ID, Equals, ids[4])
+}
+
+func (s *BlockSuite) TestTenantsShareBlocksUnlessIsolated(c *C) {
+	for _, isolate := range []bool{false, true} {
+		store, repository := newMemoryStore(c, archiveConfig(true))
+		store.IsolateTenants = isolate
+
+		first, err := store.BlockBuffer(WithTenant(ctx, "acme"), strings.NewReader("hello world"))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		second, err := store.BlockBuffer(WithTenant(ctx, "other"), strings.NewReader("hello world"))
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+		if isolate {
+			c.Assert(repository.Len(), Equals, 2)
+			c.Assert(first.BlockList[0].Hash != second.BlockList[0].Hash, IsTrue)
+		} else {
+			c.Assert(repository.Len(), Equals, 1)
+			c.Assert(first.BlockList[0].Hash, Equals, second.BlockList[0].Hash)
+		}
+
+		// Isolated blocks are still checked against the hash of their data
+		report, err := store.Fsck(ctx, FsckOptions{Verify: true})
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(report.OK(), IsTrue, Commentf("Isolated %v: %+v", isolate, report))
+
+		err = store.DeleteBlockedFile(WithTenant(ctx, "acme"), first.ID)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+		buffer, err := store.UnblockFileToBuffer(WithTenant(ctx, "other"), second.ID)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		c.Assert(buffer.String(), Equals, "hello world")
+	}
+}
+
+func (s *BlockSuite) TestQuotas(c *C) {
+	store, repository := newMemoryStore(c, archiveConfig(false))
+	store.Quotas = map[string]config.QuotaConfig{"acme": {Length: 40000}}
+	acme := WithTenant(ctx, "acme")
+
+	blockedFile, err := store.BlockBuffer(acme, strings.NewReader(strings.Repeat("a", 20000)))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// A refused file gives back the blocks it saved
+	blocks := repository.Len()
+	_, err = store.BlockBuffer(acme, strings.NewReader(strings.Repeat("b", 30720)+strings.Repeat("c", 10000)))
+	c.Assert(errors.Is(err, ErrQuotaExceeded), IsTrue, Commentf("Wrong error: %v", err))
+	c.Assert(repository.Len(), Equals, blocks)
+
+	// A copy adds to the length of the files
+	_, err = store.CopyBlockedFile(acme, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	_, err = store.CopyBlockedFile(acme, blockedFile.ID)
+	c.Assert(errors.Is(err, ErrQuotaExceeded), IsTrue, Commentf("Wrong error: %v", err))
+
+	// Other tenants are not limited
+	_, err = store.BlockBuffer(ctx, strings.NewReader(strings.Repeat("b", 50000)))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The stored size only counts each block once
+	usage, err := store.Usage(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	store.Quotas = map[string]config.QuotaConfig{"acme": {StoredSize: usage.StoredSize}}
+
+	_, err = store.BlockBuffer(acme, strings.NewReader(strings.Repeat("a", 20000)))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	_, err = store.BlockBuffer(acme, strings.NewReader("new data"))
+	c.Assert(errors.Is(err, ErrQuotaExceeded), IsTrue, Commentf("Wrong error: %v", err))
+}
+
+func (s *BlockSuite) TestUsage(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(false))
+	store.Quotas = map[string]config.QuotaConfig{"empty": {Length: 100}}
+	acme := WithTenant(ctx, "acme")
+
+	blockedFile, err := store.BlockBuffer(acme, strings.NewReader("hello world"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	_, err = store.CopyBlockedFile(acme, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	_, err = store.BlockBuffer(ctx, strings.NewReader("hello"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	usage, err := store.Usage(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usage.Tenant, Equals, "acme")
+	c.Assert(usage.Files, Equals, 2)
+	c.Assert(usage.Length, Equals, int64(22))
+	c.Assert(usage.Blocks, Equals, 1)
+	c.Assert(usage.StoredSize > 0, IsTrue)
+	c.Assert(usage.Quota == nil, IsTrue)
+
+	usages, err := store.Usages(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usages, HasLen, 3)
+	c.Assert(usages[0].Tenant, Equals, "")
+	c.Assert(usages[0].Length, Equals, int64(5))
+	c.Assert(usages[1].Tenant, Equals, "acme")
+	c.Assert(usages[2].Tenant, Equals, "empty")
+	c.Assert(usages[2].Files, Equals, 0)
+	c.Assert(usages[2].Quota.Length, Equals, int64(100))
+}
+
+func (s *BlockSuite) TestQuotasHoldForConcurrentUploads(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(false))
+	store.Quotas = map[string]config.QuotaConfig{"acme": {Length: 40000}}
+	acme := WithTenant(ctx, "acme")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = store.BlockBuffer(acme, strings.NewReader(strings.Repeat(fmt.Sprint(i), 10000)))
+		}(i)
+	}
+	wg.Wait()
+
+	saved := 0
+	for _, err := range errs {
+		if err == nil {
+			saved++
+			continue
+		}
+		c.Assert(errors.Is(err, ErrQuotaExceeded), IsTrue, Commentf("Wrong error: %v", err))
+	}
+	c.Assert(saved, Equals, 4)
+
+	usage, err := store.Usage(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usage.Files, Equals, 4)
+	c.Assert(usage.Length, Equals, int64(40000))
+
+	// The kept usage matches the usage counted again from the files
+	store.resetUsage()
+	counted, err := store.Usage(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(counted, DeepEquals, usage)
+}
+
+func (s *BlockSuite) TestUsageOnlyCountedWhenNeeded(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(false))
+	acme := WithTenant(ctx, "acme")
+
+	// Without quotas nothing is counted until a usage report needs it
+	blockedFile, err := store.BlockBuffer(acme, strings.NewReader("hello world"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(store.usage == nil, IsTrue)
+
+	// A block saved before sizes were recorded takes no space until fsck records its size
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	storedSize := blockInfo.StoredSize
+	blockInfo.Size, blockInfo.StoredSize = 0, 0
+	err = store.BlockInfoStore.SaveBlockInfo(*blockInfo)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	usage, err := store.Usage(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usage.Files, Equals, 1)
+	c.Assert(usage.StoredSize, Equals, int64(0))
+
+	report, err := store.Fsck(ctx, FsckOptions{Repair: true})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(report.RecordedSizes, Equals, 1)
+
+	usage, err = store.Usage(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usage.StoredSize, Equals, storedSize)
+
+	// Once counted, the usage is kept as files are deleted
+	err = store.DeleteBlockedFile(acme, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	usage, err = store.Usage(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usage, DeepEquals, TenantUsage{Tenant: "acme"})
+}
+
+func (s *BlockSuite) TestFailedCopyChangesNothing(c *C) {
+	store, _ := newMemoryStore(c, archiveConfig(false))
+	store.Quotas = map[string]config.QuotaConfig{"acme": {Length: 100000}}
+	acme := WithTenant(ctx, "acme")
+
+	blockedFile, err := store.BlockBuffer(acme, strings.NewReader(strings.Repeat("a", 30720)+"b"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockedFile.BlockList, HasLen, 2)
+
+	// The copy fails on its second block, after the first has been looked up
+	err = store.BlockInfoStore.DeleteBlockInfo(blockedFile.BlockList[1].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	usage, err := store.Usage(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	store.Quotas = nil
+
+	_, err = store.CopyBlockedFile(acme, blockedFile.ID)
+	c.Assert(err != nil, IsTrue)
+
+	blockInfo, err := store.BlockInfoStore.GetBlockInfo(blockedFile.BlockList[0].Hash)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockInfo.UseCount, Equals, int64(1))
+
+	files, err := store.ListBlockedFiles(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(files, HasLen, 1)
+
+	after, err := store.Usage(acme)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(after, DeepEquals, TenantUsage{Tenant: "acme", Files: usage.Files, Length: usage.Length, Blocks: usage.Blocks, StoredSize: usage.StoredSize})
+}
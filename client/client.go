@@ -0,0 +1,451 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keithballdotnet/blocker/auth"
+	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/crypto"
+	"github.com/keithballdotnet/blocker/retry"
+)
+
+// DefaultRetryPolicy is used by clients created without a retry policy
+var DefaultRetryPolicy = retry.Policy{MaxRetries: 3, InitialDelay: 100 * time.Millisecond, MaxDelay: 2 * time.Second}
+
+// listPageSize is the number of files asked for by each list request
+var listPageSize = 1000
+
+// maxErrorMessage is the most of an error response read into an Error
+const maxErrorMessage = 4096
+
+// Options configure a Client
+type Options struct {
+	// HTTPClient sends the requests.  Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Retry controls how requests failing with a network error, a 5xx or a 429 status are retried.  Defaults to DefaultRetryPolicy.
+	Retry *retry.Policy
+	// LegacySigning signs requests with the original scheme, for servers which do not know the version 2 scheme.
+	// It does not cover the query, headers or body of the request.
+	LegacySigning bool
+	// AccessKeyID is the ID of the access key whose secret is passed to New.  Leave it empty to sign with the shared key of the server.
+	AccessKeyID string
+	// BearerToken returns a token sent with each request in place of a signature, for servers accepting tokens from
+	// an identity provider.  It is called for every request, so it can renew tokens which are about to expire.
+	// The key passed to New is not used.
+	BearerToken func(ctx context.Context) (string, error)
+}
+
+// UploadOptions describe an uploaded file
+type UploadOptions struct {
+	FileName    string
+	ContentType string
+}
+
+// Error is returned when the server answers with an error status
+type Error struct {
+	StatusCode int
+	// Message is the body of the response
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Blocker returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("Blocker returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound checks if the error is the server reporting the file does not exist
+func IsNotFound(err error) bool {
+	var blockerErr *Error
+	return errors.As(err, &blockerErr) && blockerErr.StatusCode == http.StatusNotFound
+}
+
+// Client calls the REST API of a Blocker server, signing each request with an access key or the shared key, or sending a bearer token
+type Client struct {
+	baseURL    string
+	keyID      string
+	key        string
+	httpClient *http.Client
+	retrier    *retry.Retrier
+	legacy     bool
+	token      func(ctx context.Context) (string, error)
+}
+
+// New creates a Client for the server at the base URL, such as https://localhost:8010, signing requests with the key
+func New(baseURL string, key string, options Options) *Client {
+	httpClient := options.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	policy := DefaultRetryPolicy
+	if options.Retry != nil {
+		policy = *options.Retry
+	}
+
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		keyID:      options.AccessKeyID,
+		key:        key,
+		httpClient: httpClient,
+		retrier:    retry.New(policy, isTransient),
+		legacy:     options.LegacySigning,
+		token:      options.BearerToken,
+	}
+}
+
+// RetryStats returns the retries and breaker state of the client
+func (c *Client) RetryStats() retry.Stats {
+	return c.retrier.Stats()
+}
+
+// Upload blocks the content of r and returns the new file.
+// The content is hashed for the signature before it is sent, so r is copied to a temporary file unless it is an io.Seeker.
+func (c *Client) Upload(ctx context.Context, r io.Reader, options UploadOptions) (blocks.BlockedFile, error) {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/octet-stream")
+	if options.ContentType != "" {
+		header.Set("Content-Type", options.ContentType)
+	}
+	if options.FileName != "" {
+		header.Set("FileName", options.FileName)
+	}
+
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		file, err := ioutil.TempFile("", "blocker_upload_")
+		if err != nil {
+			return blocks.BlockedFile{}, err
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		if _, err := io.Copy(file, r); err != nil {
+			return blocks.BlockedFile{}, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return blocks.BlockedFile{}, err
+		}
+		body = file
+	}
+
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return blocks.BlockedFile{}, err
+	}
+
+	contentSHA256, err := auth.HashBody(body)
+	if err != nil {
+		return blocks.BlockedFile{}, err
+	}
+
+	req := request{
+		method:        "PUT",
+		path:          "/api/v1/blocker",
+		header:        header,
+		contentSHA256: contentSHA256,
+		unsafe:        true,
+		expected:      http.StatusCreated,
+		body: func() (io.Reader, error) {
+			_, err := body.Seek(start, io.SeekStart)
+			return body, err
+		},
+	}
+
+	var blockedFile blocks.BlockedFile
+	return blockedFile, c.doJSON(ctx, req, &blockedFile)
+}
+
+// Download writes the file to w
+func (c *Client) Download(ctx context.Context, id string, w io.Writer) error {
+	return c.download(ctx, request{method: "GET", path: filePath(id), expected: http.StatusOK}, w)
+}
+
+// DownloadRange writes length bytes of the file starting at offset to w.  A negative length reads to the end of the file.
+func (c *Client) DownloadRange(ctx context.Context, id string, offset int64, length int64, w io.Writer) error {
+	if offset < 0 {
+		return fmt.Errorf("Invalid offset %d", offset)
+	}
+	if length == 0 {
+		return nil
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+
+	header := make(http.Header)
+	header.Set("Range", byteRange)
+
+	return c.download(ctx, request{method: "GET", path: filePath(id), header: header, expected: http.StatusPartialContent}, w)
+}
+
+// download streams the body of the response to w.  Only getting the response is retried, as w may already hold part of the body after.
+func (c *Client) download(ctx context.Context, req request, w io.Writer) error {
+	response, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// Copy copies the file and returns the copy
+func (c *Client) Copy(ctx context.Context, id string) (blocks.BlockedFile, error) {
+	var blockedFile blocks.BlockedFile
+	return blockedFile, c.doJSON(ctx, request{method: "COPY", path: filePath(id), unsafe: true, expected: http.StatusOK}, &blockedFile)
+}
+
+// Delete deletes the file
+func (c *Client) Delete(ctx context.Context, id string) error {
+	attempts := 0
+	req := request{
+		method:   "DELETE",
+		path:     filePath(id),
+		expected: http.StatusNoContent,
+		// Counts the attempts, as the body is asked for by each
+		body: func() (io.Reader, error) {
+			attempts++
+			return nil, nil
+		},
+	}
+
+	response, err := c.do(ctx, req)
+	if err != nil {
+		// An earlier attempt may have deleted the file before failing
+		if attempts > 1 && IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	return response.Body.Close()
+}
+
+// Stat describes how the file is stored
+func (c *Client) Stat(ctx context.Context, id string) (blocks.FileStats, error) {
+	var stats blocks.FileStats
+	return stats, c.doJSON(ctx, request{method: "GET", path: filePath(id) + "/stat", expected: http.StatusOK}, &stats)
+}
+
+// List returns every file, ordered by ID.  The files are read a page at a time.
+func (c *Client) List(ctx context.Context) ([]blocks.BlockedFile, error) {
+	var blockedFiles []blocks.BlockedFile
+
+	after := ""
+	for {
+		query := url.Values{"limit": {strconv.Itoa(listPageSize)}}
+		if after != "" {
+			query.Set("after", after)
+		}
+
+		var page []blocks.BlockedFile
+		if err := c.doJSON(ctx, request{method: "GET", path: "/api/v1/files", query: query, expected: http.StatusOK}, &page); err != nil {
+			return blockedFiles, err
+		}
+
+		blockedFiles = append(blockedFiles, page...)
+		if len(page) < listPageSize {
+			return blockedFiles, nil
+		}
+
+		after = page[len(page)-1].ID
+	}
+}
+
+// Usage returns the storage used by the tenant of the client
+func (c *Client) Usage(ctx context.Context) (blocks.TenantUsage, error) {
+	var usage blocks.TenantUsage
+	return usage, c.doJSON(ctx, request{method: "GET", path: "/api/v1/usage", expected: http.StatusOK}, &usage)
+}
+
+// Tenants returns the storage used by every tenant.  Needs an admin key without a tenant.
+func (c *Client) Tenants(ctx context.Context) ([]blocks.TenantUsage, error) {
+	var usages []blocks.TenantUsage
+	return usages, c.doJSON(ctx, request{method: "GET", path: "/api/v1/tenants", expected: http.StatusOK}, &usages)
+}
+
+// filePath is the path of the REST resource of a file
+func filePath(id string) string {
+	return "/api/v1/blocker/" + url.PathEscape(id)
+}
+
+// request describes a call to the REST API
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	// body returns the body for each attempt.  Nil sends no body.
+	body func() (io.Reader, error)
+	// contentSHA256 is the hex SHA-256 of the body.  Empty for a request without a body.
+	contentSHA256 string
+	// unsafe is set for requests which are only sent again if the server can not have acted on them
+	unsafe bool
+	// expected is the status of a successful response
+	expected int
+}
+
+// doJSON sends the request and decodes the JSON response into v
+func (c *Client) doJSON(ctx context.Context, req request, v interface{}) error {
+	response, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return fmt.Errorf("Unable to decode response: %w", err)
+	}
+
+	return nil
+}
+
+// do sends the request, retrying it while it fails with a transient error.
+// Returns the response if it has the expected status, otherwise the Error it holds.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	var response *http.Response
+
+	contentSHA256 := req.contentSHA256
+	if contentSHA256 == "" {
+		contentSHA256 = auth.EmptySHA256
+	}
+
+	err := c.retrier.Do(ctx, func() error {
+		var body io.Reader
+		if req.body != nil {
+			var err error
+			if body, err = req.body(); err != nil {
+				return notRetried{err}
+			}
+
+			// The http.Client closes a body which is an io.Closer, but the reader belongs to the caller
+			if _, ok := body.(io.Closer); ok {
+				body = struct{ io.Reader }{body}
+			}
+		}
+
+		httpRequest, err := http.NewRequestWithContext(ctx, req.method, c.baseURL+req.path, body)
+		if err != nil {
+			return notRetried{err}
+		}
+		if req.query != nil {
+			httpRequest.URL.RawQuery = req.query.Encode()
+		}
+		for name, values := range req.header {
+			httpRequest.Header[name] = values
+		}
+		if err := c.sign(httpRequest, contentSHA256); err != nil {
+			return notRetried{err}
+		}
+
+		response, err = c.httpClient.Do(httpRequest)
+		if err != nil {
+			if req.unsafe && !isDialError(err) {
+				return notRetried{err}
+			}
+			return err
+		}
+
+		if response.StatusCode == req.expected {
+			return nil
+		}
+
+		err = readError(response)
+		if req.unsafe && response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable {
+			return notRetried{err}
+		}
+		return err
+	})
+
+	var stop notRetried
+	if errors.As(err, &stop) {
+		err = stop.err
+	}
+
+	return response, err
+}
+
+// sign adds the date, a nonce and the version 2 signature of the request, or the legacy signature of its method, date and path.
+// Requests of a client with a bearer token carry the token instead.
+func (c *Client) sign(request *http.Request, contentSHA256 string) error {
+	if c.token != nil {
+		token, err := c.token(request.Context())
+		if err != nil {
+			return err
+		}
+
+		request.Header.Set("Authorization", auth.BearerScheme+" "+token)
+		return nil
+	}
+
+	if c.legacy {
+		date := time.Now().UTC().Format(time.RFC1123)
+		request.Header.Set(auth.DateHeader, date)
+
+		authRequestKey := fmt.Sprintf("%s\n%s\n%s", request.Method, date, request.URL.Path)
+		request.Header.Set("Authorization", crypto.GetHmac256(authRequestKey, c.key))
+		return nil
+	}
+
+	nonce, err := auth.NewNonce()
+	if err != nil {
+		return err
+	}
+
+	return auth.SignRequest(request, c.keyID, c.key, contentSHA256, nonce, time.Now())
+}
+
+// readError reads the response of a failed request into an Error
+func readError(response *http.Response) error {
+	defer response.Body.Close()
+
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorMessage))
+	return &Error{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+}
+
+// notRetried marks an error after which the request must not be sent again
+type notRetried struct {
+	err error
+}
+
+func (e notRetried) Error() string {
+	return e.err.Error()
+}
+
+// isTransient checks if the request is worth sending again
+func isTransient(err error) bool {
+	var stop notRetried
+	if errors.As(err, &stop) {
+		return false
+	}
+
+	var blockerErr *Error
+	if errors.As(err, &blockerErr) {
+		return retry.IsTransientStatus(blockerErr.StatusCode)
+	}
+
+	return retry.IsNetworkError(err)
+}
+
+// isDialError checks if the request failed before reaching the server
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,346 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/keithballdotnet/blocker/auth"
+	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	"github.com/keithballdotnet/blocker/retry"
+	"github.com/keithballdotnet/blocker/server"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+// ClientSuite runs the client against the real handlers serving a store kept in memory
+type ClientSuite struct {
+	store  *blocks.Store
+	server *httptest.Server
+	client *Client
+	// failures is the number of requests failed with failStatus before they reach the handlers
+	failures   int32
+	failStatus int
+}
+
+var _ = Suite(&ClientSuite{})
+
+var ctx = context.Background()
+
+var fastRetry = Options{Retry: &retry.Policy{MaxRetries: 2, InitialDelay: time.Millisecond}}
+
+// sharedKey is the key of the servers the tests start
+const sharedKey = "e7yflbeeid26rredmwtbiyzxijzak6altcnrsi4yol2f5sexbgdwevlpgosfoeyy"
+
+// newServer creates a Server using the shared key
+func newServer(c *C, cfg config.ServerConfig, store *blocks.Store) *server.Server {
+	srv := server.New(cfg, store)
+	err := srv.SetSharedKey(sharedKey)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return srv
+}
+
+func (s *ClientSuite) SetUpTest(c *C) {
+	cfg := config.Default()
+	cfg.Storage.Provider = "memory"
+	cfg.Metadata.Provider = "memory"
+	cfg.Blocks.Encryption = false
+
+	store, err := blocks.NewStore(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	store.BlockStore = blocks.NewMemoryBlockRepository()
+	s.store = store
+
+	handler := newServer(c, cfg.Server, store).Handler()
+	s.failures = 0
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&s.failures, -1) >= 0 {
+			w.WriteHeader(s.failStatus)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+
+	s.client = New(s.server.URL, sharedKey, fastRetry)
+}
+
+func (s *ClientSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// fail makes the next requests fail with the status
+func (s *ClientSuite) fail(requests int32, status int) {
+	s.failStatus = status
+	atomic.StoreInt32(&s.failures, requests)
+}
+
+func (s *ClientSuite) TestUploadAndDownload(c *C) {
+	blockedFile, err := s.client.Upload(ctx, strings.NewReader("hello world"), UploadOptions{FileName: "hello.txt", ContentType: "text/plain"})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockedFile.ID != "", IsTrue)
+	c.Assert(blockedFile.Length, Equals, int64(11))
+
+	var buffer bytes.Buffer
+	err = s.client.Download(ctx, blockedFile.ID, &buffer)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(buffer.String(), Equals, "hello world")
+}
+
+func (s *ClientSuite) TestDownloadRange(c *C) {
+	blockedFile, err := s.client.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	var buffer bytes.Buffer
+	err = s.client.DownloadRange(ctx, blockedFile.ID, 2, 3, &buffer)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(buffer.String(), Equals, "llo")
+
+	buffer.Reset()
+	err = s.client.DownloadRange(ctx, blockedFile.ID, 6, -1, &buffer)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(buffer.String(), Equals, "world")
+
+	err = s.client.DownloadRange(ctx, blockedFile.ID, 20, 5, &buffer)
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *ClientSuite) TestCopyAndDelete(c *C) {
+	blockedFile, err := s.client.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	copied, err := s.client.Copy(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(copied.ID != blockedFile.ID, IsTrue)
+
+	err = s.client.Delete(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	var buffer bytes.Buffer
+	err = s.client.Download(ctx, blockedFile.ID, &buffer)
+	c.Assert(IsNotFound(err), IsTrue, Commentf("Wrong error: %v", err))
+
+	err = s.client.Download(ctx, copied.ID, &buffer)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(buffer.String(), Equals, "hello world")
+
+	err = s.client.Delete(ctx, blockedFile.ID)
+	c.Assert(IsNotFound(err), IsTrue, Commentf("Wrong error: %v", err))
+}
+
+func (s *ClientSuite) TestStat(c *C) {
+	blockedFile, err := s.client.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	stats, err := s.client.Stat(ctx, blockedFile.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(stats.ID, Equals, blockedFile.ID)
+	c.Assert(stats.Length, Equals, int64(11))
+	c.Assert(stats.Blocks, Equals, 1)
+	c.Assert(stats.StoredSize > 0, IsTrue)
+
+	_, err = s.client.Stat(ctx, "missing")
+	c.Assert(IsNotFound(err), IsTrue, Commentf("Wrong error: %v", err))
+}
+
+func (s *ClientSuite) TestList(c *C) {
+	defer func(pageSize int) { listPageSize = pageSize }(listPageSize)
+	listPageSize = 2
+
+	var ids []string
+	for _, content := range []string{"one", "two", "three", "four", "five"} {
+		blockedFile, err := s.client.Upload(ctx, strings.NewReader(content), UploadOptions{})
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		ids = append(ids, blockedFile.ID)
+	}
+	sort.Strings(ids)
+
+	blockedFiles, err := s.client.List(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(blockedFiles, HasLen, len(ids))
+	for i, blockedFile := range blockedFiles {
+		c.Assert(blockedFile.ID, Equals, ids[i])
+	}
+}
+
+func (s *ClientSuite) TestWrongKeyIsUnauthorized(c *C) {
+	client := New(s.server.URL, "wrong", fastRetry)
+
+	_, err := client.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	blockerErr, ok := err.(*Error)
+	c.Assert(ok, IsTrue, Commentf("Wrong error: %v", err))
+	c.Assert(blockerErr.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(client.RetryStats().Retries, Equals, int64(0))
+}
+
+func (s *ClientSuite) TestTransientErrorsAreRetried(c *C) {
+	s.fail(2, http.StatusServiceUnavailable)
+
+	blockedFile, err := s.client.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(s.client.RetryStats().Retries, Equals, int64(2))
+
+	s.fail(1, http.StatusInternalServerError)
+
+	var buffer bytes.Buffer
+	err = s.client.Download(ctx, blockedFile.ID, &buffer)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(buffer.String(), Equals, "hello world")
+
+	// Too many failures are given up on
+	s.fail(3, http.StatusServiceUnavailable)
+
+	_, err = s.client.Stat(ctx, blockedFile.ID)
+	blockerErr, ok := err.(*Error)
+	c.Assert(ok, IsTrue, Commentf("Wrong error: %v", err))
+	c.Assert(blockerErr.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *ClientSuite) TestRequestsWhichMayHaveRunAreNotRetried(c *C) {
+	blockedFile, err := s.client.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The copy may have been made before the server failed
+	s.fail(1, http.StatusInternalServerError)
+
+	_, err = s.client.Copy(ctx, blockedFile.ID)
+	c.Assert(err != nil, IsTrue)
+	c.Assert(s.client.RetryStats().Retries, Equals, int64(0))
+
+	// An upload the server did not act on is retried, even when it can not be read again
+	s.fail(1, http.StatusServiceUnavailable)
+
+	uploaded, err := s.client.Upload(ctx, ioutil.NopCloser(strings.NewReader("hello world")), UploadOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(uploaded.Length, Equals, int64(11))
+	c.Assert(s.client.RetryStats().Retries, Equals, int64(1))
+}
+
+func (s *ClientSuite) TestLegacySigning(c *C) {
+	client := New(s.server.URL, sharedKey, Options{LegacySigning: true})
+
+	_, err := client.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	blockerErr, ok := err.(*Error)
+	c.Assert(ok, IsTrue, Commentf("Wrong error: %v", err))
+	c.Assert(blockerErr.StatusCode, Equals, http.StatusUnauthorized)
+
+	cfg := config.Default()
+	cfg.Server.Auth.Legacy = true
+	legacyServer := httptest.NewServer(newServer(c, cfg.Server, s.store).Handler())
+	defer legacyServer.Close()
+
+	client = New(legacyServer.URL, sharedKey, Options{LegacySigning: true})
+
+	_, err = client.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+}
+
+func (s *ClientSuite) TestAccessKeys(c *C) {
+	key, err := s.client.CreateKey(ctx, auth.AccessKey{Description: "reader", Scopes: []auth.Scope{auth.ScopeRead}})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(key.Secret != "", IsTrue)
+
+	keys, err := s.client.ListKeys(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(keys, HasLen, 1)
+	c.Assert(keys[0].ID, Equals, key.ID)
+
+	reader := New(s.server.URL, key.Secret, Options{Retry: fastRetry.Retry, AccessKeyID: key.ID})
+
+	_, err = reader.List(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = reader.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	blockerErr, ok := err.(*Error)
+	c.Assert(ok, IsTrue, Commentf("Wrong error: %v", err))
+	c.Assert(blockerErr.StatusCode, Equals, http.StatusForbidden)
+
+	_, err = s.client.SetKeyDisabled(ctx, key.ID, true)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = reader.List(ctx)
+	c.Assert(err != nil, IsTrue)
+
+	err = s.client.RevokeKey(ctx, key.ID)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	keys, err = s.client.ListKeys(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(keys, HasLen, 0)
+}
+
+func (s *ClientSuite) TestTenants(c *C) {
+	key, err := s.client.CreateKey(ctx, auth.AccessKey{Tenant: "acme", Scopes: []auth.Scope{auth.ScopeRead, auth.ScopeWrite}})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(key.Tenant, Equals, "acme")
+
+	acme := New(s.server.URL, key.Secret, Options{Retry: fastRetry.Retry, AccessKeyID: key.ID})
+
+	blockedFile, err := acme.Upload(ctx, strings.NewReader("hello world"), UploadOptions{})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// The file is not seen by the default tenant
+	var buffer bytes.Buffer
+	err = s.client.Download(ctx, blockedFile.ID, &buffer)
+	c.Assert(IsNotFound(err), IsTrue, Commentf("Wrong error: %v", err))
+
+	usage, err := acme.Usage(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usage.Tenant, Equals, "acme")
+	c.Assert(usage.Length, Equals, int64(11))
+
+	usages, err := s.client.Tenants(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usages, HasLen, 1)
+	c.Assert(usages[0].Tenant, Equals, "acme")
+
+	_, err = acme.Tenants(ctx)
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *ClientSuite) TestBearerToken(c *C) {
+	var authorization string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("[]"))
+	}))
+	defer tokenServer.Close()
+
+	tokens := 0
+	client := New(tokenServer.URL, "", Options{Retry: fastRetry.Retry, BearerToken: func(ctx context.Context) (string, error) {
+		tokens++
+		return "token" + strconv.Itoa(tokens), nil
+	}})
+
+	_, err := client.ListKeys(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(authorization, Equals, "Bearer token1")
+
+	// Each request asks for the token, so it can be renewed
+	_, err = client.ListKeys(ctx)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(authorization, Equals, "Bearer token2")
+
+	// The request is not sent without a token
+	failing := New(tokenServer.URL, "", Options{Retry: fastRetry.Retry, BearerToken: func(ctx context.Context) (string, error) {
+		return "", errors.New("no token")
+	}})
+	authorization = ""
+	_, err = failing.ListKeys(ctx)
+	c.Assert(err != nil, IsTrue)
+	c.Assert(authorization, Equals, "")
+}
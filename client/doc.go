@@ -0,0 +1,5 @@
+// Package client calls the REST API of a Blocker server
+//
+// Current version: experimental
+//
+package client
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/keithballdotnet/blocker/auth"
+)
+
+// CreateKey creates an access key with the description, tenant, scopes and expiry of the key.  A key without a tenant
+// is created for the tenant of the client.  The returned key holds the secret, which the server does not give out again.
+// Needs a key with the admin scope.
+func (c *Client) CreateKey(ctx context.Context, key auth.AccessKey) (auth.AccessKey, error) {
+	body, err := json.Marshal(struct {
+		Description string       `json:"description"`
+		Tenant      string       `json:"tenant,omitempty"`
+		Scopes      []auth.Scope `json:"scopes"`
+		Expires     *time.Time   `json:"expires,omitempty"`
+	}{key.Description, key.Tenant, key.Scopes, key.Expires})
+	if err != nil {
+		return auth.AccessKey{}, err
+	}
+
+	contentSHA256, err := auth.HashBody(bytes.NewReader(body))
+	if err != nil {
+		return auth.AccessKey{}, err
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	req := request{
+		method:        "POST",
+		path:          "/api/v1/keys",
+		header:        header,
+		contentSHA256: contentSHA256,
+		unsafe:        true,
+		expected:      http.StatusCreated,
+		body: func() (io.Reader, error) {
+			return bytes.NewReader(body), nil
+		},
+	}
+
+	var created auth.AccessKey
+	return created, c.doJSON(ctx, req, &created)
+}
+
+// ListKeys returns the access keys of the tenants the client manages, without their secrets
+func (c *Client) ListKeys(ctx context.Context) ([]auth.AccessKey, error) {
+	var keys []auth.AccessKey
+	return keys, c.doJSON(ctx, request{method: "GET", path: "/api/v1/keys", expected: http.StatusOK}, &keys)
+}
+
+// SetKeyDisabled disables or enables the access key
+func (c *Client) SetKeyDisabled(ctx context.Context, id string, disabled bool) (auth.AccessKey, error) {
+	action := "/enable"
+	if disabled {
+		action = "/disable"
+	}
+
+	var key auth.AccessKey
+	return key, c.doJSON(ctx, request{method: "POST", path: keyPath(id) + action, expected: http.StatusOK}, &key)
+}
+
+// RevokeKey removes the access key
+func (c *Client) RevokeKey(ctx context.Context, id string) error {
+	response, err := c.do(ctx, request{method: "DELETE", path: keyPath(id), unsafe: true, expected: http.StatusNoContent})
+	if err != nil {
+		return err
+	}
+
+	return response.Body.Close()
+}
+
+// keyPath is the path of the REST resource of an access key
+func keyPath(id string) string {
+	return "/api/v1/keys/" + url.PathEscape(id)
+}
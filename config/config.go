@@ -0,0 +1,1044 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the complete configuration of a blocker installation
+type Config struct {
+	Storage   StorageConfig   `json:"storage" yaml:"storage" toml:"storage"`
+	Crypto    CryptoConfig    `json:"crypto" yaml:"crypto" toml:"crypto"`
+	Blocks    BlocksConfig    `json:"blocks" yaml:"blocks" toml:"blocks"`
+	Couchbase CouchbaseConfig `json:"couchbase" yaml:"couchbase" toml:"couchbase"`
+	Metadata  MetadataConfig  `json:"metadata" yaml:"metadata" toml:"metadata"`
+	Server    ServerConfig    `json:"server" yaml:"server" toml:"server"`
+	Tenants   TenantsConfig   `json:"tenants" yaml:"tenants" toml:"tenants"`
+}
+
+// StorageConfig selects and configures the provider used to persist blocks
+type StorageConfig struct {
+	// Provider is either 'nfs', 'cb', 'azure', 's3', 'memory', 'replicated' or 'erasure'
+	Provider    string            `json:"provider" yaml:"provider" toml:"provider"`
+	Disk        DiskConfig        `json:"disk" yaml:"disk" toml:"disk"`
+	S3          S3Config          `json:"s3" yaml:"s3" toml:"s3"`
+	Azure       AzureConfig       `json:"azure" yaml:"azure" toml:"azure"`
+	Replication ReplicationConfig `json:"replication" yaml:"replication" toml:"replication"`
+	Erasure     ErasureConfig     `json:"erasure" yaml:"erasure" toml:"erasure"`
+	Timeouts    TimeoutConfig     `json:"timeouts" yaml:"timeouts" toml:"timeouts"`
+	Retry       RetryConfig       `json:"retry" yaml:"retry" toml:"retry"`
+	Cache       CacheConfig       `json:"cache" yaml:"cache" toml:"cache"`
+	Backup      BackupConfig      `json:"backup" yaml:"backup" toml:"backup"`
+}
+
+// BackupConfig selects where backups are kept.  The provider is configured by its own section,
+// except for the nfs provider which keeps backups in their own directory.
+type BackupConfig struct {
+	// Provider is either 'nfs', 'cb', 'azure' or 's3'.  Backups are disabled when empty.
+	Provider string `json:"provider" yaml:"provider" toml:"provider"`
+	// Directory is where the nfs provider keeps backups
+	Directory string `json:"directory" yaml:"directory" toml:"directory"`
+}
+
+// ReplicationConfig configures the replicated storage provider.
+// Each replica is configured by its own provider section.
+type ReplicationConfig struct {
+	// Providers are the storage providers keeping a copy of every block, in the order they are read from
+	Providers []string `json:"providers" yaml:"providers" toml:"providers"`
+	// WriteQuorum is the number of providers a block must be saved to.  Zero means every provider.
+	WriteQuorum int `json:"writeQuorum" yaml:"writeQuorum" toml:"writeQuorum"`
+	// RepairInterval is how often replicas missing blocks are repaired in the background.  Zero disables background repair.
+	RepairInterval Duration `json:"repairInterval" yaml:"repairInterval" toml:"repairInterval"`
+}
+
+// ErasureConfig configures the erasure storage provider.
+// Each block is split into data and parity shards, one shard in each directory.
+type ErasureConfig struct {
+	DataShards   int `json:"dataShards" yaml:"dataShards" toml:"dataShards"`
+	ParityShards int `json:"parityShards" yaml:"parityShards" toml:"parityShards"`
+	// Directories hold the shards, ideally each on a separate disk.  There must be one per shard.
+	Directories []string `json:"directories" yaml:"directories" toml:"directories"`
+	// RepairInterval is how often blocks found missing shards are repaired in the background.  Zero disables background repair.
+	RepairInterval Duration `json:"repairInterval" yaml:"repairInterval" toml:"repairInterval"`
+}
+
+// CacheConfig configures a local cache of blocks in front of the storage provider
+type CacheConfig struct {
+	// Provider is either 'memory' or 'nfs'.  The cache is disabled when empty.
+	Provider string `json:"provider" yaml:"provider" toml:"provider"`
+	// Directory is where the nfs cache keeps blocks.  Defaults to a blocker-cache directory in the OS temp directory.
+	Directory string `json:"directory" yaml:"directory" toml:"directory"`
+	// MaxSize is the most bytes the cache holds
+	MaxSize int64 `json:"maxSize" yaml:"maxSize" toml:"maxSize"`
+	// Mode is either 'write-through' or 'write-back'
+	Mode string `json:"mode" yaml:"mode" toml:"mode"`
+	// RetryInterval is how often blocks which failed to be written back are tried again.  Zero only tries them again
+	// when more blocks are saved.
+	RetryInterval Duration `json:"retryInterval" yaml:"retryInterval" toml:"retryInterval"`
+}
+
+// TimeoutConfig limits how long a single storage operation may take.  A zero timeout means no limit.
+type TimeoutConfig struct {
+	Save   Duration `json:"save" yaml:"save" toml:"save"`
+	Get    Duration `json:"get" yaml:"get" toml:"get"`
+	Exists Duration `json:"exists" yaml:"exists" toml:"exists"`
+	Delete Duration `json:"delete" yaml:"delete" toml:"delete"`
+}
+
+// RetryConfig controls retrying operations which fail with a transient error, such as throttling or a dropped connection,
+// and the circuit breaker which stops calling a provider after too many failures in a row
+type RetryConfig struct {
+	// MaxRetries is how many times a failing operation is retried.  Zero disables retries.
+	MaxRetries int `json:"maxRetries" yaml:"maxRetries" toml:"maxRetries"`
+	// InitialDelay is the delay before the first retry, doubling for each retry after
+	InitialDelay Duration `json:"initialDelay" yaml:"initialDelay" toml:"initialDelay"`
+	// MaxDelay caps the delay between retries.  Zero means no cap.
+	MaxDelay Duration `json:"maxDelay" yaml:"maxDelay" toml:"maxDelay"`
+	// BreakerThreshold is the number of failures in a row which opens the circuit breaker.  Zero disables the breaker.
+	BreakerThreshold int `json:"breakerThreshold" yaml:"breakerThreshold" toml:"breakerThreshold"`
+	// BreakerCooldown is how long the open breaker fails operations before letting one through to test the provider
+	BreakerCooldown Duration `json:"breakerCooldown" yaml:"breakerCooldown" toml:"breakerCooldown"`
+}
+
+// DiskConfig configures the nfs storage provider
+type DiskConfig struct {
+	// Directory is where blocks are written.  Defaults to a blocker directory in the OS temp directory.
+	Directory string `json:"directory" yaml:"directory" toml:"directory"`
+	// PackFiles appends blocks into large segment files instead of writing a file per block
+	PackFiles bool `json:"packFiles" yaml:"packFiles" toml:"packFiles"`
+	// SegmentSize is the size a segment file grows to before a new one is started
+	SegmentSize int64 `json:"segmentSize" yaml:"segmentSize" toml:"segmentSize"`
+	// CompactThreshold is the fraction of live data below which a segment is compacted
+	CompactThreshold float64 `json:"compactThreshold" yaml:"compactThreshold" toml:"compactThreshold"`
+	// FileMode is the permissions blocks are written with.  Defaults to 0644.
+	FileMode FileMode `json:"fileMode" yaml:"fileMode" toml:"fileMode"`
+	// DirMode is the permissions directories are created with.  Defaults to 0777.
+	DirMode FileMode `json:"dirMode" yaml:"dirMode" toml:"dirMode"`
+}
+
+// S3Config configures the s3 storage provider
+type S3Config struct {
+	Key    string `json:"key" yaml:"key" toml:"key"`
+	Secret string `json:"secret" yaml:"secret" toml:"secret"`
+	Bucket string `json:"bucket" yaml:"bucket" toml:"bucket"`
+	// Region is the AWS region of the bucket.  Defaults to eu-west-1.
+	Region string `json:"region" yaml:"region" toml:"region"`
+	// Endpoint is the URL of an S3 compatible store, such as MinIO or Ceph, used instead of AWS
+	Endpoint string `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+	// PathStyle addresses the bucket in the path rather than the host name, as most S3 compatible stores need
+	PathStyle bool `json:"pathStyle" yaml:"pathStyle" toml:"pathStyle"`
+	// Prefix is put in front of the key of every block, so several stores can share a bucket
+	Prefix string `json:"prefix" yaml:"prefix" toml:"prefix"`
+	// ServerSideEncryption is either 'AES256' or 'aws:kms'.  Blocks are not encrypted by S3 when empty.
+	ServerSideEncryption string `json:"serverSideEncryption" yaml:"serverSideEncryption" toml:"serverSideEncryption"`
+	// KMSKeyID is the KMS key S3 encrypts with when ServerSideEncryption is 'aws:kms'.  Defaults to the account's S3 key.
+	KMSKeyID string `json:"kmsKeyId" yaml:"kmsKeyId" toml:"kmsKeyId"`
+	// StorageClass is the S3 storage class blocks are written with, such as STANDARD_IA.  Defaults to STANDARD.
+	StorageClass string `json:"storageClass" yaml:"storageClass" toml:"storageClass"`
+	// MultipartThreshold is the block size above which blocks are uploaded in parts.  Defaults to 16Mb.
+	// -1 turns multipart uploads off, which is needed with ServerSideEncryption or StorageClass.
+	MultipartThreshold int64 `json:"multipartThreshold" yaml:"multipartThreshold" toml:"multipartThreshold"`
+	// PartSize is the size of each part of a multipart upload.  S3 needs at least 5Mb.  Defaults to 8Mb.
+	PartSize int64 `json:"partSize" yaml:"partSize" toml:"partSize"`
+}
+
+// S3MinPartSize is the smallest part S3 accepts in a multipart upload
+const S3MinPartSize = 5242880
+
+// S3MultipartOff is the multipart threshold which turns multipart uploads off
+const S3MultipartOff = -1
+
+// AzureConfig configures the azure storage provider
+type AzureConfig struct {
+	Account string `json:"account" yaml:"account" toml:"account"`
+	// Secret is the base64 account key.  Either the secret or a SAS token is needed.
+	Secret string `json:"secret" yaml:"secret" toml:"secret"`
+	// SASToken is a shared access signature, such as 'sv=...&sig=...', used instead of the account key
+	SASToken string `json:"sasToken" yaml:"sasToken" toml:"sasToken"`
+	// Container holds the blocks.  Defaults to 'blocks'.
+	Container string `json:"container" yaml:"container" toml:"container"`
+	// Prefix is put in front of the name of every block, so several stores can share a container
+	Prefix string `json:"prefix" yaml:"prefix" toml:"prefix"`
+	// Endpoint is the URL of the blob service, such as http://127.0.0.1:10000/devstoreaccount1 for an emulator.
+	// Defaults to https://<account>.blob.core.windows.net
+	Endpoint string `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+	// CreateContainer creates the container when the provider starts, if it does not exist
+	CreateContainer bool `json:"createContainer" yaml:"createContainer" toml:"createContainer"`
+}
+
+// CouchbaseConfig configures the couchbase server used for meta data and the cb storage provider
+type CouchbaseConfig struct {
+	Host string `json:"host" yaml:"host" toml:"host"`
+	// Pool holds the bucket.  Defaults to 'default'.
+	Pool string `json:"pool" yaml:"pool" toml:"pool"`
+	// Bucket holds the blocks and meta data.  Defaults to 'blocker'.
+	Bucket string `json:"bucket" yaml:"bucket" toml:"bucket"`
+	// Password of the bucket, if it has one
+	Password string `json:"password" yaml:"password" toml:"password"`
+	// MaxItemSize is the largest value kept under a single key.  Larger blocks are split across several keys.  Defaults to 20Mb.
+	MaxItemSize int64 `json:"maxItemSize" yaml:"maxItemSize" toml:"maxItemSize"`
+}
+
+// MetadataConfig selects where the BlockedFiles and BlockInfo are kept
+type MetadataConfig struct {
+	// Provider is either 'cb' or 'memory'.  Memory meta data is lost when blocker stops, so is only for tests.
+	Provider string `json:"provider" yaml:"provider" toml:"provider"`
+}
+
+// CryptoConfig selects and configures the provider used to encrypt blocks
+type CryptoConfig struct {
+	// Provider is either 'gokms', 'openpgp' or 'aws'
+	Provider string        `json:"provider" yaml:"provider" toml:"provider"`
+	OpenPGP  OpenPGPConfig `json:"openpgp" yaml:"openpgp" toml:"openpgp"`
+	AWS      AWSConfig     `json:"aws" yaml:"aws" toml:"aws"`
+	GoKMS    GoKMSConfig   `json:"gokms" yaml:"gokms" toml:"gokms"`
+	// Retry applies to the gokms and aws providers, which call out to a key management service
+	Retry RetryConfig `json:"retry" yaml:"retry" toml:"retry"`
+}
+
+// OpenPGPConfig configures the openpgp crypto provider
+type OpenPGPConfig struct {
+	PublicKeyPath  string `json:"publicKey" yaml:"publicKey" toml:"publicKey"`
+	PrivateKeyPath string `json:"privateKey" yaml:"privateKey" toml:"privateKey"`
+}
+
+// AWSConfig configures the aws crypto provider
+type AWSConfig struct {
+	Key    string `json:"key" yaml:"key" toml:"key"`
+	Secret string `json:"secret" yaml:"secret" toml:"secret"`
+	Region string `json:"region" yaml:"region" toml:"region"`
+	// KeyID is optional.  If empty the first available key from the region will be selected
+	KeyID string `json:"keyId" yaml:"keyId" toml:"keyId"`
+}
+
+// GoKMSConfig configures the gokms crypto provider
+type GoKMSConfig struct {
+	AuthKey string `json:"authKey" yaml:"authKey" toml:"authKey"`
+	URL     string `json:"url" yaml:"url" toml:"url"`
+	// KeyID is optional.  If empty the newest available key will be selected
+	KeyID            string `json:"keyId" yaml:"keyId" toml:"keyId"`
+	IgnoreBadTLSCert bool   `json:"ignoreBadTlsCert" yaml:"ignoreBadTlsCert" toml:"ignoreBadTlsCert"`
+}
+
+// BlocksConfig controls how files are split into blocks
+type BlocksConfig struct {
+	// BlockSize is the size in bytes of each block
+	BlockSize   int64 `json:"blockSize" yaml:"blockSize" toml:"blockSize"`
+	Compression bool  `json:"compression" yaml:"compression" toml:"compression"`
+	Encryption  bool  `json:"encryption" yaml:"encryption" toml:"encryption"`
+}
+
+// ServerConfig configures the REST interface
+type ServerConfig struct {
+	Address string `json:"address" yaml:"address" toml:"address"`
+	// CertPath and CertKeyPath enable SSL when both are set
+	CertPath    string `json:"cert" yaml:"cert" toml:"cert"`
+	CertKeyPath string `json:"certKey" yaml:"certKey" toml:"certKey"`
+	// SharedKeyPath is the shared authentication key.  If empty a key is generated.
+	SharedKeyPath string     `json:"sharedKey" yaml:"sharedKey" toml:"sharedKey"`
+	Auth          AuthConfig `json:"auth" yaml:"auth" toml:"auth"`
+}
+
+// AuthConfig controls how the signatures of requests are checked
+type AuthConfig struct {
+	// ClockSkew is how far the date of a request may be from the clock of the server
+	ClockSkew Duration `json:"clockSkew" yaml:"clockSkew" toml:"clockSkew"`
+	// Nonces makes every request carry a nonce, which is refused if seen again within the clock skew
+	Nonces bool `json:"nonces" yaml:"nonces" toml:"nonces"`
+	// NonceCacheSize is the most nonces remembered.  Requests are refused while the cache is full.
+	NonceCacheSize int `json:"nonceCacheSize" yaml:"nonceCacheSize" toml:"nonceCacheSize"`
+	// Legacy accepts requests signed with the original scheme, which does not cover the query, headers or body
+	Legacy bool `json:"legacy" yaml:"legacy" toml:"legacy"`
+	// KeysPath is the file the access keys are kept in.  If empty access keys are lost when the server stops.
+	KeysPath string `json:"keys" yaml:"keys" toml:"keys"`
+	// JWT accepts bearer tokens in place of signed requests
+	JWT JWTConfig `json:"jwt" yaml:"jwt" toml:"jwt"`
+}
+
+// JWTConfig accepts JSON Web Tokens signed by an identity provider as bearer tokens.  Tokens are only accepted when
+// there are keys to check them with.
+type JWTConfig struct {
+	// JWKSPaths are JSON Web Key Set files holding the keys tokens may be signed with.  They are read again when a
+	// token is signed with a key they did not have.
+	JWKSPaths []string `json:"jwks" yaml:"jwks" toml:"jwks"`
+	// PublicKeyPaths are PEM public keys or certificates tokens may be signed with
+	PublicKeyPaths []string `json:"publicKeys" yaml:"publicKeys" toml:"publicKeys"`
+	// Issuer is the iss claim tokens must have.  If empty any issuer is accepted.
+	Issuer string `json:"issuer" yaml:"issuer" toml:"issuer"`
+	// Audience is the aud claim tokens must have, so tokens meant for other services are refused
+	Audience string `json:"audience" yaml:"audience" toml:"audience"`
+	// TenantClaim is the claim holding the tenant of a token.  Tokens without it act for the default tenant.
+	TenantClaim string `json:"tenantClaim" yaml:"tenantClaim" toml:"tenantClaim"`
+	// ScopesClaim is the claim holding the scopes of a token, as a space separated string or a list
+	ScopesClaim string `json:"scopesClaim" yaml:"scopesClaim" toml:"scopesClaim"`
+	// Scopes maps values of the scopes claim to the scopes they allow.  If empty the values are the names of scopes.
+	Scopes map[string][]string `json:"scopes" yaml:"scopes" toml:"scopes"`
+}
+
+// Enabled checks if there are keys to check tokens with
+func (c JWTConfig) Enabled() bool {
+	return len(c.JWKSPaths) > 0 || len(c.PublicKeyPaths) > 0
+}
+
+// TenantsConfig controls how the files of tenants are kept apart
+type TenantsConfig struct {
+	// Isolate stops the files of different tenants sharing blocks.  Sharing saves space, but lets a tenant find out
+	// if another has stored the same data.
+	Isolate bool `json:"isolate" yaml:"isolate" toml:"isolate"`
+	// Quotas limit the storage of the named tenants.  Tenants without a quota are not limited.
+	Quotas map[string]QuotaConfig `json:"quotas" yaml:"quotas" toml:"quotas"`
+}
+
+// QuotaConfig limits the storage of a tenant.  A limit of 0 is no limit.
+type QuotaConfig struct {
+	// Length is the most the lengths of the files of the tenant may add up to
+	Length int64 `json:"length,omitempty" yaml:"length" toml:"length"`
+	// StoredSize is the most space the different blocks of the files of the tenant may take, shared or not
+	StoredSize int64 `json:"storedSize,omitempty" yaml:"storedSize" toml:"storedSize"`
+}
+
+// tenantPattern is what a tenant name must look like
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ValidateTenant checks the name can be used for a tenant.  The empty name is the default tenant.
+func ValidateTenant(name string) error {
+	if name != "" && !tenantPattern.MatchString(name) {
+		return fmt.Errorf("Invalid tenant %q, must be up to 63 lower case letters, digits, '-' and '_'", name)
+	}
+	return nil
+}
+
+// StorageProviders are the names of the supported storage providers
+var StorageProviders = []string{"nfs", "cb", "azure", "s3", "memory", "replicated", "erasure"}
+
+// CacheProviders are the names of the supported cache providers
+var CacheProviders = []string{"memory", "nfs"}
+
+// MetadataProviders are the names of the supported meta data providers
+var MetadataProviders = []string{"cb", "memory"}
+
+// CacheModes are the names of the supported cache modes
+var CacheModes = []string{"write-through", "write-back"}
+
+// S3ServerSideEncryptions are the supported S3 server side encryption algorithms
+var S3ServerSideEncryptions = []string{"AES256", "aws:kms"}
+
+// S3StorageClasses are the S3 storage classes blocks can be written with
+var S3StorageClasses = []string{"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR"}
+
+// BackupProviders are the names of the storage providers which can keep backups
+var BackupProviders = []string{"nfs", "cb", "azure", "s3"}
+
+// CryptoProviders are the names of the supported crypto providers
+var CryptoProviders = []string{"gokms", "openpgp", "aws"}
+
+// Default returns a configuration with the default settings
+func Default() Config {
+	return Config{
+		Storage: StorageConfig{
+			Provider: "nfs",
+			S3: S3Config{
+				Region: "eu-west-1",
+				// 16Mb
+				MultipartThreshold: 16777216,
+				// 8Mb
+				PartSize: 8388608,
+			},
+			Disk: DiskConfig{
+				// 256Mb
+				SegmentSize:      268435456,
+				CompactThreshold: 0.5,
+				FileMode:         0644,
+				DirMode:          0777,
+			},
+			Timeouts: TimeoutConfig{
+				Save:   Duration(time.Minute),
+				Get:    Duration(time.Minute),
+				Exists: Duration(10 * time.Second),
+				Delete: Duration(30 * time.Second),
+			},
+			Retry: defaultRetry(),
+			Azure: AzureConfig{
+				Container:       "blocks",
+				CreateContainer: true,
+			},
+			Replication: ReplicationConfig{
+				RepairInterval: Duration(time.Minute),
+			},
+			Erasure: ErasureConfig{
+				DataShards:     4,
+				ParityShards:   2,
+				RepairInterval: Duration(time.Minute),
+			},
+			Cache: CacheConfig{
+				// 1Gb
+				MaxSize:       1073741824,
+				Mode:          "write-through",
+				RetryInterval: Duration(30 * time.Second),
+			},
+		},
+		Crypto: CryptoConfig{
+			Provider: "openpgp",
+			AWS:      AWSConfig{Region: "eu-central-1"},
+			Retry:    defaultRetry(),
+		},
+		Blocks: BlocksConfig{
+			// 4Mb
+			BlockSize:   4194304,
+			Compression: true,
+			Encryption:  true,
+		},
+		Couchbase: CouchbaseConfig{
+			Host:   "http://localhost:8091",
+			Pool:   "default",
+			Bucket: "blocker",
+			// 20Mb, the most couchbase takes
+			MaxItemSize: 20971520,
+		},
+		Metadata: MetadataConfig{
+			Provider: "cb",
+		},
+		Server: ServerConfig{
+			Address: ":8010",
+			Auth: AuthConfig{
+				ClockSkew:      Duration(5 * time.Minute),
+				NonceCacheSize: 100000,
+				JWT: JWTConfig{
+					TenantClaim: "tenant",
+					ScopesClaim: "scope",
+				},
+			},
+		},
+	}
+}
+
+// defaultRetry retries three times within about a second and stops calling a provider for 30 seconds after five failures
+func defaultRetry() RetryConfig {
+	return RetryConfig{
+		MaxRetries:       3,
+		InitialDelay:     Duration(100 * time.Millisecond),
+		MaxDelay:         Duration(5 * time.Second),
+		BreakerThreshold: 5,
+		BreakerCooldown:  Duration(30 * time.Second),
+	}
+}
+
+// Load returns the default configuration overlaid with the passed file (if any) and then the environment.
+// The file format is chosen by the extension: .yaml, .yml, .json or .toml
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		if err := cfg.LoadFile(path); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := cfg.LoadEnv(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// LoadFile overlays the settings found in the passed file
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".json":
+		err = json.Unmarshal(data, c)
+	case ".toml":
+		_, err = toml.Decode(string(data), c)
+	default:
+		return fmt.Errorf("unknown configuration file format: %s", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to read configuration file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// LoadEnv overlays any settings found in the BLOCKER_* environment variables.
+// Every variable which can not be read is returned as an InvalidSettingError.
+func (c *Config) LoadEnv() error {
+	settings := map[string]*string{
+		"CB_HOST":                &c.Couchbase.Host,
+		"CB_BUCKET":              &c.Couchbase.Bucket,
+		"CB_PASSWORD":            &c.Couchbase.Password,
+		"BLOCKER_DISK_DIR":       &c.Storage.Disk.Directory,
+		"BLOCKER_S3_KEY":         &c.Storage.S3.Key,
+		"BLOCKER_S3_SECRET":      &c.Storage.S3.Secret,
+		"BLOCKER_S3_BUCKET":      &c.Storage.S3.Bucket,
+		"BLOCKER_S3_REGION":      &c.Storage.S3.Region,
+		"BLOCKER_S3_ENDPOINT":    &c.Storage.S3.Endpoint,
+		"BLOCKER_S3_PREFIX":      &c.Storage.S3.Prefix,
+		"BLOCKER_AZURE_ACCOUNT":  &c.Storage.Azure.Account,
+		"BLOCKER_AZURE_SECRET":   &c.Storage.Azure.Secret,
+		"BLOCKER_AZURE_SAS":      &c.Storage.Azure.SASToken,
+		"BLOCKER_AZURE_ENDPOINT": &c.Storage.Azure.Endpoint,
+		"BLOCKER_PGP_PUBLICKEY":  &c.Crypto.OpenPGP.PublicKeyPath,
+		"BLOCKER_PGP_PRIVATEKEY": &c.Crypto.OpenPGP.PrivateKeyPath,
+		"BLOCKER_KMS_KEY":        &c.Crypto.AWS.Key,
+		"BLOCKER_KMS_SECRET":     &c.Crypto.AWS.Secret,
+		"BLOCKER_KMS_REGION":     &c.Crypto.AWS.Region,
+		"BLOCKER_KMS_KEY_ID":     &c.Crypto.AWS.KeyID,
+		"BLOCKER_GOKMS_AUTHKEY":  &c.Crypto.GoKMS.AuthKey,
+		"BLOCKER_GOKMS_URL":      &c.Crypto.GoKMS.URL,
+		"BLOCKER_GOKMS_KEYID":    &c.Crypto.GoKMS.KeyID,
+		"BLOCKER_CACHE":          &c.Storage.Cache.Provider,
+		"BLOCKER_CACHE_DIR":      &c.Storage.Cache.Directory,
+		"BLOCKER_CACHE_MODE":     &c.Storage.Cache.Mode,
+		"BLOCKER_BACKUP":         &c.Storage.Backup.Provider,
+		"BLOCKER_BACKUP_DIR":     &c.Storage.Backup.Directory,
+		"BLOCKER_AUTH_KEYS":      &c.Server.Auth.KeysPath,
+		"BLOCKER_JWT_ISSUER":     &c.Server.Auth.JWT.Issuer,
+		"BLOCKER_JWT_AUDIENCE":   &c.Server.Auth.JWT.Audience,
+	}
+
+	for name, setting := range settings {
+		if value := os.Getenv(name); value != "" {
+			*setting = value
+		}
+	}
+
+	// Lists of files are separated by commas
+	if value := os.Getenv("BLOCKER_JWT_JWKS"); value != "" {
+		c.Server.Auth.JWT.JWKSPaths = strings.Split(value, ",")
+	}
+
+	if value := os.Getenv("BLOCKER_JWT_PUBLIC_KEYS"); value != "" {
+		c.Server.Auth.JWT.PublicKeyPaths = strings.Split(value, ",")
+	}
+
+	var errs []error
+
+	bools := []struct {
+		name    string
+		setting *bool
+	}{
+		{"BLOCKER_GOKMS_IGNORE_BAD_TLS_CERT", &c.Crypto.GoKMS.IgnoreBadTLSCert},
+		{"BLOCKER_AUTH_LEGACY", &c.Server.Auth.Legacy},
+		{"BLOCKER_TENANTS_ISOLATE", &c.Tenants.Isolate},
+	}
+
+	for _, b := range bools {
+		if value := os.Getenv(b.name); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, &InvalidSettingError{Provider: "environment", Setting: b.name, Value: value, Err: errors.New("must be true or false")})
+				continue
+			}
+
+			*b.setting = parsed
+		}
+	}
+
+	durations := []struct {
+		name    string
+		setting *Duration
+	}{
+		{"BLOCKER_TIMEOUT_SAVE", &c.Storage.Timeouts.Save},
+		{"BLOCKER_TIMEOUT_GET", &c.Storage.Timeouts.Get},
+		{"BLOCKER_TIMEOUT_EXISTS", &c.Storage.Timeouts.Exists},
+		{"BLOCKER_TIMEOUT_DELETE", &c.Storage.Timeouts.Delete},
+		{"BLOCKER_AUTH_CLOCK_SKEW", &c.Server.Auth.ClockSkew},
+	}
+
+	for _, d := range durations {
+		if value := os.Getenv(d.name); value != "" {
+			if err := d.setting.UnmarshalText([]byte(value)); err != nil {
+				errs = append(errs, &InvalidSettingError{Provider: "environment", Setting: d.name, Value: value, Err: err})
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the whole configuration and returns every problem found
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.Blocks.BlockSize <= 0 {
+		errs = append(errs, &InvalidSettingError{Provider: "blocks", Setting: "blocks.blockSize", Value: strconv.FormatInt(c.Blocks.BlockSize, 10), Err: errors.New("must be greater than zero")})
+	}
+
+	if err := c.Storage.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.Couchbase.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if !contains(MetadataProviders, c.Metadata.Provider) {
+		errs = append(errs, unknownProvider("metadata.provider", c.Metadata.Provider, MetadataProviders))
+	}
+
+	if err := c.Server.Auth.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.Tenants.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.Blocks.Encryption {
+		if err := c.Crypto.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the selected storage provider has the settings it needs
+func (c StorageConfig) Validate() error {
+	if err := c.Timeouts.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Retry.validate("storage"); err != nil {
+		return err
+	}
+
+	if err := c.Cache.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.validateBackup(); err != nil {
+		return err
+	}
+
+	switch c.Provider {
+	case "nfs":
+		return c.Disk.Validate()
+	case "cb", "memory":
+		return nil
+	case "s3":
+		return c.S3.Validate()
+	case "azure":
+		return c.Azure.Validate()
+	case "replicated":
+		return c.validateReplication()
+	case "erasure":
+		return c.Erasure.Validate()
+	}
+
+	return unknownProvider("storage.provider", c.Provider, StorageProviders)
+}
+
+// validateReplication checks the replication settings and every replicated provider
+func (c StorageConfig) validateReplication() error {
+	providers := c.Replication.Providers
+	if len(providers) == 0 {
+		return &MissingSettingsError{Provider: "replicated", Settings: []string{"storage.replication.providers"}}
+	}
+
+	if c.Replication.WriteQuorum < 0 || c.Replication.WriteQuorum > len(providers) {
+		return &InvalidSettingError{Provider: "replicated", Setting: "storage.replication.writeQuorum", Value: strconv.Itoa(c.Replication.WriteQuorum), Err: fmt.Errorf("must be between 0 and %d", len(providers))}
+	}
+
+	if c.Replication.RepairInterval < 0 {
+		return &InvalidSettingError{Provider: "replicated", Setting: "storage.replication.repairInterval", Value: c.Replication.RepairInterval.String(), Err: errors.New("must not be negative")}
+	}
+
+	var errs []error
+	seen := make(map[string]bool)
+
+	for _, provider := range providers {
+		if provider == "replicated" || seen[provider] {
+			errs = append(errs, &InvalidSettingError{Provider: "replicated", Setting: "storage.replication.providers", Value: provider, Err: errors.New("each provider can only be replicated to once")})
+			continue
+		}
+		seen[provider] = true
+
+		replica := c
+		replica.Provider = provider
+		if err := replica.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateBackup checks the backup provider is configured and is not where the blocks are stored
+func (c StorageConfig) validateBackup() error {
+	provider := c.Backup.Provider
+	switch {
+	case provider == "":
+		return nil
+	case !contains(BackupProviders, provider):
+		return unknownProvider("storage.backup.provider", provider, BackupProviders)
+	case provider == "nfs" && c.Backup.Directory == "":
+		return &MissingSettingsError{Provider: "backup", Settings: []string{"storage.backup.directory"}}
+	case provider == "nfs" && c.Backup.Directory == c.Disk.Directory:
+		return &InvalidSettingError{Provider: "backup", Setting: "storage.backup.directory", Value: c.Backup.Directory, Err: errors.New("must not be the directory blocks are stored in")}
+	case provider != "nfs" && (provider == c.Provider || contains(c.Replication.Providers, provider)):
+		return &InvalidSettingError{Provider: "backup", Setting: "storage.backup.provider", Value: provider, Err: errors.New("must not be where blocks are stored")}
+	}
+
+	backup := c
+	backup.Provider = provider
+	backup.Backup = BackupConfig{}
+	return backup.Validate()
+}
+
+// Validate checks the permissions and the pack file settings when pack files are used
+func (c DiskConfig) Validate() error {
+	// Blocker must be able to read back what it writes.  Zero uses the default.
+	if c.FileMode != 0 && (c.FileMode&^0777 != 0 || c.FileMode&0600 != 0600) {
+		return &InvalidSettingError{Provider: "nfs", Setting: "storage.disk.fileMode", Value: c.FileMode.String(), Err: errors.New("must be permission bits including owner read and write")}
+	}
+
+	if c.DirMode != 0 && (c.DirMode&^0777 != 0 || c.DirMode&0700 != 0700) {
+		return &InvalidSettingError{Provider: "nfs", Setting: "storage.disk.dirMode", Value: c.DirMode.String(), Err: errors.New("must be permission bits including owner read, write and execute")}
+	}
+
+	if !c.PackFiles {
+		return nil
+	}
+
+	if c.SegmentSize <= 0 {
+		return &InvalidSettingError{Provider: "nfs", Setting: "storage.disk.segmentSize", Value: strconv.FormatInt(c.SegmentSize, 10), Err: errors.New("must be greater than 0")}
+	}
+
+	if c.CompactThreshold < 0 || c.CompactThreshold >= 1 {
+		return &InvalidSettingError{Provider: "nfs", Setting: "storage.disk.compactThreshold", Value: strconv.FormatFloat(c.CompactThreshold, 'g', -1, 64), Err: errors.New("must be at least 0 and less than 1")}
+	}
+
+	return nil
+}
+
+// Validate checks the shard counts and that there is a directory for every shard
+func (c ErasureConfig) Validate() error {
+	if len(c.Directories) == 0 {
+		return &MissingSettingsError{Provider: "erasure", Settings: []string{"storage.erasure.directories"}}
+	}
+
+	if c.DataShards < 1 {
+		return &InvalidSettingError{Provider: "erasure", Setting: "storage.erasure.dataShards", Value: strconv.Itoa(c.DataShards), Err: errors.New("must be at least 1")}
+	}
+
+	if c.ParityShards < 1 {
+		return &InvalidSettingError{Provider: "erasure", Setting: "storage.erasure.parityShards", Value: strconv.Itoa(c.ParityShards), Err: errors.New("must be at least 1")}
+	}
+
+	// The limit of Reed-Solomon over GF(2^8)
+	if c.DataShards+c.ParityShards > 256 {
+		return &InvalidSettingError{Provider: "erasure", Setting: "storage.erasure.parityShards", Value: strconv.Itoa(c.ParityShards), Err: errors.New("data and parity shards must not total more than 256")}
+	}
+
+	if len(c.Directories) != c.DataShards+c.ParityShards {
+		return &InvalidSettingError{Provider: "erasure", Setting: "storage.erasure.directories", Value: strings.Join(c.Directories, ","), Err: fmt.Errorf("need one directory for each of the %d shards", c.DataShards+c.ParityShards)}
+	}
+
+	if c.RepairInterval < 0 {
+		return &InvalidSettingError{Provider: "erasure", Setting: "storage.erasure.repairInterval", Value: c.RepairInterval.String(), Err: errors.New("must not be negative")}
+	}
+
+	return nil
+}
+
+// Validate checks no timeout is negative
+func (c TimeoutConfig) Validate() error {
+	timeouts := []struct {
+		setting string
+		value   Duration
+	}{
+		{"storage.timeouts.save", c.Save},
+		{"storage.timeouts.get", c.Get},
+		{"storage.timeouts.exists", c.Exists},
+		{"storage.timeouts.delete", c.Delete},
+	}
+
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			return &InvalidSettingError{Provider: "storage", Setting: timeout.setting, Value: timeout.value.String(), Err: errors.New("must not be negative")}
+		}
+	}
+
+	return nil
+}
+
+// validate checks no retry setting is negative.  The section is where the settings are found, such as 'storage'.
+func (c RetryConfig) validate(section string) error {
+	counts := []struct {
+		setting string
+		value   int
+	}{
+		{"maxRetries", c.MaxRetries},
+		{"breakerThreshold", c.BreakerThreshold},
+	}
+
+	for _, count := range counts {
+		if count.value < 0 {
+			return &InvalidSettingError{Provider: section, Setting: section + ".retry." + count.setting, Value: strconv.Itoa(count.value), Err: errors.New("must not be negative")}
+		}
+	}
+
+	durations := []struct {
+		setting string
+		value   Duration
+	}{
+		{"initialDelay", c.InitialDelay},
+		{"maxDelay", c.MaxDelay},
+		{"breakerCooldown", c.BreakerCooldown},
+	}
+
+	for _, duration := range durations {
+		if duration.value < 0 {
+			return &InvalidSettingError{Provider: section, Setting: section + ".retry." + duration.setting, Value: duration.value.String(), Err: errors.New("must not be negative")}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the clock skew allows some time, the nonce cache can hold nonces and tokens are checked properly
+func (c AuthConfig) Validate() error {
+	if c.ClockSkew <= 0 {
+		return &InvalidSettingError{Provider: "server", Setting: "server.auth.clockSkew", Value: c.ClockSkew.String(), Err: errors.New("must be greater than zero")}
+	}
+
+	if c.Nonces && c.NonceCacheSize <= 0 {
+		return &InvalidSettingError{Provider: "server", Setting: "server.auth.nonceCacheSize", Value: strconv.Itoa(c.NonceCacheSize), Err: errors.New("must be greater than zero")}
+	}
+
+	if c.JWT.Enabled() {
+		var missing []string
+		if c.JWT.Audience == "" {
+			missing = append(missing, "server.auth.jwt.audience")
+		}
+		if c.JWT.ScopesClaim == "" {
+			missing = append(missing, "server.auth.jwt.scopesClaim")
+		}
+		if len(missing) > 0 {
+			return &MissingSettingsError{Provider: "jwt", Settings: missing}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the tenants with quotas are named properly and their limits are not negative
+func (c TenantsConfig) Validate() error {
+	for tenant, quota := range c.Quotas {
+		if err := ValidateTenant(tenant); err != nil {
+			return &InvalidSettingError{Provider: "tenants", Setting: "tenants.quotas", Value: tenant, Err: err}
+		}
+
+		if quota.Length < 0 {
+			return &InvalidSettingError{Provider: "tenants", Setting: "tenants.quotas." + tenant + ".length", Value: strconv.FormatInt(quota.Length, 10), Err: errors.New("must not be negative")}
+		}
+
+		if quota.StoredSize < 0 {
+			return &InvalidSettingError{Provider: "tenants", Setting: "tenants.quotas." + tenant + ".storedSize", Value: strconv.FormatInt(quota.StoredSize, 10), Err: errors.New("must not be negative")}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the cache settings when a cache is enabled
+func (c CacheConfig) Validate() error {
+	if c.Provider == "" {
+		return nil
+	}
+
+	if !contains(CacheProviders, c.Provider) {
+		return unknownProvider("storage.cache.provider", c.Provider, CacheProviders)
+	}
+
+	if !contains(CacheModes, c.Mode) {
+		return &InvalidSettingError{Provider: "storage", Setting: "storage.cache.mode", Value: c.Mode, Err: fmt.Errorf("must be one of '%s'", strings.Join(CacheModes, "', '"))}
+	}
+
+	if c.MaxSize <= 0 {
+		return &InvalidSettingError{Provider: "storage", Setting: "storage.cache.maxSize", Value: strconv.FormatInt(c.MaxSize, 10), Err: errors.New("must be greater than zero")}
+	}
+
+	if c.RetryInterval < 0 {
+		return &InvalidSettingError{Provider: "storage", Setting: "storage.cache.retryInterval", Value: c.RetryInterval.String(), Err: errors.New("must not be negative")}
+	}
+
+	return nil
+}
+
+// Validate checks the s3 settings
+func (c S3Config) Validate() error {
+	if err := Required("s3",
+		"storage.s3.key", c.Key,
+		"storage.s3.secret", c.Secret,
+		"storage.s3.bucket", c.Bucket); err != nil {
+		return err
+	}
+
+	if c.Endpoint != "" {
+		if err := validateURL("s3", "storage.s3.endpoint", c.Endpoint); err != nil {
+			return err
+		}
+	}
+
+	if c.ServerSideEncryption != "" && !contains(S3ServerSideEncryptions, c.ServerSideEncryption) {
+		return unknownProvider("storage.s3.serverSideEncryption", c.ServerSideEncryption, S3ServerSideEncryptions)
+	}
+
+	if c.KMSKeyID != "" && c.ServerSideEncryption != "aws:kms" {
+		return &InvalidSettingError{Provider: "s3", Setting: "storage.s3.kmsKeyId", Value: c.KMSKeyID, Err: errors.New("needs serverSideEncryption aws:kms")}
+	}
+
+	if c.StorageClass != "" && !contains(S3StorageClasses, c.StorageClass) {
+		return unknownProvider("storage.s3.storageClass", c.StorageClass, S3StorageClasses)
+	}
+
+	if c.MultipartThreshold < S3MultipartOff {
+		return &InvalidSettingError{Provider: "s3", Setting: "storage.s3.multipartThreshold", Value: strconv.FormatInt(c.MultipartThreshold, 10), Err: errors.New("must be -1 or more")}
+	}
+
+	// Starting a multipart upload can not send the encryption and storage class headers
+	if (c.ServerSideEncryption != "" || c.StorageClass != "") && c.MultipartThreshold != S3MultipartOff {
+		return &InvalidSettingError{Provider: "s3", Setting: "storage.s3.multipartThreshold", Value: strconv.FormatInt(c.MultipartThreshold, 10), Err: errors.New("must be -1 with serverSideEncryption or storageClass, which multipart uploads can not set")}
+	}
+
+	// Zero uses the default
+	if c.PartSize != 0 && c.PartSize < S3MinPartSize {
+		return &InvalidSettingError{Provider: "s3", Setting: "storage.s3.partSize", Value: strconv.FormatInt(c.PartSize, 10), Err: fmt.Errorf("must be at least %d", S3MinPartSize)}
+	}
+
+	return nil
+}
+
+// Validate checks the azure settings.  Either the secret or a SAS token will do.
+func (c AzureConfig) Validate() error {
+	if err := Required("azure",
+		"storage.azure.account", c.Account,
+		"storage.azure.secret", c.Secret+c.SASToken); err != nil {
+		return err
+	}
+
+	// The values are kept out of the errors, as they are credentials
+	if c.Secret != "" {
+		if _, err := base64.StdEncoding.DecodeString(c.Secret); err != nil {
+			return &InvalidSettingError{Provider: "azure", Setting: "storage.azure.secret", Value: "***", Err: errors.New("must be the base64 account key")}
+		}
+	}
+
+	if c.SASToken != "" {
+		if _, err := url.ParseQuery(strings.TrimPrefix(c.SASToken, "?")); err != nil {
+			return &InvalidSettingError{Provider: "azure", Setting: "storage.azure.sasToken", Value: "***", Err: err}
+		}
+	}
+
+	if c.Container != "" && (!azureContainerName.MatchString(c.Container) || strings.Contains(c.Container, "--")) {
+		return &InvalidSettingError{Provider: "azure", Setting: "storage.azure.container", Value: c.Container, Err: errors.New("must be 3 to 63 lower case letters, numbers and single hyphens")}
+	}
+
+	if c.Endpoint != "" {
+		return validateURL("azure", "storage.azure.endpoint", c.Endpoint)
+	}
+
+	return nil
+}
+
+// azureContainerName matches the names azure allows for containers
+var azureContainerName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// validateURL checks the setting is an http or https URL
+func validateURL(provider string, setting string, value string) error {
+	parsed, err := url.Parse(value)
+	if err == nil && (parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "") {
+		err = errors.New("must be an http or https URL")
+	}
+	if err != nil {
+		return &InvalidSettingError{Provider: provider, Setting: setting, Value: value, Err: err}
+	}
+
+	return nil
+}
+
+// Validate checks the couchbase settings
+func (c CouchbaseConfig) Validate() error {
+	// Zero uses the default
+	if c.MaxItemSize < 0 || c.MaxItemSize > 20971520 {
+		return &InvalidSettingError{Provider: "couchbase", Setting: "couchbase.maxItemSize", Value: strconv.FormatInt(c.MaxItemSize, 10), Err: errors.New("must be between 0 and 20971520")}
+	}
+
+	return nil
+}
+
+// Validate checks the selected crypto provider has the settings it needs
+func (c CryptoConfig) Validate() error {
+	if err := c.Retry.validate("crypto"); err != nil {
+		return err
+	}
+
+	switch c.Provider {
+	case "openpgp":
+		return c.OpenPGP.Validate()
+	case "aws":
+		return c.AWS.Validate()
+	case "gokms":
+		return c.GoKMS.Validate()
+	}
+
+	return unknownProvider("crypto.provider", c.Provider, CryptoProviders)
+}
+
+// Validate checks the openpgp settings
+func (c OpenPGPConfig) Validate() error {
+	return Required("openpgp",
+		"crypto.openpgp.publicKey", c.PublicKeyPath,
+		"crypto.openpgp.privateKey", c.PrivateKeyPath)
+}
+
+// Validate checks the aws settings
+func (c AWSConfig) Validate() error {
+	return Required("aws",
+		"crypto.aws.key", c.Key,
+		"crypto.aws.secret", c.Secret,
+		"crypto.aws.region", c.Region)
+}
+
+// Validate checks the gokms settings
+func (c GoKMSConfig) Validate() error {
+	return Required("gokms",
+		"crypto.gokms.authKey", c.AuthKey,
+		"crypto.gokms.url", c.URL)
+}
+
+func unknownProvider(setting string, value string, known []string) error {
+	return &InvalidSettingError{Provider: strings.SplitN(setting, ".", 2)[0], Setting: setting, Value: value, Err: fmt.Errorf("must be one of '%s'", strings.Join(known, "', '"))}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
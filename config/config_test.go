@@ -0,0 +1,468 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type ConfigSuite struct {
+}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) TestLoadFileFormats(c *C) {
+	for _, path := range []string{"testdata/blocker.yaml", "testdata/blocker.json", "testdata/blocker.toml"} {
+		cfg := Default()
+		err := cfg.LoadFile(path)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+		c.Assert(cfg.Storage.Provider, Equals, "s3", Commentf("File: %v", path))
+		c.Assert(cfg.Storage.S3.Key, Equals, "THEKEY", Commentf("File: %v", path))
+		c.Assert(cfg.Storage.S3.Secret, Equals, "THESECRET", Commentf("File: %v", path))
+		c.Assert(cfg.Storage.S3.Bucket, Equals, "THEBUCKET", Commentf("File: %v", path))
+		c.Assert(cfg.Crypto.OpenPGP.PublicKeyPath, Equals, "/keys/public.pem", Commentf("File: %v", path))
+		c.Assert(cfg.Blocks.BlockSize, Equals, int64(1048576), Commentf("File: %v", path))
+		c.Assert(cfg.Blocks.Compression, IsFalse, Commentf("File: %v", path))
+		c.Assert(cfg.Server.Address, Equals, ":9010", Commentf("File: %v", path))
+		c.Assert(cfg.Storage.Timeouts.Get, Equals, Duration(5*time.Second), Commentf("File: %v", path))
+		c.Assert(cfg.Storage.Disk.FileMode, Equals, FileMode(0640), Commentf("File: %v", path))
+
+		// Settings not in the file keep their defaults
+		c.Assert(cfg.Blocks.Encryption, IsTrue, Commentf("File: %v", path))
+		c.Assert(cfg.Crypto.AWS.Region, Equals, "eu-central-1", Commentf("File: %v", path))
+		c.Assert(cfg.Storage.Timeouts.Save, Equals, Duration(time.Minute), Commentf("File: %v", path))
+		c.Assert(cfg.Storage.Disk.DirMode, Equals, FileMode(0777), Commentf("File: %v", path))
+		c.Assert(cfg.Storage.S3.Region, Equals, "eu-west-1", Commentf("File: %v", path))
+	}
+}
+
+func (s *ConfigSuite) TestLoadFileUnknownFormat(c *C) {
+	cfg := Default()
+	err := cfg.LoadFile("testdata/blocker.ini")
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *ConfigSuite) TestEnvOverridesFile(c *C) {
+	os.Setenv("BLOCKER_S3_BUCKET", "ENVBUCKET")
+	defer os.Unsetenv("BLOCKER_S3_BUCKET")
+
+	cfg, err := Load("testdata/blocker.yaml")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	c.Assert(cfg.Storage.S3.Bucket, Equals, "ENVBUCKET")
+	c.Assert(cfg.Storage.S3.Key, Equals, "THEKEY")
+}
+
+func (s *ConfigSuite) TestValidateReportsEverything(c *C) {
+	cfg := Default()
+	cfg.Storage.Provider = "s3"
+	cfg.Crypto.Provider = "gokms"
+	cfg.Crypto.GoKMS.URL = "https://localhost:8011"
+
+	err := cfg.Validate()
+	c.Assert(err != nil, IsTrue)
+
+	var missingErr *MissingSettingsError
+	c.Assert(errors.As(err, &missingErr), IsTrue)
+
+	// Both the storage and the crypto problems are reported
+	c.Assert(err.Error(), Matches, "(?s)s3: missing required settings: storage.s3.key, storage.s3.secret, storage.s3.bucket\ngokms: missing required settings: crypto.gokms.authKey")
+}
+
+func (s *ConfigSuite) TestValidateUnknownProvider(c *C) {
+	cfg := Default()
+	cfg.Storage.Provider = "floppy"
+	cfg.Crypto.OpenPGP = OpenPGPConfig{PublicKeyPath: "public.pem", PrivateKeyPath: "private.pem"}
+
+	err := cfg.Validate()
+	c.Assert(err != nil, IsTrue)
+
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(err, &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.provider")
+}
+
+func (s *ConfigSuite) TestValidateSkipsCryptoWithoutEncryption(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+
+	err := cfg.Validate()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+}
+
+func (s *ConfigSuite) TestValidateNegativeTimeout(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Timeouts.Delete = Duration(-time.Second)
+
+	err := cfg.Validate()
+	c.Assert(err != nil, IsTrue)
+
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(err, &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.timeouts.delete")
+}
+
+func (s *ConfigSuite) TestEnvTimeouts(c *C) {
+	os.Setenv("BLOCKER_TIMEOUT_EXISTS", "250ms")
+	defer os.Unsetenv("BLOCKER_TIMEOUT_EXISTS")
+
+	cfg := Default()
+	err := cfg.LoadEnv()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	c.Assert(cfg.Storage.Timeouts.Exists, Equals, Duration(250*time.Millisecond))
+}
+
+func (s *ConfigSuite) TestEnvInvalid(c *C) {
+	os.Setenv("BLOCKER_TIMEOUT_SAVE", "soon")
+	defer os.Unsetenv("BLOCKER_TIMEOUT_SAVE")
+	os.Setenv("BLOCKER_TENANTS_ISOLATE", "maybe")
+	defer os.Unsetenv("BLOCKER_TENANTS_ISOLATE")
+
+	cfg := Default()
+	err := cfg.LoadEnv()
+
+	// Every variable which can not be read is reported
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(err, &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "BLOCKER_TENANTS_ISOLATE")
+	c.Assert(strings.Contains(err.Error(), "BLOCKER_TIMEOUT_SAVE"), IsTrue)
+
+	_, err = Load("")
+	c.Assert(err != nil, IsTrue)
+}
+
+func (s *ConfigSuite) TestValidateCache(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+
+	// The cache is disabled by default
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	cfg.Storage.Cache.Provider = "memory"
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	cfg.Storage.Cache.Mode = "write-sometimes"
+	err := cfg.Validate()
+
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(err, &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.cache.mode")
+
+	cfg.Storage.Cache.Mode = "write-back"
+	cfg.Storage.Cache.RetryInterval = -1
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.cache.retryInterval")
+}
+
+func (s *ConfigSuite) TestValidateReplication(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Provider = "replicated"
+
+	var missingErr *MissingSettingsError
+	c.Assert(errors.As(cfg.Validate(), &missingErr), IsTrue)
+	c.Assert(missingErr.Settings, DeepEquals, []string{"storage.replication.providers"})
+
+	cfg.Storage.Replication.Providers = []string{"nfs", "memory"}
+	cfg.Storage.Replication.WriteQuorum = 1
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	cfg.Storage.Replication.WriteQuorum = 3
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.replication.writeQuorum")
+
+	// Every replicated provider is validated
+	cfg.Storage.Replication.WriteQuorum = 0
+	cfg.Storage.Replication.Providers = []string{"nfs", "s3"}
+	c.Assert(errors.As(cfg.Validate(), &missingErr), IsTrue)
+	c.Assert(missingErr.Provider, Equals, "s3")
+
+	cfg.Storage.Replication.Providers = []string{"nfs", "nfs"}
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.replication.providers")
+}
+
+func (s *ConfigSuite) TestValidateErasure(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Provider = "erasure"
+
+	var missingErr *MissingSettingsError
+	c.Assert(errors.As(cfg.Validate(), &missingErr), IsTrue)
+	c.Assert(missingErr.Settings, DeepEquals, []string{"storage.erasure.directories"})
+
+	// The default is 4 data and 2 parity shards
+	cfg.Storage.Erasure.Directories = []string{"a", "b", "c", "d", "e", "f"}
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	cfg.Storage.Erasure.ParityShards = 3
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.erasure.directories")
+
+	cfg.Storage.Erasure.ParityShards = 0
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.erasure.parityShards")
+
+	cfg.Storage.Erasure.ParityShards = 2
+	cfg.Storage.Erasure.RepairInterval = -1
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.erasure.repairInterval")
+}
+
+func (s *ConfigSuite) TestValidatePackFiles(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Disk.PackFiles = true
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	cfg.Storage.Disk.CompactThreshold = 1
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.disk.compactThreshold")
+}
+
+func (s *ConfigSuite) TestValidateDiskModes(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Disk.FileMode = 0400
+
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.disk.fileMode")
+	c.Assert(invalidErr.Value, Equals, "0400")
+
+	cfg.Storage.Disk.FileMode = 0600
+	cfg.Storage.Disk.DirMode = 01777
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.disk.dirMode")
+}
+
+func (s *ConfigSuite) TestValidateS3(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Provider = "s3"
+	cfg.Storage.S3 = S3Config{Key: "key", Secret: "secret", Bucket: "bucket", Endpoint: "http://localhost:9000", PathStyle: true}
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	var invalidErr *InvalidSettingError
+
+	cfg.Storage.S3.Endpoint = "localhost:9000"
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.s3.endpoint")
+
+	cfg.Storage.S3.Endpoint = ""
+	cfg.Storage.S3.Region = "eu-central-1"
+	cfg.Storage.S3.KMSKeyID = "key"
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.s3.kmsKeyId")
+
+	cfg.Storage.S3.KMSKeyID = ""
+	cfg.Storage.S3.StorageClass = "DIAMOND"
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.s3.storageClass")
+}
+
+func (s *ConfigSuite) TestValidateS3Multipart(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Provider = "s3"
+	cfg.Storage.S3.Key, cfg.Storage.S3.Secret, cfg.Storage.S3.Bucket = "key", "secret", "bucket"
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	cfg.Storage.S3.PartSize = 1024
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.s3.partSize")
+
+	// Encryption and storage classes need multipart uploads off
+	cfg.Storage.S3.PartSize = S3MinPartSize
+	cfg.Storage.S3.StorageClass = "STANDARD_IA"
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.s3.multipartThreshold")
+
+	cfg.Storage.S3.MultipartThreshold = S3MultipartOff
+	c.Assert(cfg.Validate() == nil, IsTrue)
+}
+
+func (s *ConfigSuite) TestValidateRetry(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Retry.BreakerCooldown = Duration(-time.Second)
+
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.retry.breakerCooldown")
+
+	cfg = Default()
+	cfg.Crypto.Retry.MaxRetries = -1
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "crypto.retry.maxRetries")
+
+	// Retrying and the breaker can be turned off
+	cfg = Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Retry = RetryConfig{}
+	c.Assert(cfg.Validate() == nil, IsTrue)
+}
+
+func (s *ConfigSuite) TestValidateAzure(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Provider = "azure"
+	cfg.Storage.Azure.Account = "account"
+
+	var missingErr *MissingSettingsError
+	c.Assert(errors.As(cfg.Validate(), &missingErr), IsTrue)
+	c.Assert(missingErr.Settings, DeepEquals, []string{"storage.azure.secret"})
+
+	// A SAS token will do instead of the secret
+	cfg.Storage.Azure.SASToken = "sv=2020-04-08&sig=abc"
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	cfg.Storage.Azure.SASToken = ""
+	cfg.Storage.Azure.Secret = "not base64!"
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.azure.secret")
+	c.Assert(strings.Contains(invalidErr.Error(), "not base64"), IsFalse)
+
+	cfg.Storage.Azure.Secret = "c2VjcmV0"
+	for _, container := range []string{"Blocks", "bl", "blocks--store", "-blocks"} {
+		cfg.Storage.Azure.Container = container
+		c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue, Commentf("Container: %s", container))
+		c.Assert(invalidErr.Setting, Equals, "storage.azure.container")
+	}
+
+	cfg.Storage.Azure.Container = "blocks-store"
+	cfg.Storage.Azure.Endpoint = "127.0.0.1:10000"
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.azure.endpoint")
+
+	cfg.Storage.Azure.Endpoint = "http://127.0.0.1:10000/devstoreaccount1"
+	c.Assert(cfg.Validate() == nil, IsTrue)
+}
+
+func (s *ConfigSuite) TestValidateCouchbase(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Couchbase.MaxItemSize = 30 * 1024 * 1024
+
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "couchbase.maxItemSize")
+
+	os.Setenv("CB_BUCKET", "blocks")
+	defer os.Unsetenv("CB_BUCKET")
+
+	cfg = Default()
+	c.Assert(cfg.LoadEnv() == nil, IsTrue)
+	c.Assert(cfg.Couchbase.Bucket, Equals, "blocks")
+	c.Assert(cfg.Couchbase.Pool, Equals, "default")
+}
+
+func (s *ConfigSuite) TestValidateBackup(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Storage.Backup.Provider = "nfs"
+
+	var missingErr *MissingSettingsError
+	c.Assert(errors.As(cfg.Validate(), &missingErr), IsTrue)
+	c.Assert(missingErr.Settings, DeepEquals, []string{"storage.backup.directory"})
+
+	cfg.Storage.Backup.Directory = "/backup"
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	var invalidErr *InvalidSettingError
+	cfg.Storage.Disk.Directory = "/backup"
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.backup.directory")
+
+	// The backup provider is validated
+	cfg.Storage.Backup.Provider = "s3"
+	c.Assert(errors.As(cfg.Validate(), &missingErr), IsTrue)
+	c.Assert(missingErr.Provider, Equals, "s3")
+
+	// Blocks can not be backed up to where they are
+	cfg.Storage.Provider = "s3"
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.backup.provider")
+
+	cfg.Storage.Backup.Provider = "memory"
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "storage.backup.provider")
+}
+
+func (s *ConfigSuite) TestValidateAuth(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Server.Auth.ClockSkew = 0
+
+	var invalidErr *InvalidSettingError
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "server.auth.clockSkew")
+
+	cfg = Default()
+	cfg.Blocks.Encryption = false
+	cfg.Server.Auth.Nonces = true
+	cfg.Server.Auth.NonceCacheSize = 0
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "server.auth.nonceCacheSize")
+
+	os.Setenv("BLOCKER_AUTH_LEGACY", "true")
+	defer os.Unsetenv("BLOCKER_AUTH_LEGACY")
+
+	cfg, err := Load("")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(cfg.Server.Auth.Legacy, IsTrue)
+
+	// Tokens are only accepted for an audience
+	os.Setenv("BLOCKER_JWT_JWKS", "/etc/blocker/idp.json,/etc/blocker/other.json")
+	defer os.Unsetenv("BLOCKER_JWT_JWKS")
+
+	cfg, err = Load("")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(cfg.Server.Auth.JWT.JWKSPaths, DeepEquals, []string{"/etc/blocker/idp.json", "/etc/blocker/other.json"})
+	c.Assert(cfg.Server.Auth.JWT.Enabled(), IsTrue)
+
+	cfg.Blocks.Encryption = false
+	var missingErr *MissingSettingsError
+	c.Assert(errors.As(cfg.Validate(), &missingErr), IsTrue)
+	c.Assert(missingErr.Settings, DeepEquals, []string{"server.auth.jwt.audience"})
+
+	cfg.Server.Auth.JWT.Audience = "blocker"
+	c.Assert(cfg.Validate() == nil, IsTrue)
+}
+
+func (s *ConfigSuite) TestValidateTenants(c *C) {
+	cfg := Default()
+	cfg.Blocks.Encryption = false
+	cfg.Tenants.Quotas = map[string]QuotaConfig{"acme": {Length: 1024, StoredSize: 512}}
+	c.Assert(cfg.Validate() == nil, IsTrue)
+
+	var invalidErr *InvalidSettingError
+	cfg.Tenants.Quotas = map[string]QuotaConfig{"Not A Tenant": {Length: 1024}}
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "tenants.quotas")
+
+	cfg.Tenants.Quotas = map[string]QuotaConfig{"acme": {StoredSize: -1}}
+	c.Assert(errors.As(cfg.Validate(), &invalidErr), IsTrue)
+	c.Assert(invalidErr.Setting, Equals, "tenants.quotas.acme.storedSize")
+
+	c.Assert(ValidateTenant("") == nil, IsTrue)
+	c.Assert(ValidateTenant("acme-2_b") == nil, IsTrue)
+	c.Assert(ValidateTenant("acme:b") != nil, IsTrue)
+}
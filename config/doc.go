@@ -0,0 +1,5 @@
+// Package config holds the settings used to configure a blocker installation
+//
+// Current version: experimental
+//
+package config
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"time"
+)
+
+// Duration is a time.Duration written as a string such as "30s" or "2m" in configuration files
+type Duration time.Duration
+
+// UnmarshalText parses a duration string
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+
+	return nil
+}
+
+// MarshalText writes the duration as a string
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// String returns the duration as a string
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
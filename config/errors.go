@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MissingSettingsError is returned when a provider is created without all of the settings it needs.
+// Every missing setting is listed so the whole configuration can be fixed in one go.
+type MissingSettingsError struct {
+	// Provider is the name of the provider that could not be created
+	Provider string
+	// Settings are the names of the settings that were not supplied
+	Settings []string
+}
+
+func (e *MissingSettingsError) Error() string {
+	return fmt.Sprintf("%s: missing required settings: %s", e.Provider, strings.Join(e.Settings, ", "))
+}
+
+// InvalidSettingError is returned when a setting was supplied but could not be used
+type InvalidSettingError struct {
+	// Provider is the name of the provider that could not be created
+	Provider string
+	// Setting is the name of the offending setting
+	Setting string
+	// Value is the value that was supplied
+	Value string
+	// Err is the underlying reason the value could not be used
+	Err error
+}
+
+func (e *InvalidSettingError) Error() string {
+	return fmt.Sprintf("%s: invalid setting %s=%q: %v", e.Provider, e.Setting, e.Value, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *InvalidSettingError) Unwrap() error {
+	return e.Err
+}
+
+// Required returns a MissingSettingsError for the provider if any of the named settings are empty, otherwise nil.
+// The settings are passed as name, value pairs and are reported in the order given.
+func Required(provider string, settings ...string) error {
+	var missing []string
+	for i := 0; i+1 < len(settings); i += 2 {
+		if settings[i+1] == "" {
+			missing = append(missing, settings[i])
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return &MissingSettingsError{Provider: provider, Settings: missing}
+}
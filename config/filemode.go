@@ -0,0 +1,31 @@
+package config
+
+import (
+	"os"
+	"strconv"
+)
+
+// FileMode is an os.FileMode written as an octal string such as "0640" in configuration files
+type FileMode os.FileMode
+
+// UnmarshalText parses an octal permission string
+func (m *FileMode) UnmarshalText(text []byte) error {
+	mode, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil {
+		return err
+	}
+
+	*m = FileMode(mode)
+
+	return nil
+}
+
+// MarshalText writes the mode as an octal string
+func (m FileMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// String returns the mode as an octal string
+func (m FileMode) String() string {
+	return "0" + strconv.FormatUint(uint64(m), 8)
+}
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/gen/kms"
+	"github.com/keithballdotnet/blocker/config"
 	"io"
 	"log"
-	"os"
 )
 
 // AwsCryptoProvider is an implementation of encryption using AWS KMS
@@ -17,38 +17,28 @@ type AwsCryptoProvider struct {
 	keyID string
 }
 
-// NewAwsCryptoProvider
-func NewAwsCryptoProvider() (AwsCryptoProvider, error) {
+// NewAwsCryptoProvider - Creates a provider using the configured AWS KMS credentials
+func NewAwsCryptoProvider(cfg config.AWSConfig) (AwsCryptoProvider, error) {
 
 	log.Println("Using AwsCryptoProvider for encryption...")
 
-	awskey := os.Getenv("BLOCKER_KMS_KEY")
-	awssecret := os.Getenv("BLOCKER_KMS_SECRET")
-
-	if awskey == "" || awssecret == "" {
-		panic("Enivronmental Variable: BLOCKER_KMS_KEY or BLOCKER_KMS_SECRET are empty!  You must set these values when using amazon KMS key management!")
+	if err := cfg.Validate(); err != nil {
+		return AwsCryptoProvider{}, err
 	}
 
 	// Set up credentials...
-	creds := aws.Creds(awskey, awssecret, "")
-
-	awsregion := os.Getenv("BLOCKER_KMS_REGION")
-
-	// Default to central region
-	if awsregion == "" {
-		awsregion = "eu-central-1"
-	}
+	creds := aws.Creds(cfg.Key, cfg.Secret, "")
 
-	// Connect to eu west
-	cli := kms.New(creds, awsregion, nil)
+	// Connect to the configured region
+	cli := kms.New(creds, cfg.Region, nil)
 
-	awskeyID := os.Getenv("BLOCKER_KMS_KEY_ID")
+	awskeyID := cfg.KeyID
 	if awskeyID == "" {
 		awskeyID = getNewestKeyID(cli)
 	}
 
 	if awskeyID == "" {
-		panic("Unable to find a key ID to use for encryption. You must set these values when using amazon KMS key management!")
+		return AwsCryptoProvider{}, &config.MissingSettingsError{Provider: "aws", Settings: []string{"crypto.aws.keyId"}}
 	}
 
 	log.Printf("AwsCryptoProvider using Key: %v", awskeyID)
@@ -4,16 +4,15 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"sort"
-	"strings"
 	"time"
+
+	"github.com/keithballdotnet/blocker/config"
 )
 
 // GoKMSCryptoProvider is an implementation of encryption using GO KMS
@@ -24,42 +23,40 @@ type GoKMSCryptoProvider struct {
 	cli JSONClient
 }
 
-// NewGoKMSCryptoProvider
-func NewGoKMSCryptoProvider() (GoKMSCryptoProvider, error) {
+// NewGoKMSCryptoProvider - Creates a provider using the configured GO-KMS server
+func NewGoKMSCryptoProvider(cfg config.GoKMSConfig) (GoKMSCryptoProvider, error) {
 
 	log.Println("Using GoKMSCryptoProvider for encryption...")
 
-	authKey := os.Getenv("BLOCKER_GOKMS_AUTHKEY")
-	baseUrl := os.Getenv("BLOCKER_GOKMS_URL")
-
-	if authKey == "" || baseUrl == "" {
-		panic("Enivronmental Variable: BLOCKER_GOKMS_AUTHKEY or BLOCKER_GOKMS_URL are empty!  You must set these values when using GO KMS key management!")
+	if err := cfg.Validate(); err != nil {
+		return GoKMSCryptoProvider{}, err
 	}
 
-	client := http.DefaultClient
+	client := &http.Client{}
 
-	ignoreBadTls := os.Getenv("BLOCKER_GOKMS_IGNORE_BAD_TLS_CERT")
-	if strings.ToUpper(ignoreBadTls) == "TRUE" {
+	if cfg.IgnoreBadTLSCert {
 		client.Transport = &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
 		log.Println("WARNING: Ignore bad TLS Certificates is set to TRUE!  Do not do this in production!")
 	}
 
-	log.Printf("GoKMSCryptoProvider using GO-KMS @ %v", baseUrl)
+	log.Printf("GoKMSCryptoProvider using GO-KMS @ %v", cfg.URL)
 
-	jsonClient := JSONClient{Client: client, Endpoint: baseUrl, AuthKey: authKey}
+	jsonClient := JSONClient{Client: client, Endpoint: cfg.URL, AuthKey: cfg.AuthKey}
 	gokms := GoKMSCryptoProvider{cli: jsonClient}
 
-	keyID := os.Getenv("BLOCKER_GOKMS_KEYID")
+	keyID := cfg.KeyID
 	if keyID == "" {
 		keyID = gokms.getNewestKeyID()
 	}
 
 	if keyID == "" {
-		panic("Unable to find a key ID to use for encryption. You must set these values when using amazon KMS key management!")
+		return GoKMSCryptoProvider{}, &config.MissingSettingsError{Provider: "gokms", Settings: []string{"crypto.gokms.keyId"}}
 	}
 
+	gokms.keyID = keyID
+
 	return gokms, nil
 }
 
@@ -219,7 +216,7 @@ func (c *JSONClient) Do(method, uri string, req, resp interface{}) error {
 			return err
 		}
 
-		return errors.New(fmt.Sprintf("KMSError StatusCode: %v Error: %v", response.StatusCode, string(bodyBytes)))
+		return &KMSError{StatusCode: response.StatusCode, Message: string(bodyBytes)}
 	}
 
 	if resp != nil {
@@ -228,6 +225,16 @@ func (c *JSONClient) Do(method, uri string, req, resp interface{}) error {
 	return nil
 }
 
+// KMSError is returned when the KMS answers with anything but 200 OK
+type KMSError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *KMSError) Error() string {
+	return fmt.Sprintf("KMSError StatusCode: %v Error: %v", e.StatusCode, e.Message)
+}
+
 // SetAuth will set kms auth headers
 func (c *JSONClient) SetAuth(request *http.Request, method string, resource string) *http.Request {
 
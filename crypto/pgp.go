@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto"
 
+	"github.com/keithballdotnet/blocker/config"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/packet"
 	"io"
@@ -18,7 +19,7 @@ var pgpConfig = &packet.Config{
 	DefaultCompressionAlgo: packet.CompressionNone,
 }
 
-// AwsCryptoProvider is an implementation of encryption using AWS KMS
+// OpenPGPCryptoProvider is an implementation of encryption using an OpenPGP key pair
 type OpenPGPCryptoProvider struct {
 	// publicEntityList - Public Key
 	publicEntityList openpgp.EntityList
@@ -26,74 +27,73 @@ type OpenPGPCryptoProvider struct {
 	privateEntityList openpgp.EntityList
 }
 
-// NewAwsCryptoProvider
-func NewOpenPGPCryptoProvider() (OpenPGPCryptoProvider, error) {
+// NewOpenPGPCryptoProvider - Creates a provider using the configured key ring files
+func NewOpenPGPCryptoProvider(cfg config.OpenPGPConfig) (OpenPGPCryptoProvider, error) {
 
 	log.Println("Using OpenPGPCryptoProvider for encryption...")
 
-	publicKeyPath := os.Getenv("BLOCKER_PGP_PUBLICKEY")
-	if publicKeyPath == "" {
-		panic("You must specify a public pgp key.  Set env: BLOCKER_PGP_PUBLICKEY")
+	if err := cfg.Validate(); err != nil {
+		return OpenPGPCryptoProvider{}, err
 	}
 
-	privateKeyPath := os.Getenv("BLOCKER_PGP_PRIVATEKEY")
-	if publicKeyPath == "" {
-		panic("You must specify a private pgp key.  Set env: BLOCKER_PGP_PRIVATEKEY")
-	}
+	publicKeyPath := cfg.PublicKeyPath
+	privateKeyPath := cfg.PrivateKeyPath
 
 	log.Printf("Reading public key from %s\n", publicKeyPath)
-	publicKey, err := os.Open(publicKeyPath)
-	defer publicKey.Close()
-	if err != nil {
-		panic(err)
-	}
-
-	publicEntityList, err := openpgp.ReadArmoredKeyRing(publicKey)
+	publicEntityList, err := readKeyRing(publicKeyPath)
 	if err != nil {
-		panic(err)
+		return OpenPGPCryptoProvider{}, &config.InvalidSettingError{Provider: "openpgp", Setting: "crypto.openpgp.publicKey", Value: publicKeyPath, Err: err}
 	}
 
 	log.Printf("Reading private key from %s\n", privateKeyPath)
-	privateKey, err := os.Open(privateKeyPath)
-	defer privateKey.Close()
+	privateEntityList, err := readKeyRing(privateKeyPath)
 	if err != nil {
-		panic(err)
+		return OpenPGPCryptoProvider{}, &config.InvalidSettingError{Provider: "openpgp", Setting: "crypto.openpgp.privateKey", Value: privateKeyPath, Err: err}
 	}
-	privateEntityList, err := openpgp.ReadArmoredKeyRing(privateKey)
+
+	return OpenPGPCryptoProvider{publicEntityList: publicEntityList, privateEntityList: privateEntityList}, nil
+}
+
+// readKeyRing reads an armored key ring from the passed path
+func readKeyRing(path string) (openpgp.EntityList, error) {
+	keyFile, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer keyFile.Close()
 
-	return OpenPGPCryptoProvider{publicEntityList: publicEntityList, privateEntityList: privateEntityList}, nil
+	return openpgp.ReadArmoredKeyRing(keyFile)
 }
 
 // Decrypt decrypts data that has been encrypted and compressed
 func (p OpenPGPCryptoProvider) Decrypt(data []byte) ([]byte, error) {
-	dataBuffer := bytes.NewReader(data)
-	md, err := openpgp.ReadMessage(dataBuffer, p.privateEntityList, nil, pgpConfig)
+	reader, err := p.DecryptReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 
 	// Read all the converted data...
 	var b bytes.Buffer
-	b.ReadFrom(md.UnverifiedBody)
+	if _, err := b.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+
 	return b.Bytes(), nil
 }
 
 // Encrypt - Encrypts the data
 func (p OpenPGPCryptoProvider) Encrypt(data []byte) ([]byte, error) {
 	encryptedBuffer := &bytes.Buffer{}
-	dataBuffer := bytes.NewReader(data)
 
-	// Call openpgp encrypt with default settings
-	pgpWriter, err := openpgp.Encrypt(encryptedBuffer, p.publicEntityList, nil, nil, pgpConfig)
+	pgpWriter, err := p.EncryptWriter(encryptedBuffer)
 	if err != nil {
 		return nil, err
 	}
 
 	// Encrypt streams
-	io.Copy(pgpWriter, dataBuffer)
+	if _, err := pgpWriter.Write(data); err != nil {
+		return nil, err
+	}
 
 	// Close the encryption stream
 	if err := pgpWriter.Close(); err != nil {
@@ -103,3 +103,19 @@ func (p OpenPGPCryptoProvider) Encrypt(data []byte) ([]byte, error) {
 	// return the encrypted bytes
 	return encryptedBuffer.Bytes(), nil
 }
+
+// DecryptReader returns a reader decrypting the data as it is read
+func (p OpenPGPCryptoProvider) DecryptReader(r io.Reader) (io.Reader, error) {
+	md, err := openpgp.ReadMessage(r, p.privateEntityList, nil, pgpConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return md.UnverifiedBody, nil
+}
+
+// EncryptWriter returns a writer encrypting the data as it is written
+func (p OpenPGPCryptoProvider) EncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	// Call openpgp encrypt with default settings
+	return openpgp.Encrypt(w, p.publicEntityList, nil, nil, pgpConfig)
+}
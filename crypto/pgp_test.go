@@ -3,8 +3,10 @@ package crypto
 import (
 	"bytes"
 	"fmt"
+	"github.com/keithballdotnet/blocker/config"
 	. "github.com/keithballdotnet/blocker/gocheck2"
 	. "gopkg.in/check.v1"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -34,11 +36,9 @@ func SetupPGPTests() {
 
 	ioutil.WriteFile(publicPath, []byte(publicKeyString), 0666)
 	ioutil.WriteFile(privatePath, []byte(privateKeyString), 0666)
-	os.Setenv("BLOCKER_PGP_PUBLICKEY", publicPath)
-	os.Setenv("BLOCKER_PGP_PRIVATEKEY", privatePath)
 
 	// Get the keys
-	cryptoProvider, err = NewOpenPGPCryptoProvider()
+	cryptoProvider, err = NewOpenPGPCryptoProvider(config.OpenPGPConfig{PublicKeyPath: publicPath, PrivateKeyPath: privatePath})
 }
 
 // Setup the REST testing suite
@@ -90,6 +90,57 @@ func (s *CryptoPGPSuite) TestPGPCrypto(c *C) {
 	c.Assert(bytes.Equal(bytesToEncrypt, unencryptedBytes), IsTrue)
 }
 
+func (s *CryptoPGPSuite) TestPGPStreamingCrypto(c *C) {
+	streamingProvider, ok := cryptoProvider.(StreamingCryptoProvider)
+	c.Assert(ok, IsTrue)
+
+	bytesToEncrypt := []byte(RandomSecret(100000))
+
+	var encryptedBuffer bytes.Buffer
+	writer, err := streamingProvider.EncryptWriter(&encryptedBuffer)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	_, err = io.Copy(writer, bytes.NewReader(bytesToEncrypt))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = writer.Close()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Streamed data can be decrypted as a whole
+	unencryptedBytes, err := cryptoProvider.Decrypt(encryptedBuffer.Bytes())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(bytes.Equal(bytesToEncrypt, unencryptedBytes), IsTrue)
+
+	// And data encrypted as a whole can be streamed
+	encryptedBytes, err := cryptoProvider.Encrypt(bytesToEncrypt)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	reader, err := streamingProvider.DecryptReader(bytes.NewReader(encryptedBytes))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	unencryptedBytes, err = ioutil.ReadAll(reader)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(bytes.Equal(bytesToEncrypt, unencryptedBytes), IsTrue)
+}
+
+func (s *CryptoPGPSuite) TestPGPCryptoProviderFailsWithoutPrivateKey(c *C) {
+	_, err := NewOpenPGPCryptoProvider(config.OpenPGPConfig{PublicKeyPath: publicPath})
+	c.Assert(err != nil, IsTrue)
+
+	missingErr, ok := err.(*config.MissingSettingsError)
+	c.Assert(ok, IsTrue, Commentf("Unexpected error type: %T", err))
+	c.Assert(missingErr.Settings, DeepEquals, []string{"crypto.openpgp.privateKey"})
+}
+
+func (s *CryptoPGPSuite) TestPGPCryptoProviderFailsWithUnreadableKey(c *C) {
+	_, err := NewOpenPGPCryptoProvider(config.OpenPGPConfig{PublicKeyPath: "/this/file/does/not/exist.pem", PrivateKeyPath: privatePath})
+	c.Assert(err != nil, IsTrue)
+
+	invalidErr, ok := err.(*config.InvalidSettingError)
+	c.Assert(ok, IsTrue, Commentf("Unexpected error type: %T", err))
+	c.Assert(invalidErr.Setting, Equals, "crypto.openpgp.publicKey")
+}
+
 var publicKeyString = `-----BEGIN PGP PUBLIC KEY BLOCK-----
 Version: GnuPG v2
 
@@ -1,7 +1,56 @@
 package crypto
 
+import (
+	"io"
+
+	"github.com/keithballdotnet/blocker/config"
+	"github.com/keithballdotnet/blocker/retry"
+)
+
 // CryptoProvider provides an interface for crypto provider solutions
 type CryptoProvider interface {
 	Encrypt(data []byte) ([]byte, error)
 	Decrypt(data []byte) ([]byte, error)
 }
+
+// StreamingCryptoProvider is implemented by crypto providers which can encrypt and decrypt
+// without holding all the data in memory
+type StreamingCryptoProvider interface {
+	CryptoProvider
+	// EncryptWriter returns a writer encrypting into w.  Close finishes the encryption but does not close w.
+	EncryptWriter(w io.Writer) (io.WriteCloser, error)
+	// DecryptReader returns a reader of the decrypted data from r
+	DecryptReader(r io.Reader) (io.Reader, error)
+}
+
+// NewCryptoProvider creates the crypto provider selected in the configuration.
+// Providers calling a key management service retry its transient errors.
+func NewCryptoProvider(cfg config.CryptoConfig) (CryptoProvider, error) {
+	var provider CryptoProvider
+	var transient retry.Classifier
+	var err error
+
+	switch cfg.Provider {
+	case "gokms":
+		provider, err = NewGoKMSCryptoProvider(cfg.GoKMS)
+		transient = isTransientGoKMSError
+	case "aws":
+		provider, err = NewAwsCryptoProvider(cfg.AWS)
+		transient = isTransientAwsError
+	case "openpgp":
+		provider, err = NewOpenPGPCryptoProvider(cfg.OpenPGP)
+	default:
+		err = cfg.Validate()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The key management services are called over the network, openpgp is local
+	if transient != nil {
+		return NewRetryCryptoProvider(provider, retry.NewPolicy(cfg.Retry), transient), nil
+	}
+
+	return provider, nil
+}
@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/keithballdotnet/blocker/retry"
+)
+
+// RetryCryptoProvider retries encryption and decryption which fail with a transient error,
+// and stops calling the provider for a while after too many failures in a row
+type RetryCryptoProvider struct {
+	provider CryptoProvider
+	retrier  *retry.Retrier
+}
+
+// NewRetryCryptoProvider - Creates a CryptoProvider retrying the errors the classifier finds transient
+func NewRetryCryptoProvider(provider CryptoProvider, policy retry.Policy, transient retry.Classifier) *RetryCryptoProvider {
+	return &RetryCryptoProvider{provider: provider, retrier: retry.New(policy, transient)}
+}
+
+// Stats returns the retries made and the state of the breaker
+func (p *RetryCryptoProvider) Stats() retry.Stats {
+	return p.retrier.Stats()
+}
+
+// Encrypt encrypts the data, retrying transient errors
+func (p *RetryCryptoProvider) Encrypt(data []byte) ([]byte, error) {
+	var encrypted []byte
+	err := p.retrier.Do(context.Background(), func() error {
+		var err error
+		encrypted, err = p.provider.Encrypt(data)
+		return err
+	})
+
+	return encrypted, err
+}
+
+// Decrypt decrypts the data, retrying transient errors
+func (p *RetryCryptoProvider) Decrypt(data []byte) ([]byte, error) {
+	var decrypted []byte
+	err := p.retrier.Do(context.Background(), func() error {
+		var err error
+		decrypted, err = p.provider.Decrypt(data)
+		return err
+	})
+
+	return decrypted, err
+}
+
+// isTransientGoKMSError checks if the KMS failed with a server error, throttling or a network error
+func isTransientGoKMSError(err error) bool {
+	var kmsErr *KMSError
+	if errors.As(err, &kmsErr) {
+		return retry.IsTransientStatus(kmsErr.StatusCode)
+	}
+
+	return retry.IsNetworkError(err)
+}
+
+// isTransientAwsError checks if AWS KMS failed with a server error, throttling or a network error
+func isTransientAwsError(err error) bool {
+	// The client returns the error by value or by pointer depending on the call
+	var apiErr aws.APIError
+	var apiErrPtr *aws.APIError
+	if errors.As(err, &apiErrPtr) {
+		apiErr = *apiErrPtr
+	} else if !errors.As(err, &apiErr) {
+		return retry.IsNetworkError(err)
+	}
+
+	return apiErr.Code == "ThrottlingException" || retry.IsTransientStatus(apiErr.StatusCode)
+}
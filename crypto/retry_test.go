@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"errors"
+	"time"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	"github.com/keithballdotnet/blocker/retry"
+	. "gopkg.in/check.v1"
+)
+
+// flakyCryptoProvider fails the first calls with the error, then passes the data through
+type flakyCryptoProvider struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (p *flakyCryptoProvider) Encrypt(data []byte) ([]byte, error) {
+	p.calls++
+	if p.calls <= p.failures {
+		return nil, p.err
+	}
+	return data, nil
+}
+
+func (p *flakyCryptoProvider) Decrypt(data []byte) ([]byte, error) {
+	return p.Encrypt(data)
+}
+
+func (s *CryptoSuite) TestRetryCryptoProvider(c *C) {
+	flaky := &flakyCryptoProvider{failures: 2, err: &KMSError{StatusCode: 503, Message: "Busy"}}
+	provider := NewRetryCryptoProvider(flaky, retry.Policy{MaxRetries: 3, InitialDelay: time.Millisecond}, isTransientGoKMSError)
+
+	data, err := provider.Encrypt([]byte("secret"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(data), Equals, "secret")
+	c.Assert(provider.Stats().Retries, Equals, int64(2))
+
+	// A bad request is not retried
+	flaky = &flakyCryptoProvider{failures: 2, err: &KMSError{StatusCode: 400, Message: "Bad key"}}
+	provider = NewRetryCryptoProvider(flaky, retry.Policy{MaxRetries: 3, InitialDelay: time.Millisecond}, isTransientGoKMSError)
+
+	_, err = provider.Decrypt([]byte("secret"))
+	c.Assert(err != nil, IsTrue)
+	c.Assert(flaky.calls, Equals, 1)
+}
+
+func (s *CryptoSuite) TestTransientAwsErrors(c *C) {
+	c.Assert(isTransientAwsError(aws.APIError{StatusCode: 400, Code: "ThrottlingException"}), IsTrue)
+	c.Assert(isTransientAwsError(&aws.APIError{StatusCode: 500}), IsTrue)
+	c.Assert(isTransientAwsError(aws.APIError{StatusCode: 400, Code: "NotFoundException"}), IsFalse)
+	c.Assert(isTransientAwsError(errors.New("Unable to get key from envelope")), IsFalse)
+}
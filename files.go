@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/config"
+)
+
+// storeCommand creates a command which runs against the configured store with exactly the named arguments
+func storeCommand(name string, argNames []string, run func(ctx context.Context, store *blocks.Store, args []string) error) func(args []string) int {
+	return func(args []string) int {
+		flags := flag.NewFlagSet(name, flag.ExitOnError)
+		configPath := flags.String("config", "", "Path to a YAML, JSON or TOML configuration file")
+		tenant := flags.String("tenant", "", "Tenant whose files the command works on, the default tenant if empty")
+		flags.Usage = func() {
+			fmt.Fprintf(flags.Output(), "Usage: blocker %s [options]", name)
+			for _, argName := range argNames {
+				fmt.Fprintf(flags.Output(), " <%s>", argName)
+			}
+			fmt.Fprintln(flags.Output())
+			flags.PrintDefaults()
+		}
+		flags.Parse(args)
+
+		if flags.NArg() != len(argNames) {
+			flags.Usage()
+			return 2
+		}
+
+		if err := config.ValidateTenant(*tenant); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		store, _, err := openStore(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open store: %v\n", err)
+			return 1
+		}
+		defer store.Close()
+
+		if err := run(blocks.WithTenant(context.Background(), *tenant), store, flags.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to %s: %v\n", name, err)
+			return 1
+		}
+
+		return 0
+	}
+}
+
+// putCommand blocks a file and prints the ID of the blocked file
+var putCommand = storeCommand("put", []string{"file"}, func(ctx context.Context, store *blocks.Store, args []string) error {
+	blockedFile, err := store.BlockFile(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(blockedFile.ID)
+	return nil
+})
+
+// getCommand writes a blocked file to the output path
+var getCommand = storeCommand("get", []string{"id", "out"}, func(ctx context.Context, store *blocks.Store, args []string) error {
+	return store.UnblockFile(ctx, args[0], args[1])
+})
+
+// cpCommand copies a blocked file and prints the ID of the copy
+var cpCommand = storeCommand("cp", []string{"id"}, func(ctx context.Context, store *blocks.Store, args []string) error {
+	blockedFile, err := store.CopyBlockedFile(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(blockedFile.ID)
+	return nil
+})
+
+// rmCommand deletes a blocked file and the blocks no other file uses
+var rmCommand = storeCommand("rm", []string{"id"}, func(ctx context.Context, store *blocks.Store, args []string) error {
+	return store.DeleteBlockedFile(ctx, args[0])
+})
+
+// lsCommand lists the blocked files of the tenant with their length and number of blocks
+var lsCommand = storeCommand("ls", nil, func(ctx context.Context, store *blocks.Store, args []string) error {
+	blockedFiles, err := store.ListBlockedFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLENGTH\tBLOCKS")
+	for _, blockedFile := range blockedFiles {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", blockedFile.ID, blockedFile.Length, len(blockedFile.BlockList))
+	}
+	return w.Flush()
+})
+
+// statCommand prints how a blocked file is stored
+var statCommand = storeCommand("stat", []string{"id"}, func(ctx context.Context, store *blocks.Store, args []string) error {
+	stats, err := store.Stat(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	printJSON(stats)
+	return nil
+})
+
+// infoCommand prints the totals of the store
+var infoCommand = storeCommand("info", nil, func(ctx context.Context, store *blocks.Store, args []string) error {
+	info, err := store.Info(ctx)
+	if err != nil {
+		return err
+	}
+
+	printJSON(info)
+	return nil
+})
+
+// usageCommand lists the storage used by every tenant and their quotas
+var usageCommand = storeCommand("usage", nil, func(ctx context.Context, store *blocks.Store, args []string) error {
+	usages, err := store.Usages(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TENANT\tFILES\tLENGTH\tBLOCKS\tSTORED\tQUOTA LENGTH\tQUOTA STORED")
+	for _, usage := range usages {
+		tenant := usage.Tenant
+		if tenant == "" {
+			tenant = "(default)"
+		}
+
+		quotaLength, quotaStored := "-", "-"
+		if usage.Quota != nil {
+			quotaLength, quotaStored = quotaLimit(usage.Quota.Length), quotaLimit(usage.Quota.StoredSize)
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", tenant, usage.Files, usage.Length, usage.Blocks, usage.StoredSize, quotaLength, quotaStored)
+	}
+	return w.Flush()
+})
+
+// quotaLimit formats a quota limit, where 0 is no limit
+func quotaLimit(limit int64) string {
+	if limit == 0 {
+		return "-"
+	}
+	return fmt.Sprint(limit)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/config"
+)
+
+// migrateCommand copies the blocks of the configuration's store from one storage provider to another.
+// The server can keep running on the old provider meanwhile, as long as the blocks are not deleted.
+func migrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to a YAML, JSON or TOML configuration file")
+	from := flags.String("from", "", "Storage provider to copy the blocks from.  Defaults to the configured provider")
+	to := flags.String("to", "", "Storage provider to copy the blocks to")
+	workers := flags.Int("workers", 4, "Number of blocks copied at the same time")
+	deleteSource := flags.Bool("delete", false, "Delete each block from the old provider once its copy is verified")
+	journal := flags.String("journal", "", "File recording the migrated blocks, so an interrupted migration is resumed without checking them again")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: blocker migrate -from nfs -to s3 [options]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load configuration: %v\n", err)
+		return 1
+	}
+
+	if *from != "" {
+		cfg.Storage.Provider = strings.ToLower(*from)
+	}
+
+	// Blocks are copied straight between the providers, not through the cache
+	cfg.Storage.Cache.Provider = ""
+
+	destinationConfig := cfg
+	destinationConfig.Storage.Provider = strings.ToLower(*to)
+
+	if destinationConfig.Storage.Provider == "" {
+		flags.Usage()
+		return 2
+	}
+	if destinationConfig.Storage.Provider == cfg.Storage.Provider {
+		fmt.Fprintf(os.Stderr, "The blocks are already in %s\n", cfg.Storage.Provider)
+		return 1
+	}
+
+	for _, c := range []config.Config{cfg, destinationConfig} {
+		if err := c.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+			return 1
+		}
+	}
+
+	store, err := blocks.NewStore(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open %s: %v\n", cfg.Storage.Provider, err)
+		return 1
+	}
+	defer store.Close()
+
+	destination, err := blocks.NewBlockRepository(destinationConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open %s: %v\n", destinationConfig.Storage.Provider, err)
+		return 1
+	}
+	defer closeRepository(destination)
+
+	// Stop between blocks on an interrupt, so the migration can be resumed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Stopping migration")
+		cancel()
+	}()
+
+	log.Printf("Migrating blocks from %s to %s", cfg.Storage.Provider, destinationConfig.Storage.Provider)
+
+	options := blocks.MigrateOptions{
+		Workers:      *workers,
+		DeleteSource: *deleteSource,
+		JournalPath:  *journal,
+		Progress: func(stats blocks.MigrateStats) {
+			if done := stats.Copied + stats.Existing + stats.Skipped + stats.Failed; done%100 == 0 {
+				log.Printf("Migrated %d of %d blocks", done, stats.Total)
+			}
+		},
+	}
+
+	stats, err := store.Migrate(ctx, destination, options)
+
+	log.Printf("Blocks: %d Copied: %d Existing: %d Skipped: %d Deleted: %d Failed: %d",
+		stats.Total, stats.Copied, stats.Existing, stats.Skipped, stats.Deleted, stats.Failed)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration incomplete: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,6 @@
+// Package retry retries operations failing with transient errors and stops calling
+// a failing backend with a circuit breaker
+//
+// Current version: experimental
+//
+package retry
@@ -0,0 +1,260 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/keithballdotnet/blocker/config"
+)
+
+// ErrCircuitOpen is returned without calling the backend while the circuit breaker is open
+var ErrCircuitOpen = errors.New("Circuit breaker is open")
+
+// States of the circuit breaker
+const (
+	// Closed lets every operation through
+	Closed = "closed"
+	// Open fails every operation until the cooldown is over
+	Open = "open"
+	// HalfOpen lets a single operation through to test the backend
+	HalfOpen = "half-open"
+)
+
+// Policy controls how often and how quickly operations are retried and when the breaker opens
+type Policy struct {
+	// MaxRetries is how many times a failing operation is retried.  Zero disables retries.
+	MaxRetries int
+	// InitialDelay is the delay before the first retry, doubling for each retry after
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between retries.  Zero means no cap.
+	MaxDelay time.Duration
+	// BreakerThreshold is the number of transient failures in a row which opens the breaker.  Zero disables the breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open
+	BreakerCooldown time.Duration
+}
+
+// NewPolicy creates the policy from the configuration
+func NewPolicy(cfg config.RetryConfig) Policy {
+	return Policy{
+		MaxRetries:       cfg.MaxRetries,
+		InitialDelay:     time.Duration(cfg.InitialDelay),
+		MaxDelay:         time.Duration(cfg.MaxDelay),
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerCooldown:  time.Duration(cfg.BreakerCooldown),
+	}
+}
+
+// Classifier reports whether an error is transient, so the operation is worth retrying.
+// Errors which are not transient, such as a missing block, are returned straight away.
+type Classifier func(err error) bool
+
+// Stats counts the work of a Retrier
+type Stats struct {
+	// Calls is the number of operations run
+	Calls int64 `json:"calls"`
+	// Retries is the number of times an operation was run again after a transient error
+	Retries int64 `json:"retries"`
+	// Failures is the number of operations which still failed with a transient error after retrying
+	Failures int64 `json:"failures"`
+	// Rejected is the number of operations failed by the open breaker without calling the backend
+	Rejected int64 `json:"rejected"`
+	// BreakerState is 'closed', 'open' or 'half-open'
+	BreakerState string `json:"breakerState"`
+	// BreakerOpened is the number of times the breaker has opened
+	BreakerOpened int64 `json:"breakerOpened"`
+}
+
+// Retrier runs operations against a single backend, retrying transient errors with jittered exponential backoff.
+// Failures in a row open the circuit breaker, so a backend which is down is not kept busy with calls bound to fail.
+type Retrier struct {
+	policy    Policy
+	transient Classifier
+
+	lock     sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// probing is set while the half open breaker waits for its test operation
+	probing bool
+	stats   Stats
+}
+
+// New creates a Retrier for a backend whose transient errors are recognised by the classifier
+func New(policy Policy, transient Classifier) *Retrier {
+	return &Retrier{policy: policy, transient: transient, state: Closed}
+}
+
+// Stats returns what the Retrier has done so far
+func (r *Retrier) Stats() Stats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats := r.stats
+	stats.BreakerState = r.state
+
+	return stats
+}
+
+// Do runs the operation, retrying it while it fails with a transient error.
+// An attempt running out of time is transient as long as ctx itself is not done.
+func (r *Retrier) Do(ctx context.Context, operation func() error) error {
+	return r.do(ctx, operation, r.policy.MaxRetries)
+}
+
+// Once runs the operation without retrying, for operations which cannot be repeated.
+// The breaker still applies and counts the result.
+func (r *Retrier) Once(ctx context.Context, operation func() error) error {
+	return r.do(ctx, operation, 0)
+}
+
+func (r *Retrier) do(ctx context.Context, operation func() error, maxRetries int) error {
+	r.lock.Lock()
+	r.stats.Calls++
+	r.lock.Unlock()
+
+	if err := r.allow(); err != nil {
+		return err
+	}
+
+	delay := r.policy.InitialDelay
+
+	for attempt := 0; ; attempt++ {
+		err := operation()
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up, which says nothing about the backend
+			r.release()
+			return err
+		}
+
+		transient := err != nil && (errors.Is(err, context.DeadlineExceeded) || r.isTransient(err))
+		r.record(transient)
+
+		if !transient {
+			return err
+		}
+
+		if attempt >= maxRetries {
+			r.fail()
+			return err
+		}
+
+		// Jitter stops clients failing together from retrying together
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// The failures so far may have opened the breaker
+		if openErr := r.allow(); openErr != nil {
+			r.fail()
+			return fmt.Errorf("%w: %v", openErr, err)
+		}
+
+		r.lock.Lock()
+		r.stats.Retries++
+		r.lock.Unlock()
+
+		delay *= 2
+		if r.policy.MaxDelay > 0 && delay > r.policy.MaxDelay {
+			delay = r.policy.MaxDelay
+		}
+	}
+}
+
+func (r *Retrier) isTransient(err error) bool {
+	return r.transient != nil && r.transient(err)
+}
+
+// fail counts an operation given up on
+func (r *Retrier) fail() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.stats.Failures++
+}
+
+// allow checks the breaker lets the operation through.
+// Once the cooldown is over the open breaker lets a single operation through to test the backend.
+func (r *Retrier) allow() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch r.state {
+	case Open:
+		if time.Since(r.openedAt) < r.policy.BreakerCooldown {
+			r.stats.Rejected++
+			return ErrCircuitOpen
+		}
+
+		r.state = HalfOpen
+		r.probing = true
+	case HalfOpen:
+		if r.probing {
+			r.stats.Rejected++
+			return ErrCircuitOpen
+		}
+
+		r.probing = true
+	}
+
+	return nil
+}
+
+// release lets the half open breaker test the backend with another operation
+func (r *Retrier) release() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.probing = false
+}
+
+// record updates the breaker with the result of an attempt.
+// Anything but a transient error shows the backend is answering, so closes the breaker.
+func (r *Retrier) record(transient bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.probing = false
+
+	if !transient {
+		r.failures = 0
+		r.state = Closed
+		return
+	}
+
+	r.failures++
+
+	if r.state == HalfOpen || (r.policy.BreakerThreshold > 0 && r.failures >= r.policy.BreakerThreshold) {
+		if r.state != Open {
+			r.stats.BreakerOpened++
+		}
+
+		r.state = Open
+		r.openedAt = time.Now()
+	}
+}
+
+// IsNetworkError checks if the error is a timeout or a failed connection, which are worth retrying with any backend
+func IsNetworkError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsTransientStatus checks if an HTTP status code means the request is worth retrying
+func IsTransientStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == 429
+}
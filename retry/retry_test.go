@@ -0,0 +1,153 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type RetrySuite struct {
+}
+
+var _ = Suite(&RetrySuite{})
+
+var errTransient = errors.New("Transient")
+var errPermanent = errors.New("Permanent")
+
+func isTransient(err error) bool {
+	return err == errTransient
+}
+
+// failing returns an operation failing with err the first n times it is called, counting the calls
+func failing(n int, err error, calls *int) func() error {
+	return func() error {
+		*calls++
+		if *calls <= n {
+			return err
+		}
+		return nil
+	}
+}
+
+var ctx = context.Background()
+
+func (s *RetrySuite) TestRetriesTransientErrors(c *C) {
+	retrier := New(Policy{MaxRetries: 3, InitialDelay: time.Millisecond}, isTransient)
+
+	calls := 0
+	err := retrier.Do(ctx, failing(2, errTransient, &calls))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(calls, Equals, 3)
+
+	stats := retrier.Stats()
+	c.Assert(stats.Calls, Equals, int64(1))
+	c.Assert(stats.Retries, Equals, int64(2))
+	c.Assert(stats.Failures, Equals, int64(0))
+	c.Assert(stats.BreakerState, Equals, Closed)
+}
+
+func (s *RetrySuite) TestGivesUpAfterMaxRetries(c *C) {
+	retrier := New(Policy{MaxRetries: 2, InitialDelay: time.Millisecond}, isTransient)
+
+	calls := 0
+	err := retrier.Do(ctx, failing(10, errTransient, &calls))
+	c.Assert(err, Equals, errTransient)
+	c.Assert(calls, Equals, 3)
+	c.Assert(retrier.Stats().Failures, Equals, int64(1))
+}
+
+func (s *RetrySuite) TestPermanentErrorsAreNotRetried(c *C) {
+	retrier := New(Policy{MaxRetries: 3, InitialDelay: time.Millisecond}, isTransient)
+
+	calls := 0
+	err := retrier.Do(ctx, failing(10, errPermanent, &calls))
+	c.Assert(err, Equals, errPermanent)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *RetrySuite) TestOnceDoesNotRetry(c *C) {
+	retrier := New(Policy{MaxRetries: 3, InitialDelay: time.Millisecond}, isTransient)
+
+	calls := 0
+	err := retrier.Once(ctx, failing(10, errTransient, &calls))
+	c.Assert(err, Equals, errTransient)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *RetrySuite) TestCancelledContextStopsRetrying(c *C) {
+	retrier := New(Policy{MaxRetries: 3, InitialDelay: time.Hour}, isTransient)
+
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	err := retrier.Do(cancelled, failing(10, errTransient, &calls))
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *RetrySuite) TestBreakerOpensAndRecovers(c *C) {
+	retrier := New(Policy{BreakerThreshold: 2, BreakerCooldown: 20 * time.Millisecond}, isTransient)
+
+	calls := 0
+	operation := failing(2, errTransient, &calls)
+
+	c.Assert(retrier.Do(ctx, operation), Equals, errTransient)
+	c.Assert(retrier.Do(ctx, operation), Equals, errTransient)
+	c.Assert(retrier.Stats().BreakerState, Equals, Open)
+
+	// The backend is not called while the breaker is open
+	c.Assert(retrier.Do(ctx, operation), Equals, ErrCircuitOpen)
+	c.Assert(calls, Equals, 2)
+
+	// After the cooldown a test operation is let through, and closes the breaker when it works
+	time.Sleep(30 * time.Millisecond)
+	err := retrier.Do(ctx, operation)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(calls, Equals, 3)
+
+	stats := retrier.Stats()
+	c.Assert(stats.BreakerState, Equals, Closed)
+	c.Assert(stats.BreakerOpened, Equals, int64(1))
+	c.Assert(stats.Rejected, Equals, int64(1))
+}
+
+func (s *RetrySuite) TestFailedTestReopensBreaker(c *C) {
+	retrier := New(Policy{BreakerThreshold: 1, BreakerCooldown: 10 * time.Millisecond}, isTransient)
+
+	calls := 0
+	operation := failing(10, errTransient, &calls)
+
+	c.Assert(retrier.Do(ctx, operation), Equals, errTransient)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(retrier.Do(ctx, operation), Equals, errTransient)
+
+	stats := retrier.Stats()
+	c.Assert(stats.BreakerState, Equals, Open)
+	c.Assert(stats.BreakerOpened, Equals, int64(2))
+}
+
+func (s *RetrySuite) TestBreakerStopsRetries(c *C) {
+	retrier := New(Policy{MaxRetries: 5, InitialDelay: time.Millisecond, BreakerThreshold: 2, BreakerCooldown: time.Hour}, isTransient)
+
+	calls := 0
+	err := retrier.Do(ctx, failing(10, errTransient, &calls))
+	c.Assert(errors.Is(err, ErrCircuitOpen), IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(calls, Equals, 2)
+}
+
+func (s *RetrySuite) TestIsNetworkError(c *C) {
+	c.Assert(IsNetworkError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), IsTrue)
+	c.Assert(IsNetworkError(&net.DNSError{IsTimeout: true}), IsTrue)
+	c.Assert(IsNetworkError(&net.DNSError{IsNotFound: true}), IsFalse)
+	c.Assert(IsNetworkError(errPermanent), IsFalse)
+}
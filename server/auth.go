@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/keithballdotnet/blocker/auth"
+	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/config"
+	"github.com/keithballdotnet/blocker/crypto"
+)
+
+// tokenKeysReloadInterval is the least time between reading the token keys again for tokens signed with unknown keys
+const tokenKeysReloadInterval = time.Minute
+
+// authorizer checks the signatures or tokens of requests with the settings and access keys of a Server
+type authorizer struct {
+	cfg  config.AuthConfig
+	keys *auth.KeyStore
+	// sharedKey is empty unless requests may be signed with the shared key
+	sharedKey string
+	// nonces is nil unless requests must carry a nonce
+	nonces *auth.NonceCache
+	// tokens is nil unless bearer tokens are accepted
+	tokens *auth.JWTVerifier
+	// reloadLock guards reloaded, when the token keys were last read
+	reloadLock sync.Mutex
+	reloaded   time.Time
+	now        func() time.Time
+}
+
+func newAuthorizer(cfg config.AuthConfig, keys *auth.KeyStore) *authorizer {
+	a := &authorizer{cfg: cfg, keys: keys, now: time.Now}
+	if cfg.Nonces {
+		a.nonces = auth.NewNonceCache(cfg.NonceCacheSize)
+	}
+	if cfg.JWT.Enabled() {
+		a.tokens = auth.NewJWTVerifier(cfg.JWT.Issuer, cfg.JWT.Audience, time.Duration(cfg.ClockSkew))
+	}
+	return a
+}
+
+// loadTokenKeys reads the keys bearer tokens are checked with, if they are accepted
+func (a *authorizer) loadTokenKeys() error {
+	if a.tokens == nil {
+		return nil
+	}
+
+	// Without an audience tokens other services were given would be accepted
+	if a.cfg.JWT.Audience == "" {
+		return &config.MissingSettingsError{Provider: "jwt", Settings: []string{"server.auth.jwt.audience"}}
+	}
+
+	for value, scopes := range a.cfg.JWT.Scopes {
+		if err := auth.ValidateScopes(toScopes(scopes)); err != nil {
+			return fmt.Errorf("Invalid scopes for %q in server.auth.jwt.scopes: %v", value, err)
+		}
+	}
+
+	a.reloadLock.Lock()
+	defer a.reloadLock.Unlock()
+
+	a.reloaded = a.now()
+	return a.tokens.Load(a.cfg.JWT.JWKSPaths, a.cfg.JWT.PublicKeyPaths)
+}
+
+// reloadTokenKeys reads the token keys again, unless they were read recently.  Returns true if they were read.
+func (a *authorizer) reloadTokenKeys() bool {
+	a.reloadLock.Lock()
+	defer a.reloadLock.Unlock()
+
+	now := a.now()
+	if now.Sub(a.reloaded) < tokenKeysReloadInterval {
+		return false
+	}
+	a.reloaded = now
+
+	if err := a.tokens.Load(a.cfg.JWT.JWKSPaths, a.cfg.JWT.PublicKeyPaths); err != nil {
+		log.Printf("Unable to read the token keys again: %v", err)
+		return false
+	}
+	return true
+}
+
+// defaultAuthorizer checks requests which did not come through Server.Handler
+var defaultAuthorizer = newAuthorizer(config.Default().Server.Auth, auth.NewKeyStore())
+
+type contextKey int
+
+const (
+	signedRequestKey contextKey = iota
+	accessKeyKey
+)
+
+// signedRequest is what was known of a request before routing
+type signedRequest struct {
+	// url is the URL as sent, before the router added the path parameters to its query
+	url        url.URL
+	authorizer *authorizer
+}
+
+// withAuthorizer records the URL of each request before it is routed, and the authorizer checking it
+func withAuthorizer(a *authorizer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), signedRequestKey, signedRequest{url: *r.URL, authorizer: a})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// AuthorizeRequest - Will check the request authorization, and that its key or token has the scope.  A refused request
+// is answered with 401, or 403 if the key lacks the scope.  An authorized request gets a context acting for the tenant
+// of its key, which the request should be served with.  The body of an authorized signed request fails with
+// auth.ErrContentMismatch when read to the end if it is not the body which was signed.
+func AuthorizeRequest(w http.ResponseWriter, r *http.Request, scope auth.Scope) (context.Context, bool) {
+	signed, ok := r.Context().Value(signedRequestKey).(signedRequest)
+	if !ok {
+		signed = signedRequest{url: *r.URL, authorizer: defaultAuthorizer}
+	}
+
+	// Only the key ID is logged, never the secret or signature
+	key, err := signed.authorizer.authorize(r, &signed.url)
+	if err != nil {
+		log.Printf("Authorization FAILED: %s %s: %v", r.Method, signed.url.Path, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if !key.Allows(scope) {
+		log.Printf("Authorization FAILED: %s %s: Key %s does not have the %s scope", r.Method, signed.url.Path, keyName(key), scope)
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+
+	ctx := context.WithValue(r.Context(), accessKeyKey, key)
+	return blocks.WithTenant(ctx, key.Tenant), true
+}
+
+// accessKey returns the key an authorized request was signed with
+func accessKey(ctx context.Context) auth.AccessKey {
+	key, _ := ctx.Value(accessKeyKey).(auth.AccessKey)
+	return key
+}
+
+// sharedAccessKey is the shared key as an access key of the default tenant, which may do anything
+func (a *authorizer) sharedAccessKey() (auth.AccessKey, error) {
+	// An empty secret would let anyone sign requests
+	if a.sharedKey == "" {
+		return auth.AccessKey{}, errors.New("No shared key is set")
+	}
+
+	return auth.AccessKey{Secret: a.sharedKey, Scopes: []auth.Scope{auth.ScopeAdmin}}, nil
+}
+
+// keyName names the key in the log
+func keyName(key auth.AccessKey) string {
+	if key.ID == "" {
+		return "shared"
+	}
+	return key.ID
+}
+
+// authorize checks the date and signature of the request, and its nonce if nonces are required, or its bearer token.
+// Returns the key the request was signed with, or one holding the tenant and scopes of the token.
+func (a *authorizer) authorize(r *http.Request, u *url.URL) (auth.AccessKey, error) {
+	if token := auth.BearerToken(r.Header.Get("Authorization")); token != "" {
+		return a.authorizeToken(token)
+	}
+
+	date, err := time.Parse(time.RFC1123, r.Header.Get(auth.DateHeader))
+	if err != nil {
+		return auth.AccessKey{}, fmt.Errorf("Invalid %s header: %v", auth.DateHeader, err)
+	}
+
+	now := a.now()
+	skew := time.Duration(a.cfg.ClockSkew)
+	if date.Before(now.Add(-skew)) || date.After(now.Add(skew)) {
+		return auth.AccessKey{}, fmt.Errorf("The date %s is more than %s from the server clock", r.Header.Get(auth.DateHeader), skew)
+	}
+
+	if !auth.IsV2(r.Header.Get("Authorization")) {
+		if !a.cfg.Legacy {
+			return auth.AccessKey{}, errors.New("Requests must be signed with " + auth.Algorithm)
+		}
+		key, err := a.sharedAccessKey()
+		if err != nil {
+			return auth.AccessKey{}, err
+		}
+		return key, checkLegacy(r.Method, u, r.Header, key.Secret)
+	}
+
+	signature, err := auth.ParseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return auth.AccessKey{}, err
+	}
+
+	var key auth.AccessKey
+	if signature.Credential == "" {
+		if key, err = a.sharedAccessKey(); err != nil {
+			return auth.AccessKey{}, err
+		}
+	} else {
+		if key, err = a.keys.Get(signature.Credential); err != nil {
+			return auth.AccessKey{}, fmt.Errorf("Key %s: %v", signature.Credential, err)
+		}
+		if err := key.Usable(now); err != nil {
+			return auth.AccessKey{}, fmt.Errorf("Key %s: %v", key.ID, err)
+		}
+	}
+
+	if err := signature.Check(r.Method, u, r.Header, r.Host, key.Secret); err != nil {
+		return auth.AccessKey{}, fmt.Errorf("Key %s: %v", keyName(key), err)
+	}
+
+	if a.nonces != nil {
+		nonce := r.Header.Get(auth.NonceHeader)
+		if nonce == "" || !signature.Signs(auth.NonceHeader) {
+			return auth.AccessKey{}, errors.New("A signed nonce is required")
+		}
+
+		// The nonce need only be remembered until the date is too old to be accepted
+		if !a.nonces.Use(nonce, date.Add(skew), now) {
+			return auth.AccessKey{}, errors.New("The nonce has already been used")
+		}
+	}
+
+	if r.Body != nil {
+		r.Body = auth.VerifyBody(r.Body, r.Header.Get(auth.ContentSHA256Header))
+	}
+
+	return key, nil
+}
+
+// authorizeToken checks the bearer token.  The token keys are read again for a token signed with an unknown key, in
+// case the identity provider has added a key.
+func (a *authorizer) authorizeToken(token string) (auth.AccessKey, error) {
+	if a.tokens == nil {
+		return auth.AccessKey{}, errors.New("Bearer tokens are not accepted")
+	}
+
+	claims, err := a.tokens.Verify(token, a.now())
+	if errors.Is(err, auth.ErrUnknownTokenKey) && a.reloadTokenKeys() {
+		claims, err = a.tokens.Verify(token, a.now())
+	}
+	if err != nil {
+		return auth.AccessKey{}, err
+	}
+
+	return a.tokenKey(claims)
+}
+
+// tokenKey returns an access key with the tenant and scopes of the claims of a token.  The key is named after the
+// subject of the token in the log.  When there is a tenant claim every token must have it, so a token can not act for
+// the default tenant by leaving it out.  Tokens of the default tenant only get the admin scope, which manages every
+// tenant, when the scopes map gives it to them.
+func (a *authorizer) tokenKey(claims auth.Claims) (auth.AccessKey, error) {
+	subject, _ := claims.String("sub")
+	key := auth.AccessKey{ID: "jwt:" + subject}
+
+	if a.cfg.JWT.TenantClaim != "" {
+		tenant, ok := claims.String(a.cfg.JWT.TenantClaim)
+		if !ok {
+			return auth.AccessKey{}, fmt.Errorf("Token of %s: the %s claim is missing or not a string", subject, a.cfg.JWT.TenantClaim)
+		}
+		if err := config.ValidateTenant(tenant); err != nil {
+			return auth.AccessKey{}, fmt.Errorf("Token of %s: %v", subject, err)
+		}
+		key.Tenant = tenant
+	}
+
+	for _, value := range claims.Strings(a.cfg.JWT.ScopesClaim) {
+		if len(a.cfg.JWT.Scopes) > 0 {
+			key.Scopes = append(key.Scopes, toScopes(a.cfg.JWT.Scopes[value])...)
+			continue
+		}
+
+		// Values which are not scopes of blocker may be meant for other services
+		scope := auth.Scope(value)
+		if auth.ValidateScopes([]auth.Scope{scope}) != nil || (scope == auth.ScopeAdmin && key.Tenant == "") {
+			continue
+		}
+		key.Scopes = append(key.Scopes, scope)
+	}
+
+	return key, nil
+}
+
+// toScopes converts the names of scopes in the configuration
+func toScopes(names []string) []auth.Scope {
+	scopes := make([]auth.Scope, len(names))
+	for i, name := range names {
+		scopes[i] = auth.Scope(name)
+	}
+	return scopes
+}
+
+// checkLegacy checks the original signature, which only covers the method, date and path
+func checkLegacy(method string, u *url.URL, h http.Header, sharedKey string) error {
+	authRequestKey := fmt.Sprintf("%s\n%s\n%s", method, h.Get(auth.DateHeader), u.Path)
+
+	if !hmac.Equal([]byte(h.Get("Authorization")), []byte(crypto.GetHmac256(authRequestKey, sharedKey))) {
+		return auth.ErrSignatureMismatch
+	}
+
+	return nil
+}
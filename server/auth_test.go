@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/keithballdotnet/blocker/auth"
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// signedUpload returns a PUT of the body signed at the time
+func (s *HandlerSuite) signedUpload(c *C, url string, body string, signedBody string, at time.Time) *http.Request {
+	request, err := http.NewRequest("PUT", url+"/api/v1/blocker", strings.NewReader(body))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	contentSHA256, err := auth.HashBody(strings.NewReader(signedBody))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	nonce, err := auth.NewNonce()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = auth.SignRequest(request, "", sharedKey, contentSHA256, nonce, at)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return request
+}
+
+// status sends the request and returns the status of the response
+func status(c *C, request *http.Request) int {
+	response, err := http.DefaultClient.Do(request)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	response.Body.Close()
+
+	return response.StatusCode
+}
+
+func (s *HandlerSuite) TestRequestsOutsideTheClockSkewAreRefused(c *C) {
+	c.Assert(status(c, s.signedUpload(c, s.server.URL, "hello world", "hello world", time.Now().Add(-time.Minute))), Equals, http.StatusCreated)
+	c.Assert(status(c, s.signedUpload(c, s.server.URL, "hello world", "hello world", time.Now().Add(-10*time.Minute))), Equals, http.StatusUnauthorized)
+	c.Assert(status(c, s.signedUpload(c, s.server.URL, "hello world", "hello world", time.Now().Add(10*time.Minute))), Equals, http.StatusUnauthorized)
+}
+
+func (s *HandlerSuite) TestSwappedBodyIsRefused(c *C) {
+	c.Assert(status(c, s.signedUpload(c, s.server.URL, "goodbye world", "hello world", time.Now())), Equals, http.StatusBadRequest)
+
+	files, err := s.store.BlockedFileStore.ListBlockedFiles()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(files, HasLen, 0)
+}
+
+func (s *HandlerSuite) TestSwappedMultipartBodyIsRefused(c *C) {
+	form := func(content string) string {
+		return "--boundary\r\n" +
+			"Content-Disposition: form-data; name=\"file\"; filename=\"my.file\"\r\n" +
+			"Content-Type: text/plain\r\n\r\n" +
+			content + "\r\n--boundary--\r\n"
+	}
+
+	request := s.signedUpload(c, s.server.URL, form("goodbye world"), form("hello world"), time.Now())
+	request.Method = "POST"
+	request.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+
+	contentSHA256, err := auth.HashBody(strings.NewReader(form("hello world")))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	err = auth.SignRequest(request, "", sharedKey, contentSHA256, "", time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	c.Assert(status(c, request), Equals, http.StatusBadRequest)
+
+	files, err := s.store.BlockedFileStore.ListBlockedFiles()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(files, HasLen, 0)
+}
+
+func (s *HandlerSuite) TestSharedKeyIsNeeded(c *C) {
+	server := New(config.Default().Server, s.store)
+	for _, key := range []string{"", " \n", "short"} {
+		err := server.SetSharedKey(key)
+		c.Assert(err != nil, IsTrue)
+	}
+
+	// Without a shared key, requests signed with an empty key are refused
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/files", "", "", "")), Equals, http.StatusUnauthorized)
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/files", "", "", sharedKey)), Equals, http.StatusUnauthorized)
+
+	// The whitespace around a key is left out
+	server = New(config.Default().Server, s.store)
+	err := server.SetSharedKey(sharedKey + "\n")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	keyServer := httptest.NewServer(server.Handler())
+	defer keyServer.Close()
+
+	c.Assert(status(c, keyRequest(c, "GET", keyServer.URL, "/api/v1/files", "", "", sharedKey)), Equals, http.StatusOK)
+}
+
+func (s *HandlerSuite) TestReplayedNonceIsRefused(c *C) {
+	cfg := config.Default()
+	cfg.Server.Auth.Nonces = true
+	server := httptest.NewServer(newServer(c, cfg.Server, s.store).Handler())
+	defer server.Close()
+
+	request := s.signedUpload(c, server.URL, "hello world", "hello world", time.Now())
+	c.Assert(status(c, request), Equals, http.StatusCreated)
+
+	replay, err := http.NewRequest("PUT", server.URL+"/api/v1/blocker", strings.NewReader("hello world"))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	replay.Header = request.Header
+	c.Assert(status(c, replay), Equals, http.StatusUnauthorized)
+
+	// A request without a nonce is refused
+	request = s.signedUpload(c, server.URL, "hello world", "hello world", time.Now())
+	request.Header.Del(auth.NonceHeader)
+	c.Assert(status(c, request), Equals, http.StatusUnauthorized)
+}
+
+func (s *HandlerSuite) TestLegacySigningNeedsEnabling(c *C) {
+	request, err := http.NewRequest("GET", s.server.URL+"/api/v1/status", nil)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	request = SetLegacyAuth(request, "GET", "/api/v1/status")
+	c.Assert(status(c, request), Equals, http.StatusUnauthorized)
+
+	cfg := config.Default()
+	cfg.Server.Auth.Legacy = true
+	server := httptest.NewServer(newServer(c, cfg.Server, s.store).Handler())
+	defer server.Close()
+
+	request, err = http.NewRequest("GET", server.URL+"/api/v1/status", nil)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	request = SetLegacyAuth(request, "GET", "/api/v1/status")
+	c.Assert(status(c, request), Equals, http.StatusOK)
+}
@@ -1,16 +1,20 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/keithballdotnet/blocker/auth"
 	"github.com/keithballdotnet/blocker/blocks"
-	"github.com/keithballdotnet/blocker/crypto"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"time"
 )
 
 func GetHello(u *url.URL, h http.Header, _ interface{}) (int, http.Header, string, error) {
@@ -20,98 +24,138 @@ func GetHello(u *url.URL, h http.Header, _ interface{}) (int, http.Header, strin
 	return http.StatusOK, nil, "Server: Blocker", nil
 }
 
-// AuthorizeRequest - Will check the request authorization
-func AuthorizeRequest(method string, u *url.URL, h http.Header) bool {
-
-	date := h.Get("x-blocker-date")
-	resource := u.Path
-	authRequestKey := fmt.Sprintf("%s\n%s\n%s", method, date, resource)
-
-	authorization := h.Get("Authorization")
-
-	hmac := crypto.GetHmac256(authRequestKey, SharedKey)
-
-	if authorization != hmac {
-		log.Printf("Authorization FAILED: Auth: %s HMAC: %s RequestKey: \n%s", authorization, hmac, authRequestKey)
-	}
+// CopyHandler - The REST endpoint for copying a BlockedFile
+type CopyHandler struct {
+	store *blocks.Store
+}
 
-	// Was the passed value the same as we expected?
-	return authorization == hmac
+func NewCopyHandler(store *blocks.Store) CopyHandler {
+	return CopyHandler{store}
 }
 
-// CopyHandler - The REST endpoint for deleting a BlockedFile
-func CopyHandler(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *blocks.BlockedFile, error) {
+func (handler CopyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Got COPY block request")
 
 	// Authoritze the request
-	if !AuthorizeRequest("COPY", u, h) {
-		return http.StatusUnauthorized, nil, nil, nil
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeCopy)
+	if !ok {
+		return
 	}
 
-	itemID := u.Query().Get("itemID")
+	itemID := r.URL.Query().Get("itemID")
+
+	blockedFile, err := handler.store.CopyBlockedFile(ctx, itemID)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
 
-	blockedFile, err := blocks.CopyBlockedFile(itemID)
+	body, err := json.Marshal(blockedFile)
 	if err != nil {
-		return http.StatusInternalServerError, nil, nil, err
+		HandleErrorWithResponse(w, err)
+		return
 	}
 
 	// All good!
-	return http.StatusOK, nil, &blockedFile, nil
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
 }
 
 // DeleteHandler - The REST endpoint for deleting a BlockedFile
-func DeleteHandler(u *url.URL, h http.Header, _ interface{}) (int, http.Header, interface{}, error) {
+type DeleteHandler struct {
+	store *blocks.Store
+}
+
+func NewDeleteHandler(store *blocks.Store) DeleteHandler {
+	return DeleteHandler{store}
+}
+
+func (handler DeleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Got DELETE block request")
 
 	// Authoritze the request
-	if !AuthorizeRequest("DELETE", u, h) {
-		return http.StatusUnauthorized, nil, nil, nil
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeDelete)
+	if !ok {
+		return
 	}
 
-	itemID := u.Query().Get("itemID")
+	itemID := r.URL.Query().Get("itemID")
 
-	err := blocks.DeleteBlockedFile(itemID)
+	err := handler.store.DeleteBlockedFile(ctx, itemID)
 	if err != nil {
-		return http.StatusInternalServerError, nil, false, err
+		HandleErrorWithResponse(w, err)
+		return
 	}
 
 	// All good!
-	return http.StatusNoContent, nil, nil, nil
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StatusHandler - The REST endpoint reporting the state of the block repository
+type StatusHandler struct {
+	store *blocks.Store
+}
+
+func NewStatusHandler(store *blocks.Store) StatusHandler {
+	return StatusHandler{store}
+}
+
+func (handler StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Got GET status request")
+
+	// Authoritze the request
+	if _, ok := AuthorizeRequest(w, r, auth.ScopeRead); !ok {
+		return
+	}
+
+	body, err := json.Marshal(handler.store.Status())
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
 }
 
 // RawUploadHandler handles PUT operations
 type RawUploadHandler struct {
+	store *blocks.Store
 }
 
-func NewRawUploadHandler() RawUploadHandler {
-	return RawUploadHandler{}
+func NewRawUploadHandler(store *blocks.Store) RawUploadHandler {
+	return RawUploadHandler{store}
 }
 
 func (handler RawUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Got PUT upload request")
 
 	// Authoritze the request
-	if !AuthorizeRequest("PUT", r.URL, r.Header) {
-		w.WriteHeader(http.StatusUnauthorized)
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeWrite)
+	if !ok {
 		return
 	}
 
-	BlockAndRespond(w, r.Body)
+	BlockAndRespond(ctx, handler.store, w, r.Body)
 }
 
 // PostMultipartUploadHandler handles POST operations
-type PostMultipartUploadHandler struct{}
+type PostMultipartUploadHandler struct {
+	store *blocks.Store
+}
 
-func NewPostMultipartUploadHandler() PostMultipartUploadHandler {
-	return PostMultipartUploadHandler{}
+func NewPostMultipartUploadHandler(store *blocks.Store) PostMultipartUploadHandler {
+	return PostMultipartUploadHandler{store}
 }
 
 func (handler PostMultipartUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Got POST upload request")
 
 	// Authoritze the request
-	if !AuthorizeRequest("POST", r.URL, r.Header) {
-		w.WriteHeader(http.StatusUnauthorized)
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeWrite)
+	if !ok {
 		return
 	}
 
@@ -120,6 +164,14 @@ func (handler PostMultipartUploadHandler) ServeHTTP(w http.ResponseWriter, r *ht
 		HandleErrorWithResponse(w, err)
 		return
 	}
+	defer r.MultipartForm.RemoveAll()
+
+	// The form is parsed up to its closing boundary, so read the rest of the body to check it is the one signed
+	// before anything is stored
+	if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
 
 	m := r.MultipartForm
 
@@ -143,13 +195,13 @@ func (handler PostMultipartUploadHandler) ServeHTTP(w http.ResponseWriter, r *ht
 			// This is stupid... but there you go.
 			// See this for further discussion: http://www.reddit.com/r/golang/comments/2cdu7s/how_do_i_avoid_using_ioutilreadall/
 			// fileBytes, err := ioutil.ReadAll(file)
-			BlockAndRespond(w, file)
+			BlockAndRespond(ctx, handler.store, w, file)
 		}
 	}
 }
 
 // Handle the uploaded data.
-func BlockAndRespond(w http.ResponseWriter, content io.Reader) {
+func BlockAndRespond(ctx context.Context, store *blocks.Store, w http.ResponseWriter, content io.Reader) {
 
 	// Create temp file
 	outFile, err := ioutil.TempFile(os.TempDir(), "upload_")
@@ -160,11 +212,17 @@ func BlockAndRespond(w http.ResponseWriter, content io.Reader) {
 	}
 
 	// Save content to file
-	io.Copy(outFile, content)
+	_, err = io.Copy(outFile, content)
 
 	// Close the file so it can be read
 	outFile.Close()
 
+	if err != nil {
+		os.Remove(outFile.Name())
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
 	// Get some info about the file we are going test
 	outputFileInfo, err := os.Stat(outFile.Name())
 	if err != nil {
@@ -184,11 +242,11 @@ func BlockAndRespond(w http.ResponseWriter, content io.Reader) {
 	defer sourceFile.Close()
 	defer os.Remove(outFile.Name())
 
-	blockedFile, err := blocks.BlockBuffer(sourceFile)
+	blockedFile, err := store.BlockBuffer(ctx, sourceFile)
 
 	if err != nil {
 		log.Println("Error blocking file: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		HandleErrorWithResponse(w, err)
 		return
 	}
 
@@ -205,39 +263,211 @@ func BlockAndRespond(w http.ResponseWriter, content io.Reader) {
 }
 
 type FileDownloadHandler struct {
+	store *blocks.Store
 }
 
-func NewFileDownloadHandler() FileDownloadHandler {
-	return FileDownloadHandler{}
+func NewFileDownloadHandler(store *blocks.Store) FileDownloadHandler {
+	return FileDownloadHandler{store}
 }
 
 func (handler FileDownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Got GET file request")
 
 	// Authoritze the request
-	if !AuthorizeRequest("GET", r.URL, r.Header) {
-		w.WriteHeader(http.StatusUnauthorized)
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeRead)
+	if !ok {
 		return
 	}
 
 	itemID := r.URL.Query().Get("itemID")
 	// fmt.Fprintf(w, "Going to get \"%v\"\n", itemID)
 
-	buffer, err := blocks.UnblockFileToBuffer(itemID)
+	reader, err := handler.store.OpenBlockedFile(ctx, itemID)
 
 	if err != nil {
 		HandleErrorWithResponse(w, err)
 		return
 	}
+	defer reader.Close()
+
+	// Whole downloads load the first block now, so a failing repository is answered with an error rather than a
+	// truncated file.  Range requests start elsewhere, and leave it to ServeContent.
+	if r.Header.Get("Range") == "" {
+		if err := reader.Open(); err != nil {
+			HandleErrorWithResponse(w, err)
+			return
+		}
+	}
 
 	header := w.Header()
 	header["Content-Type"] = []string{"application/octet-stream"}
 	// header["Content-Disposition"] = []string{"attachment;filename=" + fileName}
 
-	buffer.WriteTo(w)
+	// ServeContent answers Range requests with the requested part of the file, which only loads the blocks of that part
+	http.ServeContent(w, r, "", time.Time{}, reader)
+}
+
+// StatHandler - The REST endpoint describing how a BlockedFile is stored
+type StatHandler struct {
+	store *blocks.Store
+}
+
+func NewStatHandler(store *blocks.Store) StatHandler {
+	return StatHandler{store}
+}
+
+func (handler StatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Got GET stat request")
+
+	// Authoritze the request
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeRead)
+	if !ok {
+		return
+	}
+
+	stats, err := handler.store.Stat(ctx, r.URL.Query().Get("itemID"))
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
 
-	//response, err := ioutil.ReadFile(outFile)
-	//w.Write(response)
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// UsageHandler - The REST endpoint reporting the storage used by the tenant of the caller
+type UsageHandler struct {
+	store *blocks.Store
+}
+
+func NewUsageHandler(store *blocks.Store) UsageHandler {
+	return UsageHandler{store}
+}
+
+func (handler UsageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Got GET usage request")
+
+	// Authoritze the request
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeRead)
+	if !ok {
+		return
+	}
+
+	usage, err := handler.store.Usage(ctx)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	body, err := json.Marshal(usage)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// TenantsHandler - The REST endpoint reporting the storage used by every tenant.  Only admin keys without a tenant
+// may see it.
+type TenantsHandler struct {
+	store *blocks.Store
+}
+
+func NewTenantsHandler(store *blocks.Store) TenantsHandler {
+	return TenantsHandler{store}
+}
+
+func (handler TenantsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Got GET tenants request")
+
+	// Authoritze the request
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeAdmin)
+	if !ok {
+		return
+	}
+
+	if accessKey(ctx).Tenant != "" {
+		http.Error(w, "Only admin keys without a tenant can see every tenant", http.StatusForbidden)
+		return
+	}
+
+	usages, err := handler.store.Usages(ctx)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	body, err := json.Marshal(usages)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// MaxListLimit is the most BlockedFiles returned by a single list request
+const MaxListLimit = 1000
+
+// ListHandler - The REST endpoint listing the BlockedFiles of the tenant by ID.  The files after the ID in the 'after' parameter are returned,
+// at most 'limit' of them, so the list can be read a page at a time.
+type ListHandler struct {
+	store *blocks.Store
+}
+
+func NewListHandler(store *blocks.Store) ListHandler {
+	return ListHandler{store}
+}
+
+func (handler ListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Got GET list request")
+
+	// Authoritze the request
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeRead)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	after := query.Get("after")
+
+	limit := MaxListLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > MaxListLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "The limit must be between 1 and %d\n", MaxListLimit)
+			return
+		}
+	}
+
+	blockedFiles, err := handler.store.ListBlockedFilesAfter(ctx, after, limit)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	body, err := json.Marshal(blockedFiles)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
 }
 
 // checkClose is used to check the return from Close in a defer
@@ -249,8 +479,16 @@ func checkClose(c io.Closer, err *error) {
 	}
 }
 
-func HandleErrorWithResponse(w http.ResponseWriter, error error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprintln(w, error)
+func HandleErrorWithResponse(w http.ResponseWriter, err error) {
+	if errors.Is(err, blocks.ErrNotFound) || errors.Is(err, auth.ErrKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, auth.ErrContentMismatch) {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if errors.Is(err, blocks.ErrQuotaExceeded) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	fmt.Fprintln(w, err)
 	return
 }
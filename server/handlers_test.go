@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// HandlerSuite runs the handlers against a store kept in memory
+type HandlerSuite struct {
+	memory *blocks.MemoryBlockRepository
+	store  *blocks.Store
+	server *httptest.Server
+}
+
+var _ = Suite(&HandlerSuite{})
+
+func (s *HandlerSuite) SetUpTest(c *C) {
+	cfg := config.Default()
+	cfg.Storage.Provider = "memory"
+	cfg.Metadata.Provider = "memory"
+	cfg.Blocks.Encryption = false
+
+	store, err := blocks.NewStore(cfg)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	s.memory = blocks.NewMemoryBlockRepository()
+	store.BlockStore = s.memory
+	s.store = store
+
+	s.server = httptest.NewServer(newServer(c, cfg.Server, store).Handler())
+}
+
+// newServer creates a Server using the shared key the tests sign with
+func newServer(c *C, cfg config.ServerConfig, store *blocks.Store) *Server {
+	server := New(cfg, store)
+	err := server.SetSharedKey(sharedKey)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return server
+}
+
+func (s *HandlerSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// upload puts the content and returns the response
+func (s *HandlerSuite) upload(c *C, content string) *http.Response {
+	request, err := http.NewRequest("PUT", s.server.URL+"/api/v1/blocker", strings.NewReader(content))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	request = SetAuth(request, "PUT", "/api/v1/blocker")
+
+	response, err := http.DefaultClient.Do(request)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return response
+}
+
+// download gets the file and returns the response
+func (s *HandlerSuite) download(c *C, id string) *http.Response {
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/blocker/%s", s.server.URL, id), nil)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	request = SetAuth(request, "GET", fmt.Sprintf("/api/v1/blocker/%s", id))
+
+	response, err := http.DefaultClient.Do(request)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return response
+}
+
+func (s *HandlerSuite) TestUploadAndDownload(c *C) {
+	response := s.upload(c, "hello world")
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusCreated)
+
+	var blockedFile blocks.BlockedFile
+	err := json.NewDecoder(response.Body).Decode(&blockedFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	response = s.download(c, blockedFile.ID)
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+	body, err := ioutil.ReadAll(response.Body)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(body), Equals, "hello world")
+}
+
+func (s *HandlerSuite) TestUploadFailsWhenStorageFails(c *C) {
+	s.memory.SetFaults(blocks.MemoryFaults{FailOnCall: 1})
+
+	response := s.upload(c, "hello world")
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusInternalServerError)
+}
+
+func (s *HandlerSuite) TestDownloadFailsWhenStorageFails(c *C) {
+	response := s.upload(c, "hello world")
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusCreated)
+
+	var blockedFile blocks.BlockedFile
+	err := json.NewDecoder(response.Body).Decode(&blockedFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	s.memory.SetFaults(blocks.MemoryFaults{FailOnCall: 1})
+
+	response = s.download(c, blockedFile.ID)
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusInternalServerError)
+}
+
+func (s *HandlerSuite) TestStatusReportsReplicas(c *C) {
+	failing := blocks.NewMemoryBlockRepository()
+	failing.SetFaults(blocks.MemoryFaults{Fail: true})
+	s.store.BlockStore = blocks.NewReplicatedBlockRepository([]blocks.Replica{
+		{Name: "primary", Repository: s.memory},
+		{Name: "mirror", Repository: failing},
+	}, 1, 0)
+
+	response := s.upload(c, "hello world")
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusCreated)
+
+	request, err := http.NewRequest("GET", s.server.URL+"/api/v1/status", nil)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	request = SetAuth(request, "GET", "/api/v1/status")
+
+	response, err = http.DefaultClient.Do(request)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+	var status blocks.RepositoryStatus
+	err = json.NewDecoder(response.Body).Decode(&status)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(status.Replication != nil, IsTrue)
+	c.Assert(status.Replication.Replicas, HasLen, 2)
+	c.Assert(status.Replication.Replicas[0].Healthy, IsTrue)
+	c.Assert(status.Replication.Replicas[1].Healthy, IsFalse)
+	c.Assert(status.Replication.PendingRepairs > 0, IsTrue)
+}
+
+func (s *HandlerSuite) TestDownloadMissingFileIsNotFound(c *C) {
+	response := s.download(c, "missing")
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *HandlerSuite) TestDownloadRange(c *C) {
+	response := s.upload(c, "hello world")
+	defer response.Body.Close()
+
+	var blockedFile blocks.BlockedFile
+	err := json.NewDecoder(response.Body).Decode(&blockedFile)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/blocker/%s", s.server.URL, blockedFile.ID), nil)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	request = SetAuth(request, "GET", fmt.Sprintf("/api/v1/blocker/%s", blockedFile.ID))
+	request.Header.Set("Range", "bytes=6-")
+
+	response, err = http.DefaultClient.Do(request)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusPartialContent)
+
+	body, err := ioutil.ReadAll(response.Body)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(string(body), Equals, "world")
+}
+
+func (s *HandlerSuite) TestListRejectsInvalidLimit(c *C) {
+	for _, limit := range []string{"0", "1001", "many"} {
+		request, err := http.NewRequest("GET", s.server.URL+"/api/v1/files?limit="+limit, nil)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		request = SetAuth(request, "GET", "/api/v1/files")
+
+		response, err := http.DefaultClient.Do(request)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+		response.Body.Close()
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+	}
+}
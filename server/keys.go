@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/keithballdotnet/blocker/auth"
+	"github.com/keithballdotnet/blocker/config"
+)
+
+// KeyRequest describes an access key to create
+type KeyRequest struct {
+	Description string `json:"description"`
+	// Tenant defaults to the tenant of the key creating it
+	Tenant  string       `json:"tenant,omitempty"`
+	Scopes  []auth.Scope `json:"scopes"`
+	Expires *time.Time   `json:"expires,omitempty"`
+}
+
+// manages checks if the admin key may manage the keys of the tenant.  Admin keys without a tenant manage every tenant.
+func manages(admin auth.AccessKey, tenant string) bool {
+	return admin.Tenant == "" || admin.Tenant == tenant
+}
+
+// managedKey returns the key if the admin key manages its tenant.  The keys of other tenants can not be told from missing ones.
+func managedKey(keys *auth.KeyStore, admin auth.AccessKey, id string) (auth.AccessKey, error) {
+	key, err := keys.Get(id)
+	if err != nil {
+		return auth.AccessKey{}, err
+	}
+	if !manages(admin, key.Tenant) {
+		return auth.AccessKey{}, auth.ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// KeyCreateHandler - The REST endpoint creating an access key.  The response holds the secret of the key, which is
+// not given out again.  Admin keys of a tenant only create keys for their tenant.
+type KeyCreateHandler struct {
+	keys *auth.KeyStore
+}
+
+func NewKeyCreateHandler(keys *auth.KeyStore) KeyCreateHandler {
+	return KeyCreateHandler{keys}
+}
+
+func (handler KeyCreateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Got POST key request")
+
+	// Authoritze the request
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeAdmin)
+	if !ok {
+		return
+	}
+
+	// Read the whole body so a body which does not match its signature is refused
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	var keyRequest KeyRequest
+	if err := json.Unmarshal(body, &keyRequest); err != nil {
+		http.Error(w, "Invalid key request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := auth.ValidateScopes(keyRequest.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := config.ValidateTenant(keyRequest.Tenant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	admin := accessKey(ctx)
+	if keyRequest.Tenant == "" {
+		keyRequest.Tenant = admin.Tenant
+	}
+	if !manages(admin, keyRequest.Tenant) {
+		http.Error(w, "Keys can only be created for tenant "+admin.Tenant, http.StatusForbidden)
+		return
+	}
+
+	key, err := handler.keys.Create(auth.AccessKey{Description: keyRequest.Description, Tenant: keyRequest.Tenant, Scopes: keyRequest.Scopes, Expires: keyRequest.Expires}, time.Now())
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	log.Printf("Created access key %s for tenant %q with scopes %v", key.ID, key.Tenant, key.Scopes)
+
+	body, err = json.Marshal(key)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+// KeyListHandler - The REST endpoint listing the access keys of the tenants the caller manages, without their secrets
+type KeyListHandler struct {
+	keys *auth.KeyStore
+}
+
+func NewKeyListHandler(keys *auth.KeyStore) KeyListHandler {
+	return KeyListHandler{keys}
+}
+
+func (handler KeyListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Got GET keys request")
+
+	// Authoritze the request
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeAdmin)
+	if !ok {
+		return
+	}
+
+	admin := accessKey(ctx)
+	keys := make([]auth.AccessKey, 0)
+	for _, key := range handler.keys.List() {
+		if manages(admin, key.Tenant) {
+			keys = append(keys, key)
+		}
+	}
+
+	body, err := json.Marshal(keys)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// KeyDisableHandler - The REST endpoint disabling or enabling an access key
+type KeyDisableHandler struct {
+	keys     *auth.KeyStore
+	disabled bool
+}
+
+func NewKeyDisableHandler(keys *auth.KeyStore, disabled bool) KeyDisableHandler {
+	return KeyDisableHandler{keys, disabled}
+}
+
+func (handler KeyDisableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Got POST key disable request")
+
+	// Authoritze the request
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeAdmin)
+	if !ok {
+		return
+	}
+
+	key, err := managedKey(handler.keys, accessKey(ctx), r.URL.Query().Get("keyID"))
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	key, err = handler.keys.SetDisabled(key.ID, handler.disabled)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	log.Printf("Access key %s disabled: %v", key.ID, key.Disabled)
+
+	body, err := json.Marshal(key)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// KeyRevokeHandler - The REST endpoint removing an access key
+type KeyRevokeHandler struct {
+	keys *auth.KeyStore
+}
+
+func NewKeyRevokeHandler(keys *auth.KeyStore) KeyRevokeHandler {
+	return KeyRevokeHandler{keys}
+}
+
+func (handler KeyRevokeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Got DELETE key request")
+
+	// Authoritze the request
+	ctx, ok := AuthorizeRequest(w, r, auth.ScopeAdmin)
+	if !ok {
+		return
+	}
+
+	key, err := managedKey(handler.keys, accessKey(ctx), r.URL.Query().Get("keyID"))
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	if err := handler.keys.Revoke(key.ID); err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	log.Printf("Revoked access key %s", key.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/keithballdotnet/blocker/auth"
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// keyRequest returns a request signed with the access key, or the shared key if keyID is empty
+func keyRequest(c *C, method string, url string, path string, body string, keyID string, secret string) *http.Request {
+	request, err := http.NewRequest(method, url+path, strings.NewReader(body))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	contentSHA256, err := auth.HashBody(strings.NewReader(body))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	err = auth.SignRequest(request, keyID, secret, contentSHA256, "", time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return request
+}
+
+func (s *HandlerSuite) TestAccessKeyScopes(c *C) {
+	server := newServer(c, config.Default().Server, s.store)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	reader, err := server.keys.Create(auth.AccessKey{Description: "reader", Scopes: []auth.Scope{auth.ScopeRead}}, time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/files", "", reader.ID, reader.Secret)), Equals, http.StatusOK)
+	c.Assert(status(c, keyRequest(c, "PUT", httpServer.URL, "/api/v1/blocker", "hello world", reader.ID, reader.Secret)), Equals, http.StatusForbidden)
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/keys", "", reader.ID, reader.Secret)), Equals, http.StatusForbidden)
+
+	// The secret of another key does not sign for this one
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/files", "", reader.ID, sharedKey)), Equals, http.StatusUnauthorized)
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/files", "", "BKMISSING", reader.Secret)), Equals, http.StatusUnauthorized)
+
+	expires := time.Now().Add(-time.Minute)
+	expired, err := server.keys.Create(auth.AccessKey{Description: "expired", Scopes: []auth.Scope{auth.ScopeRead}, Expires: &expires}, time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/files", "", expired.ID, expired.Secret)), Equals, http.StatusUnauthorized)
+
+	admin, err := server.keys.Create(auth.AccessKey{Description: "admin", Scopes: []auth.Scope{auth.ScopeAdmin}}, time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(status(c, keyRequest(c, "PUT", httpServer.URL, "/api/v1/blocker", "hello world", admin.ID, admin.Secret)), Equals, http.StatusCreated)
+}
+
+func (s *HandlerSuite) TestManageAccessKeys(c *C) {
+	response, err := http.DefaultClient.Do(keyRequest(c, "POST", s.server.URL, "/api/v1/keys", `{"description": "uploads", "scopes": ["write"]}`, "", sharedKey))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(response.StatusCode, Equals, http.StatusCreated)
+
+	var key auth.AccessKey
+	err = json.NewDecoder(response.Body).Decode(&key)
+	response.Body.Close()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(key.ID != "", IsTrue)
+	c.Assert(key.Secret != "", IsTrue)
+	c.Assert(key.Scopes, DeepEquals, []auth.Scope{auth.ScopeWrite})
+
+	c.Assert(status(c, keyRequest(c, "PUT", s.server.URL, "/api/v1/blocker", "hello world", key.ID, key.Secret)), Equals, http.StatusCreated)
+
+	// The list does not give out the secrets
+	response, err = http.DefaultClient.Do(keyRequest(c, "GET", s.server.URL, "/api/v1/keys", "", "", sharedKey))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(strings.Contains(string(body), key.ID), IsTrue)
+	c.Assert(strings.Contains(string(body), key.Secret), IsFalse)
+
+	keyPath := fmt.Sprintf("/api/v1/keys/%s", key.ID)
+
+	c.Assert(status(c, keyRequest(c, "POST", s.server.URL, keyPath+"/disable", "", "", sharedKey)), Equals, http.StatusOK)
+	c.Assert(status(c, keyRequest(c, "PUT", s.server.URL, "/api/v1/blocker", "hello world", key.ID, key.Secret)), Equals, http.StatusUnauthorized)
+
+	c.Assert(status(c, keyRequest(c, "POST", s.server.URL, keyPath+"/enable", "", "", sharedKey)), Equals, http.StatusOK)
+	c.Assert(status(c, keyRequest(c, "PUT", s.server.URL, "/api/v1/blocker", "hello world", key.ID, key.Secret)), Equals, http.StatusCreated)
+
+	c.Assert(status(c, keyRequest(c, "DELETE", s.server.URL, keyPath, "", "", sharedKey)), Equals, http.StatusNoContent)
+	c.Assert(status(c, keyRequest(c, "PUT", s.server.URL, "/api/v1/blocker", "hello world", key.ID, key.Secret)), Equals, http.StatusUnauthorized)
+	c.Assert(status(c, keyRequest(c, "DELETE", s.server.URL, keyPath, "", "", sharedKey)), Equals, http.StatusNotFound)
+
+	// Unknown scopes are refused
+	c.Assert(status(c, keyRequest(c, "POST", s.server.URL, "/api/v1/keys", `{"scopes": ["everything"]}`, "", sharedKey)), Equals, http.StatusBadRequest)
+}
@@ -1,104 +1,163 @@
 package server
 
 import (
+	"fmt"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-	// "fmt"
-	"flag"
-	"github.com/keithballdotnet/blocker/crypto"
-	"log"
 
+	"github.com/keithballdotnet/blocker/auth"
+	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/config"
+	"github.com/keithballdotnet/blocker/crypto"
 	"github.com/rcrowley/go-tigertonic"
 )
 
-var (
-	// cert path
-	cert = flag.String("cert", "", "SSL Certificate path")
-	// cert key path
-	certKey = flag.String("certkey", "", "SSL Private key path")
-	// Shared key path
-	sharedKeyPath = flag.String("sharedKey", "", "Shared Authentication Key path")
-)
-
-var (
-	// This key is used for authentication with the server
-	SharedKey = ""
-)
+// MinSharedKeyLength is the fewest characters a shared key may have.  A generated key has 40.
+const MinSharedKeyLength = 32
 
-// Start a HTTP listener
-func Start() {
+// Server is the REST interface to a blocks.Store
+type Server struct {
+	cfg        config.ServerConfig
+	store      *blocks.Store
+	keys       *auth.KeyStore
+	authorizer *authorizer
+}
 
-	// Set up the auth key
-	SetupAuthenticationKey()
+// New creates a Server serving the passed store.  Its access keys are kept in memory until Start loads them.
+func New(cfg config.ServerConfig, store *blocks.Store) *Server {
+	keys := auth.NewKeyStore()
+	return &Server{cfg: cfg, store: store, keys: keys, authorizer: newAuthorizer(cfg.Auth, keys)}
+}
 
+// Handler returns the http.Handler serving the REST API
+func (s *Server) Handler() http.Handler {
 	// Set-up API listeners
 	mux := tigertonic.NewTrieServeMux()
 	mux.Handle("GET", "/api/v1/blocker", tigertonic.Timed(tigertonic.Marshaled(GetHello), "GetHelloHandler", nil))
-	mux.Handle("GET", "/api/v1/blocker/{itemID}", tigertonic.Timed(NewFileDownloadHandler(), "FileDownloadHandler", nil))
-	mux.Handle("DELETE", "/api/v1/blocker/{itemID}", tigertonic.Timed(tigertonic.Marshaled(DeleteHandler), "DeleteHandler", nil))
-	mux.Handle("COPY", "/api/v1/blocker/{itemID}", tigertonic.Timed(tigertonic.Marshaled(CopyHandler), "CopyHandler", nil))
-	mux.Handle("POST", "/api/v1/blocker", tigertonic.Timed(NewPostMultipartUploadHandler(), "PostMultipartUploadHandler", nil))
-	mux.Handle("PUT", "/api/v1/blocker", tigertonic.Timed(NewRawUploadHandler(), "RawUploadHandler", nil))
-	// Log to Console
-	server := tigertonic.NewServer(":8010", tigertonic.ApacheLogged(mux))
-	if *certKey == "" || *cert == "" {
-		server.ListenAndServe()
-	} else {
-		log.Println("SSL Enabled")
-		if err := server.ListenAndServeTLS(*cert, *certKey); err != nil {
-			log.Fatal(err)
+	mux.Handle("GET", "/api/v1/blocker/{itemID}", tigertonic.Timed(NewFileDownloadHandler(s.store), "FileDownloadHandler", nil))
+	mux.Handle("DELETE", "/api/v1/blocker/{itemID}", tigertonic.Timed(NewDeleteHandler(s.store), "DeleteHandler", nil))
+	mux.Handle("COPY", "/api/v1/blocker/{itemID}", tigertonic.Timed(NewCopyHandler(s.store), "CopyHandler", nil))
+	mux.Handle("POST", "/api/v1/blocker", tigertonic.Timed(NewPostMultipartUploadHandler(s.store), "PostMultipartUploadHandler", nil))
+	mux.Handle("PUT", "/api/v1/blocker", tigertonic.Timed(NewRawUploadHandler(s.store), "RawUploadHandler", nil))
+	mux.Handle("GET", "/api/v1/blocker/{itemID}/stat", tigertonic.Timed(NewStatHandler(s.store), "StatHandler", nil))
+	mux.Handle("GET", "/api/v1/files", tigertonic.Timed(NewListHandler(s.store), "ListHandler", nil))
+	mux.Handle("GET", "/api/v1/status", tigertonic.Timed(NewStatusHandler(s.store), "StatusHandler", nil))
+	mux.Handle("GET", "/api/v1/usage", tigertonic.Timed(NewUsageHandler(s.store), "UsageHandler", nil))
+	mux.Handle("GET", "/api/v1/tenants", tigertonic.Timed(NewTenantsHandler(s.store), "TenantsHandler", nil))
+	mux.Handle("POST", "/api/v1/keys", tigertonic.Timed(NewKeyCreateHandler(s.keys), "KeyCreateHandler", nil))
+	mux.Handle("GET", "/api/v1/keys", tigertonic.Timed(NewKeyListHandler(s.keys), "KeyListHandler", nil))
+	mux.Handle("POST", "/api/v1/keys/{keyID}/disable", tigertonic.Timed(NewKeyDisableHandler(s.keys, true), "KeyDisableHandler", nil))
+	mux.Handle("POST", "/api/v1/keys/{keyID}/enable", tigertonic.Timed(NewKeyDisableHandler(s.keys, false), "KeyEnableHandler", nil))
+	mux.Handle("DELETE", "/api/v1/keys/{keyID}", tigertonic.Timed(NewKeyRevokeHandler(s.keys), "KeyRevokeHandler", nil))
+
+	return withAuthorizer(s.authorizer, mux)
+}
+
+// SetSharedKey sets the key requests may be signed with to act as an admin of the default tenant.  Surrounding
+// whitespace is left out, and keys shorter than MinSharedKeyLength are refused.  Without a key only access keys
+// and bearer tokens are accepted.
+func (s *Server) SetSharedKey(key string) error {
+	key, err := checkSharedKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.authorizer.sharedKey = key
+	return nil
+}
+
+// Start a HTTP listener
+func (s *Server) Start() error {
+
+	// Set up the auth key
+	key, err := LoadSharedKey(s.cfg.SharedKeyPath)
+	if err != nil {
+		return err
+	}
+	if err := s.SetSharedKey(key); err != nil {
+		return err
+	}
+
+	// Load the access keys
+	if s.cfg.Auth.KeysPath != "" {
+		if err := s.keys.Load(s.cfg.Auth.KeysPath); err != nil {
+			return err
 		}
+		log.Printf("Using access key file: %v", s.cfg.Auth.KeysPath)
+	}
+
+	// Load the keys bearer tokens are checked with
+	if err := s.authorizer.loadTokenKeys(); err != nil {
+		return err
 	}
+
+	// Log to Console
+	server := tigertonic.NewServer(s.cfg.Address, tigertonic.ApacheLogged(s.Handler()))
+	if s.cfg.CertKeyPath == "" || s.cfg.CertPath == "" {
+		return server.ListenAndServe()
+	}
+
+	log.Println("SSL Enabled")
+	return server.ListenAndServeTLS(s.cfg.CertPath, s.cfg.CertKeyPath)
 }
 
-// SetupAuthenticationKey  - This deals with setting an auth key for the service
-func SetupAuthenticationKey() {
+// LoadSharedKey - Reads the shared key from its file.  Without a path the key is read from the default file, which is
+// created with a new key if it does not exist.
+func LoadSharedKey(sharedKeyPath string) (string, error) {
 
 	// Locate key file
-	sharedKeyFromCLI := true
-	keyPath := ""
-	if *sharedKeyPath == "" {
-		sharedKeyFromCLI = false
+	keyPath := sharedKeyPath
+	if sharedKeyPath == "" {
 		defaultAuthDir := filepath.Join(os.TempDir(), "blocker")
-		err := os.Mkdir(defaultAuthDir, 0777)
+		err := os.Mkdir(defaultAuthDir, 0700)
 		if err != nil && !os.IsExist(err) {
-			panic("Unable to create directory: " + err.Error())
+			return "", fmt.Errorf("Unable to create directory: %v", err)
 		}
 
 		keyPath = filepath.Join(defaultAuthDir, "auth.key")
-	} else {
-		keyPath = *sharedKeyPath
 	}
 
 	// Read the auth key file
 	bytes, err := ioutil.ReadFile(keyPath)
 
-	// The key file could not be located and is expected.  Get out of here...
-	if err != nil && os.IsNotExist(err) && sharedKeyFromCLI {
-		panic("Unable to read shared key file: " + err.Error())
-	}
-
-	// No file present.  Let's create a key.
-	if err != nil && os.IsNotExist(err) {
+	// No file present and none was asked for.  Let's create a key.
+	if err != nil && os.IsNotExist(err) && sharedKeyPath == "" {
 		newAccessKey := strings.ToLower(crypto.RandomSecret(40))
-		log.Printf("Generated new Access Key: %s", newAccessKey)
-		// Write key to key file
-		err := ioutil.WriteFile(keyPath, []byte(newAccessKey), 0644)
-		if err != nil {
-			panic("Unable to write shared key file: " + err.Error())
+		// Only the path is logged, the key must not end up in the logs
+		log.Printf("Generated new shared key in: %v", keyPath)
+		// Write key to key file, readable only by us
+		if err := ioutil.WriteFile(keyPath, []byte(newAccessKey), 0600); err != nil {
+			return "", fmt.Errorf("Unable to write shared key file: %v", err)
 		}
 
-		// Set the key
-		SharedKey = newAccessKey
+		return newAccessKey, nil
+	}
 
-		// We're done.
-		return
+	if err != nil {
+		return "", fmt.Errorf("Unable to read shared key file: %v", err)
 	}
 
 	log.Printf("Using auth key file: %v", keyPath)
 
-	// Get the key
-	SharedKey = string(bytes)
+	key, err := checkSharedKey(string(bytes))
+	if err != nil {
+		return "", fmt.Errorf("Shared key file %s: %v", keyPath, err)
+	}
+
+	return key, nil
+}
+
+// checkSharedKey leaves out the whitespace around the key, such as the newline ending a key file, and refuses a key
+// too short to keep requests from being forged
+func checkSharedKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if len(key) < MinSharedKeyLength {
+		return "", fmt.Errorf("The shared key has %d characters, at least %d are needed", len(key), MinSharedKeyLength)
+	}
+
+	return key, nil
 }
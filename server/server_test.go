@@ -2,8 +2,8 @@ package server
 
 import (
 	"encoding/json"
-	"flag"
 	"fmt"
+	"github.com/keithballdotnet/blocker/auth"
 	"github.com/keithballdotnet/blocker/blocks"
 	"github.com/keithballdotnet/blocker/crypto"
 	. "github.com/keithballdotnet/blocker/gocheck2"
@@ -30,33 +30,41 @@ var baseURL = "https://localhost:8010"
 
 var testAuthKey = "e7yflbeeid26rredmwtbiyzxijzak6altcnrsi4yol2f5sexbgdwevlpgosfoeyy"
 
-// const inputFile = "testdata/tempest.txt"
-func (s *ServerSuite) TestSetupAuthenticationKey(c *C) {
-	filepath.Join(os.TempDir(), "blocker")
-	defaultAuthDir := filepath.Join(os.TempDir(), "blocker")
-	err := os.Mkdir(defaultAuthDir, 0777)
-	if err != nil && !os.IsExist(err) {
-		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
-	}
+// sharedKey is the key the tests sign requests with.  The servers the tests start use it, while the server at baseURL
+// uses the default key file, which the tests against it read the key from.
+var sharedKey = testAuthKey
 
-	keyPath := filepath.Join(defaultAuthDir, "blockertest.key")
+// useDefaultSharedKey signs the requests of the test with the key in the default key file
+func useDefaultSharedKey(c *C) {
+	key, err := LoadSharedKey("")
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	sharedKey = key
+}
 
-	testAuthKey := "e7yflbeeid26rredmwtbiyzxijzak6altcnrsi4yol2f5sexbgdwevlpgosfoeyy"
-	// Write key to key file
-	err = ioutil.WriteFile(keyPath, []byte(testAuthKey), 0644)
+// const inputFile = "testdata/tempest.txt"
+func (s *ServerSuite) TestLoadSharedKey(c *C) {
+	keyPath := filepath.Join(c.MkDir(), "blockertest.key")
 
+	// The newline ending the file is not part of the key
+	err := ioutil.WriteFile(keyPath, []byte(testAuthKey+"\n"), 0600)
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 
-	// Set the key path
-	flag.Set("sharedKey", keyPath)
+	key, err := LoadSharedKey(keyPath)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(key, Equals, testAuthKey)
 
-	// Load the key
-	SetupAuthenticationKey()
+	// Empty and short keys are refused
+	for _, content := range []string{"", " \n", "short"} {
+		err = ioutil.WriteFile(keyPath, []byte(content), 0600)
+		c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 
-	c.Assert(SharedKey == testAuthKey, IsTrue, Commentf("Wanted key: %v Got Key", SharedKey, testAuthKey))
+		_, err = LoadSharedKey(keyPath)
+		c.Assert(err != nil, IsTrue)
+	}
 
-	// Clean up the key file
-	os.Remove(keyPath)
+	// A key file which was asked for is not created
+	_, err = LoadSharedKey(filepath.Join(c.MkDir(), "missing.key"))
+	c.Assert(err != nil, IsTrue)
 }
 
 func (s *ServerSuite) TestGetHello(c *C) {
@@ -71,17 +79,39 @@ func (s *ServerSuite) TestGetHello(c *C) {
 	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
 }
 
-// SetAuth will set blocker auth headers
+// SetAuth will set blocker auth headers, signed as if the request had the method and resource
 func SetAuth(request *http.Request, method string, resource string) *http.Request {
+	contentSHA256 := auth.EmptySHA256
+	if request.GetBody != nil {
+		body, _ := request.GetBody()
+		contentSHA256, _ = auth.HashBody(body)
+	} else if body, ok := request.Body.(io.ReadSeeker); ok {
+		contentSHA256, _ = auth.HashBody(body)
+		body.Seek(0, io.SeekStart)
+	}
+
+	nonce, _ := auth.NewNonce()
+
+	signed := request.Clone(request.Context())
+	signed.Method = method
+	signed.URL.Path = resource
+	auth.SignRequest(signed, "", sharedKey, contentSHA256, nonce, time.Now())
+
+	request.Header = signed.Header
+	return request
+}
+
+// SetLegacyAuth will set the blocker auth headers of the original signing scheme
+func SetLegacyAuth(request *http.Request, method string, resource string) *http.Request {
 
 	date := time.Now().UTC().Format(time.RFC1123) // UTC time
 	request.Header.Add("x-blocker-date", date)
 
 	authRequestKey := fmt.Sprintf("%s\n%s\n%s", method, date, resource)
 
-	hmac := crypto.GetHmac256(authRequestKey, SharedKey)
+	hmac := crypto.GetHmac256(authRequestKey, sharedKey)
 
-	//fmt.Printf("SharedKey: %s HMAC: %s RequestKey: \n%s\n", SharedKey, hmac, authRequestKey)
+	//fmt.Printf("sharedKey: %s HMAC: %s RequestKey: \n%s\n", sharedKey, hmac, authRequestKey)
 
 	request.Header.Add("Authorization", hmac)
 
@@ -90,11 +120,8 @@ func SetAuth(request *http.Request, method string, resource string) *http.Reques
 
 func (s *ServerSuite) TestFileUploadAndDownload(c *C) {
 
-	// Set the key path  Make sure the default key is loaded.
-	flag.Set("sharedKey", "")
-
-	// Load the key
-	SetupAuthenticationKey()
+	// Make sure the default key is loaded.
+	useDefaultSharedKey(c)
 
 	// c.Skip("Just for now.  Will skip this.")
 
@@ -248,11 +275,8 @@ func FormatJSON(name string, thing interface{}) string {
 
 func (s *ServerSuite) TestAuthFail(c *C) {
 
-	// Set the key path  Make sure the default key is loaded.
-	flag.Set("sharedKey", "")
-
-	// Load the key
-	SetupAuthenticationKey()
+	// Make sure the default key is loaded.
+	useDefaultSharedKey(c)
 
 	// Upload simple text
 	uploadContent := "hello world"
@@ -288,11 +312,8 @@ func (s *ServerSuite) TestAuthFail(c *C) {
 
 func (s *ServerSuite) TestSimpleUploadAndDownload(c *C) {
 
-	// Set the key path  Make sure the default key is loaded.
-	flag.Set("sharedKey", "")
-
-	// Load the key
-	SetupAuthenticationKey()
+	// Make sure the default key is loaded.
+	useDefaultSharedKey(c)
 
 	// Upload simple text
 	uploadContent := "hello world"
@@ -354,11 +375,8 @@ func (s *ServerSuite) TestLarge240MbUploadAndDownload(c *C) {
 
 	c.Skip("Skip large upload test")
 
-	// Set the key path  Make sure the default key is loaded.
-	flag.Set("sharedKey", "")
-
-	// Load the key
-	SetupAuthenticationKey()
+	// Make sure the default key is loaded.
+	useDefaultSharedKey(c)
 
 	// Upload simple text
 	uploadContent := crypto.RandomSecret(150000000)
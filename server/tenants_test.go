@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/keithballdotnet/blocker/auth"
+	"github.com/keithballdotnet/blocker/blocks"
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *HandlerSuite) TestTenantAdminsOnlyManageTheirTenant(c *C) {
+	server := newServer(c, config.Default().Server, s.store)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	admin, err := server.keys.Create(auth.AccessKey{Tenant: "acme", Scopes: []auth.Scope{auth.ScopeAdmin}}, time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	other, err := server.keys.Create(auth.AccessKey{Tenant: "other", Scopes: []auth.Scope{auth.ScopeRead}}, time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	// Keys are created for the tenant of the admin key
+	response, err := http.DefaultClient.Do(keyRequest(c, "POST", httpServer.URL, "/api/v1/keys", `{"scopes": ["read"]}`, admin.ID, admin.Secret))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	var created auth.AccessKey
+	err = json.NewDecoder(response.Body).Decode(&created)
+	response.Body.Close()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(created.Tenant, Equals, "acme")
+
+	c.Assert(status(c, keyRequest(c, "POST", httpServer.URL, "/api/v1/keys", `{"tenant": "other", "scopes": ["read"]}`, admin.ID, admin.Secret)), Equals, http.StatusForbidden)
+	c.Assert(status(c, keyRequest(c, "POST", httpServer.URL, "/api/v1/keys/"+other.ID+"/disable", "", admin.ID, admin.Secret)), Equals, http.StatusNotFound)
+	c.Assert(status(c, keyRequest(c, "DELETE", httpServer.URL, "/api/v1/keys/"+other.ID, "", admin.ID, admin.Secret)), Equals, http.StatusNotFound)
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/tenants", "", admin.ID, admin.Secret)), Equals, http.StatusForbidden)
+
+	response, err = http.DefaultClient.Do(keyRequest(c, "GET", httpServer.URL, "/api/v1/keys", "", admin.ID, admin.Secret))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	var keys []auth.AccessKey
+	err = json.NewDecoder(response.Body).Decode(&keys)
+	response.Body.Close()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(keys, HasLen, 2)
+	for _, key := range keys {
+		c.Assert(key.Tenant, Equals, "acme")
+	}
+
+	// The shared key manages every tenant
+	c.Assert(status(c, keyRequest(c, "POST", httpServer.URL, "/api/v1/keys/"+other.ID+"/disable", "", "", sharedKey)), Equals, http.StatusOK)
+	c.Assert(status(c, keyRequest(c, "POST", httpServer.URL, "/api/v1/keys", `{"tenant": "Not Valid", "scopes": ["read"]}`, "", sharedKey)), Equals, http.StatusBadRequest)
+}
+
+func (s *HandlerSuite) TestTenantFilesAndQuotas(c *C) {
+	s.store.Quotas = map[string]config.QuotaConfig{"acme": {Length: 15}}
+
+	server := newServer(c, config.Default().Server, s.store)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	key, err := server.keys.Create(auth.AccessKey{Tenant: "acme", Scopes: []auth.Scope{auth.ScopeRead, auth.ScopeWrite}}, time.Now())
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	response, err := http.DefaultClient.Do(keyRequest(c, "PUT", httpServer.URL, "/api/v1/blocker", "hello world", key.ID, key.Secret))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	var blockedFile blocks.BlockedFile
+	err = json.NewDecoder(response.Body).Decode(&blockedFile)
+	response.Body.Close()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	c.Assert(status(c, keyRequest(c, "PUT", httpServer.URL, "/api/v1/blocker", "hello world", key.ID, key.Secret)), Equals, http.StatusRequestEntityTooLarge)
+
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/blocker/"+blockedFile.ID, "", key.ID, key.Secret)), Equals, http.StatusOK)
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/blocker/"+blockedFile.ID, "", "", sharedKey)), Equals, http.StatusNotFound)
+
+	response, err = http.DefaultClient.Do(keyRequest(c, "GET", httpServer.URL, "/api/v1/usage", "", key.ID, key.Secret))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	var usage blocks.TenantUsage
+	err = json.NewDecoder(response.Body).Decode(&usage)
+	response.Body.Close()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usage.Tenant, Equals, "acme")
+	c.Assert(usage.Files, Equals, 1)
+	c.Assert(usage.Length, Equals, int64(11))
+	c.Assert(usage.Quota.Length, Equals, int64(15))
+}
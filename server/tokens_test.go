@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keithballdotnet/blocker/config"
+	. "github.com/keithballdotnet/blocker/gocheck2"
+	. "gopkg.in/check.v1"
+)
+
+// tokenIssuer signs tokens with an EC key published in a key set file
+type tokenIssuer struct {
+	key  *ecdsa.PrivateKey
+	kid  string
+	path string
+}
+
+func newTokenIssuer(c *C, kid string) *tokenIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return &tokenIssuer{key: key, kid: kid, path: filepath.Join(c.MkDir(), "jwks.json")}
+}
+
+// publish writes the key set with the keys of the issuers
+func (i *tokenIssuer) publish(c *C, issuers ...*tokenIssuer) {
+	var keys []map[string]string
+	for _, issuer := range append([]*tokenIssuer{i}, issuers...) {
+		x, y := make([]byte, 32), make([]byte, 32)
+		issuer.key.X.FillBytes(x)
+		issuer.key.Y.FillBytes(y)
+		keys = append(keys, map[string]string{"kty": "EC", "kid": issuer.kid, "crv": "P-256", "x": base64.RawURLEncoding.EncodeToString(x), "y": base64.RawURLEncoding.EncodeToString(y)})
+	}
+
+	set, err := json.Marshal(map[string]interface{}{"keys": keys})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	err = ioutil.WriteFile(i.path, set, 0644)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+}
+
+// token signs a token for the audience blocker with the tenant and scope claims
+func (i *tokenIssuer) token(c *C, tenant string, scope string, expires time.Time) string {
+	return i.sign(c, map[string]interface{}{"sub": "svc", "aud": "blocker", "tenant": tenant, "scope": scope, "exp": expires.Unix()})
+}
+
+// sign signs a token with the claims
+func (i *tokenIssuer) sign(c *C, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": i.kid})
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	payload, err := json.Marshal(claims)
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, i.key, digest[:])
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// bearerRequest creates a request carrying the token
+func bearerRequest(c *C, method string, url string, body string, token string) *http.Request {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	request.Header.Set("Authorization", "Bearer "+token)
+	return request
+}
+
+// tokenServer starts a server accepting tokens of the issuer
+func (s *HandlerSuite) tokenServer(c *C, issuer *tokenIssuer, scopes map[string][]string) (*Server, *httptest.Server) {
+	cfg := config.Default().Server
+	cfg.Auth.JWT.JWKSPaths = []string{issuer.path}
+	cfg.Auth.JWT.Audience = "blocker"
+	cfg.Auth.JWT.Scopes = scopes
+
+	server := newServer(c, cfg, s.store)
+	err := server.authorizer.loadTokenKeys()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+
+	return server, httptest.NewServer(server.Handler())
+}
+
+func (s *HandlerSuite) TestBearerTokens(c *C) {
+	issuer := newTokenIssuer(c, "one")
+	issuer.publish(c)
+
+	_, httpServer := s.tokenServer(c, issuer, nil)
+	defer httpServer.Close()
+
+	writer := issuer.token(c, "acme", "read write other:scope", time.Now().Add(time.Hour))
+	c.Assert(status(c, bearerRequest(c, "PUT", httpServer.URL+"/api/v1/blocker", "hello world", writer)), Equals, http.StatusCreated)
+
+	// The token acts for its tenant
+	response, err := http.DefaultClient.Do(bearerRequest(c, "GET", httpServer.URL+"/api/v1/usage", "", writer))
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	var usage struct {
+		Tenant string `json:"tenant"`
+		Files  int    `json:"files"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&usage)
+	response.Body.Close()
+	c.Assert(err == nil, IsTrue, Commentf("Failed with error: %v", err))
+	c.Assert(usage.Tenant, Equals, "acme")
+	c.Assert(usage.Files, Equals, 1)
+
+	reader := issuer.token(c, "acme", "read", time.Now().Add(time.Hour))
+	c.Assert(status(c, bearerRequest(c, "PUT", httpServer.URL+"/api/v1/blocker", "hello world", reader)), Equals, http.StatusForbidden)
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/keys", "", reader)), Equals, http.StatusForbidden)
+
+	expired := issuer.token(c, "acme", "read", time.Now().Add(-time.Hour))
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/files", "", expired)), Equals, http.StatusUnauthorized)
+
+	invalidTenant := issuer.token(c, "Not Valid", "read", time.Now().Add(time.Hour))
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/files", "", invalidTenant)), Equals, http.StatusUnauthorized)
+
+	// Tokens must name their tenant
+	noTenant := issuer.sign(c, map[string]interface{}{"sub": "svc", "aud": "blocker", "scope": "read", "exp": time.Now().Add(time.Hour).Unix()})
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/files", "", noTenant)), Equals, http.StatusUnauthorized)
+
+	// The admin scope of the default tenant manages every tenant, so it has to be mapped
+	defaultAdmin := issuer.token(c, "", "read admin", time.Now().Add(time.Hour))
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/files", "", defaultAdmin)), Equals, http.StatusOK)
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/tenants", "", defaultAdmin)), Equals, http.StatusForbidden)
+	c.Assert(status(c, bearerRequest(c, "POST", httpServer.URL+"/api/v1/keys", `{"tenant": "other", "scopes": ["read"]}`, defaultAdmin)), Equals, http.StatusForbidden)
+
+	tenantAdmin := issuer.token(c, "acme", "admin", time.Now().Add(time.Hour))
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/keys", "", tenantAdmin)), Equals, http.StatusOK)
+
+	// Signed requests still work alongside tokens
+	c.Assert(status(c, keyRequest(c, "GET", httpServer.URL, "/api/v1/files", "", "", sharedKey)), Equals, http.StatusOK)
+
+	// Servers without token keys refuse tokens
+	c.Assert(status(c, bearerRequest(c, "GET", s.server.URL+"/api/v1/files", "", reader)), Equals, http.StatusUnauthorized)
+}
+
+func (s *HandlerSuite) TestBearerTokenScopesAndNewKeys(c *C) {
+	issuer := newTokenIssuer(c, "one")
+	issuer.publish(c)
+
+	server, httpServer := s.tokenServer(c, issuer, map[string][]string{"blocker:admin": {"admin"}, "blocker:read": {"read"}})
+	defer httpServer.Close()
+
+	// Tokens are refused unless there is an audience to check
+	noAudience := newServer(c, config.Default().Server, s.store)
+	noAudience.cfg.Auth.JWT.JWKSPaths = []string{issuer.path}
+	noAudience.authorizer = newAuthorizer(noAudience.cfg.Auth, noAudience.keys)
+	c.Assert(noAudience.authorizer.loadTokenKeys() != nil, IsTrue)
+
+	// Only mapped values give scopes
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/keys", "", issuer.token(c, "", "blocker:admin", time.Now().Add(time.Hour)))), Equals, http.StatusOK)
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/keys", "", issuer.token(c, "", "admin blocker:read", time.Now().Add(time.Hour)))), Equals, http.StatusForbidden)
+
+	// A token signed with a key added to the key set is accepted once the keys are read again
+	rotated := newTokenIssuer(c, "two")
+	rotated.path = issuer.path
+	issuer.publish(c, rotated)
+
+	token := rotated.token(c, "", "blocker:read", time.Now().Add(time.Hour))
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/files", "", token)), Equals, http.StatusUnauthorized)
+
+	server.authorizer.now = func() time.Time { return time.Now().Add(tokenKeysReloadInterval) }
+	c.Assert(status(c, bearerRequest(c, "GET", httpServer.URL+"/api/v1/files", "", token)), Equals, http.StatusOK)
+}